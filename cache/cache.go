@@ -0,0 +1,211 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package cache implements the cache component, which stores the proposals and
+// votes of pending heights, detects double proposals and double votes, and
+// builds quorums once enough votes for a candidate have been collected.
+package cache
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// Aggregator combines the signatures of votes on the same candidate into a
+// single quorum signature, either by aggregating them or by recovering a group
+// signature from signature shares.
+type Aggregator interface {
+	Aggregate(votes []*message.Vote) (base.Signature, error)
+}
+
+// Window is how many heights above the last cleared height votes are stored
+// for. Proposals can only be stored once their parent is in the graph, but
+// votes can be signed for any height, so without a bound, a single member of
+// the committee could fill the cache with votes for made-up future heights.
+const Window = 16
+
+// Cache stores proposals and votes by height, indexed by proposer and signer
+// respectively. The last cleared height is the final height of the processor,
+// which always clears up to the vertex it just finalized.
+type Cache struct {
+	sync.Mutex
+	strat     consensus.Strategy
+	agg       Aggregator
+	committee consensus.Committee
+	cleared   uint64
+	proposals map[uint64]map[base.Hash]*message.Proposal
+	votes     map[uint64]map[base.Hash]*message.Vote
+}
+
+// NewCache creates a new cache, which uses the given strategy to decide when
+// enough votes were collected to aggregate their signatures. If a committee is
+// given, quorums are built in compact form, with their signers marked in a
+// bitfield over the committee of the quorum height.
+func NewCache(strat consensus.Strategy, agg Aggregator, committee consensus.Committee) *Cache {
+
+	c := Cache{
+		strat:     strat,
+		agg:       agg,
+		committee: committee,
+		proposals: make(map[uint64]map[base.Hash]*message.Proposal),
+		votes:     make(map[uint64]map[base.Hash]*message.Vote),
+	}
+
+	return &c
+}
+
+func (c *Cache) Proposal(proposal *message.Proposal) error {
+	c.Lock()
+	defer c.Unlock()
+
+	// check if we already have a proposal by this proposer at the height
+	height := proposal.Candidate.Height
+	proposerID := proposal.Candidate.ProposerID
+	proposals, ok := c.proposals[height]
+	if !ok {
+		proposals = make(map[base.Hash]*message.Proposal)
+		c.proposals[height] = proposals
+	}
+	first, ok := proposals[proposerID]
+
+	// if we don't, simply store it
+	if !ok {
+		proposals[proposerID] = proposal
+		return nil
+	}
+
+	// if we do, and it's for a different candidate, it's a double proposal
+	if first.Candidate.ID() != proposal.Candidate.ID() {
+		return signal.DoubleProposal{First: first, Second: proposal}
+	}
+
+	return nil
+}
+
+func (c *Cache) Vote(vote *message.Vote) error {
+	c.Lock()
+	defer c.Unlock()
+
+	// refuse votes too far above the last cleared height
+	if vote.Height > c.cleared+Window {
+		return signal.FutureVote{Vote: vote, Limit: c.cleared + Window}
+	}
+
+	// check if we already have a vote by this signer at the height
+	votes, ok := c.votes[vote.Height]
+	if !ok {
+		votes = make(map[base.Hash]*message.Vote)
+		c.votes[vote.Height] = votes
+	}
+	first, ok := votes[vote.SignerID]
+
+	// if we don't, simply store it
+	if !ok {
+		votes[vote.SignerID] = vote
+		return nil
+	}
+
+	// if we do, and it's for a different candidate, it's a double vote
+	if first.CandidateID != vote.CandidateID {
+		return signal.DoubleVote{First: first, Second: vote}
+	}
+
+	return nil
+}
+
+func (c *Cache) Quorum(height uint64, vertexID base.Hash) (*message.Quorum, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// collect the votes for the given vertex in a deterministic order
+	var votes []*message.Vote
+	for _, vote := range c.votes[height] {
+		if vote.CandidateID != vertexID {
+			continue
+		}
+		votes = append(votes, vote)
+	}
+	sort.Slice(votes, func(i int, j int) bool {
+		return bytes.Compare(votes[i].SignerID[:], votes[j].SignerID[:]) < 0
+	})
+	signerIDs := make([]base.Hash, 0, len(votes))
+	for _, vote := range votes {
+		signerIDs = append(signerIDs, vote.SignerID)
+	}
+
+	// if we don't have enough votes, we return the signers without signature,
+	// as there is no point in aggregating the signatures yet
+	quorum := &message.Quorum{
+		SignerIDs: signerIDs,
+	}
+	threshold, err := c.strat.Threshold(height)
+	if err != nil {
+		return nil, rich.Errorf("could not get threshold: %w", err)
+	}
+	if uint(len(votes)) >= threshold {
+		quorum.Signature, err = c.agg.Aggregate(votes)
+		if err != nil {
+			return nil, rich.Errorf("could not aggregate votes: %w", err).Uint64("height", height)
+		}
+	}
+
+	// if we know the committee, we replace the signer IDs with a bitfield
+	if c.committee != nil {
+		epoch, err := c.committee.Epoch(height)
+		if err != nil {
+			return nil, rich.Errorf("could not get epoch: %w", err).Uint64("height", height)
+		}
+		participants, err := c.committee.Participants(epoch)
+		if err != nil {
+			return nil, rich.Errorf("could not get participants: %w", err).Uint64("epoch", epoch)
+		}
+		quorum, err = quorum.Compact(participants)
+		if err != nil {
+			return nil, rich.Errorf("could not compact quorum: %w", err).Uint64("height", height)
+		}
+	}
+
+	return quorum, nil
+}
+
+func (c *Cache) Clear(height uint64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if height > c.cleared {
+		c.cleared = height
+	}
+	for pending := range c.proposals {
+		if pending <= height {
+			delete(c.proposals, pending)
+		}
+	}
+	for pending := range c.votes {
+		if pending <= height {
+			delete(c.votes, pending)
+		}
+	}
+
+	return nil
+}
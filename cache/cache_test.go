@@ -0,0 +1,187 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// concat is an aggregator that simply concatenates vote signatures.
+type concat struct{}
+
+func (concat) Aggregate(votes []*message.Vote) (base.Signature, error) {
+	var sig base.Signature
+	for _, vote := range votes {
+		sig = append(sig, vote.Signature...)
+	}
+	return sig, nil
+}
+
+func TestCacheProposal(t *testing.T) {
+
+	c := NewCache(&mocks.Strategy{}, concat{}, nil)
+	proposal := fixture.Proposal(t)
+
+	// storing the same proposal twice should be fine
+	require.NoError(t, c.Proposal(proposal), "should store first proposal")
+	require.NoError(t, c.Proposal(proposal), "should accept duplicate proposal")
+
+	// storing another proposal by a different proposer should be fine
+	other := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t)))
+	other.Candidate.Height = proposal.Candidate.Height
+	require.NoError(t, c.Proposal(other), "should store proposal by other proposer")
+
+	// storing a different proposal by the same proposer should fail
+	double := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithProposer(proposal.Candidate.ProposerID))))
+	double.Candidate.Height = proposal.Candidate.Height
+	err := c.Proposal(double)
+	assert.True(t, errors.As(err, &signal.DoubleProposal{}), "should have double proposal error")
+
+	// after clearing, the proposal should be accepted again
+	require.NoError(t, c.Clear(proposal.Candidate.Height), "should clear cache")
+	require.NoError(t, c.Proposal(double), "should store proposal after clearing")
+}
+
+func TestCacheVoteQuorum(t *testing.T) {
+
+	strat := &mocks.Strategy{}
+	strat.On("Threshold", mock.Anything).Return(uint(3), nil)
+	c := NewCache(strat, concat{}, nil)
+
+	candidate := fixture.Vertex(t, fixture.WithHeight(1))
+	votes := make([]*message.Vote, 0, 3)
+	for i := 0; i < 3; i++ {
+		vote := fixture.Vote(t, fixture.ForCandidate(candidate))
+		votes = append(votes, vote)
+	}
+
+	// below the threshold, we should get the signers without a signature
+	require.NoError(t, c.Vote(votes[0]), "should store first vote")
+	require.NoError(t, c.Vote(votes[0]), "should accept duplicate vote")
+	require.NoError(t, c.Vote(votes[1]), "should store second vote")
+	quorum, err := c.Quorum(candidate.Height, candidate.ID())
+	require.NoError(t, err, "should get partial quorum")
+	assert.Len(t, quorum.SignerIDs, 2, "should have partial signers")
+	assert.Nil(t, quorum.Signature, "should not aggregate partial quorum")
+
+	// a vote for another candidate by the same signer should be a double vote
+	double := fixture.Vote(t, fixture.WithVoter(votes[0].SignerID))
+	double.Height = candidate.Height
+	err = c.Vote(double)
+	assert.True(t, errors.As(err, &signal.DoubleVote{}), "should have double vote error")
+
+	// once we reach the threshold, the signature should be aggregated
+	require.NoError(t, c.Vote(votes[2]), "should store third vote")
+	quorum, err = c.Quorum(candidate.Height, candidate.ID())
+	require.NoError(t, err, "should get full quorum")
+	assert.Len(t, quorum.SignerIDs, 3, "should have all signers")
+	assert.Len(t, quorum.Signature, 3*len(votes[0].Signature), "should aggregate all signatures")
+
+	// after clearing, there should be no votes left
+	require.NoError(t, c.Clear(candidate.Height), "should clear cache")
+	quorum, err = c.Quorum(candidate.Height, candidate.ID())
+	require.NoError(t, err, "should get empty quorum")
+	assert.Empty(t, quorum.SignerIDs, "should have no signers after clearing")
+}
+
+func TestCacheVoteWindow(t *testing.T) {
+
+	c := NewCache(&mocks.Strategy{}, concat{}, nil)
+
+	// votes up to the window above the final height should be stored
+	vote := fixture.Vote(t, fixture.ForCandidate(fixture.Vertex(t, fixture.WithHeight(Window))))
+	require.NoError(t, c.Vote(vote), "should store vote within window")
+
+	// votes beyond the window should be refused, and not be stored
+	future := fixture.Vote(t, fixture.ForCandidate(fixture.Vertex(t, fixture.WithHeight(Window+1))))
+	err := c.Vote(future)
+	assert.True(t, errors.As(err, &signal.FutureVote{}), "should have future vote error")
+	assert.NotContains(t, c.votes, future.Height, "should not store future vote")
+
+	// once the final height moved up, they should be stored
+	require.NoError(t, c.Clear(1), "should clear cache")
+	require.NoError(t, c.Vote(future), "should store vote within moved window")
+
+	// clearing a lower height should not move the window back down
+	other := fixture.Vote(t, fixture.ForCandidate(fixture.Vertex(t, fixture.WithHeight(Window+1))))
+	require.NoError(t, c.Clear(0), "should clear cache")
+	require.NoError(t, c.Vote(other), "should keep window")
+}
+
+func TestCacheCompactQuorum(t *testing.T) {
+
+	strat := &mocks.Strategy{}
+	strat.On("Threshold", mock.Anything).Return(uint(2), nil)
+
+	// use a committee with one participant who doesn't vote
+	candidate := fixture.Vertex(t, fixture.WithHeight(1))
+	votes := make([]*message.Vote, 0, 3)
+	participantIDs := []base.Hash{fixture.Hash(t)}
+	for i := 0; i < 3; i++ {
+		vote := fixture.Vote(t, fixture.ForCandidate(candidate))
+		votes = append(votes, vote)
+		participantIDs = append(participantIDs, vote.SignerID)
+	}
+	committee := message.SortIDs(participantIDs)
+	com := &mocks.Committee{}
+	com.On("Epoch", candidate.Height).Return(uint64(0), nil)
+	com.On("Participants", uint64(0)).Return(committee, nil)
+	c := NewCache(strat, concat{}, com)
+	for _, vote := range votes {
+		require.NoError(t, c.Vote(vote), "should store vote")
+	}
+
+	// the quorum should only carry the bitfield of signers
+	quorum, err := c.Quorum(candidate.Height, candidate.ID())
+	require.NoError(t, err, "should get compact quorum")
+	assert.Nil(t, quorum.SignerIDs, "should not have signer IDs")
+	assert.Len(t, quorum.Signers, 1, "should have one byte bitfield")
+	assert.Equal(t, 3, quorum.Size(), "should have all signers")
+
+	// expanding it should restore the signers in the order they were signed
+	expanded, err := quorum.Expand(committee)
+	require.NoError(t, err, "should expand quorum")
+	var signerIDs []base.Hash
+	for _, vote := range votes {
+		signerIDs = append(signerIDs, vote.SignerID)
+	}
+	assert.Equal(t, message.SortIDs(signerIDs), expanded.SignerIDs, "should expand to sorted signers")
+	assert.Equal(t, quorum.Signature, expanded.Signature, "should keep signature")
+	compacted, err := expanded.Compact(committee)
+	require.NoError(t, err, "should compact expanded quorum")
+	assert.Equal(t, quorum, compacted, "should round trip")
+
+	// signers beyond the committee or out of order can't be represented
+	_, err = expanded.Expand(committee[:2])
+	assert.NoError(t, err, "should not expand quorum without bitfield")
+	_, err = quorum.Expand(committee[:2])
+	assert.Error(t, err, "should not expand bitfield with signers beyond committee")
+	expanded.SignerIDs[0], expanded.SignerIDs[1] = expanded.SignerIDs[1], expanded.SignerIDs[0]
+	_, err = expanded.Compact(committee)
+	assert.Error(t, err, "should not compact signers out of order")
+}
@@ -0,0 +1,225 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// Dynamic is a committee whose members change over time. Changes to the
+// member set are carried by the arcs of vertices, and handed to the committee
+// when the vertices are finalized, which the Ledger does as finalizer of the
+// graph. They only become active at the next epoch boundary
+// that is at least the finalization depth away from the vertex, so that every
+// node has finalized the changes for an epoch before the epoch starts. Votes
+// and quorums are always checked against the committee of the height they are
+// for, so the certificate for the last vertex of an epoch, which is included
+// in the first proposal of the next epoch, is still verified against the old
+// member set.
+type Dynamic struct {
+	sync.RWMutex
+	length  uint64
+	depth   uint64
+	final   uint64
+	known   uint64
+	epochs  []uint64
+	sets    map[uint64]*set
+	pending []Member
+}
+
+// set is the member set of the committee from a given epoch on.
+type set struct {
+	participants []base.Hash
+	members      map[base.Hash]Member
+}
+
+// NewDynamic creates a committee with epochs of the given length, starting
+// with the given members at genesis. The depth is the number of heights by
+// which finalization lags behind the vertices being proposed; it determines how
+// early the member set of an epoch has to be fixed. The graph package finalizes
+// a vertex as soon as the proposal carrying its quorum is processed, for which
+// a depth of one is enough.
+func NewDynamic(length uint64, depth uint64, genesis []Member) (*Dynamic, error) {
+
+	if length == 0 {
+		return nil, rich.Errorf("invalid epoch length").Uint64("length", length)
+	}
+	index, err := index(genesis)
+	if err != nil {
+		return nil, rich.Errorf("invalid genesis members: %w", err)
+	}
+
+	d := Dynamic{
+		length: length,
+		depth:  depth,
+		final:  0,
+		epochs: []uint64{0},
+		sets:   map[uint64]*set{0: {participants: participants(index), members: index}},
+	}
+	d.known = d.determined(0)
+
+	return &d, nil
+}
+
+// Finalize applies the member changes included in the finalized vertex at the
+// given height. A member with zero weight is removed, all others are added or
+// updated. It has to be called with increasing heights; heights without any
+// changes can be skipped.
+func (d *Dynamic) Finalize(height uint64, changes []Member) error {
+
+	d.Lock()
+	defer d.Unlock()
+
+	if height <= d.final {
+		return rich.Errorf("height already finalized").Uint64("height", height).Uint64("final", d.final)
+	}
+
+	// 1) skipped heights were finalized without changes, but they may still
+	// determine the member set of new epochs
+	d.advance(height - 1)
+
+	// 2) make sure the changes result in a valid member set; they are pending
+	// for the next epoch that is not determined yet
+	pending := append(append([]Member{}, d.pending...), changes...)
+	_, err := apply(d.sets[d.epochs[len(d.epochs)-1]], pending)
+	if err != nil {
+		return rich.Errorf("invalid member changes: %w", err).Uint64("height", height)
+	}
+	d.pending = pending
+
+	// 3) finalizing the height may determine the next epoch
+	d.final = height
+	d.advance(height)
+
+	return nil
+}
+
+// advance activates the pending changes once finalizing up to the given height
+// determines the member set of the next epoch.
+func (d *Dynamic) advance(final uint64) {
+	known := d.determined(final)
+	if known <= d.known {
+		return
+	}
+	if len(d.pending) > 0 {
+		activation := d.known + 1
+		next, _ := apply(d.sets[d.epochs[len(d.epochs)-1]], d.pending)
+		d.epochs = append(d.epochs, activation)
+		d.sets[activation] = next
+		d.pending = nil
+	}
+	d.known = known
+}
+
+// Epoch returns the epoch the given height is part of.
+func (d *Dynamic) Epoch(height uint64) (uint64, error) {
+	return height / d.length, nil
+}
+
+// Participants returns the IDs of the members of the epoch in ascending order.
+func (d *Dynamic) Participants(epoch uint64) ([]base.Hash, error) {
+	s, err := d.set(epoch)
+	if err != nil {
+		return nil, err
+	}
+	participants := make([]base.Hash, len(s.participants))
+	copy(participants, s.participants)
+	return participants, nil
+}
+
+// Key returns the public key of the given member at the epoch.
+func (d *Dynamic) Key(epoch uint64, participantID base.Hash) (base.PublicKey, error) {
+	s, err := d.set(epoch)
+	if err != nil {
+		return nil, err
+	}
+	member, ok := s.members[participantID]
+	if !ok {
+		return nil, rich.Errorf("unknown participant").Hex("participant", participantID[:]).Uint64("epoch", epoch)
+	}
+	return member.Key, nil
+}
+
+// Weight returns the weight of the given member at the epoch.
+func (d *Dynamic) Weight(epoch uint64, participantID base.Hash) (uint64, error) {
+	s, err := d.set(epoch)
+	if err != nil {
+		return 0, err
+	}
+	member, ok := s.members[participantID]
+	if !ok {
+		return 0, rich.Errorf("unknown participant").Hex("participant", participantID[:]).Uint64("epoch", epoch)
+	}
+	return member.Weight, nil
+}
+
+// set returns the member set active in the given epoch, as long as the epoch
+// is already determined.
+func (d *Dynamic) set(epoch uint64) (*set, error) {
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if epoch > d.known {
+		return nil, rich.Errorf("undetermined epoch").Uint64("epoch", epoch).Uint64("known", d.known)
+	}
+	index := sort.Search(len(d.epochs), func(i int) bool {
+		return d.epochs[i] > epoch
+	})
+
+	return d.sets[d.epochs[index-1]], nil
+}
+
+// determined returns the highest epoch whose member set is fixed once all
+// heights up to the given one are finalized.
+func (d *Dynamic) determined(final uint64) uint64 {
+	return (final + d.depth + 1) / d.length
+}
+
+// apply returns a new member set with the given changes applied, making sure
+// the result is still a valid committee.
+func apply(current *set, changes []Member) (*set, error) {
+	members := make(map[base.Hash]Member, len(current.members))
+	for id, member := range current.members {
+		members[id] = member
+	}
+	for _, change := range changes {
+		if change.Weight == 0 {
+			delete(members, change.ID)
+			continue
+		}
+		members[change.ID] = change
+	}
+	list := make([]Member, 0, len(members))
+	for _, member := range members {
+		list = append(list, member)
+	}
+	index, err := index(list)
+	if err != nil {
+		return nil, err
+	}
+	next := set{
+		participants: participants(index),
+		members:      index,
+	}
+	return &next, nil
+}
@@ -0,0 +1,183 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/crypto/edwards"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+)
+
+var _ consensus.Committee = (*Dynamic)(nil)
+
+// contains checks whether the participant is part of the epoch.
+func contains(t *testing.T, d *Dynamic, epoch uint64, participantID base.Hash) bool {
+	participants, err := d.Participants(epoch)
+	require.NoError(t, err, "should get participants")
+	for _, id := range participants {
+		if id == participantID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDynamicActivation(t *testing.T) {
+
+	// use epochs of ten heights, with finalization lagging two heights behind
+	genesis := members(t, 4)
+	d, err := NewDynamic(10, 2, genesis)
+	require.NoError(t, err, "should create committee")
+	added := Member{ID: fixture.Hash(t), Key: base.PublicKey{9}, Weight: 9}
+
+	// a change in the middle of the epoch only becomes active at the next
+	// epoch, and that epoch is only determined once the last height that
+	// could change it is finalized
+	require.NoError(t, d.Finalize(5, []Member{added}), "should finalize addition")
+	_, err = d.Participants(1)
+	assert.Error(t, err, "should not have participants for undetermined epoch")
+	require.NoError(t, d.Finalize(6, nil), "should finalize empty height")
+	_, err = d.Participants(1)
+	assert.Error(t, err, "should still not have participants for undetermined epoch")
+	require.NoError(t, d.Finalize(7, nil), "should finalize height determining epoch")
+	assert.False(t, contains(t, d, 0, added.ID), "should not have addition in current epoch")
+	assert.True(t, contains(t, d, 1, added.ID), "should have addition in next epoch")
+	weight, err := d.Weight(1, added.ID)
+	require.NoError(t, err, "should get weight of addition")
+	assert.Equal(t, added.Weight, weight, "should have weight of addition")
+
+	// a change after the next epoch is determined goes to the one after
+	removed := genesis[0]
+	require.NoError(t, d.Finalize(8, []Member{{ID: removed.ID}}), "should finalize removal")
+	assert.True(t, contains(t, d, 1, removed.ID), "should keep removed member in determined epoch")
+	_, err = d.Participants(2)
+	assert.Error(t, err, "should not have participants for undetermined epoch")
+
+	// skipping heights should still determine the epoch with the removal
+	require.NoError(t, d.Finalize(17, nil), "should finalize after skipped heights")
+	assert.False(t, contains(t, d, 2, removed.ID), "should not have removed member")
+	assert.True(t, contains(t, d, 2, added.ID), "should keep added member")
+	assert.True(t, contains(t, d, 0, removed.ID), "should keep history of old epochs")
+	_, err = d.Key(2, removed.ID)
+	assert.Error(t, err, "should not have key of removed member")
+}
+
+func TestDynamicSkipped(t *testing.T) {
+
+	genesis := members(t, 4)
+	d, err := NewDynamic(10, 2, genesis)
+	require.NoError(t, err, "should create committee")
+	first := Member{ID: fixture.Hash(t), Key: base.PublicKey{8}, Weight: 1}
+	second := Member{ID: fixture.Hash(t), Key: base.PublicKey{9}, Weight: 1}
+
+	// when finalization jumps ahead, the earlier change activates at its own
+	// epoch boundary and the later change at a later one
+	require.NoError(t, d.Finalize(5, []Member{first}), "should finalize first change")
+	require.NoError(t, d.Finalize(25, []Member{second}), "should finalize second change")
+	assert.True(t, contains(t, d, 1, first.ID), "should have first change in epoch one")
+	assert.True(t, contains(t, d, 2, first.ID), "should have first change in epoch two")
+	assert.False(t, contains(t, d, 2, second.ID), "should not have second change in epoch two")
+	_, err = d.Participants(3)
+	assert.Error(t, err, "should not have undetermined epoch three")
+	require.NoError(t, d.Finalize(27, nil), "should finalize height determining epoch three")
+	assert.True(t, contains(t, d, 3, second.ID), "should have second change in epoch three")
+}
+
+func TestDynamicInvalid(t *testing.T) {
+
+	_, err := NewDynamic(0, 2, members(t, 3))
+	assert.Error(t, err, "should not accept zero epoch length")
+	_, err = NewDynamic(10, 2, nil)
+	assert.Error(t, err, "should not accept empty genesis")
+
+	genesis := members(t, 2)
+	d, err := NewDynamic(10, 2, genesis)
+	require.NoError(t, err, "should create committee")
+	err = d.Finalize(3, []Member{{ID: genesis[0].ID}, {ID: genesis[1].ID}})
+	assert.Error(t, err, "should not accept removing all members")
+	err = d.Finalize(3, []Member{{ID: fixture.Hash(t), Weight: 1}})
+	assert.Error(t, err, "should not accept member without key")
+	require.NoError(t, d.Finalize(3, nil), "should finalize valid height")
+	assert.Error(t, d.Finalize(3, nil), "should not finalize same height twice")
+}
+
+func TestDynamicBoundary(t *testing.T) {
+
+	// create five validators, of which the first four start in the committee
+	domain := message.Domain{ChainID: "test", Version: 1}
+	ids := message.SortIDs(fixture.Hashes(t, 5))
+	signers := make([]*edwards.Signer, 0, len(ids))
+	members := make([]Member, 0, len(ids))
+	for _, id := range ids {
+		pub, priv, err := edwards.GenerateKey(nil)
+		require.NoError(t, err, "should generate key")
+		signers = append(signers, edwards.NewSigner(domain, id, priv))
+		members = append(members, Member{ID: id, Key: base.PublicKey(pub), Weight: 1})
+	}
+	d, err := NewDynamic(10, 2, members[:4])
+	require.NoError(t, err, "should create committee")
+
+	// the first validator leaves and the fifth one joins at epoch one
+	require.NoError(t, d.Finalize(7, []Member{{ID: ids[0]}, members[4]}), "should finalize changes")
+	strat := &mocks.Strategy{}
+	strat.On("Threshold", mock.Anything).Return(uint(3), nil)
+	verify := edwards.NewVerifier(domain, strat, d)
+
+	// the certificate for the last vertex of epoch zero includes the leaving
+	// validator and is part of the first proposal of epoch one
+	parent := fixture.Vertex(t)
+	parent.Height = 9
+	votes := make([]*message.Vote, 0, 3)
+	for _, signer := range signers[:3] {
+		vote, err := signer.Vote(parent)
+		require.NoError(t, err, "should create vote")
+		votes = append(votes, vote)
+	}
+	sig, err := edwards.NewAggregator().Aggregate(votes)
+	require.NoError(t, err, "should aggregate votes")
+	candidate := fixture.Vertex(t, fixture.WithParent(parent), fixture.WithProposer(ids[4]))
+	proposal, err := signers[4].Proposal(candidate)
+	require.NoError(t, err, "should create proposal")
+	proposal.Quorum = &message.Quorum{SignerIDs: ids[:3], Signature: sig}
+
+	// the quorum is checked against the old set, the proposal against the new
+	assert.NoError(t, verify.Quorum(proposal), "should verify quorum against old committee")
+	assert.NoError(t, verify.Proposal(proposal), "should verify proposal against new committee")
+	assert.NoError(t, verify.Vote(proposal.Vote()), "should verify new validator vote")
+	vote, err := signers[0].Vote(candidate)
+	require.NoError(t, err, "should create vote by leaving validator")
+	assert.Error(t, verify.Vote(vote), "should not verify vote by leaving validator")
+	vote, err = signers[4].Vote(parent)
+	require.NoError(t, err, "should create vote by joining validator")
+	assert.Error(t, verify.Vote(vote), "should not verify early vote by joining validator")
+
+	// the same quorum with a compact bitfield is indexed by the old committee
+	old, err := d.Participants(0)
+	require.NoError(t, err, "should get old participants")
+	proposal.Quorum, err = proposal.Quorum.Compact(old)
+	require.NoError(t, err, "should compact quorum")
+	assert.NoError(t, verify.Quorum(proposal), "should verify compact quorum against old committee")
+}
@@ -0,0 +1,468 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package committee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// Publisher makes the payload of an arc available to all nodes and returns
+// the identifier of the arc; the dispersal package provides one.
+type Publisher interface {
+	Disperse(payload []byte) (base.Hash, error)
+}
+
+// Watcher is told about every arc whose payload arrived from others; the
+// processor is one, as it holds on to the proposals whose arc payload was
+// missing until then. It is not told about the payloads of our own arcs, as
+// they are passed back to us while the processor builds its candidate.
+type Watcher interface {
+	OnArc(arcID base.Hash) error
+}
+
+// Scheme checks the signatures approving member changes, and the proofs of
+// possession for the keys members join with; the bls and edwards packages
+// provide one each.
+type Scheme interface {
+	Verify(key base.PublicKey, msg []byte, sig base.Signature) bool
+	Possession(key base.PublicKey, proof base.Signature) bool
+}
+
+// Change is a change to a member of the committee, along with what authorizes
+// it. A member that is added or updated has to prove possession of its key.
+// The change has to be approved by members holding more than two thirds of the
+// weight of the committee at the epoch of the height that finalizes it, except
+// for a member removing itself, which only needs its own approval.
+type Change struct {
+	Member
+	Proof     base.Signature
+	Approvals []Approval
+}
+
+// Approval is the signature of a member on the payload built for a change by
+// the ChangeBytes method of the domain.
+type Approval struct {
+	SignerID  base.Hash
+	Signature base.Signature
+}
+
+// The size of the identity, and the size of an encoded change without any
+// of its variable length fields.
+const (
+	idSize = len(base.ZeroHash)
+	header = idSize + 8 + 2 + 2 + 2
+)
+
+// Ledger carries the member changes of a dynamic committee on the chain. As
+// builder, it puts the changes staged on this node into the payload of the
+// arcs it proposes; as sink, it decodes the payloads of all arcs it receives;
+// and as finalizer of the graph, it hands the changes carried by every
+// finalized vertex to the committee. Changes stay staged until a finalized
+// vertex carries them, so they are not lost if a proposal fails.
+//
+// All nodes see the same payload for an arc, and check its changes against the
+// same committee, so they agree on the changes it carries. Changes that are
+// not authorized are dropped, and a payload that can't be decoded, or whose
+// changes would leave an invalid member set, carries no changes, so that it
+// can't keep the chain from being finalized. A vertex can only be finalized once the payload of its arc was
+// received, so as validator of the graph, the ledger refuses candidates whose
+// payload it doesn't have. Honest nodes thus only vote on vertices they can
+// finalize, and a quorum can't form on a made-up arc, or on one that the
+// disperser refused to rebuild; for a confirmed vertex whose payload a node
+// is still missing, the graph retries with every later confirmation.
+type Ledger struct {
+	sync.Mutex
+	committee *Dynamic
+	publish   Publisher
+	domain    message.Domain
+	scheme    Scheme
+	watch     Watcher
+	staged    []Change
+	building  map[base.Hash]uint
+	arcs      map[base.Hash][]Change
+}
+
+// NewLedger creates a ledger for the given committee, which publishes the
+// payloads of its arcs with the given publisher, and checks the approvals of
+// changes for the domain with the given signature scheme.
+func NewLedger(committee *Dynamic, publish Publisher, domain message.Domain, scheme Scheme) *Ledger {
+
+	l := Ledger{
+		committee: committee,
+		publish:   publish,
+		domain:    domain,
+		scheme:    scheme,
+		building:  make(map[base.Hash]uint),
+		arcs:      make(map[base.Hash][]Change),
+	}
+
+	return &l
+}
+
+// Attach sets the watcher that is told about the arcs whose payload arrives.
+func (l *Ledger) Attach(watch Watcher) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.watch = watch
+}
+
+// Stage adds member changes to be carried by the next arcs we build.
+func (l *Ledger) Stage(changes ...Change) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.staged = append(l.staged, changes...)
+}
+
+// Arc publishes the staged changes as the payload of a new arc. Without any
+// staged changes, it returns the zero hash, which stands for an arc without
+// changes.
+func (l *Ledger) Arc() (base.Hash, error) {
+
+	l.Lock()
+	changes := append([]Change(nil), l.staged...)
+	l.Unlock()
+
+	if len(changes) == 0 {
+		return base.ZeroHash, nil
+	}
+	payload, err := encode(changes)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not encode changes: %w", err)
+	}
+
+	// remember the payload we are publishing, so that we don't tell the
+	// watcher about it when the publisher passes it back to us
+	payloadID := base.Hash(sha3.Sum256(payload))
+	l.Lock()
+	l.building[payloadID]++
+	l.Unlock()
+
+	arcID, err := l.publish.Disperse(payload)
+
+	l.Lock()
+	l.building[payloadID]--
+	if l.building[payloadID] == 0 {
+		delete(l.building, payloadID)
+	}
+	if err == nil {
+		l.arcs[arcID] = changes
+	}
+	l.Unlock()
+
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not publish payload: %w", err)
+	}
+
+	return arcID, nil
+}
+
+// Payload decodes the changes carried by the payload of an arc and tells the
+// watcher that it arrived, unless it is the payload of an arc we are building.
+// A payload that can't be decoded is remembered as carrying no changes.
+func (l *Ledger) Payload(arcID base.Hash, payload []byte) error {
+
+	changes, failure := decode(payload)
+	payloadID := base.Hash(sha3.Sum256(payload))
+
+	l.Lock()
+	l.arcs[arcID] = changes
+	watch := l.watch
+	if l.building[payloadID] > 0 {
+		watch = nil
+	}
+	l.Unlock()
+
+	if watch != nil {
+		err := watch.OnArc(arcID)
+		if err != nil {
+			return rich.Errorf("could not notify watcher: %w", err).Hex("arc", arcID[:])
+		}
+	}
+	if failure != nil {
+		return rich.Errorf("could not decode changes: %w", failure).Hex("arc", arcID[:])
+	}
+
+	return nil
+}
+
+// Validate checks that we have the payload of the arc of the vertex, which we
+// need to finalize it.
+func (l *Ledger) Validate(vertex *base.Vertex) error {
+
+	if vertex.ArcID == base.ZeroHash {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	_, ok := l.arcs[vertex.ArcID]
+	if !ok {
+		return signal.MissingArc{Vertex: vertex}
+	}
+
+	return nil
+}
+
+// Finalize hands the changes carried by the arc of the vertex to the
+// committee, and removes them from the staged changes.
+func (l *Ledger) Finalize(vertex *base.Vertex) error {
+
+	l.Lock()
+	defer l.Unlock()
+
+	// 1) look up the changes of the arc, which we need to have received
+	var changes []Change
+	if vertex.ArcID != base.ZeroHash {
+		var ok bool
+		changes, ok = l.arcs[vertex.ArcID]
+		if !ok {
+			return rich.Errorf("missing arc payload").Hex("arc", vertex.ArcID[:]).Uint64("height", vertex.Height)
+		}
+	}
+
+	// 2) only keep the changes that are authorized by the committee at the
+	// height of the vertex
+	members, err := l.authorized(vertex.Height, changes)
+	if err != nil {
+		return rich.Errorf("could not check changes: %w", err).Uint64("height", vertex.Height)
+	}
+
+	// 3) apply them to the committee; if they would leave an invalid member
+	// set, every node rejects them alike, and the height carries no changes
+	err = l.committee.Finalize(vertex.Height, members)
+	if err != nil && len(members) > 0 {
+		err = l.committee.Finalize(vertex.Height, nil)
+	}
+	if err != nil {
+		return rich.Errorf("could not finalize changes: %w", err).Uint64("height", vertex.Height)
+	}
+	delete(l.arcs, vertex.ArcID)
+
+	// 4) the changes we staged are done once a finalized vertex carries them,
+	// even if they were rejected, as they would be rejected again
+	staged := l.staged[:0]
+	for _, change := range l.staged {
+		if !carries(changes, change) {
+			staged = append(staged, change)
+		}
+	}
+	l.staged = staged
+
+	return nil
+}
+
+// authorized returns the members of the changes that are authorized by the
+// committee at the given height. Approvals by non-members, duplicate approvals
+// and invalid signatures don't count.
+func (l *Ledger) authorized(height uint64, changes []Change) ([]Member, error) {
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	// 1) get the weights of the committee that has to approve the changes
+	epoch, err := l.committee.Epoch(height)
+	if err != nil {
+		return nil, rich.Errorf("could not get epoch: %w", err)
+	}
+	participants, err := l.committee.Participants(epoch)
+	if err != nil {
+		return nil, rich.Errorf("could not get participants: %w", err).Uint64("epoch", epoch)
+	}
+	weights := make(map[base.Hash]uint64, len(participants))
+	total := uint64(0)
+	for _, participantID := range participants {
+		weight, err := l.committee.Weight(epoch, participantID)
+		if err != nil {
+			return nil, rich.Errorf("could not get weight: %w", err).Hex("participant", participantID[:])
+		}
+		weights[participantID] = weight
+		total += weight
+	}
+
+	// 2) keep the changes that prove possession of a new key, and that are
+	// approved by more than two thirds of the weight, or by the member itself
+	// for a removal
+	members := make([]Member, 0, len(changes))
+	for _, change := range changes {
+		if change.Weight > 0 && !l.scheme.Possession(change.Key, change.Proof) {
+			continue
+		}
+		msg := l.domain.ChangeBytes(epoch, change.ID, change.Weight, change.Key)
+		approved := uint64(0)
+		self := false
+		counted := make(map[base.Hash]struct{}, len(change.Approvals))
+		for _, approval := range change.Approvals {
+			weight, ok := weights[approval.SignerID]
+			_, duplicate := counted[approval.SignerID]
+			if !ok || duplicate {
+				continue
+			}
+			key, err := l.committee.Key(epoch, approval.SignerID)
+			if err != nil {
+				return nil, rich.Errorf("could not get key: %w", err).Hex("participant", approval.SignerID[:])
+			}
+			if !l.scheme.Verify(key, msg, approval.Signature) {
+				continue
+			}
+			counted[approval.SignerID] = struct{}{}
+			approved += weight
+			self = self || approval.SignerID == change.ID
+		}
+		if 3*approved > 2*total || (change.Weight == 0 && self) {
+			members = append(members, change.Member)
+		}
+	}
+
+	return members, nil
+}
+
+// carries checks whether the given change is among the changes.
+func carries(changes []Change, change Change) bool {
+	for _, candidate := range changes {
+		if candidate.ID == change.ID && candidate.Weight == change.Weight && bytes.Equal(candidate.Key, change.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// encode encodes member changes as payload, with the number of changes
+// followed by each change: the identity and weight of the member, its
+// length-prefixed key and proof of possession, and the number of approvals,
+// each with the identity of the signer and the length-prefixed signature.
+func encode(changes []Change) ([]byte, error) {
+
+	if len(changes) > math.MaxUint16 {
+		return nil, rich.Errorf("too many changes").Int("changes", len(changes))
+	}
+	payload := make([]byte, 0, 2+len(changes)*header)
+	payload = appendUint16(payload, len(changes))
+	for _, change := range changes {
+		if len(change.Key) > math.MaxUint16 || len(change.Proof) > math.MaxUint16 || len(change.Approvals) > math.MaxUint16 {
+			return nil, rich.Errorf("change too long").Hex("member", change.ID[:]).Int("key", len(change.Key)).Int("proof", len(change.Proof)).Int("approvals", len(change.Approvals))
+		}
+		var weight [8]byte
+		binary.BigEndian.PutUint64(weight[:], change.Weight)
+		payload = append(payload, change.ID[:]...)
+		payload = append(payload, weight[:]...)
+		payload = appendUint16(payload, len(change.Key))
+		payload = append(payload, change.Key...)
+		payload = appendUint16(payload, len(change.Proof))
+		payload = append(payload, change.Proof...)
+		payload = appendUint16(payload, len(change.Approvals))
+		for _, approval := range change.Approvals {
+			if len(approval.Signature) > math.MaxUint16 {
+				return nil, rich.Errorf("signature too long").Hex("member", change.ID[:]).Hex("signer", approval.SignerID[:])
+			}
+			payload = append(payload, approval.SignerID[:]...)
+			payload = appendUint16(payload, len(approval.Signature))
+			payload = append(payload, approval.Signature...)
+		}
+	}
+
+	return payload, nil
+}
+
+// decode decodes the member changes of a payload, rejecting any payload that
+// is not exactly the encoding of its changes.
+func decode(payload []byte) ([]Change, error) {
+
+	r := reader{rest: payload}
+	count := r.uint16()
+	if r.short {
+		return nil, rich.Errorf("payload too short").Int("length", len(payload))
+	}
+	changes := make([]Change, 0, count)
+	for i := 0; i < count; i++ {
+		var change Change
+		copy(change.ID[:], r.next(idSize))
+		change.Weight = binary.BigEndian.Uint64(r.next(8))
+		change.Key = base.PublicKey(r.field())
+		change.Proof = base.Signature(r.field())
+		approvals := r.uint16()
+		for j := 0; j < approvals && !r.short; j++ {
+			var approval Approval
+			copy(approval.SignerID[:], r.next(idSize))
+			approval.Signature = base.Signature(r.field())
+			change.Approvals = append(change.Approvals, approval)
+		}
+		if r.short {
+			return nil, rich.Errorf("truncated change").Int("index", i)
+		}
+		changes = append(changes, change)
+	}
+	if len(r.rest) > 0 {
+		return nil, rich.Errorf("trailing payload bytes").Int("length", len(r.rest))
+	}
+
+	return changes, nil
+}
+
+// appendUint16 appends a length or count to the payload.
+func appendUint16(payload []byte, v int) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(v))
+	return append(payload, buf[:]...)
+}
+
+// reader reads the fields of a payload one after the other. Once the payload
+// is too short for a field, it only returns empty fields, and remembers that
+// the payload was truncated.
+type reader struct {
+	rest  []byte
+	short bool
+}
+
+// next returns the next bytes of the payload.
+func (r *reader) next(size int) []byte {
+	if r.short || len(r.rest) < size {
+		r.short = true
+		return make([]byte, size)
+	}
+	data := r.rest[:size]
+	r.rest = r.rest[size:]
+	return data
+}
+
+// uint16 returns the next length or count of the payload.
+func (r *reader) uint16() int {
+	return int(binary.BigEndian.Uint16(r.next(2)))
+}
+
+// field returns a copy of the next length-prefixed field of the payload, or
+// nil if it is empty.
+func (r *reader) field() []byte {
+	length := r.uint16()
+	data := r.next(length)
+	if r.short || length == 0 {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
@@ -0,0 +1,525 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package committee
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/cache"
+	"github.com/awfm/consensus/crypto/bls"
+	"github.com/awfm/consensus/crypto/edwards"
+	"github.com/awfm/consensus/graph"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+	"github.com/awfm/consensus/network/dispersal"
+	"github.com/awfm/consensus/strategy"
+)
+
+var (
+	_ consensus.Builder = (*Ledger)(nil)
+	_ dispersal.Sink    = (*Ledger)(nil)
+	_ graph.Finalizer   = (*Ledger)(nil)
+	_ graph.Validator   = (*Ledger)(nil)
+	_ Publisher         = (*dispersal.Disperser)(nil)
+	_ Scheme            = (*bls.Scheme)(nil)
+	_ Scheme            = (*edwards.Scheme)(nil)
+	_ Watcher           = (*consensus.Processor)(nil)
+)
+
+// publisher hands every payload to all ledgers, identifying the arc by the
+// hash of the payload; without a hub, it does so right away, otherwise the hub
+// delivers them once there are no other messages left.
+type publisher struct {
+	ledgers []*Ledger
+	count   int
+	h       *hub
+}
+
+func (p *publisher) Disperse(payload []byte) (base.Hash, error) {
+	p.count++
+	arcID := base.Hash(sha3.Sum256(payload))
+	for _, ledger := range p.ledgers {
+		if p.h != nil {
+			p.h.payloads = append(p.h.payloads, arrival{ledger: ledger, arcID: arcID, payload: payload})
+			continue
+		}
+		err := ledger.Payload(arcID, payload)
+		if err != nil {
+			return base.ZeroHash, err
+		}
+	}
+	return arcID, nil
+}
+
+// validator is a member with an edwards key, along with its private key.
+type validator struct {
+	Member
+	priv ed25519.PrivateKey
+}
+
+// validators creates validators of equal weight.
+func validators(t *testing.T, n int) []validator {
+	validators := make([]validator, 0, n)
+	for _, id := range message.SortIDs(fixture.Hashes(t, uint(n))) {
+		pub, priv, err := edwards.GenerateKey(nil)
+		require.NoError(t, err, "should generate key")
+		validators = append(validators, validator{Member: Member{ID: id, Key: base.PublicKey(pub), Weight: 1}, priv: priv})
+	}
+	return validators
+}
+
+// join creates the change adding the validator, with its proof of possession.
+func join(v validator) Change {
+	return Change{Member: v.Member, Proof: edwards.Prove(v.priv)}
+}
+
+// leave creates the change removing the validator.
+func leave(v validator) Change {
+	return Change{Member: Member{ID: v.ID}}
+}
+
+// approve adds the approvals of the given validators for the epoch to the
+// change.
+func approve(domain message.Domain, epoch uint64, change Change, approvers ...validator) Change {
+	msg := domain.ChangeBytes(epoch, change.ID, change.Weight, change.Key)
+	for _, approver := range approvers {
+		change.Approvals = append(change.Approvals, Approval{SignerID: approver.ID, Signature: ed25519.Sign(approver.priv, msg)})
+	}
+	return change
+}
+
+func TestLedgerEncoding(t *testing.T) {
+
+	// changes should survive encoding, including removals without key, proof
+	// or approvals
+	domain := message.Domain{ChainID: "test", Version: 1}
+	all := validators(t, 3)
+	changes := []Change{
+		approve(domain, 0, join(all[0]), all[1], all[2]),
+		join(all[1]),
+		leave(all[2]),
+	}
+	payload, err := encode(changes)
+	require.NoError(t, err, "should encode changes")
+	decoded, err := decode(payload)
+	require.NoError(t, err, "should decode changes")
+	assert.Equal(t, changes, decoded, "should decode same changes")
+
+	// anything but the exact encoding should be rejected
+	_, err = decode(payload[:1])
+	assert.Error(t, err, "should not decode without count")
+	for length := 2; length < len(payload); length++ {
+		_, err = decode(payload[:length])
+		assert.Error(t, err, "should not decode truncated payload (length: %d)", length)
+	}
+	_, err = decode(append(payload, 0))
+	assert.Error(t, err, "should not decode trailing bytes")
+}
+
+func TestLedger(t *testing.T) {
+
+	domain := message.Domain{ChainID: "test", Version: 1}
+	all := validators(t, 5)
+	genesis := []Member{all[0].Member, all[1].Member, all[2].Member, all[3].Member}
+	d, err := NewDynamic(10, 1, genesis)
+	require.NoError(t, err, "should create committee")
+	pub := &publisher{}
+	l := NewLedger(d, pub, domain, edwards.Scheme{})
+	pub.ledgers = []*Ledger{l}
+
+	// without staged changes, arcs carry nothing and nothing is published
+	arcID, err := l.Arc()
+	require.NoError(t, err, "should build empty arc")
+	assert.Equal(t, base.Hash{}, arcID, "should have zero arc without changes")
+	assert.Zero(t, pub.count, "should not publish empty arc")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 1, ArcID: arcID}), "should finalize empty arc")
+
+	// staged changes stay staged until a finalized vertex carries them
+	added := approve(domain, 0, join(all[4]), all[0], all[1], all[2])
+	l.Stage(added)
+	arcID, err = l.Arc()
+	require.NoError(t, err, "should build arc with changes")
+	again, err := l.Arc()
+	require.NoError(t, err, "should build arc again")
+	assert.Equal(t, arcID, again, "should carry staged changes in every arc")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 2, ArcID: base.ZeroHash}), "should finalize other arc")
+	assert.Len(t, l.staged, 1, "should keep changes staged")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 3, ArcID: arcID}), "should finalize arc with changes")
+	assert.Empty(t, l.staged, "should drop finalized changes")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 8}), "should finalize height determining next epoch")
+	assert.True(t, contains(t, d, 1, added.ID), "should apply changes at next epoch")
+
+	// a vertex can't be finalized without the payload of its arc
+	unknown := &base.Vertex{Height: 9, ArcID: fixture.Hash(t)}
+	assert.Error(t, l.Finalize(unknown), "should not finalize without payload")
+	payload, err := encode([]Change{approve(domain, 0, leave(all[0]), all[0])})
+	require.NoError(t, err, "should encode removal")
+	require.NoError(t, l.Payload(unknown.ArcID, payload), "should accept payload")
+	require.NoError(t, l.Finalize(unknown), "should finalize once payload arrived")
+
+	// payloads that don't decode, or changes that leave an invalid member set,
+	// are finalized without any changes
+	invalid := &base.Vertex{Height: 10, ArcID: fixture.Hash(t)}
+	assert.Error(t, l.Payload(invalid.ArcID, []byte{1}), "should not decode invalid payload")
+	require.NoError(t, l.Finalize(invalid), "should finalize invalid payload")
+	removal := make([]Change, 0, len(all))
+	for _, v := range all {
+		removal = append(removal, approve(domain, 1, leave(v), all...))
+	}
+	l.Stage(removal...)
+	arcID, err = l.Arc()
+	require.NoError(t, err, "should build arc removing everyone")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 11, ArcID: arcID}), "should finalize invalid changes")
+	assert.Empty(t, l.staged, "should drop rejected changes")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 18}), "should finalize height determining epoch two")
+	assert.False(t, contains(t, d, 2, all[0].ID), "should apply removal")
+	assert.True(t, contains(t, d, 2, all[1].ID), "should not apply invalid changes")
+}
+
+func TestLedgerAuthorization(t *testing.T) {
+
+	domain := message.Domain{ChainID: "test", Version: 1}
+	all := validators(t, 8)
+	genesis := []Member{all[0].Member, all[1].Member, all[2].Member, all[3].Member}
+	d, err := NewDynamic(10, 1, genesis)
+	require.NoError(t, err, "should create committee")
+	l := NewLedger(d, &publisher{}, domain, edwards.Scheme{})
+
+	// only the changes approved by more than two thirds of the weight, with a
+	// proof of possession for added keys, should be applied; counting only
+	// valid approvals by members for the epoch of the height, once each
+	stolen := join(all[5])
+	stolen.Key = all[0].Key
+	duplicate := approve(domain, 0, join(all[6]), all[0], all[1])
+	duplicate.Approvals = append(duplicate.Approvals, duplicate.Approvals...)
+	forged := approve(domain, 0, join(all[7]), all[0], all[1])
+	forged.Approvals = append(forged.Approvals, Approval{SignerID: all[2].ID, Signature: forged.Approvals[0].Signature})
+	changes := []Change{
+		approve(domain, 0, join(all[4]), all[0], all[1], all[2]),
+		approve(domain, 0, join(all[5]), all[0], all[1], all[6]),
+		approve(domain, 0, stolen, all[0], all[1], all[2]),
+		approve(domain, 0, Change{Member: all[5].Member}, all[0], all[1], all[2]),
+		approve(domain, 1, join(all[5]), all[0], all[1], all[2]),
+		duplicate,
+		forged,
+		approve(domain, 0, leave(all[3]), all[3]),
+		approve(domain, 0, leave(all[2]), all[0]),
+	}
+	members, err := l.authorized(5, changes)
+	require.NoError(t, err, "should check changes")
+	assert.Equal(t, []Member{all[4].Member, {ID: all[3].ID}}, members, "should only keep authorized changes")
+
+	// the changes should be checked against the committee of the epoch of the
+	// height they are finalized at
+	payload, err := encode(changes)
+	require.NoError(t, err, "should encode changes")
+	arcID := fixture.Hash(t)
+	require.NoError(t, l.Payload(arcID, payload), "should accept payload")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 5, ArcID: arcID}), "should finalize changes")
+	require.NoError(t, l.Finalize(&base.Vertex{Height: 8}), "should finalize height determining next epoch")
+	participants, err := d.Participants(1)
+	require.NoError(t, err, "should get participants")
+	assert.Equal(t, message.SortIDs([]base.Hash{all[0].ID, all[1].ID, all[2].ID, all[4].ID}), participants, "should apply authorized changes")
+	members, err = l.authorized(15, changes)
+	require.NoError(t, err, "should check changes again")
+	assert.Equal(t, []Member{all[5].Member}, members, "should check approvals for epoch of height")
+}
+
+// watcher records the arcs it is told about.
+type watcher struct {
+	arcIDs []base.Hash
+}
+
+func (w *watcher) OnArc(arcID base.Hash) error {
+	w.arcIDs = append(w.arcIDs, arcID)
+	return nil
+}
+
+func TestLedgerValidate(t *testing.T) {
+
+	d, err := NewDynamic(10, 1, members(t, 4))
+	require.NoError(t, err, "should create committee")
+	pub := &publisher{}
+	l := NewLedger(d, pub, message.Domain{ChainID: "test", Version: 1}, edwards.Scheme{})
+	pub.ledgers = []*Ledger{l}
+	w := &watcher{}
+	l.Attach(w)
+
+	// vertices without changes are always valid
+	assert.NoError(t, l.Validate(&base.Vertex{Height: 1}), "should validate empty arc")
+
+	// vertices with an arc we don't have the payload for are not
+	vertex := &base.Vertex{Height: 1, ArcID: fixture.Hash(t)}
+	err = l.Validate(vertex)
+	require.Error(t, err, "should not validate unknown arc")
+	assert.True(t, errors.As(err, &signal.MissingArc{}), "should have missing arc error")
+
+	// once the payload arrives, the watcher is told and the vertex is valid,
+	// even if the payload doesn't decode
+	assert.Error(t, l.Payload(vertex.ArcID, []byte{1}), "should not decode invalid payload")
+	assert.Equal(t, []base.Hash{vertex.ArcID}, w.arcIDs, "should tell watcher about arc")
+	assert.NoError(t, l.Validate(vertex), "should validate arc with payload")
+
+	// the payloads of our own arcs are known, but the watcher isn't told
+	l.Stage(Change{Member: Member{ID: fixture.Hash(t)}})
+	arcID, err := l.Arc()
+	require.NoError(t, err, "should build arc")
+	assert.NoError(t, l.Validate(&base.Vertex{Height: 2, ArcID: arcID}), "should validate own arc")
+	assert.Len(t, w.arcIDs, 1, "should not tell watcher about own arc")
+	assert.Empty(t, l.building, "should forget built payload")
+}
+
+// hub delivers the messages of all nodes in the order they were sent, except
+// for messages looped back, which are delivered first.
+type hub struct {
+	processors map[base.Hash]*consensus.Processor
+	order      []base.Hash
+	looped     []delivery
+	queue      []delivery
+	payloads   []arrival
+	limit      uint64
+	proposals  map[uint64]*message.Proposal
+}
+
+// arrival is a payload on its way to the ledger of a node.
+type arrival struct {
+	ledger  *Ledger
+	arcID   base.Hash
+	payload []byte
+}
+
+// delivery is a message on its way to a node.
+type delivery struct {
+	recipientID base.Hash
+	msg         interface{}
+}
+
+// endpoint is how a single node sends messages through the hub, and how it
+// loops messages back to itself.
+type endpoint struct {
+	h      *hub
+	selfID base.Hash
+}
+
+func (e *endpoint) Broadcast(proposal *message.Proposal) error {
+	for _, nodeID := range e.h.order {
+		if nodeID != e.selfID {
+			e.h.queue = append(e.h.queue, delivery{recipientID: nodeID, msg: proposal})
+		}
+	}
+	return nil
+}
+
+func (e *endpoint) Transmit(vote *message.Vote, recipientID base.Hash) error {
+	e.h.queue = append(e.h.queue, delivery{recipientID: recipientID, msg: vote})
+	return nil
+}
+
+func (e *endpoint) Proposal(proposal *message.Proposal) {
+	e.h.looped = append(e.h.looped, delivery{recipientID: e.selfID, msg: proposal})
+}
+
+func (e *endpoint) Vote(vote *message.Vote) {
+	e.h.looped = append(e.h.looped, delivery{recipientID: e.selfID, msg: vote})
+}
+
+// run delivers messages until there are none left, dropping proposals above
+// the height limit, and reports the errors of processing them. Payloads are
+// only delivered to all nodes at once when there are no other messages left,
+// so they always arrive after the proposals carrying their arc.
+func (h *hub) run(report func(delivery, error)) {
+	for len(h.looped) > 0 || len(h.queue) > 0 || len(h.payloads) > 0 {
+		if len(h.looped) == 0 && len(h.queue) == 0 {
+			for _, next := range h.payloads {
+				_ = next.ledger.Payload(next.arcID, next.payload)
+			}
+			h.payloads = nil
+			continue
+		}
+		var next delivery
+		if len(h.looped) > 0 {
+			next, h.looped = h.looped[0], h.looped[1:]
+		} else {
+			next, h.queue = h.queue[0], h.queue[1:]
+		}
+		pro := h.processors[next.recipientID]
+		switch msg := next.msg.(type) {
+		case *message.Proposal:
+			if msg.Candidate.Height > h.limit {
+				continue
+			}
+			_, ok := h.proposals[msg.Candidate.Height]
+			if !ok {
+				h.proposals[msg.Candidate.Height] = msg
+			}
+			report(next, pro.OnProposal(msg))
+		case *message.Vote:
+			report(next, pro.OnVote(msg))
+		}
+	}
+}
+
+func TestLedgerChain(t *testing.T) {
+
+	// five validators, of which the first four start in the committee; the
+	// first one leaves on its own and the fifth one joins with the approval
+	// of all four, staged by the leader of height two; vertices are finalized once the proposal with their quorum is
+	// processed, and the collectors of a height are the leaders of the next,
+	// so the member set has to be known two heights above the final vertex,
+	// which a depth of one provides
+	domain := message.Domain{ChainID: "test", Version: 1}
+	all := validators(t, 5)
+	ids := make([]base.Hash, 0, len(all))
+	initial := make([]Member, 0, len(all)-1)
+	for _, v := range all {
+		ids = append(ids, v.ID)
+	}
+	for _, v := range all[:4] {
+		initial = append(initial, v.Member)
+	}
+	genesis := fixture.Genesis(t)
+	h := &hub{
+		processors: make(map[base.Hash]*consensus.Processor),
+		order:      ids,
+		limit:      25,
+		proposals:  make(map[uint64]*message.Proposal),
+	}
+	pub := &publisher{h: h}
+	committees := make([]*Dynamic, 0, len(ids))
+	graphs := make([]*graph.Graph, 0, len(ids))
+	for i, id := range ids {
+		d, err := NewDynamic(10, 1, initial)
+		require.NoError(t, err, "should create committee")
+		ledger := NewLedger(d, pub, domain, edwards.Scheme{})
+		g, err := graph.New(genesis, ledger)
+		require.NoError(t, err, "should create graph")
+		strat := strategy.NewRoundRobin(d)
+		sign := edwards.NewSigner(domain, id, all[i].priv)
+		verify := edwards.NewVerifier(domain, strat, d)
+		votes := cache.NewCache(strat, edwards.NewAggregator(), d)
+		e := &endpoint{h: h, selfID: id}
+		pro := consensus.NewProcessor(e, g, ledger, strat, sign, verify, votes)
+		pro.Attach(e)
+		ledger.Attach(pro)
+		h.processors[id] = pro
+		pub.ledgers = append(pub.ledgers, ledger)
+		committees = append(committees, d)
+		graphs = append(graphs, g)
+	}
+	pub.ledgers[2].Stage(
+		approve(domain, 0, leave(all[0]), all[0]),
+		approve(domain, 0, join(all[4]), all[:4]...),
+	)
+
+	// the members of each epoch, for checking who may vote
+	old := ids[:4]
+	next := ids[1:]
+	member := func(height uint64, id base.Hash) bool {
+		set := old
+		if height >= 10 {
+			set = next
+		}
+		for _, memberID := range set {
+			if memberID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	// run the chain up to height 25, starting with the votes of the genesis
+	// members on the genesis vertex; every proposal should be processed, apart
+	// from the one carrying the changes, whose payload only arrives later, and
+	// the only votes rejected should be late ones, or from non-members
+	missing := 0
+	for _, id := range old {
+		require.NoError(t, h.processors[id].Bootstrap(), "should bootstrap")
+	}
+	h.run(func(d delivery, err error) {
+		if err == nil {
+			return
+		}
+		switch msg := d.msg.(type) {
+		case *message.Proposal:
+			if errors.As(err, &signal.MissingArc{}) {
+				missing++
+				return
+			}
+			assert.NoError(t, err, "should process proposal (height: %d)", msg.Candidate.Height)
+		case *message.Vote:
+			if errors.As(err, &signal.StaleVote{}) {
+				return
+			}
+			assert.False(t, member(msg.Height, msg.SignerID), "should only reject votes by non-members (height: %d)", msg.Height)
+		}
+	})
+	assert.Equal(t, 1, pub.count, "should publish changes in a single arc")
+	assert.Equal(t, len(ids)-1, missing, "should wait for payload on all other nodes")
+
+	// all nodes should have finalized the same chain, with the changes carried
+	// by the arc at height two, and the leaders of the respective member sets
+	for i, g := range graphs {
+		final, err := g.Final()
+		require.NoError(t, err, "should get final")
+		require.Equal(t, uint64(24), final.Height, "should finalize up to height below limit")
+		for height := uint64(1); height <= final.Height; height++ {
+			vertex, err := g.Finalized(height)
+			require.NoError(t, err, "should get finalized vertex")
+			reference, err := graphs[0].Finalized(height)
+			require.NoError(t, err, "should get reference vertex")
+			assert.Equal(t, reference.ID(), vertex.ID(), "should agree on vertex (node: %d, height: %d)", i, height)
+			assert.Equal(t, height == 2, vertex.ArcID != base.ZeroHash, "should only carry changes at height two (height: %d)", height)
+			set := old
+			if height >= 10 {
+				set = next
+			}
+			assert.Equal(t, set[height%4], vertex.ProposerID, "should be proposed by leader (height: %d)", height)
+		}
+	}
+
+	// every node should have activated the changes at epoch one
+	for i, d := range committees {
+		participants, err := d.Participants(0)
+		require.NoError(t, err, "should get participants of epoch zero")
+		assert.Equal(t, old, participants, "should keep old members in epoch zero (node: %d)", i)
+		for _, epoch := range []uint64{1, 2} {
+			participants, err := d.Participants(epoch)
+			require.NoError(t, err, "should get participants of epoch %d", epoch)
+			assert.Equal(t, next, participants, "should have new members in epoch %d (node: %d)", epoch, i)
+		}
+	}
+
+	// the first proposal of epoch one carries the quorum for the last vertex
+	// of epoch zero, which is signed by the old members, including the one
+	// that left
+	proposal := h.proposals[10]
+	require.NotNil(t, proposal, "should have proposal at epoch boundary")
+	quorum, err := proposal.Quorum.Expand(old)
+	require.NoError(t, err, "should expand quorum against old members")
+	assert.Contains(t, quorum.SignerIDs, ids[0], "should include leaving member in boundary quorum")
+	for _, signerID := range quorum.SignerIDs {
+		assert.True(t, member(9, signerID), "should only include old members in boundary quorum")
+	}
+}
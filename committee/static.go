@@ -0,0 +1,126 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package committee implements the committee component, which provides the
+// participants of each epoch along with their public keys and weights.
+package committee
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Member is a participant of the committee with its public key and weight.
+type Member struct {
+	ID     base.Hash
+	Key    base.PublicKey
+	Weight uint64
+}
+
+// Static is a committee with the same members in every epoch.
+type Static struct {
+	length       uint64
+	participants []base.Hash
+	members      map[base.Hash]Member
+}
+
+// NewStatic creates a committee with epochs of the given length in heights,
+// with the given members for all epochs.
+func NewStatic(length uint64, members []Member) (*Static, error) {
+
+	if length == 0 {
+		return nil, rich.Errorf("invalid epoch length").Uint64("length", length)
+	}
+	index, err := index(members)
+	if err != nil {
+		return nil, rich.Errorf("invalid members: %w", err)
+	}
+
+	s := Static{
+		length:       length,
+		participants: participants(index),
+		members:      index,
+	}
+
+	return &s, nil
+}
+
+// Epoch returns the epoch the given height is part of.
+func (s *Static) Epoch(height uint64) (uint64, error) {
+	return height / s.length, nil
+}
+
+// Participants returns the IDs of all members in ascending order.
+func (s *Static) Participants(epoch uint64) ([]base.Hash, error) {
+	participants := make([]base.Hash, len(s.participants))
+	copy(participants, s.participants)
+	return participants, nil
+}
+
+// Key returns the public key of the given member.
+func (s *Static) Key(epoch uint64, participantID base.Hash) (base.PublicKey, error) {
+	member, ok := s.members[participantID]
+	if !ok {
+		return nil, rich.Errorf("unknown participant").Hex("participant", participantID[:]).Uint64("epoch", epoch)
+	}
+	return member.Key, nil
+}
+
+// Weight returns the weight of the given member.
+func (s *Static) Weight(epoch uint64, participantID base.Hash) (uint64, error) {
+	member, ok := s.members[participantID]
+	if !ok {
+		return 0, rich.Errorf("unknown participant").Hex("participant", participantID[:]).Uint64("epoch", epoch)
+	}
+	return member.Weight, nil
+}
+
+// index checks that a member set is non-empty, with unique non-zero
+// identities, keys and positive weights, and indexes it by identity.
+func index(members []Member) (map[base.Hash]Member, error) {
+	if len(members) == 0 {
+		return nil, rich.Errorf("empty member set")
+	}
+	index := make(map[base.Hash]Member, len(members))
+	for _, member := range members {
+		if member.ID == base.ZeroHash {
+			return nil, rich.Errorf("zero member identity")
+		}
+		if len(member.Key) == 0 {
+			return nil, rich.Errorf("missing member key").Hex("member", member.ID[:])
+		}
+		if member.Weight == 0 {
+			return nil, rich.Errorf("zero member weight").Hex("member", member.ID[:])
+		}
+		_, duplicate := index[member.ID]
+		if duplicate {
+			return nil, rich.Errorf("duplicate member").Hex("member", member.ID[:])
+		}
+		index[member.ID] = member
+	}
+	return index, nil
+}
+
+// participants returns the IDs of the indexed members in committee order.
+func participants(index map[base.Hash]Member) []base.Hash {
+	ids := make([]base.Hash, 0, len(index))
+	for id := range index {
+		ids = append(ids, id)
+	}
+	return message.SortIDs(ids)
+}
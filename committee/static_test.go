@@ -0,0 +1,109 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+)
+
+var _ consensus.Committee = (*Static)(nil)
+
+// members creates the given number of members with increasing weights.
+func members(t *testing.T, n int) []Member {
+	members := make([]Member, 0, n)
+	for i, participantID := range fixture.Hashes(t, uint(n)) {
+		members = append(members, Member{ID: participantID, Key: base.PublicKey{byte(i)}, Weight: uint64(i + 1)})
+	}
+	return members
+}
+
+func TestStatic(t *testing.T) {
+
+	members := members(t, 5)
+	s, err := NewStatic(10, members)
+	require.NoError(t, err, "should create committee")
+
+	// epochs should be fixed ranges of heights
+	for height, expected := range map[uint64]uint64{0: 0, 9: 0, 10: 1, 25: 2} {
+		epoch, err := s.Epoch(height)
+		require.NoError(t, err, "should get epoch")
+		assert.Equal(t, expected, epoch, "should have epoch for height %d", height)
+	}
+
+	// participants should be in committee order and keys and weights match
+	ids := make([]base.Hash, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+	participants, err := s.Participants(3)
+	require.NoError(t, err, "should get participants")
+	assert.Equal(t, message.SortIDs(ids), participants, "should have sorted participants")
+	participants[0] = base.ZeroHash
+	again, err := s.Participants(3)
+	require.NoError(t, err, "should get participants again")
+	assert.NotEqual(t, participants, again, "should not expose internal participants")
+	for _, member := range members {
+		key, err := s.Key(3, member.ID)
+		require.NoError(t, err, "should get key")
+		assert.Equal(t, member.Key, key, "should have member key")
+		weight, err := s.Weight(3, member.ID)
+		require.NoError(t, err, "should get weight")
+		assert.Equal(t, member.Weight, weight, "should have member weight")
+	}
+
+	// unknown participants should give errors
+	_, err = s.Key(0, fixture.Hash(t))
+	assert.Error(t, err, "should not have key for unknown participant")
+	_, err = s.Weight(0, fixture.Hash(t))
+	assert.Error(t, err, "should not have weight for unknown participant")
+}
+
+func TestStaticInvalid(t *testing.T) {
+
+	_, err := NewStatic(0, members(t, 3))
+	assert.Error(t, err, "should not accept zero epoch length")
+	_, err = NewStatic(10, nil)
+	assert.Error(t, err, "should not accept empty members")
+
+	duplicate := members(t, 3)
+	duplicate[2].ID = duplicate[0].ID
+	_, err = NewStatic(10, duplicate)
+	assert.Error(t, err, "should not accept duplicate members")
+
+	zero := members(t, 3)
+	zero[1].ID = base.ZeroHash
+	_, err = NewStatic(10, zero)
+	assert.Error(t, err, "should not accept zero identity")
+
+	weightless := members(t, 3)
+	weightless[1].Weight = 0
+	_, err = NewStatic(10, weightless)
+	assert.Error(t, err, "should not accept zero weight")
+
+	keyless := members(t, 3)
+	keyless[1].Key = nil
+	_, err = NewStatic(10, keyless)
+	assert.Error(t, err, "should not accept missing key")
+}
@@ -0,0 +1,45 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package batch contains helpers shared by the batch verification of the
+// different signature schemes.
+package batch
+
+// Bisect finds the invalid entries of a batch that failed verification. It
+// recursively splits the batch in halves and only descends into the halves
+// that fail verification, so a few invalid entries in a large batch are found
+// with a logarithmic number of verifications each. The returned indices are in
+// ascending order.
+func Bisect(n int, verify func(indices []int) bool) []int {
+	indices := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		indices = append(indices, i)
+	}
+	return bisect(indices, verify)
+}
+
+func bisect(indices []int, verify func(indices []int) bool) []int {
+	if len(indices) == 0 || verify(indices) {
+		return nil
+	}
+	if len(indices) == 1 {
+		return indices
+	}
+	half := len(indices) / 2
+	invalid := bisect(indices[:half], verify)
+	invalid = append(invalid, bisect(indices[half:], verify)...)
+	return invalid
+}
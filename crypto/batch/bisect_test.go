@@ -0,0 +1,48 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package batch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBisect(t *testing.T) {
+
+	// create a batch with some invalid entries and count verifications
+	invalid := map[int]bool{3: true, 17: true, 18: true}
+	calls := 0
+	verify := func(indices []int) bool {
+		calls++
+		for _, index := range indices {
+			if invalid[index] {
+				return false
+			}
+		}
+		return true
+	}
+
+	found := Bisect(64, verify)
+	assert.Equal(t, []int{3, 17, 18}, found, "should find all invalid entries")
+	assert.Less(t, calls, 64, "should need fewer verifications than entries")
+
+	calls = 0
+	found = Bisect(64, func([]int) bool { calls++; return true })
+	assert.Empty(t, found, "should find no invalid entries in valid batch")
+	assert.Equal(t, 1, calls, "should verify valid batch once")
+}
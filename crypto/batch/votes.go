@@ -0,0 +1,63 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package batch
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/message"
+)
+
+// Votes verifies the votes as one batch and bisects the batch to find the
+// invalid votes if it fails. The entry function returns the batch entry of a
+// vote in the representation of the signature scheme, or nil if the voter is
+// unknown, which makes the vote invalid right away. The verify function checks
+// a batch of such entries at once.
+func Votes(votes []*message.Vote, entry func(vote *message.Vote) (interface{}, error), verify func(entries []interface{}) bool) ([]*message.Vote, error) {
+
+	// votes by unknown voters are invalid right away, all others go into the
+	// batch
+	var invalid []*message.Vote
+	var entries []interface{}
+	var batched []*message.Vote
+	for _, vote := range votes {
+		e, err := entry(vote)
+		if err != nil {
+			return nil, rich.Errorf("could not get batch entry: %w", err).Hex("voter", vote.SignerID[:])
+		}
+		if e == nil {
+			invalid = append(invalid, vote)
+			continue
+		}
+		entries = append(entries, e)
+		batched = append(batched, vote)
+	}
+
+	// if the batch fails, bisect it to find the invalid signatures
+	indices := Bisect(len(entries), func(indices []int) bool {
+		subset := make([]interface{}, 0, len(indices))
+		for _, index := range indices {
+			subset = append(subset, entries[index])
+		}
+		return verify(subset)
+	})
+	for _, index := range indices {
+		invalid = append(invalid, batched[index])
+	}
+
+	return invalid, nil
+}
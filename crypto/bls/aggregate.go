@@ -0,0 +1,68 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/bn256"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// AggregateSignatures combines the given signatures into a single signature,
+// which is valid for the same message under the aggregate of the public keys.
+func AggregateSignatures(sigs []base.Signature) (base.Signature, error) {
+	if len(sigs) == 0 {
+		return nil, rich.Errorf("no signatures to aggregate")
+	}
+	var agg *bn256.G1
+	for i, sig := range sigs {
+		s, err := decodeSignature(sig)
+		if err != nil {
+			return nil, rich.Errorf("could not decode signature: %w", err).Int("index", i)
+		}
+		if agg == nil {
+			agg = s
+			continue
+		}
+		agg = new(bn256.G1).Add(agg, s)
+	}
+	return agg.Marshal(), nil
+}
+
+// AggregatePublicKeys combines the given public keys into a single public key.
+// The proofs of possession of the keys should be verified beforehand.
+func AggregatePublicKeys(keys []*PublicKey) (*PublicKey, error) {
+	if len(keys) == 0 {
+		return nil, rich.Errorf("no public keys to aggregate")
+	}
+	agg := keys[0].p
+	for _, key := range keys[1:] {
+		agg = new(bn256.G2).Add(agg, key.p)
+	}
+	return &PublicKey{p: agg}, nil
+}
+
+// VerifyAggregate checks an aggregate signature on a single message against
+// the public keys of all signers.
+func VerifyAggregate(keys []*PublicKey, msg []byte, sig base.Signature) bool {
+	agg, err := AggregatePublicKeys(keys)
+	if err != nil {
+		return false
+	}
+	return Verify(agg, msg, sig)
+}
@@ -0,0 +1,45 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Aggregator combines the BLS signatures of votes into a single quorum
+// signature.
+type Aggregator struct{}
+
+// NewAggregator creates a new aggregator for BLS vote signatures.
+func NewAggregator() *Aggregator {
+	return &Aggregator{}
+}
+
+func (a *Aggregator) Aggregate(votes []*message.Vote) (base.Signature, error) {
+	sigs := make([]base.Signature, 0, len(votes))
+	for _, vote := range votes {
+		sigs = append(sigs, vote.Signature)
+	}
+	sig, err := AggregateSignatures(sigs)
+	if err != nil {
+		return nil, rich.Errorf("could not aggregate signatures: %w", err)
+	}
+	return sig, nil
+}
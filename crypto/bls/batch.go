@@ -0,0 +1,129 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/bn256"
+
+	"github.com/awfm/consensus/crypto/batch"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Entry is a single signature to verify as part of a batch.
+type Entry struct {
+	Key       *PublicKey
+	Message   []byte
+	Signature base.Signature
+}
+
+// VerifyBatch checks all signatures of the batch at once. It checks a random
+// linear combination of the signatures, so that invalid signatures can't
+// cancel each other out, and needs only one pairing per distinct message plus
+// one, instead of two pairings per signature. The random coefficients are read
+// from the given source, or from the default secure random source if none is
+// given.
+func VerifyBatch(entries []Entry, r io.Reader) bool {
+
+	if len(entries) == 0 {
+		return true
+	}
+	if r == nil {
+		r = rand.Reader
+	}
+
+	// we check e(∑rσ, g₂) = ∏ e(H(m), ∑rpk), where the product is over the
+	// distinct messages and each inner sum over the keys signing the message
+	var sig *bn256.G1
+	var messages [][]byte
+	keys := make(map[string]*bn256.G2)
+	bound := new(big.Int).Lsh(big.NewInt(1), 128)
+	for _, entry := range entries {
+
+		if isInfinity(entry.Key.p.Marshal()) {
+			return false
+		}
+		s, err := decodeSignature(entry.Signature)
+		if err != nil {
+			return false
+		}
+		coeff, err := rand.Int(r, bound)
+		if err != nil {
+			return false
+		}
+		coeff.Add(coeff, big.NewInt(1))
+
+		weighted := new(bn256.G1).ScalarMult(s, coeff)
+		if sig == nil {
+			sig = weighted
+		} else {
+			sig = new(bn256.G1).Add(sig, weighted)
+		}
+
+		key := new(bn256.G2).ScalarMult(entry.Key.p, coeff)
+		sum, ok := keys[string(entry.Message)]
+		if !ok {
+			messages = append(messages, entry.Message)
+			keys[string(entry.Message)] = key
+			continue
+		}
+		keys[string(entry.Message)] = new(bn256.G2).Add(sum, key)
+	}
+
+	left := bn256.Pair(sig, g2Gen())
+	var right *bn256.GT
+	for _, msg := range messages {
+		pairing := bn256.Pair(hashToG1(tagSignature, msg), keys[string(msg)])
+		if right == nil {
+			right = pairing
+			continue
+		}
+		right = new(bn256.GT).Add(right, pairing)
+	}
+
+	return bytes.Equal(left.Marshal(), right.Marshal())
+}
+
+// keyring returns the public key of the participant at the given height, or
+// nil if it is not part of the committee at that height.
+type keyring func(height uint64, participantID base.Hash) (*PublicKey, error)
+
+// verifyVotes batch verifies the given votes against the keys of the keyring
+// and bisects the batch to find the invalid votes if it fails.
+func verifyVotes(domain message.Domain, keys keyring, votes []*message.Vote) ([]*message.Vote, error) {
+	entry := func(vote *message.Vote) (interface{}, error) {
+		key, err := keys(vote.Height, vote.SignerID)
+		if key == nil || err != nil {
+			return nil, err
+		}
+		msg := domain.VoteBytes(vote.Height, vote.CandidateID)
+		return Entry{Key: key, Message: msg, Signature: vote.Signature}, nil
+	}
+	verify := func(entries []interface{}) bool {
+		subset := make([]Entry, 0, len(entries))
+		for _, e := range entries {
+			subset = append(subset, e.(Entry))
+		}
+		return VerifyBatch(subset, nil)
+	}
+	return batch.Votes(votes, entry, verify)
+}
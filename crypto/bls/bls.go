@@ -0,0 +1,156 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/bn256"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// p is the prime of the base field of the BN256 curve used by the bn256
+// package; it is not exported there, so we have to duplicate it.
+var p, _ = new(big.Int).SetString("65000549695646603732796438742359905742825358107623003571877145026864184071783", 10)
+
+// curveB is the constant of the curve equation y² = x³ + b for G1.
+var curveB = big.NewInt(3)
+
+const (
+	// tagSignature separates the hashing of messages for signatures from the
+	// hashing of messages for proofs of possession.
+	tagSignature = "BLS_SIG_BN256G1_SHA3-512_TAI_"
+
+	// tagPossession is used when hashing public keys for proofs of possession.
+	tagPossession = "BLS_POP_BN256G1_SHA3-512_TAI_"
+)
+
+// Sign creates a signature on the given message with the private key.
+func Sign(sk *PrivateKey, msg []byte) base.Signature {
+	h := hashToG1(tagSignature, msg)
+	sig := new(bn256.G1).ScalarMult(h, sk.x)
+	return sig.Marshal()
+}
+
+// Verify checks whether the signature on the given message is valid for the
+// given public key.
+func Verify(pk *PublicKey, msg []byte, sig base.Signature) bool {
+	if isInfinity(pk.p.Marshal()) {
+		return false
+	}
+	s, err := decodeSignature(sig)
+	if err != nil {
+		return false
+	}
+	h := hashToG1(tagSignature, msg)
+	return pairingsEqual(s, g2Gen(), h, pk.p)
+}
+
+// Prove creates a proof of possession for the private key, which is a
+// signature on the public key under a separate domain. Public keys must only
+// be aggregated once their proofs of possession have been checked, as they
+// would otherwise be vulnerable to rogue key attacks.
+func Prove(sk *PrivateKey) base.Signature {
+	h := hashToG1(tagPossession, sk.Public().Bytes())
+	sig := new(bn256.G1).ScalarMult(h, sk.x)
+	return sig.Marshal()
+}
+
+// VerifyPossession checks the proof of possession for the given public key.
+func VerifyPossession(pk *PublicKey, proof base.Signature) bool {
+	s, err := decodeSignature(proof)
+	if err != nil {
+		return false
+	}
+	h := hashToG1(tagPossession, pk.Bytes())
+	return pairingsEqual(s, g2Gen(), h, pk.p)
+}
+
+// decodeSignature decodes a signature into a point of G1; as the cofactor of
+// G1 on BN curves is one, every point on the curve is a valid signature.
+func decodeSignature(sig base.Signature) (*bn256.G1, error) {
+	s, ok := new(bn256.G1).Unmarshal(sig)
+	if !ok {
+		return nil, rich.Errorf("invalid signature encoding")
+	}
+	if !bytes.Equal(s.Marshal(), sig) {
+		return nil, rich.Errorf("non-canonical signature encoding")
+	}
+	return s, nil
+}
+
+// pairingsEqual checks whether e(a1, b1) == e(a2, b2).
+func pairingsEqual(a1 *bn256.G1, b1 *bn256.G2, a2 *bn256.G1, b2 *bn256.G2) bool {
+	left := bn256.Pair(a1, b1).Marshal()
+	right := bn256.Pair(a2, b2).Marshal()
+	return bytes.Equal(left, right)
+}
+
+// g2Gen returns the generator of G2.
+func g2Gen() *bn256.G2 {
+	return new(bn256.G2).ScalarBaseMult(big.NewInt(1))
+}
+
+// hashToG1 maps a message to a point of G1 using try-and-increment: we hash
+// the message with a counter until the hash is the x-coordinate of a point on
+// the curve. Each attempt succeeds with a probability of about one half.
+func hashToG1(tag string, msg []byte) *bn256.G1 {
+	counter := make([]byte, 4)
+	for i := uint32(0); ; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		hasher := sha3.New512()
+		_, _ = hasher.Write([]byte(tag))
+		_, _ = hasher.Write(counter)
+		_, _ = hasher.Write(msg)
+		digest := hasher.Sum(nil)
+
+		// reduce the 512-bit digest to get a close to uniform field element
+		x := new(big.Int).SetBytes(digest)
+		x.Mod(x, p)
+
+		// compute the right-hand side of the curve equation and try to find
+		// its square root
+		rhs := new(big.Int).Mul(x, x)
+		rhs.Mul(rhs, x)
+		rhs.Add(rhs, curveB)
+		rhs.Mod(rhs, p)
+		y := new(big.Int).ModSqrt(rhs, p)
+		if y == nil {
+			continue
+		}
+
+		// pick the root deterministically from the parity bit of the digest
+		if y.Bit(0) != uint(digest[0]&1) {
+			y.Sub(p, y)
+		}
+
+		data := make([]byte, 64)
+		xb, yb := x.Bytes(), y.Bytes()
+		copy(data[32-len(xb):32], xb)
+		copy(data[64-len(yb):], yb)
+		point, ok := new(bn256.G1).Unmarshal(data)
+		if !ok {
+			continue
+		}
+		return point
+	}
+}
@@ -0,0 +1,255 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/committee"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+func TestKeyEncoding(t *testing.T) {
+
+	sk, err := GenerateKey(nil)
+	require.NoError(t, err, "should generate private key")
+
+	// private keys should round-trip through their encoding
+	decoded, err := PrivateKeyFromBytes(sk.Bytes())
+	require.NoError(t, err, "should decode private key")
+	assert.Equal(t, sk.Scalar(), decoded.Scalar(), "should decode same private key")
+
+	// public keys should round-trip through their encoding
+	pk, err := PublicKeyFromBytes(sk.Public().Bytes())
+	require.NoError(t, err, "should decode public key")
+	assert.True(t, pk.Equal(sk.Public()), "should decode same public key")
+
+	// the identity should not be accepted as public key
+	_, err = PublicKeyFromBytes(make([]byte, PublicKeySize))
+	assert.Error(t, err, "should not decode identity public key")
+}
+
+func TestSignVerify(t *testing.T) {
+
+	sk, err := GenerateKey(nil)
+	require.NoError(t, err, "should generate private key")
+	other, err := GenerateKey(nil)
+	require.NoError(t, err, "should generate other private key")
+
+	msg := []byte("message")
+	sig := Sign(sk, msg)
+	assert.Len(t, sig, SignatureSize, "should have signature of correct size")
+	assert.True(t, Verify(sk.Public(), msg, sig), "should verify valid signature")
+	assert.False(t, Verify(sk.Public(), []byte("other"), sig), "should not verify other message")
+	assert.False(t, Verify(other.Public(), msg, sig), "should not verify other key")
+	assert.False(t, Verify(sk.Public(), msg, sig[1:]), "should not verify truncated signature")
+
+	// proofs of possession should not be usable as signatures and vice versa
+	proof := Prove(sk)
+	assert.True(t, VerifyPossession(sk.Public(), proof), "should verify proof of possession")
+	assert.False(t, VerifyPossession(other.Public(), proof), "should not verify proof for other key")
+	assert.False(t, Verify(sk.Public(), sk.Public().Bytes(), proof), "should not verify proof as signature")
+}
+
+func TestScheme(t *testing.T) {
+
+	sk, err := GenerateKey(nil)
+	require.NoError(t, err, "should generate private key")
+	key := base.PublicKey(sk.Public().Bytes())
+
+	// the scheme should check signatures and proofs for encoded keys
+	msg := []byte("message")
+	assert.True(t, Scheme{}.Verify(key, msg, Sign(sk, msg)), "should verify valid signature")
+	assert.False(t, Scheme{}.Verify(key, []byte("other"), Sign(sk, msg)), "should not verify other message")
+	assert.True(t, Scheme{}.Possession(key, Prove(sk)), "should verify proof of possession")
+	assert.False(t, Scheme{}.Possession(key, Sign(sk, key)), "should not verify signature as proof")
+
+	// keys that don't decode should never verify
+	assert.False(t, Scheme{}.Verify(key[1:], msg, Sign(sk, msg)), "should not verify with invalid key")
+	assert.False(t, Scheme{}.Possession(key[1:], Prove(sk)), "should not verify proof for invalid key")
+}
+
+func TestAggregate(t *testing.T) {
+
+	msg := []byte("message")
+	keys := make([]*PublicKey, 0, 5)
+	sigs := make([]base.Signature, 0, 5)
+	for i := 0; i < 5; i++ {
+		sk, err := GenerateKey(nil)
+		require.NoError(t, err, "should generate private key")
+		keys = append(keys, sk.Public())
+		sigs = append(sigs, Sign(sk, msg))
+	}
+
+	agg, err := AggregateSignatures(sigs)
+	require.NoError(t, err, "should aggregate signatures")
+	assert.Len(t, agg, SignatureSize, "should have constant aggregate size")
+	assert.True(t, VerifyAggregate(keys, msg, agg), "should verify aggregate signature")
+	assert.False(t, VerifyAggregate(keys[1:], msg, agg), "should not verify with missing key")
+	assert.False(t, VerifyAggregate(keys, []byte("other"), agg), "should not verify other message")
+
+	_, err = AggregateSignatures(nil)
+	assert.Error(t, err, "should not aggregate empty signatures")
+}
+
+func TestSignerVerifier(t *testing.T) {
+
+	// create a committee of participants with their keys
+	domain := message.Domain{ChainID: "test", Version: 1}
+	signers := make([]*Signer, 0, 4)
+	keys := make(map[base.Hash]*PublicKey)
+	for i := 0; i < 4; i++ {
+		sk, err := GenerateKey(nil)
+		require.NoError(t, err, "should generate private key")
+		selfID := fixture.Hash(t)
+		signers = append(signers, NewSigner(domain, selfID, sk))
+		keys[selfID] = sk.Public()
+	}
+	strat := &mocks.Strategy{}
+	strat.On("Threshold", mock.Anything).Return(uint(3), nil)
+	verify := NewVerifier(domain, strat, static(t, keys))
+
+	// check votes by all participants on the parent
+	parent := fixture.Vertex(t)
+	votes := make([]*message.Vote, 0, len(signers))
+	for _, signer := range signers {
+		vote, err := signer.Vote(parent)
+		require.NoError(t, err, "should create vote")
+		require.NoError(t, verify.Vote(vote), "should verify vote")
+		votes = append(votes, vote)
+	}
+
+	// check a vote with a signature from someone else
+	forged := *votes[0]
+	forged.Signature = votes[1].Signature
+	err := verify.Vote(&forged)
+	assert.True(t, errors.As(err, &signal.InvalidSignature{}), "should have invalid signature error")
+
+	// check the proposal, which also includes the proposer vote
+	candidate := fixture.Vertex(t, fixture.WithParent(parent), fixture.WithProposer(signers[0].selfID))
+	proposal, err := signers[0].Proposal(candidate)
+	require.NoError(t, err, "should create proposal")
+	require.NoError(t, verify.Proposal(proposal), "should verify proposal")
+	require.NoError(t, verify.Vote(proposal.Vote()), "should verify proposer vote")
+
+	// check that the proposal signature can't be replayed as a vote
+	replayed := proposal.Vote()
+	replayed.Signature = proposal.Signature
+	err = verify.Vote(replayed)
+	assert.True(t, errors.As(err, &signal.InvalidSignature{}), "should not verify proposal signature as vote")
+
+	// check that votes for another chain or version are not valid
+	other := NewVerifier(message.Domain{ChainID: "other", Version: 1}, strat, static(t, keys))
+	assert.Error(t, other.Vote(votes[0]), "should not verify vote for other chain")
+	other = NewVerifier(message.Domain{ChainID: "test", Version: 2}, strat, static(t, keys))
+	assert.Error(t, other.Vote(votes[0]), "should not verify vote for other version")
+
+	// check quorum with aggregated signature
+	sig, err := NewAggregator().Aggregate(votes[:3])
+	require.NoError(t, err, "should aggregate votes")
+	proposal.Quorum = &message.Quorum{
+		SignerIDs: []base.Hash{votes[0].SignerID, votes[1].SignerID, votes[2].SignerID},
+		Signature: sig,
+	}
+	assert.NoError(t, verify.Quorum(proposal), "should verify valid quorum")
+
+	// check the same quorum with its signers in compact form
+	participantIDs := make([]base.Hash, 0, len(keys))
+	for participantID := range keys {
+		participantIDs = append(participantIDs, participantID)
+	}
+	full := proposal.Quorum
+	sorted := &message.Quorum{SignerIDs: message.SortIDs(full.SignerIDs), Signature: sig}
+	proposal.Quorum, err = sorted.Compact(message.SortIDs(participantIDs))
+	require.NoError(t, err, "should compact quorum")
+	assert.NoError(t, verify.Quorum(proposal), "should verify compact quorum")
+	proposal.Quorum.Signers = append(proposal.Quorum.Signers, 0)
+	assert.Error(t, verify.Quorum(proposal), "should not verify compact quorum with invalid bitfield")
+	proposal.Quorum = full
+
+	// check quorum with a wrong signer set
+	proposal.Quorum.SignerIDs[2] = votes[3].SignerID
+	err = verify.Quorum(proposal)
+	assert.True(t, errors.As(err, &signal.InvalidSignature{}), "should not verify quorum with wrong signer")
+
+	// check quorum with a duplicate signer
+	proposal.Quorum.SignerIDs[2] = votes[1].SignerID
+	assert.Error(t, verify.Quorum(proposal), "should not verify quorum with duplicate signer")
+
+	// check quorum below the threshold
+	proposal.Quorum.SignerIDs = proposal.Quorum.SignerIDs[:2]
+	assert.Error(t, verify.Quorum(proposal), "should not verify quorum below threshold")
+}
+
+func TestVerifyBatch(t *testing.T) {
+
+	// create a batch of signatures, with several signers per message
+	domain := message.Domain{ChainID: "test", Version: 1}
+	keys := make(map[base.Hash]*PublicKey)
+	var votes []*message.Vote
+	for i := 0; i < 8; i++ {
+		sk, err := GenerateKey(nil)
+		require.NoError(t, err, "should generate private key")
+		selfID := fixture.Hash(t)
+		keys[selfID] = sk.Public()
+		signer := NewSigner(domain, selfID, sk)
+		for _, vertex := range []*base.Vertex{fixture.Vertex(t), fixture.Vertex(t)} {
+			vote, err := signer.Vote(vertex)
+			require.NoError(t, err, "should create vote")
+			votes = append(votes, vote)
+		}
+	}
+	verify := NewVerifier(domain, &mocks.Strategy{}, static(t, keys))
+
+	// the valid batch should pass
+	invalid, err := verify.Votes(votes)
+	require.NoError(t, err, "should batch verify valid votes")
+	assert.Empty(t, invalid, "should have no invalid votes")
+
+	// swapping two signatures should be detected, even though the sum of
+	// the signatures stays the same
+	votes[3].Signature, votes[9].Signature = votes[9].Signature, votes[3].Signature
+	invalid, err = verify.Votes(votes)
+	require.NoError(t, err, "should batch verify swapped votes")
+	assert.Equal(t, []*message.Vote{votes[3], votes[9]}, invalid, "should find swapped votes")
+
+	// votes by unknown voters should be invalid as well
+	unknown := fixture.Vote(t)
+	invalid, err = verify.Votes([]*message.Vote{votes[0], unknown})
+	require.NoError(t, err, "should batch verify unknown voter")
+	assert.Equal(t, []*message.Vote{unknown}, invalid, "should find unknown voter")
+}
+
+// static creates a committee of participants with the given keys.
+func static(t *testing.T, keys map[base.Hash]*PublicKey) *committee.Static {
+	members := make([]committee.Member, 0, len(keys))
+	for participantID, key := range keys {
+		members = append(members, committee.Member{ID: participantID, Key: key.Bytes(), Weight: 1})
+	}
+	c, err := committee.NewStatic(100, members)
+	require.NoError(t, err, "should create committee")
+	return c
+}
@@ -0,0 +1,57 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Combiner recovers the group signature from the signature shares carried by
+// votes, which requires at least a threshold of votes on the same candidate.
+type Combiner struct {
+	indices map[base.Hash]uint32
+}
+
+// NewCombiner creates a new combiner using the given share index for each of
+// the participants.
+func NewCombiner(indices map[base.Hash]uint32) *Combiner {
+
+	c := Combiner{
+		indices: indices,
+	}
+
+	return &c
+}
+
+func (c *Combiner) Aggregate(votes []*message.Vote) (base.Signature, error) {
+	shares := make([]SignatureShare, 0, len(votes))
+	for _, vote := range votes {
+		index, ok := c.indices[vote.SignerID]
+		if !ok {
+			return nil, rich.Errorf("unknown share index").Hex("signer", vote.SignerID[:])
+		}
+		shares = append(shares, SignatureShare{Index: index, Signature: vote.Signature})
+	}
+	sig, err := Recover(shares)
+	if err != nil {
+		return nil, rich.Errorf("could not recover group signature: %w", err)
+	}
+	return sig, nil
+}
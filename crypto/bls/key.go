@@ -0,0 +1,155 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package bls implements BLS signatures on the BN256 pairing-friendly curve,
+// with signatures in G1 and public keys in G2, which allows signatures on the
+// same message to be aggregated into a single constant-size signature.
+package bls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math/big"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/bn256"
+)
+
+const (
+	// PrivateKeySize is the size of an encoded private key in bytes.
+	PrivateKeySize = 32
+
+	// PublicKeySize is the size of an encoded public key in bytes.
+	PublicKeySize = 128
+
+	// SignatureSize is the size of an encoded signature in bytes.
+	SignatureSize = 64
+)
+
+// PrivateKey is a scalar in the field of the order of the BN256 groups.
+type PrivateKey struct {
+	x *big.Int
+}
+
+// PublicKey is a point in G2 corresponding to a private key.
+type PublicKey struct {
+	p *bn256.G2
+}
+
+// GenerateKey creates a new random private key, using the given source of
+// randomness, or the default secure random source if none is given.
+func GenerateKey(r io.Reader) (*PrivateKey, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	for {
+		x, err := rand.Int(r, bn256.Order)
+		if err != nil {
+			return nil, rich.Errorf("could not read random scalar: %w", err)
+		}
+		if x.Sign() != 0 {
+			return &PrivateKey{x: x}, nil
+		}
+	}
+}
+
+// PrivateKeyFromScalar creates a private key from the given scalar, which is
+// reduced modulo the group order.
+func PrivateKeyFromScalar(x *big.Int) (*PrivateKey, error) {
+	x = new(big.Int).Mod(x, bn256.Order)
+	if x.Sign() == 0 {
+		return nil, rich.Errorf("invalid zero scalar")
+	}
+	return &PrivateKey{x: x}, nil
+}
+
+// PrivateKeyFromBytes decodes a private key from its big-endian encoding.
+func PrivateKeyFromBytes(data []byte) (*PrivateKey, error) {
+	if len(data) != PrivateKeySize {
+		return nil, rich.Errorf("invalid private key size").Int("size", len(data))
+	}
+	x := new(big.Int).SetBytes(data)
+	if x.Sign() == 0 || x.Cmp(bn256.Order) >= 0 {
+		return nil, rich.Errorf("invalid private key scalar")
+	}
+	return &PrivateKey{x: x}, nil
+}
+
+// Scalar returns a copy of the scalar of the private key.
+func (sk *PrivateKey) Scalar() *big.Int {
+	return new(big.Int).Set(sk.x)
+}
+
+// Bytes returns the big-endian encoding of the private key.
+func (sk *PrivateKey) Bytes() []byte {
+	data := make([]byte, PrivateKeySize)
+	x := sk.x.Bytes()
+	copy(data[PrivateKeySize-len(x):], x)
+	return data
+}
+
+// Public returns the public key corresponding to the private key.
+func (sk *PrivateKey) Public() *PublicKey {
+	return &PublicKey{p: new(bn256.G2).ScalarBaseMult(sk.x)}
+}
+
+// PublicKeyFromBytes decodes a public key and makes sure that it is a valid
+// point of the prime-order subgroup of G2 other than the identity.
+func PublicKeyFromBytes(data []byte) (*PublicKey, error) {
+	p, ok := new(bn256.G2).Unmarshal(data)
+	if !ok {
+		return nil, rich.Errorf("invalid public key encoding")
+	}
+	if !bytes.Equal(p.Marshal(), data) {
+		return nil, rich.Errorf("non-canonical public key encoding")
+	}
+	if isInfinity(p.Marshal()) {
+		return nil, rich.Errorf("invalid identity public key")
+	}
+	check := new(bn256.G2).ScalarMult(p, bn256.Order)
+	if !isInfinity(check.Marshal()) {
+		return nil, rich.Errorf("public key not in prime-order subgroup")
+	}
+	return &PublicKey{p: p}, nil
+}
+
+// Bytes returns the encoding of the public key.
+func (pk *PublicKey) Bytes() []byte {
+	return pk.p.Marshal()
+}
+
+// Mul returns the public key multiplied by the given scalar, which corresponds
+// to the private key multiplied by the same scalar.
+func (pk *PublicKey) Mul(scalar *big.Int) *PublicKey {
+	return &PublicKey{p: new(bn256.G2).ScalarMult(pk.p, scalar)}
+}
+
+// Equal checks whether two public keys are the same.
+func (pk *PublicKey) Equal(other *PublicKey) bool {
+	return bytes.Equal(pk.p.Marshal(), other.p.Marshal())
+}
+
+// isInfinity checks whether a marshaled point is the point at infinity, which
+// is encoded as all zeroes by the bn256 package.
+func isInfinity(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
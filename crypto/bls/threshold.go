@@ -0,0 +1,170 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"crypto/rand"
+	"io"
+	"math/big"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/bn256"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// KeyShare is the share of a participant of a group private key that is shared
+// between participants with a t-of-n threshold scheme. The index of a share is
+// the point at which the secret sharing polynomial was evaluated and always
+// starts at one.
+type KeyShare struct {
+	Index uint32
+	Key   *PrivateKey
+}
+
+// SignatureShare is a signature created with a key share, which can be combined
+// with other signature shares on the same message to recover the signature of
+// the group.
+type SignatureShare struct {
+	Index     uint32
+	Signature base.Signature
+}
+
+// Deal splits a new random group key into n shares, of which any t can be
+// combined to create a group signature. It returns the group public key, the
+// private key shares and the public keys of the shares, in that order. It acts
+// as a trusted dealer and should only be used where no distributed key
+// generation is available.
+func Deal(t uint32, n uint32, r io.Reader) (*PublicKey, []*KeyShare, []*PublicKey, error) {
+
+	if t == 0 || t > n {
+		return nil, nil, nil, rich.Errorf("invalid threshold").Uint32("threshold", t).Uint32("participants", n)
+	}
+	if r == nil {
+		r = rand.Reader
+	}
+
+	// create the random secret sharing polynomial of degree t-1
+	coeffs := make([]*big.Int, 0, t)
+	for i := uint32(0); i < t; i++ {
+		coeff, err := rand.Int(r, bn256.Order)
+		if err != nil {
+			return nil, nil, nil, rich.Errorf("could not read random coefficient: %w", err)
+		}
+		coeffs = append(coeffs, coeff)
+	}
+
+	// evaluate the polynomial for each participant to get the shares
+	shares := make([]*KeyShare, 0, n)
+	public := make([]*PublicKey, 0, n)
+	for index := uint32(1); index <= n; index++ {
+		key, err := PrivateKeyFromScalar(Evaluate(coeffs, index))
+		if err != nil {
+			return nil, nil, nil, rich.Errorf("could not create key share: %w", err).Uint32("index", index)
+		}
+		shares = append(shares, &KeyShare{Index: index, Key: key})
+		public = append(public, key.Public())
+	}
+
+	group := &PublicKey{p: new(bn256.G2).ScalarBaseMult(coeffs[0])}
+
+	return group, shares, public, nil
+}
+
+// Evaluate computes the value of the polynomial with the given coefficients at
+// the given index, modulo the group order.
+func Evaluate(coeffs []*big.Int, index uint32) *big.Int {
+	x := big.NewInt(int64(index))
+	result := big.NewInt(0)
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		result.Mul(result, x)
+		result.Add(result, coeffs[i])
+		result.Mod(result, bn256.Order)
+	}
+	return result
+}
+
+// Recover combines at least t signature shares on the same message into the
+// signature of the group, using Lagrange interpolation in the exponent.
+func Recover(shares []SignatureShare) (base.Signature, error) {
+
+	if len(shares) == 0 {
+		return nil, rich.Errorf("no signature shares to recover")
+	}
+
+	// make sure the indices are valid and unique
+	indices := make([]uint32, 0, len(shares))
+	seen := make(map[uint32]struct{}, len(shares))
+	for _, share := range shares {
+		if share.Index == 0 {
+			return nil, rich.Errorf("invalid signature share index")
+		}
+		_, duplicate := seen[share.Index]
+		if duplicate {
+			return nil, rich.Errorf("duplicate signature share index").Uint32("index", share.Index)
+		}
+		seen[share.Index] = struct{}{}
+		indices = append(indices, share.Index)
+	}
+
+	// sum up the shares weighted by their Lagrange coefficients at zero
+	var group *bn256.G1
+	for _, share := range shares {
+		s, err := decodeSignature(share.Signature)
+		if err != nil {
+			return nil, rich.Errorf("could not decode signature share: %w", err).Uint32("index", share.Index)
+		}
+		weighted := new(bn256.G1).ScalarMult(s, Lagrange(indices, share.Index))
+		if group == nil {
+			group = weighted
+			continue
+		}
+		group = new(bn256.G1).Add(group, weighted)
+	}
+
+	return group.Marshal(), nil
+}
+
+// Lagrange computes the Lagrange coefficient at zero for the given index out of
+// the given set of indices, modulo the group order.
+func Lagrange(indices []uint32, index uint32) *big.Int {
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	xi := big.NewInt(int64(index))
+	for _, other := range indices {
+		if other == index {
+			continue
+		}
+		xj := big.NewInt(int64(other))
+		num.Mul(num, xj)
+		num.Mod(num, bn256.Order)
+		diff := new(big.Int).Sub(xj, xi)
+		den.Mul(den, diff)
+		den.Mod(den, bn256.Order)
+	}
+	den.ModInverse(den, bn256.Order)
+	num.Mul(num, den)
+	return num.Mod(num, bn256.Order)
+}
+
+// Randomness derives the unique random value from a group signature. As the
+// group signature on a message is unique and unpredictable without t shares,
+// the group signatures on vertices can serve as source of randomness.
+func Randomness(sig base.Signature) base.Hash {
+	return sha3.Sum256(sig)
+}
@@ -0,0 +1,127 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/cache"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+)
+
+func TestThresholdRecover(t *testing.T) {
+
+	group, shares, public, err := Deal(3, 5, nil)
+	require.NoError(t, err, "should deal key shares")
+	require.Len(t, shares, 5, "should have one share per participant")
+	require.Len(t, public, 5, "should have one public share per participant")
+
+	// every share should sign verifiably under its public share
+	msg := []byte("message")
+	sigs := make([]SignatureShare, 0, len(shares))
+	for i, share := range shares {
+		sig := Sign(share.Key, msg)
+		require.True(t, Verify(public[i], msg, sig), "should verify signature share")
+		sigs = append(sigs, SignatureShare{Index: share.Index, Signature: sig})
+	}
+
+	// any subset of at least three shares should recover the same signature
+	first, err := Recover(sigs[:3])
+	require.NoError(t, err, "should recover from first shares")
+	assert.True(t, Verify(group, msg, first), "should verify recovered signature")
+	second, err := Recover(sigs[2:])
+	require.NoError(t, err, "should recover from last shares")
+	assert.Equal(t, first, second, "should recover unique group signature")
+	all, err := Recover(sigs)
+	require.NoError(t, err, "should recover from all shares")
+	assert.Equal(t, first, all, "should recover unique group signature")
+	assert.Equal(t, Randomness(first), Randomness(all), "should derive same randomness")
+
+	// two shares should not be enough
+	partial, err := Recover(sigs[:2])
+	require.NoError(t, err, "should interpolate with too few shares")
+	assert.False(t, Verify(group, msg, partial), "should not verify signature from too few shares")
+
+	// duplicate shares should be rejected
+	_, err = Recover([]SignatureShare{sigs[0], sigs[0], sigs[1]})
+	assert.Error(t, err, "should not recover with duplicate shares")
+
+	// invalid thresholds should be rejected
+	_, _, _, err = Deal(0, 5, nil)
+	assert.Error(t, err, "should not deal zero threshold")
+	_, _, _, err = Deal(6, 5, nil)
+	assert.Error(t, err, "should not deal threshold above participants")
+}
+
+func TestThresholdQuorum(t *testing.T) {
+
+	group, shares, public, err := Deal(3, 4, nil)
+	require.NoError(t, err, "should deal key shares")
+
+	// set up the participants with their shares
+	domain := message.Domain{ChainID: "test", Version: 1}
+	signers := make([]*Signer, 0, len(shares))
+	indices := make(map[base.Hash]uint32)
+	keys := make(map[base.Hash]*PublicKey)
+	for i, share := range shares {
+		selfID := fixture.Hash(t)
+		signers = append(signers, NewSigner(domain, selfID, share.Key))
+		indices[selfID] = share.Index
+		keys[selfID] = public[i]
+	}
+	strat := &mocks.Strategy{}
+	strat.On("Threshold", mock.Anything).Return(uint(3), nil)
+	committee := static(t, keys)
+	verify := NewThresholdVerifier(domain, strat, group, committee)
+	c := cache.NewCache(strat, NewCombiner(indices), committee)
+
+	// collect the votes in the cache until we have the threshold
+	parent := fixture.Vertex(t, fixture.WithHeight(1))
+	var quorum *message.Quorum
+	for _, signer := range signers[1:] {
+		vote, err := signer.Vote(parent)
+		require.NoError(t, err, "should create vote share")
+		require.NoError(t, verify.Vote(vote), "should verify vote share")
+		require.NoError(t, c.Vote(vote), "should cache vote share")
+		quorum, err = c.Quorum(parent.Height, parent.ID())
+		require.NoError(t, err, "should get quorum")
+	}
+	require.NotNil(t, quorum.Signers, "should have compact quorum")
+	require.Equal(t, 3, quorum.Size(), "should have threshold signers")
+	require.NotNil(t, quorum.Signature, "should have recovered group signature")
+
+	// the proposal should verify with the proposer share and group signature
+	candidate := fixture.Vertex(t, fixture.WithParent(parent), fixture.WithProposer(signers[0].selfID))
+	proposal, err := signers[0].Proposal(candidate)
+	require.NoError(t, err, "should create proposal")
+	proposal.Quorum = quorum
+	assert.NoError(t, verify.Proposal(proposal), "should verify proposal share")
+	assert.NoError(t, verify.Quorum(proposal), "should verify group signature")
+
+	// a quorum with a single share instead of group signature should fail
+	vote, err := signers[1].Vote(parent)
+	require.NoError(t, err, "should create vote share")
+	proposal.Quorum = &message.Quorum{Signers: quorum.Signers, Signature: vote.Signature}
+	assert.Error(t, verify.Quorum(proposal), "should not verify single share as group signature")
+}
@@ -0,0 +1,159 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/crypto/keys"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// ThresholdVerifier verifies threshold signatures. Proposals and votes carry
+// signature shares, which are verified against the public key share of their
+// signer, while quorums carry the recovered group signature, which is verified
+// against the group public key.
+type ThresholdVerifier struct {
+	domain message.Domain
+	strat  consensus.Strategy
+	group  *PublicKey
+	shares *keys.Cache
+}
+
+// NewThresholdVerifier creates a new verifier for the given group public key.
+// The committee keys of the participants are their public key shares, so the
+// committee must be the one the group key was dealt to.
+func NewThresholdVerifier(domain message.Domain, strat consensus.Strategy, group *PublicKey, committee consensus.Committee) *ThresholdVerifier {
+
+	v := ThresholdVerifier{
+		domain: domain,
+		strat:  strat,
+		group:  group,
+		shares: keys.NewCache(committee, decodeKey),
+	}
+
+	return &v
+}
+
+func (v *ThresholdVerifier) Quorum(proposal *message.Proposal) error {
+
+	// check we have a quorum for a parent that is not before genesis
+	if proposal.Quorum == nil {
+		return rich.Errorf("missing quorum")
+	}
+	if proposal.Candidate.Height == 0 {
+		return rich.Errorf("invalid quorum for genesis")
+	}
+
+	// get the committee of the parent height, which signed the quorum
+	height := proposal.Candidate.Height - 1
+	epoch, err := v.shares.Epoch(height)
+	if err != nil {
+		return rich.Errorf("could not get committee keys: %w", err)
+	}
+
+	// decode the signers if the quorum is in compact form
+	quorum, err := proposal.Quorum.Expand(epoch.Participants)
+	if err != nil {
+		return rich.Errorf("could not expand quorum: %w", err)
+	}
+
+	// check that the quorum has enough signers for the parent height; the
+	// group signature can't be recovered without them, but we still want to
+	// know who contributed
+	threshold, err := v.strat.Threshold(height)
+	if err != nil {
+		return rich.Errorf("could not get threshold: %w", err)
+	}
+	if uint(len(quorum.SignerIDs)) < threshold {
+		return rich.Errorf("insufficient quorum signers").Int("signers", len(quorum.SignerIDs)).Uint("threshold", threshold)
+	}
+	seen := make(map[base.Hash]struct{}, len(quorum.SignerIDs))
+	for _, signerID := range quorum.SignerIDs {
+		_, duplicate := seen[signerID]
+		if duplicate {
+			return rich.Errorf("duplicate quorum signer").Hex("signer", signerID[:])
+		}
+		seen[signerID] = struct{}{}
+		_, ok := epoch.Keys[signerID]
+		if !ok {
+			return rich.Errorf("unknown quorum signer").Hex("signer", signerID[:])
+		}
+	}
+
+	// check the group signature on the parent against the group key
+	msg := v.domain.VoteBytes(height, proposal.Candidate.ParentID)
+	if !Verify(v.group, msg, quorum.Signature) {
+		return signal.InvalidSignature{Entity: "quorum", Signer: proposal.Candidate.ProposerID}
+	}
+
+	return nil
+}
+
+func (v *ThresholdVerifier) Proposal(proposal *message.Proposal) error {
+
+	proposerID := proposal.Candidate.ProposerID
+	share, err := v.share(proposal.Candidate.Height, proposerID)
+	if err != nil {
+		return rich.Errorf("could not get proposer share: %w", err)
+	}
+	if share == nil {
+		return rich.Errorf("unknown proposer").Hex("proposer", proposerID[:])
+	}
+
+	msg := v.domain.ProposalBytes(proposal.Candidate)
+	if !Verify(share, msg, proposal.Signature) {
+		return signal.InvalidSignature{Entity: "proposal", Signer: proposerID}
+	}
+
+	return nil
+}
+
+func (v *ThresholdVerifier) Vote(vote *message.Vote) error {
+
+	share, err := v.share(vote.Height, vote.SignerID)
+	if err != nil {
+		return rich.Errorf("could not get voter share: %w", err)
+	}
+	if share == nil {
+		return rich.Errorf("unknown voter").Hex("voter", vote.SignerID[:])
+	}
+
+	msg := v.domain.VoteBytes(vote.Height, vote.CandidateID)
+	if !Verify(share, msg, vote.Signature) {
+		return signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID}
+	}
+
+	return nil
+}
+
+func (v *ThresholdVerifier) Votes(votes []*message.Vote) ([]*message.Vote, error) {
+	return verifyVotes(v.domain, v.share, votes)
+}
+
+// share returns the public key share of the participant at the given height,
+// or nil if it is not part of the committee at that height.
+func (v *ThresholdVerifier) share(height uint64, participantID base.Hash) (*PublicKey, error) {
+	share, err := v.shares.Key(height, participantID)
+	if share == nil || err != nil {
+		return nil, err
+	}
+	return share.(*PublicKey), nil
+}
@@ -0,0 +1,166 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bls
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/crypto/keys"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// Verifier verifies BLS signatures on proposals, votes and quorums. Quorum
+// signatures are aggregates of the vote signatures of all quorum signers.
+type Verifier struct {
+	domain message.Domain
+	strat  consensus.Strategy
+	keys   *keys.Cache
+}
+
+// NewVerifier creates a new verifier using the public keys of the committee
+// participants. The proofs of possession for the keys must already have been
+// checked, as the keys are aggregated to verify quorums.
+func NewVerifier(domain message.Domain, strat consensus.Strategy, committee consensus.Committee) *Verifier {
+
+	v := Verifier{
+		domain: domain,
+		strat:  strat,
+		keys:   keys.NewCache(committee, decodeKey),
+	}
+
+	return &v
+}
+
+func (v *Verifier) Quorum(proposal *message.Proposal) error {
+
+	// check we have a quorum for a parent that is not before genesis
+	if proposal.Quorum == nil {
+		return rich.Errorf("missing quorum")
+	}
+	if proposal.Candidate.Height == 0 {
+		return rich.Errorf("invalid quorum for genesis")
+	}
+
+	// get the committee of the parent height, which signed the quorum
+	height := proposal.Candidate.Height - 1
+	epoch, err := v.keys.Epoch(height)
+	if err != nil {
+		return rich.Errorf("could not get committee keys: %w", err)
+	}
+
+	// decode the signers if the quorum is in compact form
+	quorum, err := proposal.Quorum.Expand(epoch.Participants)
+	if err != nil {
+		return rich.Errorf("could not expand quorum: %w", err)
+	}
+
+	// check that the quorum has enough signers for the parent height
+	threshold, err := v.strat.Threshold(height)
+	if err != nil {
+		return rich.Errorf("could not get threshold: %w", err)
+	}
+	if uint(len(quorum.SignerIDs)) < threshold {
+		return rich.Errorf("insufficient quorum signers").Int("signers", len(quorum.SignerIDs)).Uint("threshold", threshold)
+	}
+
+	// collect the public keys of all signers, making sure they are unique
+	signers := make([]*PublicKey, 0, len(quorum.SignerIDs))
+	seen := make(map[base.Hash]struct{}, len(quorum.SignerIDs))
+	for _, signerID := range quorum.SignerIDs {
+		_, duplicate := seen[signerID]
+		if duplicate {
+			return rich.Errorf("duplicate quorum signer").Hex("signer", signerID[:])
+		}
+		seen[signerID] = struct{}{}
+		key, ok := epoch.Keys[signerID]
+		if !ok {
+			return rich.Errorf("unknown quorum signer").Hex("signer", signerID[:])
+		}
+		signers = append(signers, key.(*PublicKey))
+	}
+
+	// check the aggregate signature on the parent against the aggregate key
+	msg := v.domain.VoteBytes(height, proposal.Candidate.ParentID)
+	if !VerifyAggregate(signers, msg, quorum.Signature) {
+		return signal.InvalidSignature{Entity: "quorum", Signer: proposal.Candidate.ProposerID}
+	}
+
+	return nil
+}
+
+func (v *Verifier) Proposal(proposal *message.Proposal) error {
+
+	proposerID := proposal.Candidate.ProposerID
+	key, err := v.key(proposal.Candidate.Height, proposerID)
+	if err != nil {
+		return rich.Errorf("could not get proposer key: %w", err)
+	}
+	if key == nil {
+		return rich.Errorf("unknown proposer").Hex("proposer", proposerID[:])
+	}
+
+	msg := v.domain.ProposalBytes(proposal.Candidate)
+	if !Verify(key, msg, proposal.Signature) {
+		return signal.InvalidSignature{Entity: "proposal", Signer: proposerID}
+	}
+
+	return nil
+}
+
+func (v *Verifier) Vote(vote *message.Vote) error {
+
+	key, err := v.key(vote.Height, vote.SignerID)
+	if err != nil {
+		return rich.Errorf("could not get voter key: %w", err)
+	}
+	if key == nil {
+		return rich.Errorf("unknown voter").Hex("voter", vote.SignerID[:])
+	}
+
+	msg := v.domain.VoteBytes(vote.Height, vote.CandidateID)
+	if !Verify(key, msg, vote.Signature) {
+		return signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID}
+	}
+
+	return nil
+}
+
+func (v *Verifier) Votes(votes []*message.Vote) ([]*message.Vote, error) {
+	return verifyVotes(v.domain, v.key, votes)
+}
+
+// key returns the public key of the participant at the given height, or nil if
+// it is not part of the committee at that height.
+func (v *Verifier) key(height uint64, participantID base.Hash) (*PublicKey, error) {
+	key, err := v.keys.Key(height, participantID)
+	if key == nil || err != nil {
+		return nil, err
+	}
+	return key.(*PublicKey), nil
+}
+
+// decodeKey decodes a committee key for the key cache.
+func decodeKey(data base.PublicKey) (interface{}, error) {
+	key, err := PublicKeyFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
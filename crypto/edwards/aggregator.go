@@ -0,0 +1,39 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package edwards
+
+import (
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Aggregator concatenates the Ed25519 signatures of votes into the quorum
+// signature, in the same order as the votes.
+type Aggregator struct{}
+
+// NewAggregator creates a new aggregator for Ed25519 vote signatures.
+func NewAggregator() *Aggregator {
+	return &Aggregator{}
+}
+
+func (a *Aggregator) Aggregate(votes []*message.Vote) (base.Signature, error) {
+	sig := make(base.Signature, 0, len(votes)*SignatureSize)
+	for _, vote := range votes {
+		sig = append(sig, vote.Signature...)
+	}
+	return sig, nil
+}
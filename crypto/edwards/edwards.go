@@ -0,0 +1,160 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package edwards implements Ed25519 signatures for the consensus harness,
+// with batch verification of many signatures at once. Ed25519 signatures can't
+// be aggregated, so quorum signatures are the concatenation of the signatures
+// of all quorum signers.
+package edwards
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+
+	"filippo.io/edwards25519"
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+const (
+	// PublicKeySize is the size of an encoded public key in bytes.
+	PublicKeySize = ed25519.PublicKeySize
+
+	// SignatureSize is the size of an encoded signature in bytes.
+	SignatureSize = ed25519.SignatureSize
+
+	// tagPossession is prepended to public keys for proofs of possession; the
+	// payloads of consensus messages start with the length of their tag
+	// instead, so the two can never be confused.
+	tagPossession = "ED25519_POP_"
+)
+
+// Entry is a single signature to verify as part of a batch.
+type Entry struct {
+	Key       ed25519.PublicKey
+	Message   []byte
+	Signature base.Signature
+}
+
+// Verify checks a single signature. It uses the same cofactored verification
+// equation as the batch verification, so that a signature is always either
+// valid or invalid, regardless of how it was verified.
+func Verify(key ed25519.PublicKey, msg []byte, sig base.Signature) bool {
+	return VerifyBatch([]Entry{{Key: key, Message: msg, Signature: sig}}, nil)
+}
+
+// VerifyBatch checks all signatures of the batch at once, which is much faster
+// than checking them one by one for large batches. It only tells us whether
+// all signatures are valid; invalid entries have to be found by
+// bisecting the batch. The random coefficients are read from the given source,
+// or from the default secure random source if none is given.
+func VerifyBatch(entries []Entry, r io.Reader) bool {
+
+	if len(entries) == 0 {
+		return true
+	}
+	if r == nil {
+		r = rand.Reader
+	}
+
+	// we check the cofactored equation [8](-∑zS·B + ∑zR + ∑zk·A) = 0, where
+	// the z are random 128-bit coefficients, so that invalid signatures can't
+	// cancel each other out
+	scalars := make([]*edwards25519.Scalar, 0, 2*len(entries)+1)
+	points := make([]*edwards25519.Point, 0, 2*len(entries)+1)
+	sum := edwards25519.NewScalar()
+	scalars = append(scalars, sum)
+	points = append(points, edwards25519.NewGeneratorPoint())
+	for _, entry := range entries {
+
+		// decode the public key, the commitment and the response
+		if len(entry.Key) != PublicKeySize || len(entry.Signature) != SignatureSize {
+			return false
+		}
+		A, err := new(edwards25519.Point).SetBytes(entry.Key)
+		if err != nil {
+			return false
+		}
+		R, err := new(edwards25519.Point).SetBytes(entry.Signature[:32])
+		if err != nil {
+			return false
+		}
+		S, err := edwards25519.NewScalar().SetCanonicalBytes(entry.Signature[32:])
+		if err != nil {
+			return false
+		}
+
+		// compute the challenge of the signature
+		hasher := sha512.New()
+		_, _ = hasher.Write(entry.Signature[:32])
+		_, _ = hasher.Write(entry.Key)
+		_, _ = hasher.Write(entry.Message)
+		k := edwards25519.NewScalar().SetUniformBytes(hasher.Sum(nil))
+
+		// draw the random coefficient for this entry
+		seed := make([]byte, 32)
+		_, err = io.ReadFull(r, seed[:16])
+		if err != nil {
+			return false
+		}
+		z, err := edwards25519.NewScalar().SetCanonicalBytes(seed)
+		if err != nil {
+			return false
+		}
+
+		sum.MultiplyAdd(z, S, sum)
+		scalars = append(scalars, z, edwards25519.NewScalar().Multiply(z, k))
+		points = append(points, R, A)
+	}
+	sum.Negate(sum)
+
+	check := new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points)
+	check.MultByCofactor(check)
+
+	return check.Equal(edwards25519.NewIdentityPoint()) == 1
+}
+
+// Prove creates a proof of possession for the private key, which is a
+// signature on the public key under a separate tag. Ed25519 keys are never
+// aggregated, but the proof still shows that a member joining the committee
+// controls its key, rather than claiming the key of someone else.
+func Prove(key ed25519.PrivateKey) base.Signature {
+	pub := key.Public().(ed25519.PublicKey)
+	return ed25519.Sign(key, possession(pub))
+}
+
+// VerifyPossession checks the proof of possession for the given public key.
+func VerifyPossession(key ed25519.PublicKey, proof base.Signature) bool {
+	return Verify(key, possession(key), proof)
+}
+
+// possession returns the message signed by a proof of possession.
+func possession(key ed25519.PublicKey) []byte {
+	return append([]byte(tagPossession), key...)
+}
+
+// GenerateKey creates a new random key pair, using the given source of
+// randomness, or the default secure random source if none is given.
+func GenerateKey(r io.Reader) (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(r)
+	if err != nil {
+		return nil, nil, rich.Errorf("could not generate key: %w", err)
+	}
+	return pub, priv, nil
+}
@@ -0,0 +1,159 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package edwards
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/committee"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+func TestVerifyBatch(t *testing.T) {
+
+	// create a batch of valid signatures on different messages
+	entries := make([]Entry, 0, 16)
+	for i := 0; i < 16; i++ {
+		pub, priv, err := GenerateKey(nil)
+		require.NoError(t, err, "should generate key")
+		msg := fixture.Sig(t)
+		sig := ed25519.Sign(priv, msg)
+		require.True(t, Verify(pub, msg, sig), "should verify single signature")
+		entries = append(entries, Entry{Key: pub, Message: msg, Signature: sig})
+	}
+	assert.True(t, VerifyBatch(entries, nil), "should verify valid batch")
+	assert.True(t, VerifyBatch(nil, nil), "should verify empty batch")
+
+	// a single invalid signature should make the batch fail
+	entries[5].Message = fixture.Sig(t)
+	assert.False(t, VerifyBatch(entries, nil), "should not verify batch with wrong message")
+	assert.False(t, Verify(entries[5].Key, entries[5].Message, entries[5].Signature), "should not verify wrong message")
+
+	// swapping signatures should make the batch fail, too
+	entries[5] = entries[6]
+	entries[6].Signature, entries[7].Signature = entries[7].Signature, entries[6].Signature
+	assert.False(t, VerifyBatch(entries, nil), "should not verify batch with swapped signatures")
+}
+
+func TestPossession(t *testing.T) {
+
+	pub, priv, err := GenerateKey(nil)
+	require.NoError(t, err, "should generate key")
+	other, _, err := GenerateKey(nil)
+	require.NoError(t, err, "should generate other key")
+
+	// proofs of possession should only verify for their own key, and should not
+	// be usable as signatures and vice versa
+	proof := Prove(priv)
+	assert.True(t, VerifyPossession(pub, proof), "should verify proof of possession")
+	assert.False(t, VerifyPossession(other, proof), "should not verify proof for other key")
+	assert.False(t, Verify(pub, pub, proof), "should not verify proof as signature")
+	assert.False(t, VerifyPossession(pub, ed25519.Sign(priv, pub)), "should not verify signature as proof")
+
+	// the scheme should check them for encoded keys
+	msg := fixture.Sig(t)
+	assert.True(t, Scheme{}.Verify(base.PublicKey(pub), msg, ed25519.Sign(priv, msg)), "should verify valid signature")
+	assert.True(t, Scheme{}.Possession(base.PublicKey(pub), proof), "should verify proof with scheme")
+	assert.False(t, Scheme{}.Possession(base.PublicKey(pub[1:]), proof), "should not verify proof for invalid key")
+}
+
+func TestSignerVerifier(t *testing.T) {
+
+	// create a committee of participants with their keys
+	domain := message.Domain{ChainID: "test", Version: 1}
+	signers := make([]*Signer, 0, 8)
+	keys := make(map[base.Hash]ed25519.PublicKey)
+	for i := 0; i < 8; i++ {
+		pub, priv, err := GenerateKey(nil)
+		require.NoError(t, err, "should generate key")
+		selfID := fixture.Hash(t)
+		signers = append(signers, NewSigner(domain, selfID, priv))
+		keys[selfID] = pub
+	}
+	strat := &mocks.Strategy{}
+	strat.On("Threshold", mock.Anything).Return(uint(6), nil)
+	verify := NewVerifier(domain, strat, static(t, keys))
+
+	// create votes by all participants and forge two of them
+	parent := fixture.Vertex(t)
+	votes := make([]*message.Vote, 0, len(signers))
+	for _, signer := range signers {
+		vote, err := signer.Vote(parent)
+		require.NoError(t, err, "should create vote")
+		require.NoError(t, verify.Vote(vote), "should verify vote")
+		votes = append(votes, vote)
+	}
+	forged := []*message.Vote{
+		{Height: votes[2].Height, CandidateID: votes[2].CandidateID, SignerID: votes[2].SignerID, Signature: votes[3].Signature},
+		{Height: votes[6].Height, CandidateID: fixture.Hash(t), SignerID: votes[6].SignerID, Signature: votes[6].Signature},
+	}
+	err := verify.Vote(forged[0])
+	assert.True(t, errors.As(err, &signal.InvalidSignature{}), "should have invalid signature error")
+
+	// batch verification should find exactly the forged votes
+	invalid, err := verify.Votes(votes)
+	require.NoError(t, err, "should batch verify valid votes")
+	assert.Empty(t, invalid, "should have no invalid votes")
+	batch := append([]*message.Vote{}, votes...)
+	batch[2], batch[6] = forged[0], forged[1]
+	invalid, err = verify.Votes(batch)
+	require.NoError(t, err, "should batch verify forged votes")
+	assert.Equal(t, forged, invalid, "should find forged votes")
+
+	// check the proposal, which also includes the proposer vote
+	candidate := fixture.Vertex(t, fixture.WithParent(parent), fixture.WithProposer(signers[0].selfID))
+	proposal, err := signers[0].Proposal(candidate)
+	require.NoError(t, err, "should create proposal")
+	require.NoError(t, verify.Proposal(proposal), "should verify proposal")
+	require.NoError(t, verify.Vote(proposal.Vote()), "should verify proposer vote")
+
+	// check quorum with concatenated signatures
+	sig, err := NewAggregator().Aggregate(votes[:6])
+	require.NoError(t, err, "should aggregate votes")
+	signerIDs := make([]base.Hash, 0, 6)
+	for _, vote := range votes[:6] {
+		signerIDs = append(signerIDs, vote.SignerID)
+	}
+	proposal.Quorum = &message.Quorum{SignerIDs: signerIDs, Signature: sig}
+	assert.NoError(t, verify.Quorum(proposal), "should verify valid quorum")
+
+	// check quorum with signers in the wrong order
+	signerIDs[0], signerIDs[1] = signerIDs[1], signerIDs[0]
+	err = verify.Quorum(proposal)
+	assert.True(t, errors.As(err, &signal.InvalidSignature{}), "should not verify quorum with wrong order")
+}
+
+// static creates a committee of participants with the given keys.
+func static(t *testing.T, keys map[base.Hash]ed25519.PublicKey) *committee.Static {
+	members := make([]committee.Member, 0, len(keys))
+	for participantID, key := range keys {
+		members = append(members, committee.Member{ID: participantID, Key: base.PublicKey(key), Weight: 1})
+	}
+	c, err := committee.NewStatic(100, members)
+	require.NoError(t, err, "should create committee")
+	return c
+}
@@ -0,0 +1,36 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package edwards
+
+import (
+	"crypto/ed25519"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// Scheme checks signatures and proofs of possession for encoded public keys,
+// for example those of the member changes carried by the committee ledger.
+type Scheme struct{}
+
+// Verify checks the signature on the given message for the encoded key.
+func (Scheme) Verify(key base.PublicKey, msg []byte, sig base.Signature) bool {
+	return Verify(ed25519.PublicKey(key), msg, sig)
+}
+
+// Possession checks the proof of possession for the encoded key.
+func (Scheme) Possession(key base.PublicKey, proof base.Signature) bool {
+	return VerifyPossession(ed25519.PublicKey(key), proof)
+}
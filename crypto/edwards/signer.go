@@ -0,0 +1,72 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package edwards
+
+import (
+	"crypto/ed25519"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Signer signs proposals and votes with an Ed25519 private key, using the
+// payloads of the given domain.
+type Signer struct {
+	domain message.Domain
+	selfID base.Hash
+	key    ed25519.PrivateKey
+}
+
+// NewSigner creates a new signer for the participant with the given ID.
+func NewSigner(domain message.Domain, selfID base.Hash, key ed25519.PrivateKey) *Signer {
+
+	s := Signer{
+		domain: domain,
+		selfID: selfID,
+		key:    key,
+	}
+
+	return &s
+}
+
+func (s *Signer) Self() (base.Hash, error) {
+	return s.selfID, nil
+}
+
+func (s *Signer) Proposal(vertex *base.Vertex) (*message.Proposal, error) {
+
+	proposal := message.Proposal{
+		Candidate:     vertex,
+		Signature:     ed25519.Sign(s.key, s.domain.ProposalBytes(vertex)),
+		VoteSignature: ed25519.Sign(s.key, s.domain.VoteBytes(vertex.Height, vertex.ID())),
+	}
+
+	return &proposal, nil
+}
+
+func (s *Signer) Vote(vertex *base.Vertex) (*message.Vote, error) {
+
+	candidateID := vertex.ID()
+	vote := message.Vote{
+		Height:      vertex.Height,
+		CandidateID: candidateID,
+		SignerID:    s.selfID,
+		Signature:   ed25519.Sign(s.key, s.domain.VoteBytes(vertex.Height, candidateID)),
+	}
+
+	return &vote, nil
+}
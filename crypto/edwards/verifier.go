@@ -0,0 +1,186 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package edwards
+
+import (
+	"crypto/ed25519"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/crypto/batch"
+	"github.com/awfm/consensus/crypto/keys"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// Verifier verifies Ed25519 signatures on proposals, votes and quorums. Quorum
+// signatures and batches of votes are checked with batch verification.
+type Verifier struct {
+	domain message.Domain
+	strat  consensus.Strategy
+	keys   *keys.Cache
+}
+
+// NewVerifier creates a new verifier using the public keys of the committee
+// participants.
+func NewVerifier(domain message.Domain, strat consensus.Strategy, committee consensus.Committee) *Verifier {
+
+	v := Verifier{
+		domain: domain,
+		strat:  strat,
+		keys:   keys.NewCache(committee, decodeKey),
+	}
+
+	return &v
+}
+
+func (v *Verifier) Quorum(proposal *message.Proposal) error {
+
+	// check we have a quorum for a parent that is not before genesis
+	if proposal.Quorum == nil {
+		return rich.Errorf("missing quorum")
+	}
+	if proposal.Candidate.Height == 0 {
+		return rich.Errorf("invalid quorum for genesis")
+	}
+
+	// get the committee of the parent height, which signed the quorum
+	height := proposal.Candidate.Height - 1
+	epoch, err := v.keys.Epoch(height)
+	if err != nil {
+		return rich.Errorf("could not get committee keys: %w", err)
+	}
+
+	// decode the signers if the quorum is in compact form
+	quorum, err := proposal.Quorum.Expand(epoch.Participants)
+	if err != nil {
+		return rich.Errorf("could not expand quorum: %w", err)
+	}
+
+	// check that the quorum has enough signers for the parent height
+	threshold, err := v.strat.Threshold(height)
+	if err != nil {
+		return rich.Errorf("could not get threshold: %w", err)
+	}
+	if uint(len(quorum.SignerIDs)) < threshold {
+		return rich.Errorf("insufficient quorum signers").Int("signers", len(quorum.SignerIDs)).Uint("threshold", threshold)
+	}
+	if len(quorum.Signature) != len(quorum.SignerIDs)*SignatureSize {
+		return rich.Errorf("invalid quorum signature size").Int("size", len(quorum.Signature))
+	}
+
+	// build a batch with the signature of each unique signer
+	msg := v.domain.VoteBytes(height, proposal.Candidate.ParentID)
+	entries := make([]Entry, 0, len(quorum.SignerIDs))
+	seen := make(map[base.Hash]struct{}, len(quorum.SignerIDs))
+	for i, signerID := range quorum.SignerIDs {
+		_, duplicate := seen[signerID]
+		if duplicate {
+			return rich.Errorf("duplicate quorum signer").Hex("signer", signerID[:])
+		}
+		seen[signerID] = struct{}{}
+		key, ok := epoch.Keys[signerID]
+		if !ok {
+			return rich.Errorf("unknown quorum signer").Hex("signer", signerID[:])
+		}
+		sig := quorum.Signature[i*SignatureSize : (i+1)*SignatureSize]
+		entries = append(entries, Entry{Key: key.(ed25519.PublicKey), Message: msg, Signature: sig})
+	}
+
+	// check all of the signatures at once
+	if !VerifyBatch(entries, nil) {
+		return signal.InvalidSignature{Entity: "quorum", Signer: proposal.Candidate.ProposerID}
+	}
+
+	return nil
+}
+
+func (v *Verifier) Proposal(proposal *message.Proposal) error {
+
+	proposerID := proposal.Candidate.ProposerID
+	key, err := v.key(proposal.Candidate.Height, proposerID)
+	if err != nil {
+		return rich.Errorf("could not get proposer key: %w", err)
+	}
+	if key == nil {
+		return rich.Errorf("unknown proposer").Hex("proposer", proposerID[:])
+	}
+
+	msg := v.domain.ProposalBytes(proposal.Candidate)
+	if !Verify(key, msg, proposal.Signature) {
+		return signal.InvalidSignature{Entity: "proposal", Signer: proposerID}
+	}
+
+	return nil
+}
+
+func (v *Verifier) Vote(vote *message.Vote) error {
+
+	key, err := v.key(vote.Height, vote.SignerID)
+	if err != nil {
+		return rich.Errorf("could not get voter key: %w", err)
+	}
+	if key == nil {
+		return rich.Errorf("unknown voter").Hex("voter", vote.SignerID[:])
+	}
+
+	msg := v.domain.VoteBytes(vote.Height, vote.CandidateID)
+	if !Verify(key, msg, vote.Signature) {
+		return signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID}
+	}
+
+	return nil
+}
+
+func (v *Verifier) Votes(votes []*message.Vote) ([]*message.Vote, error) {
+	entry := func(vote *message.Vote) (interface{}, error) {
+		key, err := v.key(vote.Height, vote.SignerID)
+		if key == nil || err != nil {
+			return nil, err
+		}
+		msg := v.domain.VoteBytes(vote.Height, vote.CandidateID)
+		return Entry{Key: key, Message: msg, Signature: vote.Signature}, nil
+	}
+	verify := func(entries []interface{}) bool {
+		subset := make([]Entry, 0, len(entries))
+		for _, e := range entries {
+			subset = append(subset, e.(Entry))
+		}
+		return VerifyBatch(subset, nil)
+	}
+	return batch.Votes(votes, entry, verify)
+}
+
+// key returns the public key of the participant at the given height, or nil if
+// it is not part of the committee at that height.
+func (v *Verifier) key(height uint64, participantID base.Hash) (ed25519.PublicKey, error) {
+	key, err := v.keys.Key(height, participantID)
+	if key == nil || err != nil {
+		return nil, err
+	}
+	return key.(ed25519.PublicKey), nil
+}
+
+// decodeKey checks the size of a committee key for the key cache.
+func decodeKey(data base.PublicKey) (interface{}, error) {
+	if len(data) != ed25519.PublicKeySize {
+		return nil, rich.Errorf("invalid key size").Int("size", len(data))
+	}
+	return ed25519.PublicKey(data), nil
+}
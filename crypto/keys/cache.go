@@ -0,0 +1,136 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package keys caches the decoded public keys of the committee for the
+// verifiers of the different signature schemes.
+package keys
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+)
+
+// Retain is the number of epochs for which the cache keeps the decoded keys
+// around.
+const Retain = 4
+
+// Decoder decodes the public key of a participant into the representation
+// used by a signature scheme.
+type Decoder func(data base.PublicKey) (interface{}, error)
+
+// Epoch are the decoded public keys of the committee of one epoch, along with
+// the committee ordering used to index the signers of compact quorums.
+type Epoch struct {
+	Participants []base.Hash
+	Keys         map[base.Hash]interface{}
+}
+
+// Cache decodes the public keys of the committee on first use of an epoch and
+// forgets them for old epochs.
+type Cache struct {
+	sync.Mutex
+	committee consensus.Committee
+	decode    Decoder
+	epochs    map[uint64]*Epoch
+}
+
+// NewCache creates a new key cache for the committee, using the decoder of the
+// signature scheme.
+func NewCache(committee consensus.Committee, decode Decoder) *Cache {
+
+	c := Cache{
+		committee: committee,
+		decode:    decode,
+		epochs:    make(map[uint64]*Epoch),
+	}
+
+	return &c
+}
+
+// Key returns the decoded public key of the participant at the given height,
+// or nil if it is not part of the committee at that height.
+func (c *Cache) Key(height uint64, participantID base.Hash) (interface{}, error) {
+	epoch, err := c.Epoch(height)
+	if err != nil {
+		return nil, err
+	}
+	return epoch.Keys[participantID], nil
+}
+
+// Epoch returns the decoded committee keys for the epoch of the given height.
+func (c *Cache) Epoch(height uint64) (*Epoch, error) {
+
+	epoch, err := c.committee.Epoch(height)
+	if err != nil {
+		return nil, rich.Errorf("could not get epoch: %w", err).Uint64("height", height)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	cached, ok := c.epochs[epoch]
+	if ok {
+		return cached, nil
+	}
+
+	participants, err := c.committee.Participants(epoch)
+	if err != nil {
+		return nil, rich.Errorf("could not get participants: %w", err).Uint64("epoch", epoch)
+	}
+	keys := make(map[base.Hash]interface{}, len(participants))
+	for _, participantID := range participants {
+		data, err := c.committee.Key(epoch, participantID)
+		if err != nil {
+			return nil, rich.Errorf("could not get key: %w", err).Hex("participant", participantID[:])
+		}
+		key, err := c.decode(data)
+		if err != nil {
+			return nil, rich.Errorf("could not decode key: %w", err).Hex("participant", participantID[:])
+		}
+		keys[participantID] = key
+	}
+
+	loaded := Epoch{
+		Participants: participants,
+		Keys:         keys,
+	}
+	c.epochs[epoch] = &loaded
+	c.evict()
+
+	return &loaded, nil
+}
+
+// evict removes the oldest epochs from the cache once it holds too many.
+func (c *Cache) evict() {
+	if len(c.epochs) <= Retain {
+		return
+	}
+	cached := make([]uint64, 0, len(c.epochs))
+	for epoch := range c.epochs {
+		cached = append(cached, epoch)
+	}
+	sort.Slice(cached, func(i int, j int) bool {
+		return cached[i] < cached[j]
+	})
+	for _, epoch := range cached[:len(cached)-Retain] {
+		delete(c.epochs, epoch)
+	}
+}
@@ -0,0 +1,87 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keys
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+)
+
+func TestCache(t *testing.T) {
+
+	// use one epoch per height, with the same participants in each
+	participants := fixture.Hashes(t, 3)
+	committee := &mocks.Committee{}
+	committee.On("Epoch", mock.Anything).Return(func(height uint64) uint64 { return height }, nil)
+	committee.On("Participants", mock.Anything).Return(participants, nil)
+	committee.On("Key", mock.Anything, mock.Anything).Return(func(epoch uint64, participantID base.Hash) base.PublicKey {
+		return participantID[:]
+	}, nil)
+	decoded := 0
+	c := NewCache(committee, func(data base.PublicKey) (interface{}, error) {
+		decoded++
+		return string(data), nil
+	})
+
+	// keys should be decoded once per epoch
+	key, err := c.Key(1, participants[0])
+	require.NoError(t, err, "should get key")
+	assert.Equal(t, string(participants[0][:]), key, "should return decoded key")
+	_, err = c.Key(1, participants[1])
+	require.NoError(t, err, "should get cached key")
+	assert.Equal(t, 3, decoded, "should decode each key once")
+
+	epoch, err := c.Epoch(1)
+	require.NoError(t, err, "should get epoch")
+	assert.Equal(t, participants, epoch.Participants, "should keep committee ordering")
+
+	// unknown participants should have no key
+	key, err = c.Key(1, fixture.Hash(t))
+	require.NoError(t, err, "should not fail for unknown participant")
+	assert.Nil(t, key, "should have no key for unknown participant")
+
+	// only the most recent epochs should be kept
+	for height := uint64(2); height <= Retain+1; height++ {
+		_, err = c.Epoch(height)
+		require.NoError(t, err, "should get epoch")
+	}
+	assert.Len(t, c.epochs, Retain, "should retain limited epochs")
+	assert.NotContains(t, c.epochs, uint64(1), "should evict oldest epoch")
+}
+
+func TestCacheDecodeError(t *testing.T) {
+
+	committee := &mocks.Committee{}
+	committee.On("Epoch", mock.Anything).Return(uint64(0), nil)
+	committee.On("Participants", mock.Anything).Return(fixture.Hashes(t, 3), nil)
+	committee.On("Key", mock.Anything, mock.Anything).Return(base.PublicKey{}, nil)
+	c := NewCache(committee, func(data base.PublicKey) (interface{}, error) {
+		return nil, fmt.Errorf("invalid key")
+	})
+
+	_, err := c.Epoch(0)
+	assert.Error(t, err, "should fail on invalid key")
+	assert.Empty(t, c.epochs, "should not cache epoch with invalid key")
+}
@@ -0,0 +1,513 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package dkg implements a distributed key generation protocol based on the
+// joint Feldman verifiable secret sharing by Pedersen. Each participant deals a
+// random secret to all others, participants complain about invalid shares,
+// accused dealers justify themselves by revealing the disputed shares, and the
+// group key is the sum of the secrets of all dealers that were not
+// disqualified. No single participant ever learns the group private key.
+//
+// Every participant decides on the qualified dealers locally, based on the
+// messages it received before each phase timed out. Honest participants thus
+// only agree on the qualified dealers, and derive the same group key, if the
+// network is synchronous: every message has to reach all participants within
+// the phase timeout, and a message that arrives later is treated as missing by
+// everyone. Where this can't be assumed, the participants have to agree on the
+// qualified dealers of their results, for example through consensus, before
+// using the group key.
+package dkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/bn256"
+
+	"github.com/awfm/consensus/crypto/bls"
+	"github.com/awfm/consensus/model/base"
+)
+
+// Config contains the parameters of a key generation run.
+type Config struct {
+	SelfID       base.Hash     // identity of the local participant
+	Participants []base.Hash   // identities of all participants, including ourselves
+	Threshold    uint32        // number of shares needed to create a group signature
+	Timeout      time.Duration // maximum duration of each protocol phase, which has to exceed the network delay
+	Random       io.Reader     // source of randomness (defaults to secure random)
+}
+
+// Result is the output of a successful key generation run.
+type Result struct {
+	Share     *bls.KeyShare                // private key share of the local participant
+	Group     *bls.PublicKey               // public key of the group
+	Public    map[base.Hash]*bls.PublicKey // public key shares of all participants
+	Indices   map[base.Hash]uint32         // share indices of all participants
+	Qualified []base.Hash                  // dealers that contributed to the group key
+}
+
+// DKG runs the distributed key generation for one participant.
+type DKG struct {
+	cfg          Config
+	tr           Transport
+	participants []base.Hash
+	indices      map[base.Hash]uint32
+	coeffs       []*big.Int
+	commitments  map[base.Hash][]*bls.PublicKey
+	shares       map[base.Hash]*big.Int
+	complaints   map[base.Hash]map[base.Hash]struct{}
+	complained   map[base.Hash]struct{}
+	revealed     map[base.Hash]map[base.Hash]*big.Int
+	justified    map[base.Hash]struct{}
+	after        func(timeout time.Duration) (<-chan time.Time, func() bool)
+}
+
+// New creates a new key generation run for the given configuration, which
+// communicates with the other participants over the given transport.
+func New(cfg Config, tr Transport) (*DKG, error) {
+
+	// sort the participants, so that all of them derive the same indices
+	participants := make([]base.Hash, len(cfg.Participants))
+	copy(participants, cfg.Participants)
+	sort.Slice(participants, func(i int, j int) bool {
+		return bytes.Compare(participants[i][:], participants[j][:]) < 0
+	})
+	indices := make(map[base.Hash]uint32, len(participants))
+	for i, participantID := range participants {
+		_, duplicate := indices[participantID]
+		if duplicate {
+			return nil, rich.Errorf("duplicate participant").Hex("participant", participantID[:])
+		}
+		indices[participantID] = uint32(i + 1)
+	}
+
+	// check that the configuration is valid
+	_, ok := indices[cfg.SelfID]
+	if !ok {
+		return nil, rich.Errorf("self not in participants").Hex("self", cfg.SelfID[:])
+	}
+	if cfg.Threshold == 0 || int(cfg.Threshold) > len(participants) {
+		return nil, rich.Errorf("invalid threshold").Uint32("threshold", cfg.Threshold).Int("participants", len(participants))
+	}
+	if cfg.Timeout <= 0 {
+		return nil, rich.Errorf("invalid phase timeout").Dur("timeout", cfg.Timeout)
+	}
+	if cfg.Random == nil {
+		cfg.Random = rand.Reader
+	}
+
+	d := DKG{
+		cfg:          cfg,
+		tr:           tr,
+		participants: participants,
+		indices:      indices,
+		commitments:  make(map[base.Hash][]*bls.PublicKey),
+		shares:       make(map[base.Hash]*big.Int),
+		complaints:   make(map[base.Hash]map[base.Hash]struct{}),
+		complained:   make(map[base.Hash]struct{}),
+		revealed:     make(map[base.Hash]map[base.Hash]*big.Int),
+		justified:    make(map[base.Hash]struct{}),
+		after:        timer,
+	}
+
+	return &d, nil
+}
+
+// Run executes all phases of the protocol and returns the key share of the
+// local participant, along with the public keys of the group.
+func (d *DKG) Run(ctx context.Context) (*Result, error) {
+
+	// 1) deal our own secret to all participants
+	err := d.deal()
+	if err != nil {
+		return nil, rich.Errorf("could not deal secret: %w", err)
+	}
+
+	// 2) wait for the commitments and shares of all other dealers
+	err = d.await(ctx, d.dealt)
+	if err != nil {
+		return nil, rich.Errorf("could not await deals: %w", err)
+	}
+
+	// 3) complain about all dealers that did not send us a valid share
+	err = d.complain()
+	if err != nil {
+		return nil, rich.Errorf("could not complain: %w", err)
+	}
+
+	// 4) wait for the complaints of all other participants
+	err = d.await(ctx, d.accused)
+	if err != nil {
+		return nil, rich.Errorf("could not await complaints: %w", err)
+	}
+
+	// 5) justify ourselves by revealing the shares that were complained about
+	err = d.justify()
+	if err != nil {
+		return nil, rich.Errorf("could not justify: %w", err)
+	}
+
+	// 6) wait for the justifications of all accused dealers
+	err = d.await(ctx, d.defended)
+	if err != nil {
+		return nil, rich.Errorf("could not await justifications: %w", err)
+	}
+
+	// 7) determine the qualified dealers and combine their secrets
+	result, err := d.combine()
+	if err != nil {
+		return nil, rich.Errorf("could not combine secrets: %w", err)
+	}
+
+	return result, nil
+}
+
+func (d *DKG) deal() error {
+
+	// create the random polynomial of degree t-1 and commit to it
+	d.coeffs = make([]*big.Int, 0, d.cfg.Threshold)
+	points := make([][]byte, 0, d.cfg.Threshold)
+	commitments := make([]*bls.PublicKey, 0, d.cfg.Threshold)
+	for len(d.coeffs) < int(d.cfg.Threshold) {
+		key, err := bls.GenerateKey(d.cfg.Random)
+		if err != nil {
+			return rich.Errorf("could not generate coefficient: %w", err)
+		}
+		d.coeffs = append(d.coeffs, key.Scalar())
+		points = append(points, key.Public().Bytes())
+		commitments = append(commitments, key.Public())
+	}
+	d.commitments[d.cfg.SelfID] = commitments
+	err := d.tr.Broadcast(&Commitment{Points: points})
+	if err != nil {
+		return rich.Errorf("could not broadcast commitment: %w", err)
+	}
+
+	// send each participant its share of the secret
+	for _, participantID := range d.participants {
+		value := bls.Evaluate(d.coeffs, d.indices[participantID])
+		if participantID == d.cfg.SelfID {
+			d.shares[participantID] = value
+			continue
+		}
+		err = d.tr.Send(&Share{Value: encodeScalar(value)}, participantID)
+		if err != nil {
+			return rich.Errorf("could not send share: %w", err).Hex("recipient", participantID[:])
+		}
+	}
+
+	return nil
+}
+
+func (d *DKG) complain() error {
+
+	// accuse every dealer whose share we can't verify against its commitment
+	var accusedIDs []base.Hash
+	for _, dealerID := range d.participants {
+		if dealerID == d.cfg.SelfID {
+			continue
+		}
+		if d.verify(dealerID, d.cfg.SelfID, d.shares[dealerID]) {
+			continue
+		}
+		accusedIDs = append(accusedIDs, dealerID)
+	}
+
+	// record our own complaints and broadcast them to everyone else; we always
+	// broadcast, so that the others know when we are done
+	d.record(d.cfg.SelfID, accusedIDs)
+	err := d.tr.Broadcast(&Complaint{AccusedIDs: accusedIDs})
+	if err != nil {
+		return rich.Errorf("could not broadcast complaint: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DKG) justify() error {
+
+	// reveal the share of every participant that complained about us; we
+	// always broadcast, so that the others know when we are done
+	shares := make(map[base.Hash][]byte)
+	revealed := make(map[base.Hash]*big.Int)
+	for complainerID := range d.complaints[d.cfg.SelfID] {
+		value := bls.Evaluate(d.coeffs, d.indices[complainerID])
+		shares[complainerID] = encodeScalar(value)
+		revealed[complainerID] = value
+	}
+	d.justified[d.cfg.SelfID] = struct{}{}
+	d.revealed[d.cfg.SelfID] = revealed
+	err := d.tr.Broadcast(&Justification{Shares: shares})
+	if err != nil {
+		return rich.Errorf("could not broadcast justification: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DKG) combine() (*Result, error) {
+
+	// a dealer is qualified if it committed to a polynomial and every share
+	// that was complained about was revealed and is valid; if we complained
+	// about a qualified dealer, we use the revealed share instead
+	var qualified []base.Hash
+	for _, dealerID := range d.participants {
+		if d.commitments[dealerID] == nil {
+			continue
+		}
+		valid := true
+		for complainerID := range d.complaints[dealerID] {
+			value := d.revealed[dealerID][complainerID]
+			if !d.verify(dealerID, complainerID, value) {
+				valid = false
+				break
+			}
+			if complainerID == d.cfg.SelfID {
+				d.shares[dealerID] = value
+			}
+		}
+		if !valid {
+			continue
+		}
+		qualified = append(qualified, dealerID)
+	}
+	if len(qualified) < int(d.cfg.Threshold) {
+		return nil, rich.Errorf("insufficient qualified dealers").Int("qualified", len(qualified)).Uint32("threshold", d.cfg.Threshold)
+	}
+
+	// our key share is the sum of the shares of all qualified dealers
+	sum := big.NewInt(0)
+	for _, dealerID := range qualified {
+		sum.Add(sum, d.shares[dealerID])
+	}
+	key, err := bls.PrivateKeyFromScalar(sum)
+	if err != nil {
+		return nil, rich.Errorf("could not create key share: %w", err)
+	}
+
+	// the group key is the sum of the constant term commitments, while the
+	// public key shares are the sums of the evaluated commitments
+	constants := make([]*bls.PublicKey, 0, len(qualified))
+	for _, dealerID := range qualified {
+		constants = append(constants, d.commitments[dealerID][0])
+	}
+	group, err := bls.AggregatePublicKeys(constants)
+	if err != nil {
+		return nil, rich.Errorf("could not aggregate group key: %w", err)
+	}
+	public := make(map[base.Hash]*bls.PublicKey, len(d.participants))
+	for _, participantID := range d.participants {
+		evaluated := make([]*bls.PublicKey, 0, len(qualified))
+		for _, dealerID := range qualified {
+			evaluated = append(evaluated, evaluate(d.commitments[dealerID], d.indices[participantID]))
+		}
+		public[participantID], err = bls.AggregatePublicKeys(evaluated)
+		if err != nil {
+			return nil, rich.Errorf("could not aggregate public share: %w", err)
+		}
+	}
+
+	result := Result{
+		Share:     &bls.KeyShare{Index: d.indices[d.cfg.SelfID], Key: key},
+		Group:     group,
+		Public:    public,
+		Indices:   d.indices,
+		Qualified: qualified,
+	}
+
+	return &result, nil
+}
+
+// await processes incoming messages until the given condition is met or the
+// phase times out; a timeout is not an error, as missing messages are dealt
+// with by the protocol itself.
+func (d *DKG) await(ctx context.Context, done func() bool) error {
+	expired, stop := d.after(d.cfg.Timeout)
+	defer stop()
+	for !done() {
+		select {
+		case env := <-d.tr.Receive():
+			d.process(env)
+		case <-expired:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// timer starts a timer for the phase timeout and returns its channel, along
+// with the function that stops it.
+func timer(timeout time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(timeout)
+	return t.C, t.Stop
+}
+
+// process stores the content of a received message; messages from unknown
+// senders and repeated messages are ignored.
+func (d *DKG) process(env *Envelope) {
+
+	_, known := d.indices[env.SenderID]
+	if !known || env.SenderID == d.cfg.SelfID {
+		return
+	}
+
+	switch msg := env.Message.(type) {
+
+	case *Commitment:
+		_, ok := d.commitments[env.SenderID]
+		if ok {
+			return
+		}
+		// an invalid commitment is stored as empty, which disqualifies the
+		// dealer, but still lets us know that it was received
+		commitments := make([]*bls.PublicKey, 0, len(msg.Points))
+		for _, point := range msg.Points {
+			commitment, err := bls.PublicKeyFromBytes(point)
+			if err != nil {
+				break
+			}
+			commitments = append(commitments, commitment)
+		}
+		if len(commitments) != int(d.cfg.Threshold) {
+			commitments = []*bls.PublicKey{}
+		}
+		d.commitments[env.SenderID] = commitments
+
+	case *Share:
+		_, ok := d.shares[env.SenderID]
+		if ok {
+			return
+		}
+		d.shares[env.SenderID] = decodeScalar(msg.Value)
+
+	case *Complaint:
+		_, ok := d.complained[env.SenderID]
+		if ok {
+			return
+		}
+		d.record(env.SenderID, msg.AccusedIDs)
+
+	case *Justification:
+		_, ok := d.justified[env.SenderID]
+		if ok {
+			return
+		}
+		d.justified[env.SenderID] = struct{}{}
+		revealed := make(map[base.Hash]*big.Int, len(msg.Shares))
+		for complainerID, value := range msg.Shares {
+			revealed[complainerID] = decodeScalar(value)
+		}
+		d.revealed[env.SenderID] = revealed
+	}
+}
+
+// record stores the complaints of the given complainer.
+func (d *DKG) record(complainerID base.Hash, accusedIDs []base.Hash) {
+	d.complained[complainerID] = struct{}{}
+	for _, accusedID := range accusedIDs {
+		_, known := d.indices[accusedID]
+		if !known {
+			continue
+		}
+		complainers, ok := d.complaints[accusedID]
+		if !ok {
+			complainers = make(map[base.Hash]struct{})
+			d.complaints[accusedID] = complainers
+		}
+		complainers[complainerID] = struct{}{}
+	}
+}
+
+// verify checks the share of the given dealer for the given participant
+// against the commitments of the dealer.
+func (d *DKG) verify(dealerID base.Hash, participantID base.Hash, value *big.Int) bool {
+	commitments := d.commitments[dealerID]
+	if len(commitments) == 0 || value == nil {
+		return false
+	}
+	key, err := bls.PrivateKeyFromScalar(value)
+	if err != nil {
+		return false
+	}
+	expected := evaluate(commitments, d.indices[participantID])
+	return key.Public().Equal(expected)
+}
+
+// dealt checks whether we have commitments and shares from all dealers.
+func (d *DKG) dealt() bool {
+	return len(d.commitments) == len(d.participants) && len(d.shares) == len(d.participants)
+}
+
+// accused checks whether we have the complaints of all participants.
+func (d *DKG) accused() bool {
+	return len(d.complained) == len(d.participants)
+}
+
+// defended checks whether we have the justifications of all accused dealers.
+func (d *DKG) defended() bool {
+	for accusedID := range d.complaints {
+		_, ok := d.justified[accusedID]
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate computes the public value of a committed polynomial at the given
+// index, which is the sum of the commitments weighted by the powers of the
+// index.
+func evaluate(commitments []*bls.PublicKey, index uint32) *bls.PublicKey {
+	x := big.NewInt(int64(index))
+	power := big.NewInt(1)
+	weighted := make([]*bls.PublicKey, 0, len(commitments))
+	for _, commitment := range commitments {
+		weighted = append(weighted, commitment.Mul(power))
+		power = new(big.Int).Mul(power, x)
+		power.Mod(power, bn256.Order)
+	}
+	sum, _ := bls.AggregatePublicKeys(weighted)
+	return sum
+}
+
+// encodeScalar encodes a scalar as fixed-size big-endian bytes.
+func encodeScalar(value *big.Int) []byte {
+	data := make([]byte, bls.PrivateKeySize)
+	b := value.Bytes()
+	copy(data[len(data)-len(b):], b)
+	return data
+}
+
+// decodeScalar decodes a scalar, returning nil if it is not a valid element of
+// the scalar field.
+func decodeScalar(data []byte) *big.Int {
+	if len(data) != bls.PrivateKeySize {
+		return nil
+	}
+	value := new(big.Int).SetBytes(data)
+	if value.Cmp(bn256.Order) >= 0 {
+		return nil
+	}
+	return value
+}
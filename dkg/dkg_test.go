@@ -0,0 +1,275 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dkg
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/crypto/bls"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+)
+
+// memory is an in-memory network connecting all participants.
+type memory struct {
+	inboxes map[base.Hash]chan *Envelope
+}
+
+func newMemory(participants []base.Hash) *memory {
+	m := memory{
+		inboxes: make(map[base.Hash]chan *Envelope),
+	}
+	for _, participantID := range participants {
+		m.inboxes[participantID] = make(chan *Envelope, 1024)
+	}
+	return &m
+}
+
+// endpoint is the transport of a single participant on the in-memory network;
+// the tamper function can modify or drop outgoing messages.
+type endpoint struct {
+	mem    *memory
+	selfID base.Hash
+	tamper func(msg interface{}, recipientID base.Hash) interface{}
+}
+
+func (e *endpoint) Broadcast(msg interface{}) error {
+	for recipientID := range e.mem.inboxes {
+		if recipientID == e.selfID {
+			continue
+		}
+		e.deliver(msg, recipientID)
+	}
+	return nil
+}
+
+func (e *endpoint) Send(msg interface{}, recipientID base.Hash) error {
+	e.deliver(msg, recipientID)
+	return nil
+}
+
+func (e *endpoint) Receive() <-chan *Envelope {
+	return e.mem.inboxes[e.selfID]
+}
+
+func (e *endpoint) deliver(msg interface{}, recipientID base.Hash) {
+	if e.tamper != nil {
+		msg = e.tamper(msg, recipientID)
+	}
+	if msg == nil {
+		return
+	}
+	e.mem.inboxes[recipientID] <- &Envelope{SenderID: e.selfID, Message: msg}
+}
+
+// run executes the key generation for all participants and returns the results
+// by participant, using the given phase timeout and tamper functions for the
+// respective participants.
+func run(t *testing.T, participants []base.Hash, threshold uint32, timeout time.Duration, tampers map[base.Hash]func(interface{}, base.Hash) interface{}) map[base.Hash]*Result {
+	return prepared(t, participants, threshold, timeout, tampers, nil)
+}
+
+// prepared works like run, but lets the given function prepare the key
+// generation of each participant before it runs, for example to control its
+// phase timeouts.
+func prepared(t *testing.T, participants []base.Hash, threshold uint32, timeout time.Duration, tampers map[base.Hash]func(interface{}, base.Hash) interface{}, prepare func(selfID base.Hash, d *DKG)) map[base.Hash]*Result {
+
+	mem := newMemory(participants)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	results := make(map[base.Hash]*Result)
+	for _, participantID := range participants {
+		cfg := Config{
+			SelfID:       participantID,
+			Participants: participants,
+			Threshold:    threshold,
+			Timeout:      timeout,
+		}
+		tr := &endpoint{mem: mem, selfID: participantID, tamper: tampers[participantID]}
+		d, err := New(cfg, tr)
+		require.NoError(t, err, "should create key generation")
+		if prepare != nil {
+			prepare(participantID, d)
+		}
+		wg.Add(1)
+		go func(selfID base.Hash) {
+			defer wg.Done()
+			result, err := d.Run(context.Background())
+			assert.NoError(t, err, "should run key generation")
+			mutex.Lock()
+			results[selfID] = result
+			mutex.Unlock()
+		}(participantID)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// check makes sure that the results of the given participants agree on the
+// group key and that their shares can create a valid group signature.
+func check(t *testing.T, results map[base.Hash]*Result, honest []base.Hash, threshold uint32) {
+
+	reference := results[honest[0]]
+	require.NotNil(t, reference, "should have result")
+	msg := []byte("message")
+	shares := make([]bls.SignatureShare, 0, len(honest))
+	for _, participantID := range honest {
+		result := results[participantID]
+		require.NotNil(t, result, "should have result")
+		assert.True(t, reference.Group.Equal(result.Group), "should agree on group key")
+		assert.Equal(t, reference.Qualified, result.Qualified, "should agree on qualified dealers")
+		assert.True(t, result.Share.Key.Public().Equal(reference.Public[participantID]), "should match public share")
+		shares = append(shares, bls.SignatureShare{Index: result.Share.Index, Signature: bls.Sign(result.Share.Key, msg)})
+	}
+	sig, err := bls.Recover(shares[:threshold])
+	require.NoError(t, err, "should recover group signature")
+	assert.True(t, bls.Verify(reference.Group, msg, sig), "should verify group signature")
+}
+
+func TestHonest(t *testing.T) {
+	participants := fixture.Hashes(t, 4)
+	results := run(t, participants, 3, 5*time.Second, nil)
+	check(t, results, participants, 3)
+	assert.Len(t, results[participants[0]].Qualified, 4, "should qualify all dealers")
+}
+
+func TestJustifiedComplaint(t *testing.T) {
+
+	// the first participant sends a corrupted share to the second, but then
+	// reveals the valid share when the second complains
+	participants := fixture.Hashes(t, 4)
+	victimID := participants[1]
+	tampers := map[base.Hash]func(interface{}, base.Hash) interface{}{
+		participants[0]: func(msg interface{}, recipientID base.Hash) interface{} {
+			share, ok := msg.(*Share)
+			if !ok || recipientID != victimID {
+				return msg
+			}
+			value := new(big.Int).SetBytes(share.Value)
+			value.Add(value, big.NewInt(1))
+			return &Share{Value: encodeScalar(value)}
+		},
+	}
+	results := run(t, participants, 3, 5*time.Second, tampers)
+	check(t, results, participants, 3)
+	assert.Len(t, results[participants[0]].Qualified, 4, "should qualify justified dealer")
+}
+
+func TestUnjustifiedComplaint(t *testing.T) {
+
+	// the first participant sends a corrupted share to the second, and then
+	// does not respond to the complaint
+	participants := fixture.Hashes(t, 5)
+	cheaterID := participants[0]
+	victimID := participants[1]
+	tampers := map[base.Hash]func(interface{}, base.Hash) interface{}{
+		cheaterID: func(msg interface{}, recipientID base.Hash) interface{} {
+			switch msg.(type) {
+			case *Share:
+				if recipientID == victimID {
+					return &Share{Value: encodeScalar(big.NewInt(1))}
+				}
+			case *Justification:
+				return nil
+			}
+			return msg
+		},
+	}
+	results := run(t, participants, 3, 5*time.Second, tampers)
+	check(t, results, participants[1:], 3)
+	assert.NotContains(t, results[victimID].Qualified, cheaterID, "should disqualify cheating dealer")
+	assert.Len(t, results[victimID].Qualified, 4, "should qualify honest dealers")
+}
+
+func TestLateJustification(t *testing.T) {
+
+	// the first participant sends a corrupted share to the second, and then
+	// reveals the valid share, but only after the justification phase of all
+	// honest participants timed out
+	participants := fixture.Hashes(t, 5)
+	cheaterID := participants[0]
+	victimID := participants[1]
+	honest := participants[1:]
+	var left sync.WaitGroup
+	left.Add(len(honest))
+	tampers := map[base.Hash]func(interface{}, base.Hash) interface{}{
+		cheaterID: func(msg interface{}, recipientID base.Hash) interface{} {
+			switch msg.(type) {
+			case *Share:
+				if recipientID == victimID {
+					return &Share{Value: encodeScalar(big.NewInt(1))}
+				}
+			case *Justification:
+				left.Wait()
+			}
+			return msg
+		},
+	}
+
+	// the phases only time out when we say so: the first two phases never do,
+	// as everyone sends their deals and complaints, while the justification
+	// phase of the honest participants times out once all of them entered it
+	entered := make(chan struct{}, len(honest))
+	expire := make(chan time.Time)
+	go func() {
+		for range honest {
+			<-entered
+		}
+		close(expire)
+	}()
+	prepare := func(selfID base.Hash, d *DKG) {
+		phase := 0
+		d.after = func(time.Duration) (<-chan time.Time, func() bool) {
+			phase++
+			if selfID == cheaterID || phase < 3 {
+				return nil, func() bool { return true }
+			}
+			entered <- struct{}{}
+			return expire, func() bool {
+				left.Done()
+				return true
+			}
+		}
+	}
+
+	// all honest participants should treat the justification as missing, and
+	// thus agree on disqualifying the dealer
+	results := prepared(t, participants, 3, time.Second, tampers, prepare)
+	check(t, results, honest, 3)
+	for _, participantID := range honest {
+		assert.NotContains(t, results[participantID].Qualified, cheaterID, "should disqualify late dealer")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	participants := fixture.Hashes(t, 3)
+	tr := &endpoint{mem: newMemory(participants), selfID: participants[0]}
+	_, err := New(Config{SelfID: fixture.Hash(t), Participants: participants, Threshold: 2, Timeout: time.Second}, tr)
+	assert.Error(t, err, "should not accept unknown self")
+	_, err = New(Config{SelfID: participants[0], Participants: participants, Threshold: 4, Timeout: time.Second}, tr)
+	assert.Error(t, err, "should not accept threshold above participants")
+	_, err = New(Config{SelfID: participants[0], Participants: append(participants, participants[0]), Threshold: 2, Timeout: time.Second}, tr)
+	assert.Error(t, err, "should not accept duplicate participants")
+}
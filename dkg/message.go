@@ -0,0 +1,63 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dkg
+
+import (
+	"github.com/awfm/consensus/model/base"
+)
+
+// Transport is the abstract network used by the participants of the key
+// generation. Broadcasts are assumed to be reliable, so that all participants
+// receive the same broadcast messages within the phase timeout, and sends are
+// assumed to be private and authenticated, so that shares are only seen by
+// their recipient.
+type Transport interface {
+	Broadcast(msg interface{}) error
+	Send(msg interface{}, recipientID base.Hash) error
+	Receive() <-chan *Envelope
+}
+
+// Envelope is a message received from the transport, along with the
+// authenticated identity of its sender.
+type Envelope struct {
+	SenderID base.Hash
+	Message  interface{}
+}
+
+// Commitment is broadcast by each dealer and contains the Feldman commitments
+// to the coefficients of its secret sharing polynomial.
+type Commitment struct {
+	Points [][]byte
+}
+
+// Share is sent privately by a dealer to each participant and contains the
+// evaluation of its polynomial at the index of the recipient.
+type Share struct {
+	Value []byte
+}
+
+// Complaint is broadcast by each participant and lists the dealers that sent
+// it a missing or invalid share.
+type Complaint struct {
+	AccusedIDs []base.Hash
+}
+
+// Justification is broadcast by each participant and reveals the shares it
+// dealt to participants that complained about it.
+type Justification struct {
+	Shares map[base.Hash][]byte
+}
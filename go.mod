@@ -3,6 +3,7 @@ module github.com/awfm/consensus
 go 1.13
 
 require (
+	filippo.io/edwards25519 v1.0.0-beta.2
 	github.com/awfm/rich v0.0.0-20200517132033-b6a10aaa2513
 	github.com/stretchr/testify v1.5.1
 	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
@@ -20,10 +20,16 @@ import (
 	"github.com/awfm/consensus/model/base"
 )
 
+// Graph holds the consensus graph state. Finalized returns the finalized vertex
+// at a height at or below the final vertex, or nil if no vertex was finalized
+// at that height. That can only happen with a graph that lets vertices skip
+// heights; the graph package always extends the parent height by one, so it
+// has a vertex at every height.
 type Graph interface {
 	Extend(vertex *base.Vertex) error
 	Confirm(vertexID base.Hash) error
 	Contains(vertexID base.Hash) (bool, error)
 	Tip() (*base.Vertex, error)
 	Final() (*base.Vertex, error)
+	Finalized(height uint64) (*base.Vertex, error)
 }
@@ -0,0 +1,245 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+// Package graph implements the graph component, which keeps the consensus
+// graph in memory and finalizes its vertices as they are confirmed.
+//
+// Every proposal carries a quorum for its parent, which is always the vertex
+// at the height right below it, and a guarded signer only signs one vertex per
+// height. Two quorums of more than two thirds thus can't exist for different
+// vertices at the same height, and every later vertex has to descend from the
+// confirmed one. A confirmed vertex can therefore never be replaced, so the
+// graph finalizes it, along with any of its ancestors that are not final yet,
+// as soon as it is confirmed. The genesis vertex is final from the start, but
+// it is only confirmed once the first proposal carries a quorum for it.
+package graph
+
+import (
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// Finalizer is handed every vertex the graph finalizes, in order of height,
+// before the vertex becomes final. It is called with the graph locked, so it
+// must not call back into the graph.
+type Finalizer interface {
+	Finalize(vertex *base.Vertex) error
+}
+
+// Validator checks every candidate before it extends the graph, for example
+// whether the payload of its arc is available and valid. The processor only
+// votes on candidates that extend the graph, so a finalizer that needs more
+// than the vertex to finalize it should also be a validator; otherwise, a
+// quorum could form on a vertex it can never finalize. Like the finalizer, it
+// is called with the graph locked.
+type Validator interface {
+	Validate(vertex *base.Vertex) error
+}
+
+// Graph holds the finalized chain of vertices, as well as the candidates that
+// extend it and are still waiting for a quorum.
+type Graph struct {
+	sync.RWMutex
+	finalize  Finalizer
+	validate  Validator
+	vertices  map[base.Hash]*base.Vertex
+	heights   map[uint64][]base.Hash
+	confirmed map[base.Hash]struct{}
+	history   []*base.Vertex
+	tip       *base.Vertex
+}
+
+// New creates a graph starting at the given genesis vertex. The finalizer is
+// optional; if it is given, it has to accept every vertex the graph finalizes,
+// and if it is also a validator, it validates every candidate.
+func New(genesis *base.Vertex, finalize Finalizer) (*Graph, error) {
+
+	if genesis.Height != 0 {
+		return nil, rich.Errorf("invalid genesis height").Uint64("height", genesis.Height)
+	}
+
+	validate, _ := finalize.(Validator)
+	genesisID := genesis.ID()
+	g := Graph{
+		finalize:  finalize,
+		validate:  validate,
+		vertices:  map[base.Hash]*base.Vertex{genesisID: genesis},
+		heights:   make(map[uint64][]base.Hash),
+		confirmed: make(map[base.Hash]struct{}),
+		history:   []*base.Vertex{genesis},
+		tip:       genesis,
+	}
+
+	return &g, nil
+}
+
+// Extend adds a candidate vertex on top of a vertex we already know, if the
+// validator accepts it. Adding the same vertex again has no effect.
+func (g *Graph) Extend(vertex *base.Vertex) error {
+
+	g.Lock()
+	defer g.Unlock()
+
+	vertexID := vertex.ID()
+	_, ok := g.vertices[vertexID]
+	if ok {
+		return nil
+	}
+	final := g.history[len(g.history)-1]
+	if vertex.Height <= final.Height {
+		return rich.Errorf("vertex not above final").Uint64("height", vertex.Height).Uint64("final", final.Height)
+	}
+	parent, ok := g.vertices[vertex.ParentID]
+	if !ok {
+		return rich.Errorf("unknown parent").Hex("parent", vertex.ParentID[:])
+	}
+	if vertex.Height != parent.Height+1 {
+		return rich.Errorf("invalid vertex height").Uint64("height", vertex.Height).Uint64("parent_height", parent.Height)
+	}
+	if g.validate != nil {
+		err := g.validate.Validate(vertex)
+		if err != nil {
+			return rich.Errorf("could not validate vertex: %w", err).Uint64("height", vertex.Height)
+		}
+	}
+
+	g.vertices[vertexID] = vertex
+	g.heights[vertex.Height] = append(g.heights[vertex.Height], vertexID)
+	if vertex.Height > g.tip.Height {
+		g.tip = vertex
+	}
+
+	return nil
+}
+
+// Confirm marks the vertex as having a quorum, which finalizes it along with
+// all of its ancestors that were not final yet. If the finalizer fails for one
+// of them, that vertex and its descendants stay candidates, so that confirming
+// the vertex again retries from there.
+func (g *Graph) Confirm(vertexID base.Hash) error {
+
+	g.Lock()
+	defer g.Unlock()
+
+	vertex, ok := g.vertices[vertexID]
+	if !ok {
+		return rich.Errorf("unknown vertex").Hex("vertex", vertexID[:])
+	}
+
+	// 1) a vertex that is already final only needs to be marked confirmed;
+	// all competing vertices at final heights were pruned, so it can't
+	// conflict with the finalized one
+	final := g.history[len(g.history)-1]
+	if vertex.Height <= final.Height {
+		g.confirmed[vertexID] = struct{}{}
+		return nil
+	}
+
+	// 2) collect the vertices between the final vertex and this one
+	var chain []*base.Vertex
+	current := vertex
+	for current.Height > final.Height {
+		chain = append(chain, current)
+		current, ok = g.vertices[current.ParentID]
+		if !ok {
+			return rich.Errorf("vertex does not descend from final").Hex("vertex", vertexID[:]).Uint64("final", final.Height)
+		}
+	}
+	if current != final {
+		return rich.Errorf("vertex does not descend from final").Hex("vertex", vertexID[:]).Uint64("final", final.Height)
+	}
+
+	// 3) finalize them from the lowest up, dropping the competing candidates
+	// at each height as we go
+	for index := len(chain) - 1; index >= 0; index-- {
+		current = chain[index]
+		if g.finalize != nil {
+			err := g.finalize.Finalize(current)
+			if err != nil {
+				return rich.Errorf("could not finalize vertex: %w", err).Uint64("height", current.Height)
+			}
+		}
+		g.history = append(g.history, current)
+		g.confirmed[current.ID()] = struct{}{}
+		g.prune(current)
+	}
+
+	return nil
+}
+
+// Contains checks whether the vertex was confirmed.
+func (g *Graph) Contains(vertexID base.Hash) (bool, error) {
+
+	g.RLock()
+	defer g.RUnlock()
+
+	_, ok := g.confirmed[vertexID]
+
+	return ok, nil
+}
+
+// Tip returns the highest vertex that extends the graph, which is the first
+// candidate we got at the highest height if it is above the final vertex.
+func (g *Graph) Tip() (*base.Vertex, error) {
+
+	g.RLock()
+	defer g.RUnlock()
+
+	return g.tip, nil
+}
+
+// Final returns the highest finalized vertex.
+func (g *Graph) Final() (*base.Vertex, error) {
+
+	g.RLock()
+	defer g.RUnlock()
+
+	return g.history[len(g.history)-1], nil
+}
+
+// Finalized returns the finalized vertex at the given height. As vertices
+// always extend the height of their parent by one, there is one at every
+// height up to the final vertex.
+func (g *Graph) Finalized(height uint64) (*base.Vertex, error) {
+
+	g.RLock()
+	defer g.RUnlock()
+
+	if height >= uint64(len(g.history)) {
+		return nil, rich.Errorf("height not finalized").Uint64("height", height).Uint64("final", uint64(len(g.history)-1))
+	}
+
+	return g.history[height], nil
+}
+
+// prune forgets the candidates competing with the finalized vertex at its
+// height, along with the index of that height, and moves the tip to the
+// finalized vertex if it was one of them. It has to be called with the lock
+// held.
+func (g *Graph) prune(vertex *base.Vertex) {
+	vertexID := vertex.ID()
+	for _, candidateID := range g.heights[vertex.Height] {
+		if candidateID != vertexID {
+			delete(g.vertices, candidateID)
+		}
+	}
+	delete(g.heights, vertex.Height)
+	if g.tip.Height == vertex.Height {
+		g.tip = vertex
+	}
+}
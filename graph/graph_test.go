@@ -0,0 +1,195 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package graph
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+)
+
+var _ consensus.Graph = (*Graph)(nil)
+
+// recorder remembers the vertices it finalized, and fails at the given height
+// as long as fail is set.
+type recorder struct {
+	vertices []*base.Vertex
+	fail     uint64
+}
+
+func (r *recorder) Finalize(vertex *base.Vertex) error {
+	if vertex.Height == r.fail {
+		return errors.New("finalizer failure")
+	}
+	r.vertices = append(r.vertices, vertex)
+	return nil
+}
+
+func TestGraph(t *testing.T) {
+
+	genesis := fixture.Genesis(t)
+	final := &recorder{}
+	g, err := New(genesis, final)
+	require.NoError(t, err, "should create graph")
+
+	// the genesis vertex is final and the tip, but not confirmed yet
+	vertex, err := g.Final()
+	require.NoError(t, err, "should get final")
+	assert.Equal(t, genesis, vertex, "should have genesis as final")
+	vertex, err = g.Tip()
+	require.NoError(t, err, "should get tip")
+	assert.Equal(t, genesis, vertex, "should have genesis as tip")
+	contains, err := g.Contains(genesis.ID())
+	require.NoError(t, err, "should check genesis")
+	assert.False(t, contains, "should not contain unconfirmed genesis")
+	require.NoError(t, g.Confirm(genesis.ID()), "should confirm genesis")
+	contains, err = g.Contains(genesis.ID())
+	require.NoError(t, err, "should check genesis")
+	assert.True(t, contains, "should contain confirmed genesis")
+	assert.Empty(t, final.vertices, "should not finalize genesis again")
+
+	// two competing candidates extend the genesis, and the first one is tip
+	first := fixture.Vertex(t, fixture.WithParent(genesis))
+	second := fixture.Vertex(t, fixture.WithParent(genesis))
+	require.NoError(t, g.Extend(first), "should extend first candidate")
+	require.NoError(t, g.Extend(second), "should extend second candidate")
+	require.NoError(t, g.Extend(first), "should accept same candidate twice")
+	vertex, err = g.Tip()
+	require.NoError(t, err, "should get tip")
+	assert.Equal(t, first, vertex, "should have first candidate as tip")
+	contains, err = g.Contains(first.ID())
+	require.NoError(t, err, "should check candidate")
+	assert.False(t, contains, "should not contain unconfirmed candidate")
+
+	// confirming a grandchild of the second candidate finalizes the whole
+	// chain in order, and drops the first candidate
+	child := fixture.Vertex(t, fixture.WithParent(second))
+	grandchild := fixture.Vertex(t, fixture.WithParent(child))
+	require.NoError(t, g.Extend(child), "should extend child")
+	require.NoError(t, g.Extend(grandchild), "should extend grandchild")
+	require.NoError(t, g.Confirm(grandchild.ID()), "should confirm grandchild")
+	assert.Equal(t, []*base.Vertex{second, child, grandchild}, final.vertices, "should finalize chain in order")
+	for height, expected := range []*base.Vertex{genesis, second, child, grandchild} {
+		vertex, err := g.Finalized(uint64(height))
+		require.NoError(t, err, "should get finalized vertex")
+		assert.Equal(t, expected, vertex, "should have finalized vertex at height %d", height)
+		contains, err := g.Contains(expected.ID())
+		require.NoError(t, err, "should check finalized vertex")
+		assert.True(t, contains, "should contain finalized vertex at height %d", height)
+	}
+	_, err = g.Finalized(4)
+	assert.Error(t, err, "should not have finalized vertex above final")
+	vertex, err = g.Tip()
+	require.NoError(t, err, "should get tip")
+	assert.Equal(t, grandchild, vertex, "should move tip to final vertex")
+	assert.Error(t, g.Confirm(first.ID()), "should not confirm dropped candidate")
+	assert.NoError(t, g.Confirm(child.ID()), "should confirm final vertex again")
+	assert.Len(t, final.vertices, 3, "should not finalize vertex twice")
+}
+
+func TestGraphExtend(t *testing.T) {
+
+	genesis := fixture.Genesis(t)
+	g, err := New(genesis, nil)
+	require.NoError(t, err, "should create graph")
+	parent := fixture.Vertex(t, fixture.WithParent(genesis))
+	require.NoError(t, g.Extend(parent), "should extend genesis")
+
+	// candidates have to extend a known vertex by exactly one height
+	assert.Error(t, g.Extend(fixture.Vertex(t, fixture.WithHeight(2))), "should not extend unknown parent")
+	skipped := fixture.Vertex(t, fixture.WithParent(parent))
+	skipped.Height++
+	assert.Error(t, g.Extend(skipped), "should not skip heights")
+
+	// nothing can be added at or below the final vertex
+	require.NoError(t, g.Confirm(parent.ID()), "should confirm parent")
+	assert.Error(t, g.Extend(fixture.Vertex(t, fixture.WithParent(genesis))), "should not extend below final")
+
+	// the genesis has to be at height zero
+	_, err = New(fixture.Vertex(t, fixture.WithHeight(1)), nil)
+	assert.Error(t, err, "should not accept genesis above zero")
+}
+
+func TestGraphFinalizer(t *testing.T) {
+
+	genesis := fixture.Genesis(t)
+	final := &recorder{fail: 2}
+	g, err := New(genesis, final)
+	require.NoError(t, err, "should create graph")
+	vertices := []*base.Vertex{genesis}
+	for height := 1; height <= 3; height++ {
+		vertex := fixture.Vertex(t, fixture.WithParent(vertices[height-1]))
+		require.NoError(t, g.Extend(vertex), "should extend vertex")
+		vertices = append(vertices, vertex)
+	}
+
+	// a failing finalizer stops finalization at the height it fails
+	assert.Error(t, g.Confirm(vertices[3].ID()), "should not confirm with failing finalizer")
+	vertex, err := g.Final()
+	require.NoError(t, err, "should get final")
+	assert.Equal(t, vertices[1], vertex, "should finalize up to failing height")
+	contains, err := g.Contains(vertices[3].ID())
+	require.NoError(t, err, "should check vertex")
+	assert.False(t, contains, "should not contain vertex above failure")
+
+	// confirming again retries from the height that failed
+	final.fail = 0
+	require.NoError(t, g.Confirm(vertices[3].ID()), "should confirm once finalizer works")
+	assert.Equal(t, vertices[1:], final.vertices, "should finalize every vertex once")
+}
+
+// validator is a finalizer that also refuses to extend the graph with vertices
+// for the given arc.
+type validator struct {
+	recorder
+	refused base.Hash
+}
+
+func (v *validator) Validate(vertex *base.Vertex) error {
+	if vertex.ArcID == v.refused {
+		return errors.New("invalid arc")
+	}
+	return nil
+}
+
+func TestGraphValidator(t *testing.T) {
+
+	genesis := fixture.Genesis(t)
+	final := &validator{refused: fixture.Hash(t)}
+	g, err := New(genesis, final)
+	require.NoError(t, err, "should create graph")
+
+	// a vertex the validator refuses should not extend the graph
+	refused := fixture.Vertex(t, fixture.WithParent(genesis))
+	refused.ArcID = final.refused
+	assert.Error(t, g.Extend(refused), "should not extend refused vertex")
+	vertex, err := g.Tip()
+	require.NoError(t, err, "should get tip")
+	assert.Equal(t, genesis, vertex, "should not move tip to refused vertex")
+	assert.Error(t, g.Confirm(refused.ID()), "should not know refused vertex")
+
+	// others should extend it as usual
+	accepted := fixture.Vertex(t, fixture.WithParent(genesis))
+	require.NoError(t, g.Extend(accepted), "should extend accepted vertex")
+	require.NoError(t, g.Confirm(accepted.ID()), "should confirm accepted vertex")
+	assert.Equal(t, []*base.Vertex{accepted}, final.vertices, "should finalize accepted vertex")
+}
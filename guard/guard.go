@@ -0,0 +1,160 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package guard protects the local validator against signing conflicting
+// messages. It wraps a signer and keeps a persistent high-water mark of the
+// heights and vertices it signed, so that neither a restart nor a bug in the
+// engine can make us sign two different vertices at the same height, which
+// would be punished as a double vote or double proposal.
+package guard
+
+import (
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// Guard is a signer that refuses to sign conflicting messages. It only signs
+// a vertex above its high-water mark, or the exact vertex at its high-water
+// mark again. Signing below the mark is refused, as we no longer know what we
+// signed at those heights.
+type Guard struct {
+	sync.Mutex
+	sign   consensus.Signer
+	store  Store
+	record *Record
+}
+
+// New creates a guard around the given signer, loading the high-water mark
+// record from the given store.
+func New(sign consensus.Signer, store Store) (*Guard, error) {
+
+	record, err := store.Load()
+	if err != nil {
+		return nil, rich.Errorf("could not load record: %w", err)
+	}
+
+	g := Guard{
+		sign:   sign,
+		store:  store,
+		record: record,
+	}
+
+	return &g, nil
+}
+
+// Self returns the identity of the wrapped signer.
+func (g *Guard) Self() (base.Hash, error) {
+	return g.sign.Self()
+}
+
+// Proposal signs a proposal for the vertex, unless we have already proposed
+// or voted for a different vertex at the same or a higher height.
+func (g *Guard) Proposal(vertex *base.Vertex) (*message.Proposal, error) {
+
+	g.Lock()
+	defer g.Unlock()
+
+	// 1) check both marks, as the proposal includes our vote
+	err := check("proposal", g.record.Proposal, vertex)
+	if err != nil {
+		return nil, err
+	}
+	err = check("proposal", g.record.Vote, vertex)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2) persist the new marks before signing anything
+	mark := Mark{Height: vertex.Height, CandidateID: vertex.ID()}
+	record := Record{Proposal: mark, Vote: mark}
+	err = g.save(&record)
+	if err != nil {
+		return nil, rich.Errorf("could not save record: %w", err)
+	}
+
+	// 3) sign the proposal
+	proposal, err := g.sign.Proposal(vertex)
+	if err != nil {
+		return nil, rich.Errorf("could not sign proposal: %w", err)
+	}
+
+	return proposal, nil
+}
+
+// Vote signs a vote for the vertex, unless we have already voted for a
+// different vertex at the same or a higher height.
+func (g *Guard) Vote(vertex *base.Vertex) (*message.Vote, error) {
+
+	g.Lock()
+	defer g.Unlock()
+
+	// 1) check the vote mark
+	err := check("vote", g.record.Vote, vertex)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2) persist the new mark before signing anything
+	record := Record{
+		Proposal: g.record.Proposal,
+		Vote:     Mark{Height: vertex.Height, CandidateID: vertex.ID()},
+	}
+	err = g.save(&record)
+	if err != nil {
+		return nil, rich.Errorf("could not save record: %w", err)
+	}
+
+	// 3) sign the vote
+	vote, err := g.sign.Vote(vertex)
+	if err != nil {
+		return nil, rich.Errorf("could not sign vote: %w", err)
+	}
+
+	return vote, nil
+}
+
+// save persists the record if it changed and makes it the current one.
+func (g *Guard) save(record *Record) error {
+	if *record == *g.record {
+		return nil
+	}
+	err := g.store.Save(record)
+	if err != nil {
+		return err
+	}
+	g.record = record
+	return nil
+}
+
+// check makes sure signing the vertex does not conflict with the mark.
+func check(entity string, mark Mark, vertex *base.Vertex) error {
+	if mark.CandidateID == base.ZeroHash {
+		return nil
+	}
+	if vertex.Height > mark.Height {
+		return nil
+	}
+	if vertex.Height == mark.Height && vertex.ID() == mark.CandidateID {
+		return nil
+	}
+	return signal.DoubleSign{Entity: entity, Vertex: vertex, Height: mark.Height, SignedID: mark.CandidateID}
+}
@@ -0,0 +1,128 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guard
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/crypto/edwards"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+func TestGuard(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "guard")
+	require.NoError(t, err, "should create temporary directory")
+	defer os.RemoveAll(dir)
+
+	_, priv, err := edwards.GenerateKey(rand.Reader)
+	require.NoError(t, err, "should generate key")
+	signer := edwards.NewSigner(message.Domain{ChainID: "test", Version: 1}, fixture.Hash(t), priv)
+	store := NewFileStore(filepath.Join(dir, "guard.json"))
+
+	g, err := New(signer, store)
+	require.NoError(t, err, "should create guard without record")
+
+	// we can vote on genesis without any record
+	genesis := fixture.Genesis(t)
+	_, err = g.Vote(genesis)
+	require.NoError(t, err, "should vote on genesis")
+
+	// a vote at a new height passes and can be repeated
+	vertex := fixture.Vertex(t, fixture.WithParent(genesis))
+	_, err = g.Vote(vertex)
+	require.NoError(t, err, "should vote at new height")
+	_, err = g.Vote(vertex)
+	require.NoError(t, err, "should vote again on same vertex")
+
+	// a vote for a different vertex at the same height is refused
+	conflict := fixture.Vertex(t, fixture.WithParent(genesis))
+	_, err = g.Vote(conflict)
+	require.Error(t, err, "should not vote on conflicting vertex")
+	assert.True(t, errors.As(err, &signal.DoubleSign{}), "should have double sign error")
+
+	// we can't propose a different vertex at the height we voted at
+	_, err = g.Proposal(conflict)
+	require.Error(t, err, "should not propose conflicting vertex")
+	assert.True(t, errors.As(err, &signal.DoubleSign{}), "should have double sign error")
+
+	// a proposal at the next height also moves the vote mark
+	next := fixture.Vertex(t, fixture.WithParent(vertex))
+	_, err = g.Proposal(next)
+	require.NoError(t, err, "should propose at next height")
+	_, err = g.Proposal(next)
+	require.NoError(t, err, "should propose same vertex again")
+	_, err = g.Vote(next)
+	require.NoError(t, err, "should vote on own proposal")
+	_, err = g.Vote(fixture.Vertex(t, fixture.WithParent(vertex)))
+	require.Error(t, err, "should not vote against own proposal")
+
+	// signing below the high-water mark is always refused
+	_, err = g.Vote(genesis)
+	require.Error(t, err, "should not vote below high-water mark")
+
+	// after a restart, the record is restored from disk
+	g, err = New(signer, store)
+	require.NoError(t, err, "should create guard with record")
+	_, err = g.Proposal(next)
+	require.NoError(t, err, "should propose same vertex after restart")
+	_, err = g.Proposal(fixture.Vertex(t, fixture.WithParent(vertex)))
+	require.Error(t, err, "should not propose conflicting vertex after restart")
+	assert.True(t, errors.As(err, &signal.DoubleSign{}), "should have double sign error")
+}
+
+func TestFileStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "guard")
+	require.NoError(t, err, "should create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "guard.json")
+	store := NewFileStore(path)
+
+	// loading without file should give an empty record
+	record, err := store.Load()
+	require.NoError(t, err, "should load without file")
+	assert.Equal(t, &Record{}, record, "should have empty record")
+
+	// what we save is what we load
+	saved := Record{
+		Proposal: Mark{Height: 7, CandidateID: fixture.Hash(t)},
+		Vote:     Mark{Height: 8, CandidateID: fixture.Hash(t)},
+	}
+	err = store.Save(&saved)
+	require.NoError(t, err, "should save record")
+	record, err = store.Load()
+	require.NoError(t, err, "should load record")
+	assert.Equal(t, &saved, record, "should load saved record")
+
+	// a corrupted record should never be treated as empty
+	err = ioutil.WriteFile(path, []byte(`{"vote":{"height":1,"candidate_id":"zz"}}`), 0600)
+	require.NoError(t, err, "should write corrupted record")
+	_, err = store.Load()
+	assert.Error(t, err, "should not load corrupted record")
+}
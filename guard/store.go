@@ -0,0 +1,181 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guard
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// Mark is the highest height at which we signed a message of a given type,
+// along with the vertex we signed at that height.
+type Mark struct {
+	Height      uint64
+	CandidateID base.Hash
+}
+
+// Record is the high-water mark record of our signer. As a proposal always
+// includes the vote of the proposer, proposing a vertex also moves the vote
+// mark.
+type Record struct {
+	Proposal Mark
+	Vote     Mark
+}
+
+// Store persists the high-water mark record of a signer. Save has to make sure
+// the record is durable before returning, as we sign right after.
+type Store interface {
+	Load() (*Record, error)
+	Save(record *Record) error
+}
+
+// FileStore stores the high-water mark record as JSON in a single file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates a store that keeps the record in the file at the given
+// path. If the file doesn't exist yet, we start with an empty record.
+func NewFileStore(path string) *FileStore {
+	fs := FileStore{
+		path: path,
+	}
+	return &fs
+}
+
+// mark is the JSON representation of a mark.
+type mark struct {
+	Height      uint64 `json:"height"`
+	CandidateID string `json:"candidate_id"`
+}
+
+// record is the JSON representation of a record.
+type record struct {
+	Proposal mark `json:"proposal"`
+	Vote     mark `json:"vote"`
+}
+
+// Load reads the record from the file, or returns an empty record if the file
+// does not exist.
+func (fs *FileStore) Load() (*Record, error) {
+
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return &Record{}, nil
+	}
+	if err != nil {
+		return nil, rich.Errorf("could not read record file: %w", err).Str("path", fs.path)
+	}
+
+	var r record
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, rich.Errorf("could not decode record: %w", err).Str("path", fs.path)
+	}
+
+	var rec Record
+	rec.Proposal, err = decodeMark(r.Proposal)
+	if err != nil {
+		return nil, rich.Errorf("invalid proposal mark: %w", err)
+	}
+	rec.Vote, err = decodeMark(r.Vote)
+	if err != nil {
+		return nil, rich.Errorf("invalid vote mark: %w", err)
+	}
+
+	return &rec, nil
+}
+
+// Save writes the record to a temporary file and atomically replaces the
+// record file with it, so that a crash never leaves a partial record.
+func (fs *FileStore) Save(rec *Record) error {
+
+	r := record{
+		Proposal: encodeMark(rec.Proposal),
+		Vote:     encodeMark(rec.Vote),
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return rich.Errorf("could not encode record: %w", err)
+	}
+
+	dir := filepath.Dir(fs.path)
+	temp, err := ioutil.TempFile(dir, ".guard-")
+	if err != nil {
+		return rich.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err != nil {
+		temp.Close()
+		return rich.Errorf("could not write record file: %w", err)
+	}
+	err = temp.Sync()
+	if err != nil {
+		temp.Close()
+		return rich.Errorf("could not sync record file: %w", err)
+	}
+	err = temp.Close()
+	if err != nil {
+		return rich.Errorf("could not close record file: %w", err)
+	}
+	err = os.Rename(temp.Name(), fs.path)
+	if err != nil {
+		return rich.Errorf("could not move record file: %w", err)
+	}
+
+	// sync the directory so the rename itself survives a crash
+	d, err := os.Open(dir)
+	if err != nil {
+		return rich.Errorf("could not open record directory: %w", err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return rich.Errorf("could not sync record directory: %w", err)
+	}
+
+	return nil
+}
+
+func encodeMark(m Mark) mark {
+	return mark{
+		Height:      m.Height,
+		CandidateID: hex.EncodeToString(m.CandidateID[:]),
+	}
+}
+
+func decodeMark(m mark) (Mark, error) {
+	id, err := hex.DecodeString(m.CandidateID)
+	if err != nil {
+		return Mark{}, rich.Errorf("invalid candidate: %w", err)
+	}
+	if len(id) != len(base.Hash{}) {
+		return Mark{}, rich.Errorf("invalid candidate length").Int("length", len(id))
+	}
+	var dec Mark
+	dec.Height = m.Height
+	copy(dec.CandidateID[:], id)
+	return dec, nil
+}
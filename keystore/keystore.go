@@ -0,0 +1,362 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package keystore stores the private keys of validators on disk, encrypted
+// with a key derived from a passphrase. Each key file contains the identity of
+// the validator, the type and public key of the key in plaintext, so they can
+// be inspected without the passphrase, and the private key encrypted with
+// XChaCha20-Poly1305 under a key derived with scrypt. The plaintext fields are
+// authenticated as additional data, so they can't be swapped between files.
+package keystore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/crypto/bls"
+	"github.com/awfm/consensus/crypto/edwards"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Version is the version of the key file format.
+const Version = 1
+
+// Type is the signature scheme a key is used with.
+type Type string
+
+// The supported key types.
+const (
+	TypeBLS     Type = "bls"
+	TypeEd25519 Type = "ed25519"
+)
+
+// Params are the parameters of the scrypt key derivation.
+type Params struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// DefaultParams are the recommended scrypt parameters for interactive use,
+// which take about one second and 256 MiB of memory to derive a key.
+var DefaultParams = Params{N: 1 << 18, R: 8, P: 1}
+
+// MaxParams are the highest scrypt parameters we accept, so that a crafted key
+// file can't make us spend more than a few times the time and memory of the
+// default parameters on deriving its key.
+var MaxParams = Params{N: 1 << 20, R: 8, P: 4}
+
+// Key is a decrypted private key of a validator. The private key is the
+// encoding of a BLS private key or the seed of an Ed25519 private key.
+type Key struct {
+	ID      base.Hash
+	Type    Type
+	Public  []byte
+	Private []byte
+}
+
+// file is the JSON representation of a key file.
+type file struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	Type    Type   `json:"type"`
+	Public  string `json:"public"`
+	Crypto  struct {
+		KDF        string `json:"kdf"`
+		Params     Params `json:"kdfparams"`
+		Salt       string `json:"salt"`
+		Cipher     string `json:"cipher"`
+		Nonce      string `json:"nonce"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"crypto"`
+}
+
+// GenerateKey creates a new random key of the given type for the validator
+// with the given identity.
+func GenerateKey(id base.Hash, typ Type) (*Key, error) {
+	switch typ {
+	case TypeBLS:
+		sk, err := bls.GenerateKey(nil)
+		if err != nil {
+			return nil, rich.Errorf("could not generate BLS key: %w", err)
+		}
+		return &Key{ID: id, Type: typ, Public: sk.Public().Bytes(), Private: sk.Bytes()}, nil
+	case TypeEd25519:
+		pub, priv, err := edwards.GenerateKey(nil)
+		if err != nil {
+			return nil, rich.Errorf("could not generate Ed25519 key: %w", err)
+		}
+		return &Key{ID: id, Type: typ, Public: pub, Private: priv.Seed()}, nil
+	default:
+		return nil, rich.Errorf("unknown key type").Str("type", string(typ))
+	}
+}
+
+// Encrypt encodes the key as key file, with the private key encrypted under the
+// given passphrase.
+func Encrypt(key *Key, passphrase []byte, params Params) ([]byte, error) {
+
+	// make sure the private key matches the public key before storing it
+	err := check(key)
+	if err != nil {
+		return nil, rich.Errorf("invalid key: %w", err)
+	}
+
+	// fill in the plaintext fields, which are authenticated as well
+	var f file
+	f.Version = Version
+	f.ID = hex.EncodeToString(key.ID[:])
+	f.Type = key.Type
+	f.Public = hex.EncodeToString(key.Public)
+
+	// derive the encryption key from the passphrase with a random salt
+	salt := make([]byte, 32)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, rich.Errorf("could not read salt: %w", err)
+	}
+	aead, err := derive(passphrase, salt, params)
+	if err != nil {
+		return nil, rich.Errorf("could not derive key: %w", err)
+	}
+
+	// encrypt the private key with a random nonce
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, rich.Errorf("could not read nonce: %w", err)
+	}
+	ciphertext := aead.Seal(nil, nonce, key.Private, additional(&f))
+
+	f.Crypto.KDF = "scrypt"
+	f.Crypto.Params = params
+	f.Crypto.Salt = hex.EncodeToString(salt)
+	f.Crypto.Cipher = "xchacha20-poly1305"
+	f.Crypto.Nonce = hex.EncodeToString(nonce)
+	f.Crypto.Ciphertext = hex.EncodeToString(ciphertext)
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, rich.Errorf("could not encode key file: %w", err)
+	}
+
+	return data, nil
+}
+
+// Decrypt decodes the key file and decrypts the private key with the given
+// passphrase.
+func Decrypt(data []byte, passphrase []byte) (*Key, error) {
+
+	// decode the key file and check the algorithms
+	var f file
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, rich.Errorf("could not decode key file: %w", err)
+	}
+	if f.Version != Version {
+		return nil, rich.Errorf("unsupported key file version").Int("version", f.Version)
+	}
+	if f.Crypto.KDF != "scrypt" || f.Crypto.Cipher != "xchacha20-poly1305" {
+		return nil, rich.Errorf("unsupported key file crypto").Str("kdf", f.Crypto.KDF).Str("cipher", f.Crypto.Cipher)
+	}
+
+	// decode the plaintext fields
+	var key Key
+	id, err := hex.DecodeString(f.ID)
+	if err != nil || len(id) != len(key.ID) {
+		return nil, rich.Errorf("invalid key identity").Str("id", f.ID)
+	}
+	copy(key.ID[:], id)
+	key.Type = f.Type
+	key.Public, err = hex.DecodeString(f.Public)
+	if err != nil {
+		return nil, rich.Errorf("invalid public key: %w", err)
+	}
+
+	// derive the encryption key and decrypt the private key
+	salt, err := hex.DecodeString(f.Crypto.Salt)
+	if err != nil {
+		return nil, rich.Errorf("invalid salt: %w", err)
+	}
+	nonce, err := hex.DecodeString(f.Crypto.Nonce)
+	if err != nil {
+		return nil, rich.Errorf("invalid nonce: %w", err)
+	}
+	ciphertext, err := hex.DecodeString(f.Crypto.Ciphertext)
+	if err != nil {
+		return nil, rich.Errorf("invalid ciphertext: %w", err)
+	}
+	aead, err := derive(passphrase, salt, f.Crypto.Params)
+	if err != nil {
+		return nil, rich.Errorf("could not derive key: %w", err)
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, rich.Errorf("invalid nonce size").Int("size", len(nonce))
+	}
+	key.Private, err = aead.Open(nil, nonce, ciphertext, additional(&f))
+	if err != nil {
+		return nil, rich.Errorf("could not decrypt private key (wrong passphrase?): %w", err)
+	}
+
+	// make sure the decrypted key is consistent
+	err = check(&key)
+	if err != nil {
+		return nil, rich.Errorf("invalid key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// Store encrypts the key and writes it to the file at the given path, which
+// is only readable by the current user. The file is replaced atomically.
+func Store(path string, key *Key, passphrase []byte, params Params) error {
+
+	data, err := Encrypt(key, passphrase, params)
+	if err != nil {
+		return rich.Errorf("could not encrypt key: %w", err)
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".keystore-")
+	if err != nil {
+		return rich.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err != nil {
+		temp.Close()
+		return rich.Errorf("could not write key file: %w", err)
+	}
+	err = temp.Sync()
+	if err != nil {
+		temp.Close()
+		return rich.Errorf("could not sync key file: %w", err)
+	}
+	err = temp.Close()
+	if err != nil {
+		return rich.Errorf("could not close key file: %w", err)
+	}
+	err = os.Rename(temp.Name(), path)
+	if err != nil {
+		return rich.Errorf("could not move key file: %w", err)
+	}
+
+	return nil
+}
+
+// Load reads the key file at the given path and decrypts it with the given
+// passphrase.
+func Load(path string, passphrase []byte) (*Key, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, rich.Errorf("could not read key file: %w", err).Str("path", path)
+	}
+
+	key, err := Decrypt(data, passphrase)
+	if err != nil {
+		return nil, rich.Errorf("could not decrypt key file: %w", err).Str("path", path)
+	}
+
+	return key, nil
+}
+
+// NewSigner loads the key file at the given path and creates a signer for the
+// validator identity stored with the key, using the given signing domain.
+func NewSigner(path string, passphrase []byte, domain message.Domain) (consensus.Signer, error) {
+
+	key, err := Load(path, passphrase)
+	if err != nil {
+		return nil, rich.Errorf("could not load key: %w", err)
+	}
+
+	switch key.Type {
+	case TypeBLS:
+		sk, err := bls.PrivateKeyFromBytes(key.Private)
+		if err != nil {
+			return nil, rich.Errorf("could not decode BLS key: %w", err)
+		}
+		return bls.NewSigner(domain, key.ID, sk), nil
+	case TypeEd25519:
+		priv := ed25519.NewKeyFromSeed(key.Private)
+		return edwards.NewSigner(domain, key.ID, priv), nil
+	default:
+		return nil, rich.Errorf("unknown key type").Str("type", string(key.Type))
+	}
+}
+
+// derive derives the encryption key from the passphrase and creates the cipher.
+func derive(passphrase []byte, salt []byte, params Params) (cipher.AEAD, error) {
+	if params.N > MaxParams.N || params.R > MaxParams.R || params.P > MaxParams.P {
+		return nil, rich.Errorf("scrypt parameters too high").Int("n", params.N).Int("r", params.R).Int("p", params.P)
+	}
+	secret, err := scrypt.Key(passphrase, salt, params.N, params.R, params.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, rich.Errorf("could not run scrypt: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(secret)
+	if err != nil {
+		return nil, rich.Errorf("could not create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// additional returns the plaintext fields of the key file that are
+// authenticated along with the encrypted private key.
+func additional(f *file) []byte {
+	return []byte(f.ID + "|" + string(f.Type) + "|" + f.Public)
+}
+
+// check makes sure the private key of a key matches its public key.
+func check(key *Key) error {
+	switch key.Type {
+	case TypeBLS:
+		sk, err := bls.PrivateKeyFromBytes(key.Private)
+		if err != nil {
+			return rich.Errorf("could not decode BLS key: %w", err)
+		}
+		pk, err := bls.PublicKeyFromBytes(key.Public)
+		if err != nil {
+			return rich.Errorf("could not decode BLS public key: %w", err)
+		}
+		if !sk.Public().Equal(pk) {
+			return rich.Errorf("mismatching BLS public key")
+		}
+	case TypeEd25519:
+		if len(key.Private) != ed25519.SeedSize {
+			return rich.Errorf("invalid Ed25519 seed size").Int("size", len(key.Private))
+		}
+		pub := ed25519.NewKeyFromSeed(key.Private).Public().(ed25519.PublicKey)
+		if !bytes.Equal(pub, key.Public) {
+			return rich.Errorf("mismatching Ed25519 public key")
+		}
+	default:
+		return rich.Errorf("unknown key type").Str("type", string(key.Type))
+	}
+	return nil
+}
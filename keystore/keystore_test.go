@@ -0,0 +1,109 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keystore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+)
+
+// testParams are cheap scrypt parameters to keep the tests fast.
+var testParams = Params{N: 1 << 10, R: 8, P: 1}
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, typ := range []Type{TypeBLS, TypeEd25519} {
+		t.Run(string(typ), func(t *testing.T) {
+
+			key, err := GenerateKey(fixture.Hash(t), typ)
+			require.NoError(t, err, "should generate key")
+
+			data, err := Encrypt(key, []byte("passphrase"), testParams)
+			require.NoError(t, err, "should encrypt key")
+			assert.False(t, bytes.Contains(data, key.Private), "should not contain plain private key")
+
+			decrypted, err := Decrypt(data, []byte("passphrase"))
+			require.NoError(t, err, "should decrypt key")
+			assert.Equal(t, key, decrypted, "should decrypt same key")
+
+			_, err = Decrypt(data, []byte("wrong"))
+			assert.Error(t, err, "should not decrypt with wrong passphrase")
+
+			// swapping the identity should break the authentication
+			other := fixture.Hash(t)
+			tampered := bytes.Replace(data, []byte(hex.EncodeToString(key.ID[:])), []byte(hex.EncodeToString(other[:])), 1)
+			_, err = Decrypt(tampered, []byte("passphrase"))
+			assert.Error(t, err, "should not decrypt with tampered identity")
+
+			// excessive scrypt parameters should be rejected before deriving
+			expensive := bytes.Replace(data, []byte(`"n": 1024`), []byte(`"n": 1073741824`), 1)
+			require.NotEqual(t, data, expensive, "should tamper with parameters")
+			_, err = Decrypt(expensive, []byte("passphrase"))
+			assert.Error(t, err, "should not decrypt with excessive parameters")
+			_, err = Encrypt(key, []byte("passphrase"), Params{N: 1 << 18, R: 8, P: 16})
+			assert.Error(t, err, "should not encrypt with excessive parameters")
+		})
+	}
+}
+
+func TestStoreLoadSigner(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keystore")
+	require.NoError(t, err, "should create temporary directory")
+	defer os.RemoveAll(dir)
+
+	for _, typ := range []Type{TypeBLS, TypeEd25519} {
+		t.Run(string(typ), func(t *testing.T) {
+
+			path := filepath.Join(dir, string(typ)+".json")
+			key, err := GenerateKey(fixture.Hash(t), typ)
+			require.NoError(t, err, "should generate key")
+			err = Store(path, key, []byte("passphrase"), testParams)
+			require.NoError(t, err, "should store key")
+
+			info, err := os.Stat(path)
+			require.NoError(t, err, "should stat key file")
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "should only be readable by owner")
+
+			loaded, err := Load(path, []byte("passphrase"))
+			require.NoError(t, err, "should load key")
+			assert.Equal(t, key, loaded, "should load same key")
+
+			// the signer should sign with the identity stored in the file
+			signer, err := NewSigner(path, []byte("passphrase"), message.Domain{ChainID: "test", Version: 1})
+			require.NoError(t, err, "should create signer")
+			selfID, err := signer.Self()
+			require.NoError(t, err, "should get self")
+			assert.Equal(t, key.ID, selfID, "should use stored identity")
+			vote, err := signer.Vote(fixture.Vertex(t))
+			require.NoError(t, err, "should create vote")
+			assert.NotEmpty(t, vote.Signature, "should sign vote")
+
+			_, err = NewSigner(path, []byte("wrong"), message.Domain{})
+			assert.Error(t, err, "should not create signer with wrong passphrase")
+		})
+	}
+}
@@ -21,8 +21,25 @@ import (
 )
 
 // Looper is used to loop back messages to ourselves, with priority, thus
-// pre-empting other messages that might be submitted next.
+// pre-empting other messages that might be submitted next. The processor only
+// passes messages to the looper after it has finished processing the current
+// message, so the looper may process them synchronously.
 type Looper interface {
 	Proposal(proposal *message.Proposal)
 	Vote(vote *message.Vote)
 }
+
+// direct loops messages back by processing them right away. It is used until
+// a looper is attached, and drops the errors of the looped messages, as there
+// is no one to report them to.
+type direct struct {
+	pro *Processor
+}
+
+func (d direct) Proposal(proposal *message.Proposal) {
+	_ = d.pro.OnProposal(proposal)
+}
+
+func (d direct) Vote(vote *message.Vote) {
+	_ = d.pro.OnVote(vote)
+}
@@ -85,6 +85,29 @@ func (_m *Graph) Final() (*base.Vertex, error) {
 	return r0, r1
 }
 
+// Finalized provides a mock function with given fields: height
+func (_m *Graph) Finalized(height uint64) (*base.Vertex, error) {
+	ret := _m.Called(height)
+
+	var r0 *base.Vertex
+	if rf, ok := ret.Get(0).(func(uint64) *base.Vertex); ok {
+		r0 = rf(height)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*base.Vertex)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(uint64) error); ok {
+		r1 = rf(height)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Tip provides a mock function with given fields:
 func (_m *Graph) Tip() (*base.Vertex, error) {
 	ret := _m.Called()
@@ -13,16 +13,16 @@ type Strategy struct {
 	mock.Mock
 }
 
-// Collector provides a mock function with given fields: height
-func (_m *Strategy) Collector(height uint64) (base.Hash, error) {
+// Collectors provides a mock function with given fields: height
+func (_m *Strategy) Collectors(height uint64) ([]base.Hash, error) {
 	ret := _m.Called(height)
 
-	var r0 base.Hash
-	if rf, ok := ret.Get(0).(func(uint64) base.Hash); ok {
+	var r0 []base.Hash
+	if rf, ok := ret.Get(0).(func(uint64) []base.Hash); ok {
 		r0 = rf(height)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(base.Hash)
+			r0 = ret.Get(0).([]base.Hash)
 		}
 	}
 
@@ -0,0 +1,5 @@
+package base
+
+// PublicKey is an opaque byte slice that contains the encoding of a public key
+// for the signature scheme in use.
+type PublicKey []byte
@@ -9,9 +9,10 @@ import (
 
 func Proposal(t testing.TB, options ...func(*message.Proposal)) *message.Proposal {
 	proposal := message.Proposal{
-		Candidate: Vertex(t),
-		Quorum:    Quorum(t),
-		Signature: Sig(t),
+		Candidate:     Vertex(t),
+		Quorum:        Quorum(t),
+		Signature:     Sig(t),
+		VoteSignature: Sig(t),
 	}
 	for _, option := range options {
 		option(&proposal)
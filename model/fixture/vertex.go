@@ -33,3 +33,9 @@ func WithProposer(proposerID base.Hash) func(*base.Vertex) {
 		vertex.ProposerID = proposerID
 	}
 }
+
+func WithHeight(height uint64) func(*base.Vertex) {
+	return func(vertex *base.Vertex) {
+		vertex.Height = height
+	}
+}
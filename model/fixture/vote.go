@@ -15,6 +15,9 @@ func Vote(t testing.TB, options ...func(*message.Vote)) *message.Vote {
 		SignerID:    Hash(t),
 		Signature:   Sig(t),
 	}
+	for _, option := range options {
+		option(&vote)
+	}
 	return &vote
 }
 
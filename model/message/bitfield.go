@@ -0,0 +1,130 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// Bitfield marks a subset of a committee, with bit i (counting from the least
+// significant bit of the first byte) set if the participant at index i of the
+// committee ordering is part of the subset.
+type Bitfield []byte
+
+// NewBitfield creates an empty bitfield for a committee of the given size.
+func NewBitfield(size int) Bitfield {
+	return make(Bitfield, (size+7)/8)
+}
+
+// Set marks the participant at the given index.
+func (b Bitfield) Set(index int) {
+	b[index/8] |= 1 << uint(index%8)
+}
+
+// Has checks whether the participant at the given index is marked.
+func (b Bitfield) Has(index int) bool {
+	return b[index/8]&(1<<uint(index%8)) != 0
+}
+
+// Count returns the number of marked participants.
+func (b Bitfield) Count() int {
+	count := 0
+	for _, v := range b {
+		count += bits.OnesCount8(v)
+	}
+	return count
+}
+
+// SortIDs returns a copy of the given participant IDs in ascending order, which
+// is the committee ordering used to index bitfields.
+func SortIDs(ids []base.Hash) []base.Hash {
+	sorted := make([]base.Hash, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i int, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	return sorted
+}
+
+// Size returns the number of signers of the quorum, in either representation.
+func (q *Quorum) Size() int {
+	if q.Signers != nil {
+		return q.Signers.Count()
+	}
+	return len(q.SignerIDs)
+}
+
+// Compact returns the quorum with its signers encoded as a bitfield over the
+// given committee ordering. As the ordering of signers can matter for the
+// quorum signature, the signers have to be unique and appear in committee
+// order, so that expanding the bitfield again restores the exact same list.
+func (q *Quorum) Compact(committee []base.Hash) (*Quorum, error) {
+
+	if q.Signers != nil {
+		return q, nil
+	}
+
+	indices := make(map[base.Hash]int, len(committee))
+	for index, participantID := range committee {
+		indices[participantID] = index
+	}
+
+	signers := NewBitfield(len(committee))
+	last := -1
+	for _, signerID := range q.SignerIDs {
+		index, ok := indices[signerID]
+		if !ok {
+			return nil, fmt.Errorf("signer not in committee (signer: %x)", signerID)
+		}
+		if index <= last {
+			return nil, fmt.Errorf("signer out of committee order (signer: %x)", signerID)
+		}
+		signers.Set(index)
+		last = index
+	}
+
+	compact := Quorum{
+		Signers:   signers,
+		Signature: q.Signature,
+	}
+
+	return &compact, nil
+}
+
+// Expand returns the quorum with its signers listed by ID, decoding the
+// bitfield over the given committee ordering. Bitfields that don't exactly
+// fit the committee are rejected, so that each quorum has a single encoding.
+func (q *Quorum) Expand(committee []base.Hash) (*Quorum, error) {
+
+	if q.Signers == nil {
+		return q, nil
+	}
+	if len(q.SignerIDs) != 0 {
+		return nil, fmt.Errorf("quorum with both signer representations")
+	}
+
+	size := len(committee)
+	if len(q.Signers) != (size+7)/8 {
+		return nil, fmt.Errorf("invalid bitfield length (length: %d, committee: %d)", len(q.Signers), size)
+	}
+	if size%8 != 0 && q.Signers[len(q.Signers)-1]>>uint(size%8) != 0 {
+		return nil, fmt.Errorf("bitfield marks signers beyond committee (committee: %d)", size)
+	}
+
+	signerIDs := make([]base.Hash, 0, q.Signers.Count())
+	for index, participantID := range committee {
+		if q.Signers.Has(index) {
+			signerIDs = append(signerIDs, participantID)
+		}
+	}
+
+	expanded := Quorum{
+		SignerIDs: signerIDs,
+		Signature: q.Signature,
+	}
+
+	return &expanded, nil
+}
@@ -0,0 +1,106 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+const (
+	// TagProposal is the domain tag for the signature of a proposal.
+	TagProposal = "CONSENSUS_PROPOSAL"
+
+	// TagVote is the domain tag for the signature of a vote.
+	TagVote = "CONSENSUS_VOTE"
+
+	// TagChange is the domain tag for the approval of a member change.
+	TagChange = "CONSENSUS_CHANGE"
+
+	// MaxChainID is the maximum length of a chain ID, which is well below what
+	// its length prefix can encode.
+	MaxChainID = 256
+)
+
+// Domain identifies the chain and the protocol version a signature is made
+// for. All signers and verifiers have to sign and verify the payloads built by
+// the domain, which are separated by message type, so that a signature can
+// never be replayed as a different message type, on a different chain or with
+// a different protocol version. It should be created with NewDomain, so that
+// its chain ID is checked.
+type Domain struct {
+	ChainID string
+	Version uint16
+}
+
+// NewDomain creates the domain for the given chain ID and protocol version. It
+// rejects chain IDs that are too long, as their length would not fit the
+// length prefix, which would let different domains encode to the same payload.
+func NewDomain(chainID string, version uint16) (Domain, error) {
+	if len(chainID) > MaxChainID {
+		return Domain{}, fmt.Errorf("chain ID too long (length: %d, max: %d)", len(chainID), MaxChainID)
+	}
+	d := Domain{
+		ChainID: chainID,
+		Version: version,
+	}
+	return d, nil
+}
+
+// ProposalBytes returns the canonical payload that is signed by the proposer of
+// the given candidate vertex.
+func (d Domain) ProposalBytes(candidate *base.Vertex) []byte {
+	data := d.prefix(TagProposal, 8+3*len(base.ZeroHash))
+	data = appendUint64(data, candidate.Height)
+	data = append(data, candidate.ParentID[:]...)
+	data = append(data, candidate.ProposerID[:]...)
+	data = append(data, candidate.ArcID[:]...)
+	return data
+}
+
+// VoteBytes returns the canonical payload that is signed by voters for the
+// candidate vertex with the given height and ID. It does not include the
+// voter, so that the signatures of all voters on the same candidate can be
+// aggregated.
+func (d Domain) VoteBytes(height uint64, candidateID base.Hash) []byte {
+	data := d.prefix(TagVote, 8+len(candidateID))
+	data = appendUint64(data, height)
+	data = append(data, candidateID[:]...)
+	return data
+}
+
+// ChangeBytes returns the canonical payload that is signed by the members
+// approving a change to the member with the given identity, weight and key,
+// for the given epoch.
+func (d Domain) ChangeBytes(epoch uint64, memberID base.Hash, weight uint64, key base.PublicKey) []byte {
+	data := d.prefix(TagChange, 8+len(memberID)+8+len(key))
+	data = appendUint64(data, epoch)
+	data = append(data, memberID[:]...)
+	data = appendUint64(data, weight)
+	data = append(data, key...)
+	return data
+}
+
+// prefix encodes the length-prefixed tag, the length-prefixed chain ID and the
+// protocol version, reserving enough capacity for the given payload size.
+func (d Domain) prefix(tag string, size int) []byte {
+	data := make([]byte, 0, 2+len(tag)+2+len(d.ChainID)+2+size)
+	data = appendUint16(data, uint16(len(tag)))
+	data = append(data, tag...)
+	data = appendUint16(data, uint16(len(d.ChainID)))
+	data = append(data, d.ChainID...)
+	data = appendUint16(data, d.Version)
+	return data
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+func appendUint64(data []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(data, buf[:]...)
+}
@@ -5,23 +5,26 @@ import (
 )
 
 // Proposal is a proposal for a new vertex in the consensus graph. It contains
-// the proposed vertex, a quorum for the parent graph and the signature of the
-// proposer.
+// the proposed vertex, a quorum for the parent graph, the signature of the
+// proposer on the proposal and the signature of the proposer's vote on the
+// proposed vertex.
 type Proposal struct {
-	Candidate *base.Vertex
-	Quorum    *Quorum
-	Signature base.Signature
+	Candidate     *base.Vertex
+	Quorum        *Quorum
+	Signature     base.Signature
+	VoteSignature base.Signature
 }
 
 // Vote returns the vote of the proposer that is implicitly included in each
-// proposal.
+// proposal. It carries a separate signature, as the proposal signature is made
+// on a different payload and can't be used as a vote.
 func (p *Proposal) Vote() *Vote {
 
 	vote := Vote{
 		Height:      p.Candidate.Height,
 		CandidateID: p.Candidate.ID(),
 		SignerID:    p.Candidate.ProposerID,
-		Signature:   p.Signature,
+		Signature:   p.VoteSignature,
 	}
 
 	return &vote
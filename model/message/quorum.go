@@ -4,8 +4,11 @@ import (
 	"github.com/awfm/consensus/model/base"
 )
 
-// Quorum is a collection of signers and their combined signatures.
+// Quorum is a collection of signers and their combined signatures. The signers
+// are either listed by ID, or marked in a bitfield over the committee of the
+// quorum height to save space.
 type Quorum struct {
 	SignerIDs []base.Hash
+	Signers   Bitfield
 	Signature base.Signature
 }
@@ -16,3 +16,17 @@ type InvalidSignature struct {
 func (is InvalidSignature) Error() string {
 	return fmt.Sprintf("invalid signature (entity: %T, signer: %x)", is.Entity, is.Signer)
 }
+
+// DoubleSign is an error returned when our own signer refuses to sign a
+// vertex, because it has already signed a conflicting vertex at the same or a
+// higher height.
+type DoubleSign struct {
+	Entity   string
+	Vertex   *base.Vertex
+	Height   uint64
+	SignedID base.Hash
+}
+
+func (ds DoubleSign) Error() string {
+	return fmt.Sprintf("double sign (entity: %s, height: %d, candidate: %x, signed height: %d, signed: %x)", ds.Entity, ds.Vertex.Height, ds.Vertex.ID(), ds.Height, ds.SignedID)
+}
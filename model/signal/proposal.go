@@ -18,14 +18,15 @@ func (sp StaleProposal) Error() string {
 }
 
 // InvalidProposer is an error that returned when processing a proposal made by
-// a proposer who is not the leader for the proposal round.
+// a proposer who is not one of the valid proposers for the proposal round,
+// which are the collectors of the parent round.
 type InvalidProposer struct {
-	Proposal *message.Proposal
-	Leader   base.Hash
+	Proposal  *message.Proposal
+	Proposers []base.Hash
 }
 
 func (ip InvalidProposer) Error() string {
-	return fmt.Sprintf("invalid proposer (proposer: %x, leader: %x)", ip.Proposal.Candidate.ProposerID, ip.Leader)
+	return fmt.Sprintf("invalid proposer (proposer: %x, proposers: %x)", ip.Proposal.Candidate.ProposerID, ip.Proposers)
 }
 
 // ConflictingProposal is an error returned when processing a proposal that is
@@ -61,3 +62,13 @@ type DoubleProposal struct {
 func (dp DoubleProposal) Error() string {
 	return fmt.Sprintf("double proposal (height: %d, proposer: %x, proposal1: %x, proposal2: %x)", dp.First.Candidate.Height, dp.First.Candidate.ProposerID, dp.First.Candidate.ID(), dp.Second.Candidate.ID())
 }
+
+// MissingArc is an error returned when a candidate can't extend the graph yet,
+// because the payload of its arc has not been received.
+type MissingArc struct {
+	Vertex *base.Vertex
+}
+
+func (ma MissingArc) Error() string {
+	return fmt.Sprintf("missing arc (height: %d, candidate: %x, arc: %x)", ma.Vertex.Height, ma.Vertex.ID(), ma.Vertex.ArcID)
+}
@@ -0,0 +1,18 @@
+package signal
+
+import (
+	"fmt"
+)
+
+// QueueFull is an error returned when a message can't be queued for
+// processing because the queue is at capacity. It signals backpressure to the
+// network layer, which should hold off and try again rather than drop the
+// message.
+type QueueFull struct {
+	Queue    string
+	Capacity int
+}
+
+func (qf QueueFull) Error() string {
+	return fmt.Sprintf("queue full (queue: %s, capacity: %d)", qf.Queue, qf.Capacity)
+}
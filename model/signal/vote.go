@@ -42,17 +42,28 @@ func (ov ObsoleteVote) Error() string {
 	return fmt.Sprintf("obsolete vote (height: %d, tip: %d)", ov.Vote.Height, ov.Tip.Height)
 }
 
+// FutureVote is an error returned when a vote is for a height too far above
+// the final height to be stored yet.
+type FutureVote struct {
+	Vote  *message.Vote
+	Limit uint64
+}
+
+func (fv FutureVote) Error() string {
+	return fmt.Sprintf("future vote (height: %d, limit: %d)", fv.Vote.Height, fv.Limit)
+}
+
 // InvalidCollector is an error returned when processing a vote that has been
-// sent to the wrong collector, and the intended collector is not the recipient
-// (which is usually ourselves).
+// sent to the wrong collector, and the recipient (which is usually ourselves)
+// is not one of the intended collectors.
 type InvalidCollector struct {
-	Vote      *message.Vote
-	Receiver  base.Hash
-	Collector base.Hash
+	Vote       *message.Vote
+	Receiver   base.Hash
+	Collectors []base.Hash
 }
 
 func (ic InvalidCollector) Error() string {
-	return fmt.Sprintf("invalid collector (sender: %x, receiver: %x, collector: %x)", ic.Vote.SignerID, ic.Receiver, ic.Collector)
+	return fmt.Sprintf("invalid collector (sender: %x, receiver: %x, collectors: %x)", ic.Vote.SignerID, ic.Receiver, ic.Collectors)
 }
 
 // DoubleVote is an error returned when trying to store a vote by a voter who
@@ -0,0 +1,605 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package codec implements the binary wire format of the consensus messages.
+// Every encoded message starts with the format version and a tag for its type,
+// followed by its fields in a fixed order. Integers are encoded as big-endian
+// numbers of fixed size, and variable length fields are prefixed with their
+// length, so that every message has exactly one valid encoding. Decoding
+// rejects any input that is not the canonical encoding of a message, as well
+// as messages that exceed the size limits.
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+)
+
+// Version is the version of the wire format.
+const Version = 1
+
+// Tag identifies the type of an encoded message.
+type Tag uint8
+
+// The tags of the supported message types.
+const (
+	TagVertex   Tag = 1
+	TagVote     Tag = 2
+	TagQuorum   Tag = 3
+	TagProposal Tag = 4
+	TagGossip   Tag = 5
+	TagQuery    Tag = 6
+	TagRequest  Tag = 7
+	TagResponse Tag = 8
+	TagChunk    Tag = 9
+)
+
+// The size limits of encoded messages.
+const (
+	MaxSize      = 1 << 20 // maximum size of an encoded message
+	MaxSigners   = 1 << 12 // maximum number of signers in a quorum
+	MaxSignature = 1 << 18 // maximum size of a signature, including quorums
+	MaxError     = 1 << 10 // maximum size of the error in a response
+	MaxProof     = 16      // maximum number of hashes in a chunk proof
+)
+
+// Encode encodes a vertex, vote, quorum, proposal, gossip envelope, query or
+// chunk, or a request or response carrying one of them.
+func Encode(msg interface{}) ([]byte, error) {
+
+	w := writer{}
+	w.byte(Version)
+	switch m := msg.(type) {
+	case *network.Request:
+		w.byte(byte(TagRequest))
+		w.request(m)
+	case *network.Response:
+		w.byte(byte(TagResponse))
+		w.response(m)
+	default:
+		w.message(msg)
+	}
+	if w.err != nil {
+		return nil, rich.Errorf("could not encode message: %w", w.err)
+	}
+	if len(w.data) > MaxSize {
+		return nil, rich.Errorf("message too large").Int("size", len(w.data))
+	}
+
+	return w.data, nil
+}
+
+// Fingerprint hashes the encoding of the message. As every message has exactly
+// one valid encoding, two messages only share a fingerprint if they are equal,
+// signatures included. Filters that pass messages on before they are verified
+// have to tell them apart this way: if they went by the candidate or vertex
+// instead, a copy with a forged signature that arrives first would shadow the
+// genuine message.
+func Fingerprint(msg interface{}) (base.Hash, error) {
+	data, err := Encode(msg)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not encode message: %w", err)
+	}
+	return sha3.Sum256(data), nil
+}
+
+// Decode decodes a message and returns a vertex, vote, quorum, proposal,
+// gossip envelope, query, chunk, request or response, depending on its tag.
+func Decode(data []byte) (interface{}, error) {
+
+	if len(data) > MaxSize {
+		return nil, rich.Errorf("message too large").Int("size", len(data))
+	}
+	r := reader{data: data}
+	version := r.byte()
+	tag := Tag(r.byte())
+	if r.err != nil {
+		return nil, rich.Errorf("could not decode header: %w", r.err)
+	}
+	if version != Version {
+		return nil, rich.Errorf("unsupported version").Uint("version", uint(version))
+	}
+
+	var msg interface{}
+	switch tag {
+	case TagRequest:
+		msg = r.request()
+	case TagResponse:
+		msg = r.response()
+	default:
+		msg = r.message(tag)
+	}
+	if r.err != nil {
+		return nil, rich.Errorf("could not decode message: %w", r.err).Uint("tag", uint(tag))
+	}
+	if len(r.data) > 0 {
+		return nil, rich.Errorf("trailing data").Int("size", len(r.data))
+	}
+
+	return msg, nil
+}
+
+// writer appends the encoded fields to its data; the first error is kept and
+// stops all further encoding.
+type writer struct {
+	data []byte
+	err  error
+}
+
+func (w *writer) byte(b byte) {
+	w.data = append(w.data, b)
+}
+
+func (w *writer) uint16(v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	w.data = append(w.data, buf[:]...)
+}
+
+func (w *writer) uint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	w.data = append(w.data, buf[:]...)
+}
+
+func (w *writer) uint64(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	w.data = append(w.data, buf[:]...)
+}
+
+func (w *writer) hash(h base.Hash) {
+	w.data = append(w.data, h[:]...)
+}
+
+func (w *writer) bytes(b []byte, max int) {
+	if w.err != nil {
+		return
+	}
+	if len(b) > max {
+		w.err = rich.Errorf("field too large").Int("size", len(b)).Int("max", max)
+		return
+	}
+	w.uint32(uint32(len(b)))
+	w.data = append(w.data, b...)
+}
+
+// message writes the tag and fields of a message that can be carried in a
+// request or response.
+func (w *writer) message(msg interface{}) {
+	if w.err != nil {
+		return
+	}
+	switch m := msg.(type) {
+	case *base.Vertex:
+		w.byte(byte(TagVertex))
+		w.vertex(m)
+	case *message.Vote:
+		w.byte(byte(TagVote))
+		w.vote(m)
+	case *message.Quorum:
+		w.byte(byte(TagQuorum))
+		w.quorum(m)
+	case *message.Proposal:
+		w.byte(byte(TagProposal))
+		w.proposal(m)
+	case *network.Gossip:
+		w.byte(byte(TagGossip))
+		w.gossip(m)
+	case *network.Query:
+		w.byte(byte(TagQuery))
+		w.query(m)
+	case *network.Chunk:
+		w.byte(byte(TagChunk))
+		w.chunk(m)
+	default:
+		w.err = rich.Errorf("unsupported message type").Str("type", fmt.Sprintf("%T", msg))
+	}
+}
+
+func (w *writer) vertex(v *base.Vertex) {
+	if w.err != nil {
+		return
+	}
+	if v == nil {
+		w.err = rich.Errorf("missing vertex")
+		return
+	}
+	w.uint64(v.Height)
+	w.hash(v.ParentID)
+	w.hash(v.ProposerID)
+	w.hash(v.ArcID)
+}
+
+func (w *writer) vote(v *message.Vote) {
+	if w.err != nil {
+		return
+	}
+	if v == nil {
+		w.err = rich.Errorf("missing vote")
+		return
+	}
+	w.uint64(v.Height)
+	w.hash(v.CandidateID)
+	w.hash(v.SignerID)
+	w.bytes(v.Signature, MaxSignature)
+}
+
+func (w *writer) quorum(q *message.Quorum) {
+	if w.err != nil {
+		return
+	}
+	if q == nil {
+		w.err = rich.Errorf("missing quorum")
+		return
+	}
+	if len(q.SignerIDs) > MaxSigners {
+		w.err = rich.Errorf("too many signers").Int("signers", len(q.SignerIDs))
+		return
+	}
+	w.uint32(uint32(len(q.SignerIDs)))
+	for _, signerID := range q.SignerIDs {
+		w.hash(signerID)
+	}
+	w.bytes(q.Signers, MaxSigners/8)
+	w.bytes(q.Signature, MaxSignature)
+}
+
+func (w *writer) proposal(p *message.Proposal) {
+	if w.err != nil {
+		return
+	}
+	if p == nil {
+		w.err = rich.Errorf("missing proposal")
+		return
+	}
+	w.vertex(p.Candidate)
+	if p.Quorum == nil {
+		w.byte(0)
+	} else {
+		w.byte(1)
+		w.quorum(p.Quorum)
+	}
+	w.bytes(p.Signature, MaxSignature)
+	w.bytes(p.VoteSignature, MaxSignature)
+}
+
+func (w *writer) gossip(g *network.Gossip) {
+	if w.err != nil {
+		return
+	}
+	if g == nil {
+		w.err = rich.Errorf("missing gossip")
+		return
+	}
+	w.byte(g.TTL)
+	w.proposal(g.Proposal)
+}
+
+func (w *writer) query(q *network.Query) {
+	if w.err != nil {
+		return
+	}
+	if q == nil {
+		w.err = rich.Errorf("missing query")
+		return
+	}
+	w.byte(byte(q.Kind))
+	w.hash(q.ID)
+}
+
+func (w *writer) chunk(c *network.Chunk) {
+	if w.err != nil {
+		return
+	}
+	if c == nil {
+		w.err = rich.Errorf("missing chunk")
+		return
+	}
+	if len(c.Proof) > MaxProof {
+		w.err = rich.Errorf("proof too long").Int("hashes", len(c.Proof))
+		return
+	}
+	w.hash(c.ArcID)
+	w.uint16(c.Index)
+	w.uint16(c.Required)
+	w.uint16(c.Total)
+	if c.Relay {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+	w.bytes(c.Data, MaxSize)
+	w.byte(byte(len(c.Proof)))
+	for _, hash := range c.Proof {
+		w.hash(hash)
+	}
+}
+
+func (w *writer) request(r *network.Request) {
+	if w.err != nil {
+		return
+	}
+	if r == nil {
+		w.err = rich.Errorf("missing request")
+		return
+	}
+	w.uint64(r.ID)
+	w.message(r.Message)
+}
+
+// response writes a flag for whether there is a message, which is followed by
+// the message if there is, and then the error, which is empty on success.
+func (w *writer) response(r *network.Response) {
+	if w.err != nil {
+		return
+	}
+	if r == nil {
+		w.err = rich.Errorf("missing response")
+		return
+	}
+	w.uint64(r.ID)
+	if r.Message == nil {
+		w.byte(0)
+	} else {
+		w.byte(1)
+		w.message(r.Message)
+	}
+	w.bytes([]byte(r.Error), MaxError)
+}
+
+// reader consumes the encoded fields from its data; the first error is kept
+// and makes all further reads return zero values.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = rich.Errorf("unexpected end of data").Int("required", n).Int("available", len(r.data))
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *reader) hash() base.Hash {
+	var h base.Hash
+	copy(h[:], r.next(len(h)))
+	return h
+}
+
+// bytes reads a length-prefixed field, which is nil if it is empty, and
+// checks the length before allocating anything.
+func (r *reader) bytes(max int) []byte {
+	size := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(size) > uint64(max) {
+		r.err = rich.Errorf("field too large").Uint64("size", uint64(size)).Int("max", max)
+		return nil
+	}
+	if size == 0 {
+		return nil
+	}
+	b := r.next(int(size))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// message reads the fields of a message that can be carried in a request or
+// response, depending on the tag.
+func (r *reader) message(tag Tag) interface{} {
+	if r.err != nil {
+		return nil
+	}
+	switch tag {
+	case TagVertex:
+		return r.vertex()
+	case TagVote:
+		return r.vote()
+	case TagQuorum:
+		return r.quorum()
+	case TagProposal:
+		return r.proposal()
+	case TagGossip:
+		return r.gossip()
+	case TagQuery:
+		return r.query()
+	case TagChunk:
+		return r.chunk()
+	default:
+		r.err = rich.Errorf("unknown tag").Uint("tag", uint(tag))
+		return nil
+	}
+}
+
+func (r *reader) vertex() *base.Vertex {
+	v := base.Vertex{
+		Height:     r.uint64(),
+		ParentID:   r.hash(),
+		ProposerID: r.hash(),
+		ArcID:      r.hash(),
+	}
+	return &v
+}
+
+func (r *reader) vote() *message.Vote {
+	v := message.Vote{
+		Height:      r.uint64(),
+		CandidateID: r.hash(),
+		SignerID:    r.hash(),
+		Signature:   r.bytes(MaxSignature),
+	}
+	return &v
+}
+
+func (r *reader) quorum() *message.Quorum {
+	var q message.Quorum
+	count := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if count > MaxSigners {
+		r.err = rich.Errorf("too many signers").Uint64("signers", uint64(count))
+		return nil
+	}
+	if count > 0 {
+		q.SignerIDs = make([]base.Hash, 0, count)
+	}
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		q.SignerIDs = append(q.SignerIDs, r.hash())
+	}
+	q.Signers = r.bytes(MaxSigners / 8)
+	q.Signature = r.bytes(MaxSignature)
+	return &q
+}
+
+func (r *reader) proposal() *message.Proposal {
+	var p message.Proposal
+	p.Candidate = r.vertex()
+	switch r.byte() {
+	case 0:
+	case 1:
+		p.Quorum = r.quorum()
+	default:
+		if r.err == nil {
+			r.err = rich.Errorf("invalid quorum flag")
+		}
+	}
+	p.Signature = r.bytes(MaxSignature)
+	p.VoteSignature = r.bytes(MaxSignature)
+	return &p
+}
+
+func (r *reader) gossip() *network.Gossip {
+	g := network.Gossip{
+		TTL:      r.byte(),
+		Proposal: r.proposal(),
+	}
+	return &g
+}
+
+func (r *reader) query() *network.Query {
+	q := network.Query{
+		Kind: network.QueryKind(r.byte()),
+		ID:   r.hash(),
+	}
+	return &q
+}
+
+func (r *reader) chunk() *network.Chunk {
+	var c network.Chunk
+	c.ArcID = r.hash()
+	c.Index = r.uint16()
+	c.Required = r.uint16()
+	c.Total = r.uint16()
+	switch r.byte() {
+	case 0:
+	case 1:
+		c.Relay = true
+	default:
+		if r.err == nil {
+			r.err = rich.Errorf("invalid relay flag")
+		}
+	}
+	c.Data = r.bytes(MaxSize)
+	count := r.byte()
+	if r.err != nil {
+		return nil
+	}
+	if count > MaxProof {
+		r.err = rich.Errorf("proof too long").Uint("hashes", uint(count))
+		return nil
+	}
+	if count > 0 {
+		c.Proof = make([]base.Hash, 0, count)
+	}
+	for i := byte(0); i < count && r.err == nil; i++ {
+		c.Proof = append(c.Proof, r.hash())
+	}
+	return &c
+}
+
+func (r *reader) request() *network.Request {
+	var req network.Request
+	req.ID = r.uint64()
+	req.Message = r.message(Tag(r.byte()))
+	return &req
+}
+
+func (r *reader) response() *network.Response {
+	var res network.Response
+	res.ID = r.uint64()
+	switch r.byte() {
+	case 0:
+	case 1:
+		res.Message = r.message(Tag(r.byte()))
+	default:
+		if r.err == nil {
+			r.err = rich.Errorf("invalid message flag")
+		}
+	}
+	res.Error = string(r.bytes(MaxError))
+	return &res
+}
@@ -0,0 +1,302 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package codec
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+)
+
+// generate creates a random message of a random type; variable length fields
+// are either nil or non-empty, as empty fields decode as nil.
+func generate(rng *rand.Rand) interface{} {
+
+	hash := func() base.Hash {
+		var h base.Hash
+		_, _ = rng.Read(h[:])
+		return h
+	}
+	blob := func(max int) []byte {
+		if rng.Intn(4) == 0 {
+			return nil
+		}
+		b := make([]byte, 1+rng.Intn(max))
+		_, _ = rng.Read(b)
+		return b
+	}
+	vertex := func() *base.Vertex {
+		return &base.Vertex{Height: rng.Uint64(), ParentID: hash(), ProposerID: hash(), ArcID: hash()}
+	}
+	quorum := func() *message.Quorum {
+		q := message.Quorum{Signers: blob(16), Signature: blob(256)}
+		count := rng.Intn(8)
+		for i := 0; i < count; i++ {
+			q.SignerIDs = append(q.SignerIDs, hash())
+		}
+		return &q
+	}
+
+	proposal := func() *message.Proposal {
+		p := message.Proposal{Candidate: vertex(), Signature: blob(128), VoteSignature: blob(128)}
+		if rng.Intn(2) == 0 {
+			p.Quorum = quorum()
+		}
+		return &p
+	}
+
+	plain := func() interface{} {
+		switch rng.Intn(7) {
+		case 0:
+			return vertex()
+		case 1:
+			return &message.Vote{Height: rng.Uint64(), CandidateID: hash(), SignerID: hash(), Signature: blob(128)}
+		case 2:
+			return quorum()
+		case 3:
+			return proposal()
+		case 4:
+			return &network.Query{Kind: network.QueryKind(rng.Intn(256)), ID: hash()}
+		case 5:
+			c := network.Chunk{ArcID: hash(), Index: uint16(rng.Uint32()), Required: uint16(rng.Uint32()), Total: uint16(rng.Uint32()), Relay: rng.Intn(2) == 0, Data: blob(512)}
+			for i := rng.Intn(MaxProof + 1); i > 0; i-- {
+				c.Proof = append(c.Proof, hash())
+			}
+			return &c
+		default:
+			return &network.Gossip{TTL: uint8(rng.Intn(256)), Proposal: proposal()}
+		}
+	}
+
+	switch rng.Intn(4) {
+	case 0:
+		return &network.Request{ID: rng.Uint64(), Message: plain()}
+	case 1:
+		res := network.Response{ID: rng.Uint64(), Error: string(blob(64))}
+		if rng.Intn(2) == 0 {
+			res.Message = plain()
+		}
+		return &res
+	default:
+		return plain()
+	}
+}
+
+// roundtrip checks that arbitrary input is either rejected or is the canonical
+// encoding of the message it decodes to.
+func roundtrip(t *testing.T, data []byte) bool {
+	msg, err := Decode(data)
+	if err != nil {
+		return false
+	}
+	encoded, err := Encode(msg)
+	require.NoError(t, err, "should encode decoded message")
+	require.Equal(t, data, encoded, "should have canonical encoding")
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		msg := generate(rng)
+		data, err := Encode(msg)
+		require.NoError(t, err, "should encode message")
+		again, err := Encode(msg)
+		require.NoError(t, err, "should encode message again")
+		require.Equal(t, data, again, "should encode deterministically")
+		decoded, err := Decode(data)
+		require.NoError(t, err, "should decode message")
+		require.Equal(t, msg, decoded, "should decode same message")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+
+	// the encoding of a vote should not change within a version
+	vote := &message.Vote{Height: 258, CandidateID: base.Hash{1}, SignerID: base.Hash{2}, Signature: base.Signature{3, 4}}
+	data, err := Encode(vote)
+	require.NoError(t, err, "should encode vote")
+	expected := "0102" + "0000000000000102" +
+		"01" + "00000000000000000000000000000000000000000000000000000000000000" +
+		"02" + "00000000000000000000000000000000000000000000000000000000000000" +
+		"00000002" + "0304"
+	assert.Equal(t, expected, hex.EncodeToString(data), "should have stable encoding")
+
+	// unsupported and incomplete messages should not be encoded
+	_, err = Encode(base.Vertex{})
+	assert.Error(t, err, "should not encode vertex value")
+	_, err = Encode((*message.Vote)(nil))
+	assert.Error(t, err, "should not encode nil vote")
+	_, err = Encode(&message.Proposal{})
+	assert.Error(t, err, "should not encode proposal without candidate")
+	_, err = Encode(&network.Gossip{TTL: 1})
+	assert.Error(t, err, "should not encode gossip without proposal")
+	_, err = Encode(&message.Quorum{SignerIDs: make([]base.Hash, MaxSigners+1)})
+	assert.Error(t, err, "should not encode too many signers")
+	_, err = Encode(&message.Vote{Signature: make([]byte, MaxSignature+1)})
+	assert.Error(t, err, "should not encode oversized signature")
+}
+
+func TestFingerprint(t *testing.T) {
+
+	// equal messages should share their fingerprint
+	vote := &message.Vote{Height: 258, CandidateID: base.Hash{1}, SignerID: base.Hash{2}, Signature: base.Signature{3, 4}}
+	same := *vote
+	fingerprint, err := Fingerprint(vote)
+	require.NoError(t, err, "should fingerprint vote")
+	again, err := Fingerprint(&same)
+	require.NoError(t, err, "should fingerprint same vote")
+	assert.Equal(t, fingerprint, again, "should have same fingerprint")
+
+	// a copy that only differs in its signature should not
+	forged := *vote
+	forged.Signature = base.Signature{3, 5}
+	other, err := Fingerprint(&forged)
+	require.NoError(t, err, "should fingerprint forged vote")
+	assert.NotEqual(t, fingerprint, other, "should have different fingerprint")
+
+	// messages that can't be encoded have no fingerprint
+	_, err = Fingerprint(&message.Proposal{})
+	assert.Error(t, err, "should not fingerprint proposal without candidate")
+}
+
+func TestDecodeInvalid(t *testing.T) {
+
+	proposal := &message.Proposal{
+		Candidate:     &base.Vertex{Height: 1},
+		Quorum:        &message.Quorum{SignerIDs: []base.Hash{{1}, {2}}, Signers: message.Bitfield{3}, Signature: base.Signature{4}},
+		Signature:     base.Signature{5},
+		VoteSignature: base.Signature{6},
+	}
+	data, err := Encode(proposal)
+	require.NoError(t, err, "should encode proposal")
+
+	// every truncation and extension should be rejected
+	for i := 0; i < len(data); i++ {
+		_, err = Decode(data[:i])
+		assert.Error(t, err, "should not decode truncated proposal (length: %d)", i)
+	}
+	_, err = Decode(append(append([]byte{}, data...), 0))
+	assert.Error(t, err, "should not decode trailing data")
+
+	// invalid headers should be rejected
+	invalid := append([]byte{}, data...)
+	invalid[0] = Version + 1
+	_, err = Decode(invalid)
+	assert.Error(t, err, "should not decode unknown version")
+	invalid[0], invalid[1] = Version, 0
+	_, err = Decode(invalid)
+	assert.Error(t, err, "should not decode unknown tag")
+
+	// an invalid quorum flag should be rejected
+	invalid = append([]byte{}, data...)
+	invalid[2+8+3*32] = 2
+	_, err = Decode(invalid)
+	assert.Error(t, err, "should not decode invalid quorum flag")
+
+	// huge length fields should be rejected before allocating anything
+	invalid = append([]byte{}, data...)
+	copy(invalid[2+8+3*32+1:], []byte{0xff, 0xff, 0xff, 0xff})
+	_, err = Decode(invalid)
+	assert.Error(t, err, "should not decode too many signers")
+	vote := []byte{Version, byte(TagVote)}
+	vote = append(vote, make([]byte, 8+2*32)...)
+	vote = append(vote, 0xff, 0xff, 0xff, 0xff)
+	_, err = Decode(vote)
+	assert.Error(t, err, "should not decode oversized signature")
+	_, err = Decode(make([]byte, MaxSize+1))
+	assert.Error(t, err, "should not decode oversized message")
+
+	// requests and responses should only carry plain messages, and must not
+	// be nested
+	nested := &network.Request{ID: 1, Message: &network.Request{ID: 2, Message: &base.Vertex{}}}
+	_, err = Encode(nested)
+	assert.Error(t, err, "should not encode nested request")
+	_, err = Encode(&network.Response{ID: 1, Message: &network.Response{ID: 2}})
+	assert.Error(t, err, "should not encode nested response")
+	_, err = Encode(&network.Request{ID: 1})
+	assert.Error(t, err, "should not encode request without message")
+	request := []byte{Version, byte(TagRequest), 0, 0, 0, 0, 0, 0, 0, 1, byte(TagRequest)}
+	_, err = Decode(request)
+	assert.Error(t, err, "should not decode nested request")
+	response := []byte{Version, byte(TagResponse), 0, 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0}
+	_, err = Decode(response)
+	assert.Error(t, err, "should not decode invalid message flag")
+	response = []byte{Version, byte(TagResponse), 0, 0, 0, 0, 0, 0, 0, 1, 0, 0xff, 0xff, 0xff, 0xff}
+	_, err = Decode(response)
+	assert.Error(t, err, "should not decode oversized error")
+
+	// chunks with invalid flags or too many proof hashes should be rejected
+	_, err = Encode(&network.Chunk{Proof: make([]base.Hash, MaxProof+1)})
+	assert.Error(t, err, "should not encode long proof")
+	chunk := []byte{Version, byte(TagChunk)}
+	chunk = append(chunk, make([]byte, 32+3*2)...)
+	_, err = Decode(append(append([]byte{}, chunk...), 2, 0, 0, 0, 0, 0))
+	assert.Error(t, err, "should not decode invalid relay flag")
+	_, err = Decode(append(append([]byte{}, chunk...), 0, 0, 0, 0, 0, MaxProof+1))
+	assert.Error(t, err, "should not decode long proof")
+}
+
+func TestDecodeMutations(t *testing.T) {
+
+	// mutate valid encodings in random ways; decoding should never panic, and
+	// anything that still decodes must be canonical
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 20000; i++ {
+		data, err := Encode(generate(rng))
+		require.NoError(t, err, "should encode message")
+		for j := rng.Intn(4); j >= 0; j-- {
+			position := rng.Intn(len(data))
+			switch rng.Intn(4) {
+			case 0:
+				data[position] ^= byte(1 << uint(rng.Intn(8)))
+			case 1:
+				data = data[:position]
+			case 2:
+				data = append(data[:position], append([]byte{byte(rng.Intn(256))}, data[position:]...)...)
+			default:
+				data[position] = 0xff
+			}
+			if len(data) == 0 {
+				break
+			}
+		}
+		roundtrip(t, data)
+	}
+
+	// random input should never panic either
+	decoded := 0
+	for i := 0; i < 20000; i++ {
+		data := make([]byte, rng.Intn(256))
+		_, _ = rng.Read(data)
+		if len(data) >= 2 && rng.Intn(2) == 0 {
+			data[0], data[1] = Version, byte(1+rng.Intn(5))
+		}
+		if roundtrip(t, data) {
+			decoded++
+		}
+	}
+	assert.True(t, decoded > 0, "should decode some random inputs")
+}
@@ -0,0 +1,43 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build gofuzz
+// +build gofuzz
+
+package codec
+
+import (
+	"bytes"
+)
+
+// Fuzz checks that decoding arbitrary input never panics, and that every
+// input that decodes successfully is the canonical encoding of its message.
+func Fuzz(data []byte) int {
+
+	msg, err := Decode(data)
+	if err != nil {
+		return 0
+	}
+	encoded, err := Encode(msg)
+	if err != nil {
+		panic("could not encode decoded message: " + err.Error())
+	}
+	if !bytes.Equal(encoded, data) {
+		panic("decoded message has different encoding")
+	}
+
+	return 1
+}
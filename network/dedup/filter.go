@@ -0,0 +1,254 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package dedup filters duplicate messages on their way from the network to
+// the engine, as processing the same proposal or vote several times wastes
+// expensive signature verifications. It remembers the messages it has passed
+// on for a limited time, and forgets the messages at finalized heights as
+// soon as finalization moves past them.
+package dedup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/codec"
+)
+
+// Stats counts the messages the filter passed on and dropped.
+type Stats struct {
+	Proposals          uint
+	Votes              uint
+	ProposalDuplicates uint
+	VoteDuplicates     uint
+}
+
+// key identifies a message in the seen set by its fingerprint, along with its
+// height.
+type key struct {
+	vote   bool
+	height uint64
+	digest base.Hash
+}
+
+// entry is a key in the order it was added to the seen set.
+type entry struct {
+	key key
+	at  time.Time
+}
+
+// Filter is a handler that drops the messages it has already passed on to the
+// wrapped handler. A message is only remembered once the wrapped handler has
+// accepted it, so that an invalid copy, such as a proposal with a forged
+// signature, can't keep the valid message from getting through. The wrapped
+// handler may accept messages before verifying them, for example when it is a
+// vote queue, so messages are told apart by their codec.Fingerprint.
+type Filter struct {
+	sync.Mutex
+	handler network.Handler
+	graph   consensus.Graph
+	expiry  time.Duration
+	clock   func() time.Time
+	seen    map[key]time.Time
+	heights map[uint64]map[key]struct{}
+	order   []entry
+	final   uint64
+	stats   Stats
+}
+
+// New creates a filter in front of the given handler, which remembers messages
+// for the given duration or until their height is finalized in the graph.
+func New(handler network.Handler, graph consensus.Graph, expiry time.Duration) *Filter {
+
+	f := Filter{
+		handler: handler,
+		graph:   graph,
+		expiry:  expiry,
+		clock:   time.Now,
+		seen:    make(map[key]time.Time),
+		heights: make(map[uint64]map[key]struct{}),
+	}
+
+	return &f
+}
+
+// Proposal passes the proposal on, unless it was seen before.
+func (f *Filter) Proposal(originID base.Hash, proposal *message.Proposal) error {
+
+	if proposal.Candidate == nil {
+		return rich.Errorf("missing candidate").Hex("origin", originID[:])
+	}
+	digest, err := codec.Fingerprint(proposal)
+	if err != nil {
+		return rich.Errorf("could not fingerprint proposal: %w", err).Hex("origin", originID[:])
+	}
+	k := key{height: proposal.Candidate.Height, digest: digest}
+	fresh, err := f.check(k)
+	if err != nil {
+		return rich.Errorf("could not check proposal: %w", err)
+	}
+	if !fresh {
+		return nil
+	}
+
+	err = f.handler.Proposal(originID, proposal)
+	if err != nil {
+		return err
+	}
+
+	f.mark(k)
+
+	return nil
+}
+
+// Vote passes the vote on, unless it was seen before.
+func (f *Filter) Vote(originID base.Hash, vote *message.Vote) error {
+
+	digest, err := codec.Fingerprint(vote)
+	if err != nil {
+		return rich.Errorf("could not fingerprint vote: %w", err).Hex("origin", originID[:])
+	}
+	k := key{vote: true, height: vote.Height, digest: digest}
+	fresh, err := f.check(k)
+	if err != nil {
+		return rich.Errorf("could not check vote: %w", err)
+	}
+	if !fresh {
+		return nil
+	}
+
+	err = f.handler.Vote(originID, vote)
+	if err != nil {
+		return err
+	}
+
+	f.mark(k)
+
+	return nil
+}
+
+// Stats returns the message counters of the filter.
+func (f *Filter) Stats() Stats {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.stats
+}
+
+// Size returns the number of messages in the seen set.
+func (f *Filter) Size() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.seen)
+}
+
+// check forgets the messages that expired or were finalized, and then checks
+// whether the message with the given key is new.
+func (f *Filter) check(k key) (bool, error) {
+
+	final, err := f.graph.Final()
+	if err != nil {
+		return false, rich.Errorf("could not get final: %w", err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	// 1) forget messages at heights that were finalized since the last check
+	if final.Height > f.final {
+		for height, keys := range f.heights {
+			if height > final.Height {
+				continue
+			}
+			for k := range keys {
+				delete(f.seen, k)
+			}
+			delete(f.heights, height)
+		}
+		f.final = final.Height
+	}
+
+	// 2) forget messages that expired, in the order they were added; entries
+	// that were already forgotten or added again later are skipped
+	now := f.clock()
+	for len(f.order) > 0 && now.Sub(f.order[0].at) >= f.expiry {
+		first := f.order[0]
+		f.order = f.order[1:]
+		at, ok := f.seen[first.key]
+		if ok && at.Equal(first.at) {
+			f.forget(first.key)
+		}
+	}
+
+	// 3) check the message itself
+	_, ok := f.seen[k]
+	if ok && k.vote {
+		f.stats.VoteDuplicates++
+	}
+	if ok && !k.vote {
+		f.stats.ProposalDuplicates++
+	}
+
+	return !ok, nil
+}
+
+// mark adds the message with the given key to the seen set, unless its height
+// is already finalized.
+func (f *Filter) mark(k key) {
+	f.Lock()
+	defer f.Unlock()
+
+	if k.vote {
+		f.stats.Votes++
+	} else {
+		f.stats.Proposals++
+	}
+	if k.height <= f.final {
+		return
+	}
+	_, ok := f.seen[k]
+	if ok {
+		return
+	}
+
+	now := f.clock()
+	f.seen[k] = now
+	keys, ok := f.heights[k.height]
+	if !ok {
+		keys = make(map[key]struct{})
+		f.heights[k.height] = keys
+	}
+	keys[k] = struct{}{}
+	f.order = append(f.order, entry{key: k, at: now})
+}
+
+// forget removes the message with the given key from the seen set. It has to
+// be called with the lock held.
+func (f *Filter) forget(k key) {
+	delete(f.seen, k)
+	keys := f.heights[k.height]
+	delete(keys, k)
+	if len(keys) == 0 {
+		delete(f.heights, k.height)
+	}
+}
@@ -0,0 +1,182 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dedup
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+)
+
+var _ network.Handler = (*Filter)(nil)
+
+// counter is a handler that counts the messages it gets, and fails while it
+// has an error set.
+type counter struct {
+	proposals int
+	votes     int
+	err       error
+}
+
+func (c *counter) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	c.proposals++
+	return c.err
+}
+
+func (c *counter) Vote(originID base.Hash, vote *message.Vote) error {
+	c.votes++
+	return c.err
+}
+
+// setup creates a filter with a controlled clock and final height.
+func setup(t *testing.T) (*Filter, *counter, *uint64, *time.Time) {
+	final := uint64(0)
+	now := time.Unix(1000, 0)
+	graph := &mocks.Graph{}
+	graph.On("Final").Return(
+		func() *base.Vertex {
+			return &base.Vertex{Height: final}
+		},
+		nil,
+	)
+	handler := &counter{}
+	f := New(handler, graph, time.Minute)
+	f.clock = func() time.Time {
+		return now
+	}
+	return f, handler, &final, &now
+}
+
+func TestFilterDuplicates(t *testing.T) {
+
+	f, handler, _, _ := setup(t)
+	originID := fixture.Hash(t)
+
+	// a proposal should only be passed on once, even from different origins
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(10))))
+	require.NoError(t, f.Proposal(originID, proposal), "should pass proposal")
+	require.NoError(t, f.Proposal(fixture.Hash(t), proposal), "should drop duplicate proposal")
+	assert.Equal(t, 1, handler.proposals, "should pass proposal once")
+	require.NoError(t, f.Proposal(originID, fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(10))))), "should pass other proposal")
+	assert.Equal(t, 2, handler.proposals, "should pass other proposal")
+
+	// votes should be identified by signer, height and candidate, so that a
+	// double vote still reaches the engine
+	vote := fixture.Vote(t, fixture.ForCandidate(proposal.Candidate))
+	require.NoError(t, f.Vote(originID, vote), "should pass vote")
+	require.NoError(t, f.Vote(originID, vote), "should drop duplicate vote")
+	assert.Equal(t, 1, handler.votes, "should pass vote once")
+	other := *vote
+	other.SignerID = fixture.Hash(t)
+	require.NoError(t, f.Vote(originID, &other), "should pass vote by other signer")
+	double := *vote
+	double.CandidateID = fixture.Hash(t)
+	require.NoError(t, f.Vote(originID, &double), "should pass vote for other candidate")
+	assert.Equal(t, 3, handler.votes, "should pass distinct votes")
+
+	assert.Equal(t, Stats{Proposals: 2, Votes: 3, ProposalDuplicates: 1, VoteDuplicates: 1}, f.Stats(), "should count messages")
+	assert.Error(t, f.Proposal(originID, &message.Proposal{}), "should reject proposal without candidate")
+}
+
+func TestFilterRejected(t *testing.T) {
+
+	// messages rejected by the handler should not be remembered, so that a
+	// forged copy doesn't shadow the valid message
+	f, handler, _, _ := setup(t)
+	handler.err = errors.New("invalid signature")
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(10))))
+	vote := fixture.Vote(t, fixture.ForCandidate(proposal.Candidate))
+	assert.Error(t, f.Proposal(fixture.Hash(t), proposal), "should return handler error")
+	assert.Error(t, f.Vote(fixture.Hash(t), vote), "should return handler error")
+	assert.Equal(t, 0, f.Size(), "should not remember rejected messages")
+	handler.err = nil
+	require.NoError(t, f.Proposal(fixture.Hash(t), proposal), "should pass valid proposal")
+	require.NoError(t, f.Vote(fixture.Hash(t), vote), "should pass valid vote")
+	assert.Equal(t, 2, handler.proposals, "should pass proposal again")
+	assert.Equal(t, 2, handler.votes, "should pass vote again")
+}
+
+func TestFilterForgery(t *testing.T) {
+
+	// a handler that accepts messages before verifying them, like a queue,
+	// remembers forged copies, which should not shadow the genuine messages
+	f, handler, _, _ := setup(t)
+	originID := fixture.Hash(t)
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(10))))
+	forgedProposal := *proposal
+	forgedProposal.Signature = fixture.Sig(t)
+	require.NoError(t, f.Proposal(originID, &forgedProposal), "should pass forged proposal")
+	require.NoError(t, f.Proposal(originID, proposal), "should pass genuine proposal")
+	require.NoError(t, f.Proposal(originID, proposal), "should drop duplicate proposal")
+	assert.Equal(t, 2, handler.proposals, "should pass genuine proposal after forged copy")
+
+	vote := fixture.Vote(t, fixture.ForCandidate(proposal.Candidate))
+	forgedVote := *vote
+	forgedVote.Signature = fixture.Sig(t)
+	require.NoError(t, f.Vote(originID, &forgedVote), "should pass forged vote")
+	require.NoError(t, f.Vote(originID, vote), "should pass genuine vote")
+	require.NoError(t, f.Vote(originID, vote), "should drop duplicate vote")
+	assert.Equal(t, 2, handler.votes, "should pass genuine vote after forged copy")
+}
+
+func TestFilterBounds(t *testing.T) {
+
+	f, handler, final, now := setup(t)
+	originID := fixture.Hash(t)
+
+	// messages should be forgotten once they expire
+	early := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(10))))
+	require.NoError(t, f.Proposal(originID, early), "should pass proposal")
+	*now = now.Add(30 * time.Second)
+	late := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	require.NoError(t, f.Proposal(originID, late), "should pass proposal")
+	*now = now.Add(30 * time.Second)
+	require.NoError(t, f.Proposal(originID, early), "should pass expired proposal")
+	require.NoError(t, f.Proposal(originID, late), "should drop unexpired proposal")
+	assert.Equal(t, 3, handler.proposals, "should pass expired proposal again")
+	assert.Equal(t, 2, f.Size(), "should remember messages again")
+
+	// messages should be forgotten once their height is finalized, and
+	// messages at finalized heights should no longer be remembered
+	vote := fixture.Vote(t, fixture.ForCandidate(late.Candidate))
+	require.NoError(t, f.Vote(originID, vote), "should pass vote")
+	*final = 10
+	require.NoError(t, f.Proposal(originID, early), "should pass finalized proposal")
+	assert.Equal(t, 4, handler.proposals, "should pass finalized proposal again")
+	assert.Equal(t, 2, f.Size(), "should forget finalized messages")
+	*final = 20
+	require.NoError(t, f.Vote(originID, vote), "should pass finalized vote")
+	assert.Equal(t, 2, handler.votes, "should pass finalized vote again")
+	assert.Equal(t, 0, f.Size(), "should forget all finalized messages")
+	assert.Empty(t, f.heights, "should not keep empty heights")
+
+	// the final height should be required for filtering
+	graph := &mocks.Graph{}
+	graph.On("Final").Return(nil, errors.New("no final"))
+	f = New(handler, graph, time.Minute)
+	assert.Error(t, f.Vote(originID, vote), "should fail without final")
+	assert.Error(t, f.Proposal(originID, late), "should fail without final")
+}
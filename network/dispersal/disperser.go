@@ -0,0 +1,421 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package dispersal spreads large payloads with erasure coding, so that the
+// upload bandwidth of the node proposing a payload doesn't limit its size.
+// The disperser encodes the payload into one chunk per node, of which only a
+// fraction is needed to rebuild it, and sends every peer its own chunk, along
+// with a Merkle proof against the root over all chunks. Each peer relays its
+// chunk to all other peers, so that every node ends up with enough chunks to
+// rebuild the payload, while the disperser only uploads a small multiple of
+// the payload size in total.
+//
+// Chunks are assigned to the nodes in the sorted order of their identities,
+// starting with the disperser, which keeps the first chunk. A node thus only
+// relays the chunk with its own index relative to the peer it got it from, so
+// that only the disperser of an arc can have a node relay its chunk; anyone
+// else can at most make the node relay its own valid chunk, for an arc the
+// node would otherwise have to relay anyway. Every peer can still open arcs
+// of its own, so the number of unfinished arcs a peer can open at a time is
+// limited, which keeps faulty peers from pushing out the arcs of others.
+//
+// The Merkle root is the identifier of the arc, which is what proposals
+// commit to, so that every chunk can be checked on its own. A disperser could
+// still commit to chunks that are not a valid encoding of any payload; nodes
+// thus encode the payload they rebuilt once more, and only accept it if they
+// arrive at the same root, so that all nodes agree on whether the arc is valid,
+// regardless of which chunks they used.
+package dispersal
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/erasure"
+)
+
+// Config holds the parameters of the dispersal.
+type Config struct {
+	Redundancy uint // ratio of total chunks to the chunks required to rebuild
+	Retain     uint // number of arcs whose chunks are kept at once
+	PerOrigin  uint // number of unfinished arcs a single peer can open at once
+}
+
+// DefaultConfig lets nodes rebuild a payload from a third of the chunks, so
+// that chunks relayed by faulty peers don't matter, and keeps enough arcs that
+// a few faulty peers opening as many arcs as they can don't push out the arcs
+// of honest peers.
+var DefaultConfig = Config{
+	Redundancy: 3,
+	Retain:     64,
+	PerOrigin:  4,
+}
+
+// Sink receives the payloads that were rebuilt from their chunks.
+type Sink interface {
+	Payload(arcID base.Hash, payload []byte) error
+}
+
+// arc collects the chunks of a single payload, and remembers the peer that
+// opened it.
+type arc struct {
+	originID base.Hash
+	required uint16
+	total    uint16
+	chunks   [][]byte
+	count    int
+	relayed  bool
+	done     bool
+}
+
+// Disperser is a receiver that collects the chunks of payloads, relays the
+// chunks it is asked to relay, and passes the payloads it rebuilds to the
+// sink. All other messages are passed on to the wrapped receiver.
+type Disperser struct {
+	sync.Mutex
+	selfID   base.Hash
+	nodeIDs  []base.Hash
+	position map[base.Hash]int
+	receiver network.Receiver
+	sink     Sink
+	config   Config
+	trans    network.Transport
+	arcs     map[base.Hash]*arc
+	order    []base.Hash
+	opened   map[base.Hash]uint
+}
+
+// New creates a disperser for the node with the given identity, among the
+// given nodes, which have to include the node itself.
+func New(selfID base.Hash, nodeIDs []base.Hash, receiver network.Receiver, sink Sink, config Config) (*Disperser, error) {
+
+	sorted := message.SortIDs(append([]base.Hash(nil), nodeIDs...))
+	if len(sorted) > erasure.MaxChunks {
+		return nil, rich.Errorf("too many nodes").Int("nodes", len(sorted)).Int("max", erasure.MaxChunks)
+	}
+	position := make(map[base.Hash]int, len(sorted))
+	for index, nodeID := range sorted {
+		_, duplicate := position[nodeID]
+		if duplicate {
+			return nil, rich.Errorf("duplicate node").Hex("node", nodeID[:])
+		}
+		position[nodeID] = index
+	}
+	_, ok := position[selfID]
+	if !ok {
+		return nil, rich.Errorf("self not among nodes").Hex("self", selfID[:])
+	}
+
+	d := Disperser{
+		selfID:   selfID,
+		nodeIDs:  sorted,
+		position: position,
+		receiver: receiver,
+		sink:     sink,
+		config:   config,
+		arcs:     make(map[base.Hash]*arc),
+		opened:   make(map[base.Hash]uint),
+	}
+
+	return &d, nil
+}
+
+// Attach sets the transport used to send chunks, which has to be done before
+// dispersing or relaying anything.
+func (d *Disperser) Attach(trans network.Transport) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.trans = trans
+}
+
+// Disperse encodes the payload into one chunk for us and for each other node,
+// and sends each node its chunk to relay, as well as our own chunk. It returns
+// the identifier of the arc, which is the root over all chunks. It returns the
+// first error if the chunks could not be sent to some of the nodes, but still
+// sends them to all others.
+func (d *Disperser) Disperse(payload []byte) (base.Hash, error) {
+
+	trans, err := d.transport()
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not get transport: %w", err)
+	}
+
+	// 1) encode the payload, with the first chunk being ours
+	total := len(d.nodeIDs)
+	coder, err := erasure.NewCoder(d.required(total), total)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not create coder: %w", err)
+	}
+	chunks := coder.Encode(payload)
+	tree := commit(coder, chunks)
+	arcID := tree.Root()
+
+	// 2) remember that we already have the payload, so we ignore the chunks
+	// that come back to us, and pass it on like any other payload
+	d.Lock()
+	a := d.arc(arcID, d.selfID, uint16(coder.Required()), uint16(total))
+	a.relayed = true
+	a.done = true
+	d.Unlock()
+	err = d.sink.Payload(arcID, payload)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not pass on payload: %w", err)
+	}
+
+	// 3) send every node its chunk to relay, and our own chunk
+	var failure error
+	for offset := 1; offset < total; offset++ {
+		peerID := d.nodeIDs[(d.position[d.selfID]+offset)%total]
+		for _, index := range []int{offset, 0} {
+			chunk := network.Chunk{
+				ArcID:    arcID,
+				Index:    uint16(index),
+				Required: uint16(coder.Required()),
+				Total:    uint16(total),
+				Relay:    index != 0,
+				Data:     chunks[index],
+				Proof:    tree.Proof(index),
+			}
+			err = trans.Send(peerID, &chunk)
+			if err != nil && failure == nil {
+				failure = rich.Errorf("could not send chunk: %w", err).Hex("peer", peerID[:]).Int("index", index)
+			}
+		}
+	}
+
+	return arcID, failure
+}
+
+// Receive processes chunks and passes all other messages on.
+func (d *Disperser) Receive(originID base.Hash, msg interface{}) error {
+
+	chunk, ok := msg.(*network.Chunk)
+	if !ok {
+		return d.receiver.Receive(originID, msg)
+	}
+
+	// 1) check the chunk against the commitment of the arc
+	if chunk.Required == 0 || chunk.Required > chunk.Total || int(chunk.Total) > erasure.MaxChunks || chunk.Index >= chunk.Total {
+		return rich.Errorf("invalid chunk parameters").Uint("index", uint(chunk.Index)).Uint("required", uint(chunk.Required)).Uint("total", uint(chunk.Total))
+	}
+	if !erasure.Verify(chunk.ArcID, int(chunk.Index), int(chunk.Total), leaf(int(chunk.Index), int(chunk.Required), int(chunk.Total), chunk.Data), chunk.Proof) {
+		return rich.Errorf("invalid chunk proof").Hex("arc", chunk.ArcID[:]).Uint("index", uint(chunk.Index)).Hex("origin", originID[:])
+	}
+
+	// 2) add it to the arc, and see whether it needs to be relayed, or we can
+	// rebuild the payload now; we only relay our own chunk of the arc, which
+	// we can only get from its disperser
+	d.Lock()
+	a := d.arc(chunk.ArcID, originID, chunk.Required, chunk.Total)
+	if a == nil {
+		d.Unlock()
+		return rich.Errorf("too many open arcs").Hex("origin", originID[:]).Uint("max", d.config.PerOrigin)
+	}
+	if a.required != chunk.Required || a.total != chunk.Total {
+		d.Unlock()
+		return rich.Errorf("inconsistent chunk parameters").Hex("arc", chunk.ArcID[:])
+	}
+	relay := chunk.Relay && !a.relayed && d.assigned(originID, chunk)
+	if relay {
+		a.relayed = true
+	}
+	if !a.done && a.chunks[chunk.Index] == nil {
+		a.chunks[chunk.Index] = chunk.Data
+		a.count++
+	}
+	var chunks [][]byte
+	if !a.done && a.count >= int(a.required) {
+		a.done = true
+		d.release(a)
+		chunks = append([][]byte(nil), a.chunks...)
+		a.chunks = nil
+	}
+	d.Unlock()
+
+	// 3) relay the chunk to everyone but the disperser
+	var failure error
+	if relay {
+		failure = d.relay(originID, chunk)
+	}
+
+	// 4) rebuild the payload once we have enough chunks
+	if chunks != nil {
+		err := d.rebuild(chunk.ArcID, int(chunk.Required), chunks)
+		if err != nil {
+			return rich.Errorf("could not rebuild payload: %w", err)
+		}
+	}
+	if failure != nil {
+		return rich.Errorf("could not relay chunk: %w", failure)
+	}
+
+	return nil
+}
+
+// required returns the number of chunks required to rebuild a payload for the
+// given total number of chunks.
+func (d *Disperser) required(total int) int {
+	redundancy := int(d.config.Redundancy)
+	if redundancy < 1 {
+		redundancy = 1
+	}
+	return (total + redundancy - 1) / redundancy
+}
+
+// assigned checks whether the chunk is the one assigned to us, if the arc was
+// dispersed by the given origin.
+func (d *Disperser) assigned(originID base.Hash, chunk *network.Chunk) bool {
+	total := len(d.nodeIDs)
+	origin, ok := d.position[originID]
+	if !ok || int(chunk.Total) != total {
+		return false
+	}
+	index := (d.position[d.selfID] - origin + total) % total
+	return int(chunk.Index) == index
+}
+
+// arc returns the arc with the given identifier, creating it if necessary, and
+// forgets the oldest arcs once there are too many. It returns nil if the arc
+// is new and the origin already has too many unfinished arcs open; our own
+// arcs are not limited. It has to be called with the lock held.
+func (d *Disperser) arc(arcID base.Hash, originID base.Hash, required uint16, total uint16) *arc {
+
+	a, ok := d.arcs[arcID]
+	if ok {
+		return a
+	}
+	if originID != d.selfID && d.opened[originID] >= d.config.PerOrigin {
+		return nil
+	}
+	a = &arc{
+		originID: originID,
+		required: required,
+		total:    total,
+		chunks:   make([][]byte, total),
+	}
+	d.arcs[arcID] = a
+	d.order = append(d.order, arcID)
+	if originID != d.selfID {
+		d.opened[originID]++
+	}
+	for uint(len(d.order)) > d.config.Retain && len(d.order) > 1 {
+		evicted := d.arcs[d.order[0]]
+		if !evicted.done {
+			d.release(evicted)
+		}
+		delete(d.arcs, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	return a
+}
+
+// release stops counting the arc among the unfinished arcs of its origin. It
+// has to be called with the lock held.
+func (d *Disperser) release(a *arc) {
+	if a.originID == d.selfID {
+		return
+	}
+	d.opened[a.originID]--
+	if d.opened[a.originID] == 0 {
+		delete(d.opened, a.originID)
+	}
+}
+
+// relay sends a copy of the chunk, which is no longer marked for relay, to
+// all peers other than the one we got it from.
+func (d *Disperser) relay(originID base.Hash, chunk *network.Chunk) error {
+
+	trans, err := d.transport()
+	if err != nil {
+		return rich.Errorf("could not get transport: %w", err)
+	}
+	relayed := *chunk
+	relayed.Relay = false
+	var failure error
+	for _, peerID := range trans.Peers() {
+		if peerID == originID {
+			continue
+		}
+		err = trans.Send(peerID, &relayed)
+		if err != nil && failure == nil {
+			failure = rich.Errorf("could not send chunk: %w", err).Hex("peer", peerID[:])
+		}
+	}
+
+	return failure
+}
+
+// rebuild decodes the payload from the chunks, and checks that encoding it
+// again results in the same commitment before passing it on.
+func (d *Disperser) rebuild(arcID base.Hash, required int, chunks [][]byte) error {
+
+	coder, err := erasure.NewCoder(required, len(chunks))
+	if err != nil {
+		return rich.Errorf("could not create coder: %w", err)
+	}
+	payload, err := coder.Decode(chunks)
+	if err != nil {
+		return rich.Errorf("could not decode chunks: %w", err)
+	}
+	root := commit(coder, coder.Encode(payload)).Root()
+	if root != arcID {
+		return rich.Errorf("inconsistent encoding").Hex("arc", arcID[:]).Hex("root", root[:])
+	}
+	err = d.sink.Payload(arcID, payload)
+	if err != nil {
+		return rich.Errorf("could not pass on payload: %w", err)
+	}
+
+	return nil
+}
+
+// transport returns the attached transport.
+func (d *Disperser) transport() (network.Transport, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.trans == nil {
+		return nil, rich.Errorf("no transport attached")
+	}
+
+	return d.trans, nil
+}
+
+// commit builds the Merkle tree over the chunks of a payload.
+func commit(coder *erasure.Coder, chunks [][]byte) *erasure.Tree {
+	leaves := make([][]byte, 0, len(chunks))
+	for index, chunk := range chunks {
+		leaves = append(leaves, leaf(index, coder.Required(), coder.Total(), chunk))
+	}
+	return erasure.NewTree(leaves)
+}
+
+// leaf is the Merkle leaf of a chunk, which includes its position and the
+// chunk counts, so that the commitment covers how the chunks are decoded.
+func leaf(index int, required int, total int, data []byte) []byte {
+	leaf := make([]byte, 6, 6+len(data))
+	binary.BigEndian.PutUint16(leaf[0:], uint16(index))
+	binary.BigEndian.PutUint16(leaf[2:], uint16(required))
+	binary.BigEndian.PutUint16(leaf[4:], uint16(total))
+	return append(leaf, data...)
+}
@@ -0,0 +1,335 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispersal
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/erasure"
+	"github.com/awfm/consensus/network/sim"
+)
+
+var _ network.Receiver = (*Disperser)(nil)
+
+// sent is a message sent over the fake transport.
+type sent struct {
+	peerID base.Hash
+	msg    interface{}
+}
+
+// fake is a transport that records the messages it sends, and drops those to
+// the peers in its drop set.
+type fake struct {
+	sync.Mutex
+	trans network.Transport
+	drop  map[base.Hash]bool
+	sent  []sent
+	bytes int
+}
+
+func (f *fake) Peers() []base.Hash {
+	return f.trans.Peers()
+}
+
+func (f *fake) Send(peerID base.Hash, msg interface{}) error {
+	f.Lock()
+	defer f.Unlock()
+	f.sent = append(f.sent, sent{peerID: peerID, msg: msg})
+	chunk, ok := msg.(*network.Chunk)
+	if ok {
+		f.bytes += len(chunk.Data)
+	}
+	if f.drop[peerID] {
+		return nil
+	}
+	return f.trans.Send(peerID, msg)
+}
+
+// peers is a transport that only knows its peers and sends nothing.
+type peers []base.Hash
+
+func (p peers) Peers() []base.Hash {
+	return p
+}
+
+func (p peers) Send(peerID base.Hash, msg interface{}) error {
+	return nil
+}
+
+// recorder is a sink and receiver that records what it gets.
+type recorder struct {
+	sync.Mutex
+	payloads map[base.Hash][][]byte
+	msgs     []interface{}
+}
+
+func (r *recorder) Payload(arcID base.Hash, payload []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	r.payloads[arcID] = append(r.payloads[arcID], payload)
+	return nil
+}
+
+func (r *recorder) Receive(originID base.Hash, msg interface{}) error {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = append(r.msgs, msg)
+	return nil
+}
+
+func (r *recorder) count(arcID base.Hash) int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.payloads[arcID])
+}
+
+func setup(t *testing.T, selfID base.Hash, nodeIDs []base.Hash, trans network.Transport) (*Disperser, *recorder) {
+	r := &recorder{payloads: make(map[base.Hash][][]byte)}
+	d, err := New(selfID, nodeIDs, r, r, Config{Redundancy: 3, Retain: 4, PerOrigin: 2})
+	require.NoError(t, err, "should create disperser")
+	d.Attach(trans)
+	return d, r
+}
+
+func payload(t *testing.T, size int) []byte {
+	payload := make([]byte, size)
+	_, _ = rand.Read(payload)
+	return payload
+}
+
+func TestDisperserReceive(t *testing.T) {
+
+	// disperse a payload among eight nodes, so that three chunks are required;
+	// with the leader first in order, the chunk indices match the positions
+	nodeIDs := message.SortIDs(fixture.Hashes(t, 8))
+	leaderID, selfID := nodeIDs[0], nodeIDs[1]
+	leader := &fake{trans: peers(nodeIDs[1:])}
+	l, lr := setup(t, leaderID, nodeIDs, leader)
+	data := payload(t, 1000)
+	arcID, err := l.Disperse(data)
+	require.NoError(t, err, "should disperse payload")
+	assert.Equal(t, [][]byte{data}, lr.payloads[arcID], "should pass on own payload")
+	require.Len(t, leader.sent, 14, "should send two chunks to each peer")
+	var chunks []*network.Chunk
+	for i, s := range leader.sent {
+		chunk := s.msg.(*network.Chunk)
+		assert.Equal(t, nodeIDs[i/2+1], s.peerID, "should send chunks to each peer in order")
+		assert.Equal(t, arcID, chunk.ArcID, "should use root as arc identifier")
+		assert.Equal(t, uint16(3), chunk.Required, "should require a third of the chunks")
+		assert.Equal(t, uint16(8), chunk.Total, "should have a chunk per node")
+		assert.Equal(t, i%2 == 0, chunk.Relay, "should only mark the chunk of the peer for relay")
+		if i%2 == 0 {
+			assert.Equal(t, uint16(i/2+1), chunk.Index, "should send each peer its own chunk")
+			chunks = append(chunks, chunk)
+		} else {
+			assert.Equal(t, uint16(0), chunk.Index, "should send own chunk")
+		}
+	}
+
+	// neither our chunk nor any other chunk should be relayed when another
+	// peer marks it for relay, as only the leader can assign it to us
+	trans := &fake{trans: peers(append([]base.Hash{leaderID}, nodeIDs[2:]...))}
+	d, r := setup(t, selfID, nodeIDs, trans)
+	require.NoError(t, d.Receive(nodeIDs[2], chunks[0]), "should receive own chunk from other peer")
+	require.NoError(t, d.Receive(nodeIDs[3], chunks[1]), "should receive other chunk marked for relay")
+	assert.Empty(t, trans.sent, "should not relay chunk from other peer")
+
+	// our chunk should be relayed once to everyone but the leader
+	require.NoError(t, d.Receive(leaderID, chunks[0]), "should receive own chunk")
+	require.NoError(t, d.Receive(leaderID, chunks[0]), "should receive own chunk again")
+	require.Len(t, trans.sent, 6, "should relay chunk once")
+	for _, s := range trans.sent {
+		assert.NotEqual(t, leaderID, s.peerID, "should not relay to leader")
+		relayed := *chunks[0]
+		relayed.Relay = false
+		assert.Equal(t, &relayed, s.msg, "should relay chunk without relay flag")
+	}
+
+	// invalid chunks should be rejected
+	corrupted := *chunks[1]
+	corrupted.Data = append([]byte{^chunks[1].Data[0]}, chunks[1].Data[1:]...)
+	assert.Error(t, d.Receive(nodeIDs[2], &corrupted), "should reject corrupted data")
+	forged := *chunks[1]
+	forged.Proof = append([]base.Hash{fixture.Hash(t)}, chunks[1].Proof[1:]...)
+	assert.Error(t, d.Receive(nodeIDs[2], &forged), "should reject forged proof")
+	moved := *chunks[1]
+	moved.Index = 3
+	assert.Error(t, d.Receive(nodeIDs[2], &moved), "should reject chunk at wrong index")
+	params := *chunks[1]
+	params.Required = 2
+	assert.Error(t, d.Receive(nodeIDs[2], &params), "should reject chunk with wrong parameters")
+	outside := *chunks[1]
+	outside.Index = 8
+	assert.Error(t, d.Receive(nodeIDs[2], &outside), "should reject chunk outside of range")
+	assert.Empty(t, r.payloads, "should not rebuild payload from invalid chunks")
+
+	// the payload should be rebuilt exactly once with enough chunks
+	relayed := *chunks[1]
+	relayed.Relay = false
+	require.NoError(t, d.Receive(nodeIDs[2], &relayed), "should receive second chunk")
+	assert.Empty(t, r.payloads, "should not rebuild payload from two chunks")
+	relayed = *chunks[4]
+	relayed.Relay = false
+	require.NoError(t, d.Receive(nodeIDs[5], &relayed), "should receive third chunk")
+	assert.Equal(t, [][]byte{data}, r.payloads[arcID], "should rebuild payload")
+	relayed = *chunks[5]
+	relayed.Relay = false
+	require.NoError(t, d.Receive(nodeIDs[6], &relayed), "should receive fourth chunk")
+	assert.Len(t, r.payloads[arcID], 1, "should not rebuild payload again")
+	assert.Len(t, trans.sent, 6, "should only relay own chunk")
+	assert.Empty(t, d.opened, "should not count finished arc against its origin")
+
+	// other messages should be passed on
+	vote := fixture.Vote(t)
+	require.NoError(t, d.Receive(leaderID, vote), "should receive vote")
+	assert.Equal(t, []interface{}{vote}, r.msgs, "should pass on other messages")
+
+	// nothing should be dispersed without transport
+	d, err = New(selfID, nodeIDs, r, r, DefaultConfig)
+	require.NoError(t, err, "should create disperser")
+	_, err = d.Disperse(data)
+	assert.Error(t, err, "should not disperse without transport")
+
+	// the nodes should be unique and include ourselves
+	_, err = New(selfID, nodeIDs[2:], r, r, DefaultConfig)
+	assert.Error(t, err, "should not create disperser without self")
+	_, err = New(selfID, append(nodeIDs, selfID), r, r, DefaultConfig)
+	assert.Error(t, err, "should not create disperser with duplicate node")
+}
+
+func TestDisperserInconsistent(t *testing.T) {
+
+	// commit to chunks that are not an encoding of any payload
+	leaderID := fixture.Hash(t)
+	coder, err := erasure.NewCoder(3, 8)
+	require.NoError(t, err, "should create coder")
+	chunks := coder.Encode(payload(t, 1000))
+	for _, chunk := range chunks[3:] {
+		chunk[0] ^= 0xff
+	}
+	tree := commit(coder, chunks)
+	arcID := tree.Root()
+
+	// nodes should refuse the payload no matter which chunks they use
+	for _, indices := range [][]int{{0, 1, 2}, {0, 3, 7}, {5, 6, 7}} {
+		selfID := fixture.Hash(t)
+		d, r := setup(t, selfID, []base.Hash{selfID, leaderID}, peers{leaderID})
+		for i, index := range indices {
+			chunk := network.Chunk{
+				ArcID:    arcID,
+				Index:    uint16(index),
+				Required: 3,
+				Total:    8,
+				Data:     chunks[index],
+				Proof:    tree.Proof(index),
+			}
+			err = d.Receive(leaderID, &chunk)
+			if i < len(indices)-1 {
+				require.NoError(t, err, "should receive chunk")
+			}
+		}
+		assert.Error(t, err, "should detect inconsistent encoding")
+		assert.Empty(t, r.payloads, "should not pass on payload")
+	}
+}
+
+func TestDisperserRetain(t *testing.T) {
+
+	selfID := fixture.Hash(t)
+	d, _ := setup(t, selfID, []base.Hash{selfID}, peers{})
+	for i := 0; i < 10; i++ {
+		require.NotNil(t, d.arc(fixture.Hash(t), fixture.Hash(t), 1, 1), "should open arc")
+	}
+	assert.Len(t, d.arcs, 4, "should only retain configured number of arcs")
+	assert.Len(t, d.order, 4, "should prune arc order")
+	assert.Len(t, d.opened, 4, "should only count retained arcs")
+
+	// a single peer should only be able to open a limited number of arcs, so
+	// that it can't push out the arcs of all other peers
+	originID := fixture.Hash(t)
+	arcIDs := fixture.Hashes(t, 2)
+	for _, arcID := range arcIDs {
+		require.NotNil(t, d.arc(arcID, originID, 1, 1), "should open arc within limit")
+	}
+	assert.Nil(t, d.arc(fixture.Hash(t), originID, 1, 1), "should not open arc over limit")
+	assert.NotNil(t, d.arc(arcIDs[0], originID, 1, 1), "should still return open arc")
+	assert.NotNil(t, d.arc(fixture.Hash(t), selfID, 1, 1), "should not limit own arcs")
+
+	// once its arcs are gone, the peer should be able to open new ones
+	for i := 0; i < 4; i++ {
+		require.NotNil(t, d.arc(fixture.Hash(t), fixture.Hash(t), 1, 1), "should open arc")
+	}
+	assert.NotNil(t, d.arc(fixture.Hash(t), originID, 1, 1), "should open arc after eviction")
+}
+
+func TestDisperserDissemination(t *testing.T) {
+
+	// connect a number of dispersers through a simulated network, with the
+	// leader unable to reach some of the nodes
+	hub := sim.NewHub(1, sim.Faults{Latency: sim.Uniform(0, time.Millisecond)})
+	defer hub.Close()
+	nodeIDs := fixture.Hashes(t, 20)
+	recorders := make([]*recorder, 0, len(nodeIDs))
+	var leader *Disperser
+	var trans *fake
+	for i, nodeID := range nodeIDs {
+		r := &recorder{payloads: make(map[base.Hash][][]byte)}
+		d, err := New(nodeID, nodeIDs, r, r, DefaultConfig)
+		require.NoError(t, err, "should create disperser")
+		e, err := hub.Join(nodeID, d)
+		require.NoError(t, err, "should join hub")
+		if i == 0 {
+			leader = d
+			trans = &fake{trans: e, drop: make(map[base.Hash]bool)}
+			d.Attach(trans)
+		} else {
+			d.Attach(e)
+		}
+		recorders = append(recorders, r)
+	}
+	for _, nodeID := range nodeIDs[1:4] {
+		trans.drop[nodeID] = true
+	}
+
+	// every node should rebuild the payload
+	data := payload(t, 1<<16)
+	arcID, err := leader.Disperse(data)
+	require.NoError(t, err, "should disperse payload")
+	for i, r := range recorders {
+		require.Eventuallyf(t, func() bool { return r.count(arcID) == 1 }, 5*time.Second, time.Millisecond, "node %d should rebuild payload", i)
+		r.Lock()
+		assert.True(t, bytes.Equal(data, r.payloads[arcID][0]), "node %d should rebuild original payload", i)
+		r.Unlock()
+	}
+
+	// the leader should upload much less than a full broadcast
+	trans.Lock()
+	defer trans.Unlock()
+	broadcast := (len(nodeIDs) - 1) * len(data)
+	assert.Less(t, trans.bytes, broadcast/3, "should upload less than a third of a broadcast")
+}
@@ -0,0 +1,228 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package erasure splits payloads into chunks with a systematic Reed-Solomon
+// code over GF(2^8), so that any large enough subset of the chunks is enough
+// to rebuild the payload, and commits to the chunks with a Merkle tree, so
+// that every single chunk can be checked against the root.
+//
+// The first chunks hold the payload itself, prefixed with its length and
+// padded to a multiple of the number of data chunks; the remaining chunks are
+// parity, computed with a Cauchy matrix, which makes every square submatrix
+// of the encoding matrix invertible.
+package erasure
+
+import (
+	"encoding/binary"
+
+	"github.com/awfm/rich"
+)
+
+// MaxChunks is the maximum total number of chunks, which is limited by the
+// size of the field.
+const MaxChunks = 256
+
+// Coder encodes payloads into a fixed number of chunks, of which a fixed
+// number are required to decode them again.
+type Coder struct {
+	required int
+	total    int
+	parity   [][]byte
+}
+
+// NewCoder creates a coder for the given number of required and total chunks.
+func NewCoder(required int, total int) (*Coder, error) {
+
+	if required < 1 || required > total || total > MaxChunks {
+		return nil, rich.Errorf("invalid chunk counts").Int("required", required).Int("total", total)
+	}
+
+	// the parity rows of the encoding matrix form a Cauchy matrix, where the
+	// element at row i and column j is 1 / (x_i + y_j), with the x being the
+	// indices of the parity chunks and the y the indices of the data chunks
+	parity := make([][]byte, 0, total-required)
+	for i := required; i < total; i++ {
+		row := make([]byte, required)
+		for j := 0; j < required; j++ {
+			row[j] = inv(byte(i) ^ byte(j))
+		}
+		parity = append(parity, row)
+	}
+
+	c := Coder{
+		required: required,
+		total:    total,
+		parity:   parity,
+	}
+
+	return &c, nil
+}
+
+// Required returns the number of chunks needed to decode a payload.
+func (c *Coder) Required() int {
+	return c.required
+}
+
+// Total returns the number of chunks a payload is encoded into.
+func (c *Coder) Total() int {
+	return c.total
+}
+
+// Encode splits the payload into the total number of chunks, which are all
+// the same size.
+func (c *Coder) Encode(payload []byte) [][]byte {
+
+	// 1) lay out the length and the payload over the data chunks
+	size := (8 + len(payload) + c.required - 1) / c.required
+	data := make([]byte, size*c.required)
+	binary.BigEndian.PutUint64(data, uint64(len(payload)))
+	copy(data[8:], payload)
+	chunks := make([][]byte, 0, c.total)
+	for i := 0; i < c.required; i++ {
+		chunks = append(chunks, data[i*size:(i+1)*size])
+	}
+
+	// 2) compute the parity chunks from the data chunks
+	for _, row := range c.parity {
+		chunk := make([]byte, size)
+		for j, coefficient := range row {
+			muladd(chunk, chunks[j], coefficient)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// Decode rebuilds the payload from the chunks, which are indexed by their
+// position in the encoding, with nil for any missing chunk. At least the
+// required number of chunks have to be present, and all of the same size.
+func (c *Coder) Decode(chunks [][]byte) ([]byte, error) {
+
+	if len(chunks) != c.total {
+		return nil, rich.Errorf("invalid number of chunks").Int("chunks", len(chunks)).Int("total", c.total)
+	}
+
+	// 1) pick the first required chunks that are present, preferring data
+	// chunks, which need no decoding
+	indices := make([]int, 0, c.required)
+	size := -1
+	for i, chunk := range chunks {
+		if chunk == nil {
+			continue
+		}
+		if size >= 0 && len(chunk) != size {
+			return nil, rich.Errorf("inconsistent chunk size").Int("index", i).Int("size", len(chunk)).Int("expected", size)
+		}
+		size = len(chunk)
+		if len(indices) < c.required {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) < c.required {
+		return nil, rich.Errorf("not enough chunks").Int("available", len(indices)).Int("required", c.required)
+	}
+
+	// 2) invert the rows of the encoding matrix for the chunks we have, and
+	// use the inverse to recover the data chunks
+	rows := make([][]byte, 0, c.required)
+	for _, index := range indices {
+		rows = append(rows, c.row(index))
+	}
+	inverse, err := invert(rows)
+	if err != nil {
+		return nil, rich.Errorf("could not invert matrix: %w", err)
+	}
+	data := make([]byte, 0, size*c.required)
+	for j := 0; j < c.required; j++ {
+		if indices[j] == j {
+			data = append(data, chunks[j]...)
+			continue
+		}
+		chunk := make([]byte, size)
+		for r, index := range indices {
+			muladd(chunk, chunks[index], inverse[j][r])
+		}
+		data = append(data, chunk...)
+	}
+
+	// 3) cut the payload out of the data
+	if len(data) < 8 {
+		return nil, rich.Errorf("missing payload length")
+	}
+	length := binary.BigEndian.Uint64(data)
+	if length > uint64(len(data)-8) {
+		return nil, rich.Errorf("invalid payload length").Uint64("length", length).Int("available", len(data)-8)
+	}
+
+	return data[8 : 8+length], nil
+}
+
+// row returns the row of the encoding matrix for the chunk with the index.
+func (c *Coder) row(index int) []byte {
+	if index >= c.required {
+		return c.parity[index-c.required]
+	}
+	row := make([]byte, c.required)
+	row[index] = 1
+	return row
+}
+
+// invert inverts the square matrix with Gauss-Jordan elimination.
+func invert(matrix [][]byte) ([][]byte, error) {
+
+	// work on a copy, extended with the identity matrix
+	n := len(matrix)
+	work := make([][]byte, 0, n)
+	for i, row := range matrix {
+		extended := make([]byte, 2*n)
+		copy(extended, row)
+		extended[n+i] = 1
+		work = append(work, extended)
+	}
+
+	for col := 0; col < n; col++ {
+
+		// find a row with a non-zero pivot and move it into place
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, rich.Errorf("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		// scale the pivot to one and eliminate the column everywhere else
+		scale := inv(work[col][col])
+		for k := range work[col] {
+			work[col][k] = mul(work[col][k], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			muladd(work[row], work[col], work[row][col])
+		}
+	}
+
+	inverse := make([][]byte, 0, n)
+	for _, row := range work {
+		inverse = append(inverse, row[n:])
+	}
+
+	return inverse, nil
+}
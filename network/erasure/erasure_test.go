@@ -0,0 +1,142 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package erasure
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+func TestField(t *testing.T) {
+
+	// every non-zero element should have an inverse, and multiplication
+	// should distribute over addition
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), mul(byte(a), inv(byte(a))), "should invert element (%d)", a)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		a, b, c := byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))
+		assert.Equal(t, mul(a, b^c), mul(a, b)^mul(a, c), "should distribute (%d, %d, %d)", a, b, c)
+	}
+}
+
+func TestCoderSubsets(t *testing.T) {
+
+	// with few chunks, every possible subset of required chunks should
+	// rebuild the payload
+	coder, err := NewCoder(3, 7)
+	require.NoError(t, err, "should create coder")
+	payload := []byte("a payload that spans several chunks")
+	chunks := coder.Encode(payload)
+	require.Len(t, chunks, 7, "should encode into total chunks")
+	assert.Equal(t, payload, append(append(chunks[0][8:], chunks[1]...), chunks[2]...)[:len(payload)], "should keep payload in data chunks")
+	for mask := 0; mask < 1<<7; mask++ {
+		subset := make([][]byte, 7)
+		count := 0
+		for i := range chunks {
+			if mask&(1<<i) != 0 {
+				subset[i] = chunks[i]
+				count++
+			}
+		}
+		decoded, err := coder.Decode(subset)
+		if count < 3 {
+			assert.Error(t, err, "should not decode with too few chunks (mask: %b)", mask)
+			continue
+		}
+		require.NoError(t, err, "should decode (mask: %b)", mask)
+		assert.Equal(t, payload, decoded, "should rebuild payload (mask: %b)", mask)
+	}
+}
+
+func TestCoderRandom(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+
+		// random sizes, including the largest number of chunks and empty
+		// payloads
+		total := 1 + rng.Intn(MaxChunks)
+		if i == 0 {
+			total = MaxChunks
+		}
+		required := 1 + rng.Intn(total)
+		coder, err := NewCoder(required, total)
+		require.NoError(t, err, "should create coder")
+		payload := make([]byte, rng.Intn(4096))
+		_, _ = rng.Read(payload)
+
+		// drop all but the required number of chunks at random
+		chunks := coder.Encode(payload)
+		for _, index := range rng.Perm(total)[required:] {
+			chunks[index] = nil
+		}
+		decoded, err := coder.Decode(chunks)
+		require.NoError(t, err, "should decode (required: %d, total: %d)", required, total)
+		assert.Equal(t, len(payload), len(decoded), "should rebuild payload length")
+		assert.Equal(t, payload, append([]byte{}, decoded...), "should rebuild payload")
+	}
+
+	// invalid parameters and inputs should be rejected
+	_, err := NewCoder(0, 3)
+	assert.Error(t, err, "should not create coder without required chunks")
+	_, err = NewCoder(4, 3)
+	assert.Error(t, err, "should not require more than total chunks")
+	_, err = NewCoder(3, MaxChunks+1)
+	assert.Error(t, err, "should not exceed maximum chunks")
+	coder, err := NewCoder(2, 4)
+	require.NoError(t, err, "should create coder")
+	chunks := coder.Encode([]byte("payload"))
+	_, err = coder.Decode(chunks[:3])
+	assert.Error(t, err, "should not decode wrong number of chunks")
+	_, err = coder.Decode([][]byte{chunks[0], nil, append(chunks[2], 0), nil})
+	assert.Error(t, err, "should not decode chunks of different sizes")
+}
+
+func TestMerkle(t *testing.T) {
+
+	for count := 1; count <= 33; count++ {
+		leaves := make([][]byte, 0, count)
+		for i := 0; i < count; i++ {
+			leaves = append(leaves, []byte{byte(i), byte(count)})
+		}
+		tree := NewTree(leaves)
+		root := tree.Root()
+
+		// every leaf should verify at its index, and nowhere else
+		for i, leaf := range leaves {
+			proof := tree.Proof(i)
+			assert.True(t, Verify(root, i, count, leaf, proof), "should verify leaf (count: %d, index: %d)", count, i)
+			assert.False(t, Verify(root, (i+1)%count, count, leaf, proof) && count > 1, "should not verify at other index (count: %d, index: %d)", count, i)
+			assert.False(t, Verify(root, i, count, append(leaf, 0), proof), "should not verify other leaf (count: %d, index: %d)", count, i)
+			if len(proof) > 0 {
+				tampered := append([]base.Hash{}, proof...)
+				tampered[0][0] ^= 1
+				assert.False(t, Verify(root, i, count, leaf, tampered), "should not verify tampered proof (count: %d, index: %d)", count, i)
+				assert.False(t, Verify(root, i, count, leaf, proof[1:]), "should not verify short proof (count: %d, index: %d)", count, i)
+			}
+			assert.False(t, Verify(root, i, count, leaf, append(proof, root)), "should not verify long proof (count: %d, index: %d)", count, i)
+		}
+		assert.False(t, Verify(root, count, count, leaves[0], tree.Proof(0)), "should not verify index out of range")
+	}
+}
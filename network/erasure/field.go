@@ -0,0 +1,71 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package erasure
+
+// The arithmetic of GF(2^8), with the field generated by the polynomial
+// x^8 + x^4 + x^3 + x^2 + 1, and with 2 as generator of the multiplicative
+// group. Addition is XOR, and multiplication goes through logarithm tables.
+var (
+	exps [510]byte
+	logs [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exps[i] = byte(x)
+		exps[i+255] = byte(x)
+		logs[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+// mul multiplies two field elements.
+func mul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return exps[int(logs[a])+int(logs[b])]
+}
+
+// inv returns the multiplicative inverse of a non-zero field element.
+func inv(a byte) byte {
+	return exps[255-int(logs[a])]
+}
+
+// muladd adds the source multiplied by the coefficient to the destination,
+// element by element.
+func muladd(dst []byte, src []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	if coefficient == 1 {
+		for i, s := range src {
+			dst[i] ^= s
+		}
+		return
+	}
+	log := int(logs[coefficient])
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= exps[int(logs[s])+log]
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package erasure
+
+import (
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// The prefixes that separate the hashes of leaves from those of inner nodes,
+// so that an inner node can't be passed off as a leaf.
+const (
+	prefixLeaf  = 0x00
+	prefixInner = 0x01
+)
+
+// Tree is a Merkle tree over a list of leaves. On levels with an odd number
+// of nodes, the last node is carried up to the next level as is.
+type Tree struct {
+	levels [][]base.Hash
+}
+
+// NewTree builds the Merkle tree over the leaves, which must not be empty.
+func NewTree(leaves [][]byte) *Tree {
+
+	level := make([]base.Hash, 0, len(leaves))
+	for _, leaf := range leaves {
+		level = append(level, hashLeaf(leaf))
+	}
+	levels := [][]base.Hash{level}
+	for len(level) > 1 {
+		next := make([]base.Hash, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, hashInner(level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	t := Tree{
+		levels: levels,
+	}
+
+	return &t
+}
+
+// Root returns the root of the tree, which commits to all leaves.
+func (t *Tree) Root() base.Hash {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Proof returns the sibling hashes on the path from the leaf with the given
+// index up to the root.
+func (t *Tree) Proof(index int) []base.Hash {
+	var proof []base.Hash
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// Verify checks that the leaf is at the given index of a tree with the given
+// number of leaves and the given root. Trees with different numbers of leaves
+// can share the path to a leaf, so leaves have to include the number of
+// leaves if a proof should commit to it.
+func Verify(root base.Hash, index int, count int, leaf []byte, proof []base.Hash) bool {
+
+	if index < 0 || index >= count {
+		return false
+	}
+	hash := hashLeaf(leaf)
+	for width := count; width > 1; width = (width + 1) / 2 {
+		sibling := index ^ 1
+		if sibling < width {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				hash = hashInner(hash, proof[0])
+			} else {
+				hash = hashInner(proof[0], hash)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+
+	return len(proof) == 0 && hash == root
+}
+
+func hashLeaf(leaf []byte) base.Hash {
+	return sha3.Sum256(append([]byte{prefixLeaf}, leaf...))
+}
+
+func hashInner(left base.Hash, right base.Hash) base.Hash {
+	data := make([]byte, 0, 1+2*len(left))
+	data = append(data, prefixInner)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha3.Sum256(data)
+}
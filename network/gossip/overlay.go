@@ -0,0 +1,334 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package gossip disseminates proposals through a gossip overlay, so that the
+// proposer doesn't need a direct link to every participant. The proposer sends
+// its proposal to a random subset of its peers, and every node that receives
+// it for the first time forwards it to a random subset of its own peers, until
+// its time-to-live runs out. Votes are still sent directly to the collectors.
+//
+// The overlay deduplicates proposals, as the processor expects the network to
+// do, so that every node delivers each proposal at most once to its engine.
+// Proposals are forwarded before the engine validates them. A node thus can't
+// vouch for the proposals it relays, and the score package doesn't charge
+// relays for invalid ones. For the same reason, proposals are told apart by
+// their codec.Fingerprint, and the heights of the proposals the overlay tracks
+// are bounded by the final height of the graph, rather than by the heights of
+// the proposals themselves; otherwise, a single forged proposal at a huge
+// height would make the overlay drop all genuine ones.
+package gossip
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/codec"
+)
+
+// Config contains the parameters of the gossip overlay.
+type Config struct {
+	Fanout uint   // number of random peers a proposal is forwarded to
+	TTL    uint8  // number of hops a proposal travels from the proposer
+	Retain uint64 // number of heights around the final height proposals are tracked for
+}
+
+// DefaultConfig reaches all nodes of committees with hundreds of participants
+// with high probability.
+var DefaultConfig = Config{
+	Fanout: 8,
+	TTL:    8,
+	Retain: 64,
+}
+
+// Overlay implements the consensus network on top of a transport. It has to
+// be attached to the transport it uses for sending, and the transport has to
+// pass all messages it receives to the overlay.
+type Overlay struct {
+	sync.Mutex
+	selfID     base.Hash
+	handler    network.Handler
+	graph      consensus.Graph
+	config     Config
+	rng        *rand.Rand
+	trans      network.Transport
+	seen       map[base.Hash]uint64
+	final      uint64
+	duplicates uint
+}
+
+// New creates a gossip overlay for the node with the given identity, which
+// passes the messages it receives to the handler and tracks proposals around
+// the final height of the graph. The seed is used for the random selection of
+// peers.
+func New(selfID base.Hash, handler network.Handler, graph consensus.Graph, config Config, seed int64) *Overlay {
+
+	o := Overlay{
+		selfID:  selfID,
+		handler: handler,
+		graph:   graph,
+		config:  config,
+		rng:     rand.New(rand.NewSource(seed)),
+		seen:    make(map[base.Hash]uint64),
+	}
+
+	return &o
+}
+
+// Attach sets the transport used to send messages, which has to be done before
+// sending anything.
+func (o *Overlay) Attach(trans network.Transport) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.trans = trans
+}
+
+// Broadcast starts the gossip of our own proposal.
+func (o *Overlay) Broadcast(proposal *message.Proposal) error {
+
+	if proposal.Candidate == nil {
+		return rich.Errorf("missing candidate")
+	}
+	_, err := o.transport()
+	if err != nil {
+		return rich.Errorf("could not get transport: %w", err)
+	}
+
+	// mark our own proposal as seen, so we ignore it when it comes back
+	proposalID, err := codec.Fingerprint(proposal)
+	if err != nil {
+		return rich.Errorf("could not fingerprint proposal: %w", err)
+	}
+	_, err = o.mark(proposal.Candidate.Height, proposalID)
+	if err != nil {
+		return rich.Errorf("could not mark proposal: %w", err)
+	}
+
+	err = o.forward(o.selfID, &network.Gossip{TTL: o.config.TTL, Proposal: proposal})
+	if err != nil {
+		return rich.Errorf("could not gossip proposal: %w", err)
+	}
+
+	return nil
+}
+
+// Transmit sends the vote directly to the recipient.
+func (o *Overlay) Transmit(vote *message.Vote, recipientID base.Hash) error {
+
+	trans, err := o.transport()
+	if err != nil {
+		return rich.Errorf("could not get transport: %w", err)
+	}
+	err = trans.Send(recipientID, vote)
+	if err != nil {
+		return rich.Errorf("could not send vote: %w", err)
+	}
+
+	return nil
+}
+
+// Receive processes a message received from a peer. Proposals that were seen
+// before are dropped, new ones are forwarded if their time-to-live allows it,
+// and then passed to the handler along with votes.
+func (o *Overlay) Receive(originID base.Hash, msg interface{}) error {
+
+	switch m := msg.(type) {
+
+	case *network.Gossip:
+		if m.Proposal == nil || m.Proposal.Candidate == nil {
+			return rich.Errorf("missing proposal").Hex("origin", originID[:])
+		}
+		proposalID, err := codec.Fingerprint(m.Proposal)
+		if err != nil {
+			return rich.Errorf("could not fingerprint proposal: %w", err).Hex("origin", originID[:])
+		}
+		fresh, err := o.mark(m.Proposal.Candidate.Height, proposalID)
+		if err != nil {
+			return rich.Errorf("could not mark proposal: %w", err).Hex("origin", originID[:])
+		}
+		if !fresh {
+			return nil
+		}
+
+		// forward before processing, so the gossip doesn't wait for the engine;
+		// a failure to forward shouldn't keep us from processing the proposal
+		var failure error
+		if m.TTL > 1 {
+			failure = o.forward(originID, &network.Gossip{TTL: m.TTL - 1, Proposal: m.Proposal})
+		}
+		err = o.handler.Proposal(originID, m.Proposal)
+		if network.Backpressure(err) {
+			o.unmark(proposalID)
+		}
+		if err != nil {
+			return rich.Errorf("could not handle proposal: %w", err)
+		}
+		if failure != nil {
+			return rich.Errorf("could not forward proposal: %w", failure)
+		}
+		return nil
+
+	case *message.Proposal:
+		if m.Candidate == nil {
+			return rich.Errorf("missing candidate").Hex("origin", originID[:])
+		}
+		proposalID, err := codec.Fingerprint(m)
+		if err != nil {
+			return rich.Errorf("could not fingerprint proposal: %w", err).Hex("origin", originID[:])
+		}
+		fresh, err := o.mark(m.Candidate.Height, proposalID)
+		if err != nil {
+			return rich.Errorf("could not mark proposal: %w", err).Hex("origin", originID[:])
+		}
+		if !fresh {
+			return nil
+		}
+		err = o.handler.Proposal(originID, m)
+		if network.Backpressure(err) {
+			o.unmark(proposalID)
+		}
+		return err
+
+	case *message.Vote:
+		return o.handler.Vote(originID, m)
+
+	default:
+		return rich.Errorf("unsupported message type").Str("type", fmt.Sprintf("%T", msg)).Hex("origin", originID[:])
+	}
+}
+
+// Duplicates returns the number of proposals that were dropped because they
+// were seen before, or because their height is not tracked.
+func (o *Overlay) Duplicates() uint {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.duplicates
+}
+
+// mark adds the proposal with the given fingerprint at the given height to the
+// set of seen proposals and returns whether it is new. Proposals at heights
+// that are not tracked are treated as seen.
+func (o *Overlay) mark(height uint64, proposalID base.Hash) (bool, error) {
+
+	final, err := o.graph.Final()
+	if err != nil {
+		return false, rich.Errorf("could not get final: %w", err)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	// 1) forget about old proposals once finalization moved on
+	if final.Height > o.final {
+		o.final = final.Height
+		for seenID, seenHeight := range o.seen {
+			if !o.tracked(seenHeight) {
+				delete(o.seen, seenID)
+			}
+		}
+	}
+
+	// 2) drop proposals at heights we don't track
+	if !o.tracked(height) {
+		o.duplicates++
+		return false, nil
+	}
+
+	// 3) drop proposals we have already seen
+	_, ok := o.seen[proposalID]
+	if ok {
+		o.duplicates++
+		return false, nil
+	}
+	o.seen[proposalID] = height
+
+	return true, nil
+}
+
+// unmark removes the proposal from the set of seen proposals, so that it is
+// processed when the transport delivers it again after backpressure; if it was
+// gossip, it is forwarded again, too, which peers will drop as a duplicate.
+func (o *Overlay) unmark(proposalID base.Hash) {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.seen, proposalID)
+}
+
+// tracked checks whether proposals at the given height are within the retained
+// heights around the final height. It has to be called with the lock held.
+func (o *Overlay) tracked(height uint64) bool {
+	if o.final > o.config.Retain && height < o.final-o.config.Retain {
+		return false
+	}
+	return height <= o.final+o.config.Retain
+}
+
+// forward sends the gossip to a random subset of peers, other than the peer
+// we received it from. It returns the first error, but tries all peers.
+func (o *Overlay) forward(originID base.Hash, gossip *network.Gossip) error {
+
+	trans, err := o.transport()
+	if err != nil {
+		return rich.Errorf("could not get transport: %w", err)
+	}
+
+	// select the peers under the lock, as the random source is not safe for
+	// concurrent use
+	var peerIDs []base.Hash
+	for _, peerID := range trans.Peers() {
+		if peerID != originID && peerID != o.selfID {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	o.Lock()
+	o.rng.Shuffle(len(peerIDs), func(i int, j int) {
+		peerIDs[i], peerIDs[j] = peerIDs[j], peerIDs[i]
+	})
+	o.Unlock()
+	if uint(len(peerIDs)) > o.config.Fanout {
+		peerIDs = peerIDs[:o.config.Fanout]
+	}
+
+	var failure error
+	for _, peerID := range peerIDs {
+		err := trans.Send(peerID, gossip)
+		if err != nil && failure == nil {
+			failure = rich.Errorf("could not send gossip: %w", err).Hex("peer", peerID[:])
+		}
+	}
+
+	return failure
+}
+
+// transport returns the attached transport.
+func (o *Overlay) transport() (network.Transport, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.trans == nil {
+		return nil, rich.Errorf("no transport attached")
+	}
+	return o.trans, nil
+}
@@ -0,0 +1,360 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gossip
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/sim"
+)
+
+var _ consensus.Network = (*Overlay)(nil)
+var _ network.Receiver = (*Overlay)(nil)
+
+// sent is a message sent over the fake transport.
+type sent struct {
+	peerID base.Hash
+	msg    interface{}
+}
+
+// fake is a transport that records the messages it sends.
+type fake struct {
+	peerIDs []base.Hash
+	sent    []sent
+}
+
+func (f *fake) Peers() []base.Hash {
+	return f.peerIDs
+}
+
+func (f *fake) Send(peerID base.Hash, msg interface{}) error {
+	f.sent = append(f.sent, sent{peerID: peerID, msg: msg})
+	return nil
+}
+
+// counter is a handler that counts how often it gets each proposal, and fails
+// proposals while it has an error set.
+type counter struct {
+	sync.Mutex
+	proposals map[base.Hash]int
+	votes     int
+	err       error
+}
+
+func (c *counter) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	c.Lock()
+	defer c.Unlock()
+	c.proposals[proposal.Candidate.ID()]++
+	return c.err
+}
+
+func (c *counter) Vote(originID base.Hash, vote *message.Vote) error {
+	c.Lock()
+	defer c.Unlock()
+	c.votes++
+	return nil
+}
+
+// finalized creates a graph with the given final height, which can be moved
+// up while the graph is in use.
+func finalized(final *uint64) *mocks.Graph {
+	graph := &mocks.Graph{}
+	graph.On("Final").Return(
+		func() *base.Vertex {
+			return &base.Vertex{Height: *final}
+		},
+		nil,
+	)
+	return graph
+}
+
+func TestOverlayReceive(t *testing.T) {
+
+	selfID := fixture.Hash(t)
+	originID := fixture.Hash(t)
+	trans := &fake{peerIDs: append(fixture.Hashes(t, 5), originID)}
+	handler := &counter{proposals: make(map[base.Hash]int)}
+	final := uint64(15)
+	o := New(selfID, handler, finalized(&final), Config{Fanout: 3, TTL: 4, Retain: 10}, 1)
+
+	// nothing should be sent before attaching the transport
+	assert.Error(t, o.Broadcast(fixture.Proposal(t)), "should not broadcast without transport")
+	assert.Error(t, o.Transmit(fixture.Vote(t), originID), "should not transmit without transport")
+	o.Attach(trans)
+
+	// our own proposal should go to fanout peers with the full time-to-live
+	own := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	require.NoError(t, o.Broadcast(own), "should broadcast proposal")
+	require.Len(t, trans.sent, 3, "should send to fanout peers")
+	for _, s := range trans.sent {
+		assert.Equal(t, &network.Gossip{TTL: 4, Proposal: own}, s.msg, "should send gossip with full time-to-live")
+	}
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 3, Proposal: own}), "should receive own proposal")
+	assert.Empty(t, handler.proposals, "should not deliver own proposal")
+
+	// a new proposal should be forwarded with a lower time-to-live, but not to
+	// its origin, and be delivered exactly once
+	trans.sent = nil
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: proposal}), "should receive proposal")
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: proposal}), "should receive duplicate")
+	require.NoError(t, o.Receive(originID, proposal), "should receive direct duplicate")
+	require.Len(t, trans.sent, 3, "should forward once to fanout peers")
+	for _, s := range trans.sent {
+		assert.NotEqual(t, originID, s.peerID, "should not forward to origin")
+		assert.Equal(t, &network.Gossip{TTL: 1, Proposal: proposal}, s.msg, "should forward with lower time-to-live")
+	}
+	assert.Equal(t, 1, handler.proposals[proposal.Candidate.ID()], "should deliver proposal once")
+	assert.Equal(t, uint(3), o.Duplicates(), "should count duplicates")
+
+	// a proposal at the end of its time-to-live should not be forwarded
+	trans.sent = nil
+	last := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(21))))
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 1, Proposal: last}), "should receive proposal")
+	assert.Empty(t, trans.sent, "should not forward expired gossip")
+	assert.Equal(t, 1, handler.proposals[last.Candidate.ID()], "should deliver expired gossip")
+
+	// once finalization moved on, proposals below the retained heights should
+	// be dropped, and forgotten proposals should not be delivered again
+	final = 31
+	stale := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(19))))
+	require.NoError(t, o.Receive(originID, stale), "should receive stale proposal")
+	require.NoError(t, o.Receive(originID, proposal), "should receive forgotten proposal")
+	assert.Equal(t, 0, handler.proposals[stale.Candidate.ID()], "should not deliver stale proposal")
+	assert.Equal(t, 1, handler.proposals[proposal.Candidate.ID()], "should not deliver forgotten proposal again")
+	assert.Len(t, o.seen, 1, "should prune seen set")
+
+	// votes should be sent directly and passed through
+	vote := fixture.Vote(t)
+	require.NoError(t, o.Transmit(vote, originID), "should transmit vote")
+	assert.Equal(t, sent{peerID: originID, msg: vote}, trans.sent[len(trans.sent)-1], "should send vote directly")
+	require.NoError(t, o.Receive(originID, vote), "should receive vote")
+	require.NoError(t, o.Receive(originID, vote), "should receive vote again")
+	assert.Equal(t, 2, handler.votes, "should deliver votes")
+
+	// invalid messages should be rejected
+	assert.Error(t, o.Receive(originID, &network.Gossip{TTL: 2}), "should reject gossip without proposal")
+	assert.Error(t, o.Receive(originID, &message.Proposal{}), "should reject proposal without candidate")
+	assert.Error(t, o.Receive(originID, fixture.Vertex(t)), "should reject other messages")
+	assert.Error(t, o.Broadcast(&message.Proposal{}), "should not broadcast proposal without candidate")
+}
+
+func TestOverlayForgery(t *testing.T) {
+
+	originID := fixture.Hash(t)
+	trans := &fake{peerIDs: fixture.Hashes(t, 3)}
+	handler := &counter{proposals: make(map[base.Hash]int)}
+	final := uint64(15)
+	o := New(fixture.Hash(t), handler, finalized(&final), Config{Fanout: 3, TTL: 4, Retain: 10}, 1)
+	o.Attach(trans)
+
+	// a copy of the proposal with a forged signature arriving first should not
+	// keep the genuine proposal from being delivered and forwarded
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	forged := *proposal
+	forged.Signature = fixture.Sig(t)
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: &forged}), "should receive forged proposal")
+	trans.sent = nil
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: proposal}), "should receive genuine proposal")
+	assert.Equal(t, 2, handler.proposals[proposal.Candidate.ID()], "should deliver genuine proposal after forged copy")
+	require.Len(t, trans.sent, 3, "should forward genuine proposal")
+	for _, s := range trans.sent {
+		assert.Equal(t, &network.Gossip{TTL: 1, Proposal: proposal}, s.msg, "should forward genuine proposal")
+	}
+
+	// the genuine proposal should still only be delivered once
+	require.NoError(t, o.Receive(originID, proposal), "should receive duplicate")
+	assert.Equal(t, 2, handler.proposals[proposal.Candidate.ID()], "should not deliver genuine proposal again")
+}
+
+func TestOverlayHeights(t *testing.T) {
+
+	originID := fixture.Hash(t)
+	trans := &fake{peerIDs: fixture.Hashes(t, 3)}
+	handler := &counter{proposals: make(map[base.Hash]int)}
+	final := uint64(15)
+	o := New(fixture.Hash(t), handler, finalized(&final), Config{Fanout: 3, TTL: 4, Retain: 10}, 1)
+	o.Attach(trans)
+
+	// a single forged proposal at a huge height should be dropped without
+	// being delivered or forwarded
+	forged := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(1<<63))))
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: forged}), "should receive forged proposal")
+	assert.Equal(t, 0, handler.proposals[forged.Candidate.ID()], "should not deliver proposal above retained heights")
+	assert.Empty(t, trans.sent, "should not forward proposal above retained heights")
+	assert.Empty(t, o.seen, "should not track proposal above retained heights")
+
+	// it should not keep genuine proposals at the next height from getting
+	// through
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(16))))
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: proposal}), "should receive genuine proposal")
+	assert.Equal(t, 1, handler.proposals[proposal.Candidate.ID()], "should deliver genuine proposal")
+	assert.Len(t, trans.sent, 3, "should forward genuine proposal")
+
+	// proposals above the retained heights should get through once the final
+	// height caught up with them
+	ahead := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(26))))
+	require.NoError(t, o.Receive(originID, ahead), "should receive proposal ahead")
+	assert.Equal(t, 0, handler.proposals[ahead.Candidate.ID()], "should not deliver proposal ahead")
+	final = 16
+	require.NoError(t, o.Receive(originID, ahead), "should receive proposal ahead again")
+	assert.Equal(t, 1, handler.proposals[ahead.Candidate.ID()], "should deliver proposal once caught up")
+}
+
+func TestOverlayBackpressure(t *testing.T) {
+
+	originID := fixture.Hash(t)
+	trans := &fake{peerIDs: fixture.Hashes(t, 3)}
+	handler := &counter{proposals: make(map[base.Hash]int)}
+	final := uint64(15)
+	o := New(fixture.Hash(t), handler, finalized(&final), Config{Fanout: 3, TTL: 4, Retain: 10}, 1)
+	o.Attach(trans)
+
+	// a proposal refused because of backpressure should be processed when it
+	// is delivered again
+	handler.err = signal.QueueFull{Queue: "proposal", Capacity: 1}
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	err := o.Receive(originID, &network.Gossip{TTL: 2, Proposal: proposal})
+	assert.True(t, network.Backpressure(err), "should pass on backpressure")
+	err = o.Receive(originID, proposal)
+	assert.True(t, network.Backpressure(err), "should pass on backpressure")
+	handler.err = nil
+	require.NoError(t, o.Receive(originID, &network.Gossip{TTL: 2, Proposal: proposal}), "should receive proposal again")
+	assert.Equal(t, 3, handler.proposals[proposal.Candidate.ID()], "should deliver proposal again")
+
+	// once accepted, the proposal should be a duplicate
+	require.NoError(t, o.Receive(originID, proposal), "should receive duplicate")
+	assert.Equal(t, 3, handler.proposals[proposal.Candidate.ID()], "should not deliver proposal again")
+
+	// other errors should not make the overlay forget the proposal
+	handler.err = errors.New("dummy error")
+	other := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	assert.Error(t, o.Receive(originID, other), "should pass on error")
+	handler.err = nil
+	require.NoError(t, o.Receive(originID, other), "should receive duplicate")
+	assert.Equal(t, 1, handler.proposals[other.Candidate.ID()], "should not deliver failed proposal again")
+}
+
+func TestOverlayDissemination(t *testing.T) {
+
+	// connect a number of overlays through a simulated network
+	hub := sim.NewHub(1, sim.Faults{Latency: sim.Uniform(0, time.Millisecond)})
+	defer hub.Close()
+	nodeIDs := fixture.Hashes(t, 40)
+	overlays := make([]*Overlay, 0, len(nodeIDs))
+	handlers := make([]*counter, 0, len(nodeIDs))
+	final := uint64(0)
+	for i, nodeID := range nodeIDs {
+		handler := &counter{proposals: make(map[base.Hash]int)}
+		o := New(nodeID, handler, finalized(&final), Config{Fanout: 6, TTL: 6, Retain: 64}, int64(i))
+		e, err := hub.Join(nodeID, o)
+		require.NoError(t, err, "should join hub")
+		o.Attach(e)
+		overlays = append(overlays, o)
+		handlers = append(handlers, handler)
+	}
+
+	// gossip a number of proposals from different proposers
+	proposals := make([]*message.Proposal, 0, 10)
+	for i := 0; i < 10; i++ {
+		proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(uint64(i)))))
+		require.NoError(t, overlays[i].Broadcast(proposal), "should broadcast proposal")
+		proposals = append(proposals, proposal)
+	}
+	require.Eventually(t, func() bool {
+		stats := hub.Stats()
+		return stats.Delivered == stats.Sent
+	}, time.Second, 10*time.Millisecond, "should deliver all gossip")
+
+	// no node should deliver a proposal twice, and almost all should get all
+	delivered := 0
+	for i, handler := range handlers {
+		for j, proposal := range proposals {
+			count := handler.proposals[proposal.Candidate.ID()]
+			require.True(t, count <= 1, "should deliver proposal at most once (node: %d, proposal: %d)", i, j)
+			if i == j && count != 0 {
+				assert.Fail(t, "should not deliver own proposal", "node: %d", i)
+			}
+			delivered += count
+		}
+	}
+	expected := len(proposals) * (len(nodeIDs) - 1)
+	assert.True(t, delivered >= expected*95/100, "should reach almost all nodes (delivered: %d, expected: %d)", delivered, expected)
+	duplicates := uint(0)
+	for _, o := range overlays {
+		duplicates += o.Duplicates()
+	}
+	assert.True(t, duplicates > 0, "should drop duplicate gossip")
+
+	// with a fanout covering everyone, all nodes should get a proposal
+	flood := New(fixture.Hash(t), &counter{}, finalized(&final), Config{Fanout: 100, TTL: 1}, 0)
+	e, err := hub.Join(flood.selfID, flood)
+	require.NoError(t, err, "should join hub")
+	flood.Attach(e)
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(10))))
+	require.NoError(t, flood.Broadcast(proposal), "should broadcast proposal")
+	require.Eventually(t, func() bool {
+		for _, handler := range handlers {
+			handler.Lock()
+			count := handler.proposals[proposal.Candidate.ID()]
+			handler.Unlock()
+			if count != 1 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond, "should deliver to all nodes")
+}
+
+func TestOverlayForwardFailure(t *testing.T) {
+
+	// a failure to forward should be reported after delivering the proposal
+	handler := &counter{proposals: make(map[base.Hash]int)}
+	final := uint64(0)
+	o := New(fixture.Hash(t), handler, finalized(&final), DefaultConfig, 1)
+	o.Attach(&failing{peerIDs: fixture.Hashes(t, 2)})
+	proposal := fixture.Proposal(t, fixture.WithCandidate(fixture.Vertex(t, fixture.WithHeight(20))))
+	err := o.Receive(fixture.Hash(t), &network.Gossip{TTL: 2, Proposal: proposal})
+	assert.Error(t, err, "should report failed forward")
+	assert.Equal(t, 1, handler.proposals[proposal.Candidate.ID()], "should deliver proposal anyway")
+}
+
+// failing is a transport that fails to send anything.
+type failing struct {
+	peerIDs []base.Hash
+}
+
+func (f *failing) Peers() []base.Hash {
+	return f.peerIDs
+}
+
+func (f *failing) Send(peerID base.Hash, msg interface{}) error {
+	return errors.New("unreachable")
+}
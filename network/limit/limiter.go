@@ -0,0 +1,250 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package limit protects the engine from peers flooding it with messages. It
+// keeps a token bucket for every peer and message type, so that a peer that
+// sends too many votes can't eat into the budget for its proposals, nor into
+// the budget of any other peer. Messages over budget are dropped, as a flood
+// is most likely an attack; a full engine queue, on the other hand, is passed
+// on to the transport as backpressure, as it is most likely a burst of honest
+// traffic. Requests of peers, such as queries for missing vertices, have a
+// budget of their own, which the limiter applies in front of the responder.
+package limit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+)
+
+// Rate is the budget of a token bucket, which allows a sustained number of
+// messages per second, as well as bursts of up to the given size.
+type Rate struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// Config holds the budgets for each message type, which apply to every peer
+// separately.
+type Config struct {
+	Proposals Rate
+	Votes     Rate
+	Requests  Rate
+}
+
+// DefaultConfig allows a few proposals per second, which is more than an
+// honest peer will relay, and a lot more votes, which arrive in bursts when
+// the peer collects or forwards a full round of them, and enough requests to
+// catch up on a few dozen missing vertices at once.
+var DefaultConfig = Config{
+	Proposals: Rate{PerSecond: 4, Burst: 16},
+	Votes:     Rate{PerSecond: 256, Burst: 1024},
+	Requests:  Rate{PerSecond: 16, Burst: 64},
+}
+
+// Stats counts the messages the limiter passed on and dropped.
+type Stats struct {
+	Proposals        uint
+	Votes            uint
+	Requests         uint
+	ProposalsLimited uint
+	VotesLimited     uint
+	RequestsLimited  uint
+}
+
+// kind is a message type with a budget of its own.
+type kind uint8
+
+// The message types with separate budgets.
+const (
+	kindProposal kind = iota
+	kindVote
+	kindRequest
+)
+
+// key identifies the bucket of a peer for one message type.
+type key struct {
+	peerID base.Hash
+	kind   kind
+}
+
+// bucket holds the tokens left to a peer, as of the last update.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter is a handler that passes messages on to the wrapped handler, as long
+// as their origin stays within its budget. Buckets are kept for every origin,
+// so the limiter should sit behind a transport that only accepts messages from
+// a known set of peers.
+type Limiter struct {
+	sync.Mutex
+	handler network.Handler
+	config  Config
+	clock   func() time.Time
+	buckets map[key]*bucket
+	stats   Stats
+}
+
+// New creates a limiter in front of the given handler.
+func New(handler network.Handler, config Config) *Limiter {
+
+	l := Limiter{
+		handler: handler,
+		config:  config,
+		clock:   time.Now,
+		buckets: make(map[key]*bucket),
+	}
+
+	return &l
+}
+
+// Proposal passes the proposal on if its origin has budget left.
+func (l *Limiter) Proposal(originID base.Hash, proposal *message.Proposal) error {
+
+	k := key{peerID: originID, kind: kindProposal}
+	if !l.take(k, l.config.Proposals) {
+		return rich.Errorf("proposal rate exceeded").Hex("origin", originID[:])
+	}
+
+	err := l.handler.Proposal(originID, proposal)
+	if network.Backpressure(err) {
+		l.refund(k, l.config.Proposals)
+	}
+
+	return err
+}
+
+// Vote passes the vote on if its origin has budget left.
+func (l *Limiter) Vote(originID base.Hash, vote *message.Vote) error {
+
+	k := key{peerID: originID, kind: kindVote}
+	if !l.take(k, l.config.Votes) {
+		return rich.Errorf("vote rate exceeded").Hex("origin", originID[:])
+	}
+
+	err := l.handler.Vote(originID, vote)
+	if network.Backpressure(err) {
+		l.refund(k, l.config.Votes)
+	}
+
+	return err
+}
+
+// Responder returns a responder in front of the given one, which passes the
+// requests on as long as their origin has budget left. It should be served by
+// the transport instead of the given responder, so that requests are limited
+// like all other messages.
+func (l *Limiter) Responder(responder network.Responder) network.Responder {
+	return &limited{limiter: l, responder: responder}
+}
+
+// limited is a responder limited by the request budgets of a limiter.
+type limited struct {
+	limiter   *Limiter
+	responder network.Responder
+}
+
+// Respond passes the request on if its origin has budget left.
+func (r *limited) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+
+	k := key{peerID: originID, kind: kindRequest}
+	if !r.limiter.take(k, r.limiter.config.Requests) {
+		return nil, rich.Errorf("request rate exceeded").Hex("origin", originID[:])
+	}
+
+	return r.responder.Respond(originID, msg)
+}
+
+// Stats returns the message counters of the limiter.
+func (l *Limiter) Stats() Stats {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.stats
+}
+
+// take refills the bucket for the time that passed since its last update, and
+// then takes a token from it, if there is one.
+func (l *Limiter) take(k key, rate Rate) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	// 1) refill the bucket, which starts out full
+	now := l.clock()
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: rate.Burst, updated: now}
+		l.buckets[k] = b
+	}
+	elapsed := now.Sub(b.updated)
+	if elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate.PerSecond
+		if b.tokens > rate.Burst {
+			b.tokens = rate.Burst
+		}
+		b.updated = now
+	}
+
+	// 2) take a token, or count the message as limited
+	if b.tokens < 1 {
+		switch k.kind {
+		case kindProposal:
+			l.stats.ProposalsLimited++
+		case kindVote:
+			l.stats.VotesLimited++
+		case kindRequest:
+			l.stats.RequestsLimited++
+		}
+		return false
+	}
+	b.tokens--
+	switch k.kind {
+	case kindProposal:
+		l.stats.Proposals++
+	case kindVote:
+		l.stats.Votes++
+	case kindRequest:
+		l.stats.Requests++
+	}
+
+	return true
+}
+
+// refund gives a token back, when the message was not processed because of
+// backpressure, so that the transport delivering it again doesn't cost the
+// peer twice.
+func (l *Limiter) refund(k key, rate Rate) {
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.buckets[k]
+	b.tokens++
+	if b.tokens > rate.Burst {
+		b.tokens = rate.Burst
+	}
+	if k.kind == kindVote {
+		l.stats.Votes--
+	} else {
+		l.stats.Proposals--
+	}
+}
@@ -0,0 +1,168 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package limit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+)
+
+var _ network.Handler = (*Limiter)(nil)
+
+// counter is a handler and responder that counts the messages it gets, and
+// fails while it has an error set.
+type counter struct {
+	proposals int
+	votes     int
+	requests  int
+	err       error
+}
+
+func (c *counter) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	c.proposals++
+	return c.err
+}
+
+func (c *counter) Vote(originID base.Hash, vote *message.Vote) error {
+	c.votes++
+	return c.err
+}
+
+func (c *counter) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+	c.requests++
+	return msg, c.err
+}
+
+// setup creates a limiter with a small budget and a controlled clock.
+func setup(t *testing.T, handler network.Handler) (*Limiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	config := Config{
+		Proposals: Rate{PerSecond: 1, Burst: 2},
+		Votes:     Rate{PerSecond: 10, Burst: 5},
+		Requests:  Rate{PerSecond: 1, Burst: 3},
+	}
+	l := New(handler, config)
+	l.clock = func() time.Time {
+		return now
+	}
+	return l, &now
+}
+
+func TestLimiterBudgets(t *testing.T) {
+
+	handler := &counter{}
+	l, now := setup(t, handler)
+	originID := fixture.Hash(t)
+	otherID := fixture.Hash(t)
+
+	// a peer should be able to send a burst of votes, but no more
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.Vote(originID, fixture.Vote(t)), "should pass vote within burst")
+	}
+	assert.Error(t, l.Vote(originID, fixture.Vote(t)), "should drop vote over budget")
+	assert.Equal(t, 5, handler.votes, "should not pass vote over budget")
+
+	// the vote budget should neither affect proposals nor other peers
+	require.NoError(t, l.Proposal(originID, fixture.Proposal(t)), "should pass proposal")
+	require.NoError(t, l.Vote(otherID, fixture.Vote(t)), "should pass vote of other peer")
+
+	// the proposal budget should be separate, too
+	require.NoError(t, l.Proposal(originID, fixture.Proposal(t)), "should pass proposal within burst")
+	assert.Error(t, l.Proposal(originID, fixture.Proposal(t)), "should drop proposal over budget")
+
+	// the buckets should refill at their rate, up to their burst
+	*now = now.Add(200 * time.Millisecond)
+	require.NoError(t, l.Vote(originID, fixture.Vote(t)), "should pass vote after refill")
+	require.NoError(t, l.Vote(originID, fixture.Vote(t)), "should pass vote after refill")
+	assert.Error(t, l.Vote(originID, fixture.Vote(t)), "should drop vote once refill is used up")
+	assert.Error(t, l.Proposal(originID, fixture.Proposal(t)), "should not refill proposals as quickly")
+	*now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.Vote(originID, fixture.Vote(t)), "should pass vote within burst")
+	}
+	assert.Error(t, l.Vote(originID, fixture.Vote(t)), "should not refill beyond burst")
+
+	stats := l.Stats()
+	assert.Equal(t, Stats{Proposals: 2, Votes: 13, ProposalsLimited: 2, VotesLimited: 3}, stats, "should count messages")
+}
+
+func TestLimiterBackpressure(t *testing.T) {
+
+	// put a vote queue that can hold a single vote behind the limiter
+	queue := consensus.NewVoteQueue(nil, 1, 1, time.Second, nil)
+	l, _ := setup(t, network.Enqueue(nil, queue))
+	originID := fixture.Hash(t)
+
+	// once the queue is full, the limiter should pass on the backpressure
+	// signal, and should not charge the peer for the vote
+	require.NoError(t, l.Vote(originID, fixture.Vote(t)), "should queue vote")
+	for i := 0; i < 10; i++ {
+		err := l.Vote(originID, fixture.Vote(t))
+		require.Error(t, err, "should not queue vote")
+		assert.True(t, network.Backpressure(err), "should signal backpressure")
+	}
+	assert.Equal(t, Stats{Votes: 1}, l.Stats(), "should not count votes refused by queue")
+
+	// any other error should still cost budget
+	handler := &counter{err: assert.AnError}
+	l, _ = setup(t, handler)
+	for i := 0; i < 5; i++ {
+		err := l.Vote(originID, fixture.Vote(t))
+		require.Error(t, err, "should return handler error")
+		assert.False(t, network.Backpressure(err), "should not signal backpressure")
+	}
+	assert.Error(t, l.Vote(originID, fixture.Vote(t)), "should drop vote over budget")
+	assert.Equal(t, 5, handler.votes, "should not pass vote over budget")
+}
+
+func TestLimiterRequests(t *testing.T) {
+
+	handler := &counter{}
+	l, now := setup(t, handler)
+	r := l.Responder(handler)
+	originID := fixture.Hash(t)
+
+	// a peer should be able to send a burst of requests, but no more
+	for i := 0; i < 3; i++ {
+		_, err := r.Respond(originID, fixture.Vertex(t))
+		require.NoError(t, err, "should answer request within burst")
+	}
+	_, err := r.Respond(originID, fixture.Vertex(t))
+	assert.Error(t, err, "should refuse request over budget")
+	assert.Equal(t, 3, handler.requests, "should not pass request over budget")
+
+	// the request budget should neither affect votes nor other peers
+	require.NoError(t, l.Vote(originID, fixture.Vote(t)), "should pass vote")
+	_, err = r.Respond(fixture.Hash(t), fixture.Vertex(t))
+	require.NoError(t, err, "should answer request of other peer")
+
+	// the bucket should refill at its rate
+	*now = now.Add(time.Second)
+	_, err = r.Respond(originID, fixture.Vertex(t))
+	require.NoError(t, err, "should answer request after refill")
+
+	assert.Equal(t, Stats{Votes: 1, Requests: 5, RequestsLimited: 1}, l.Stats(), "should count requests")
+}
@@ -0,0 +1,222 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package network contains the building blocks shared by the network layer
+// implementations, which connect the consensus engines of the participants.
+// Transports implement the consensus network interface as well as sending
+// messages to individual peers, and pass the messages they receive to a
+// receiver, along with the peer they received them from. Overlays sit on top
+// of transports to change how messages travel between the peers.
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// Transport sends messages to individual peers of the node.
+type Transport interface {
+	Peers() []base.Hash
+	Send(peerID base.Hash, msg interface{}) error
+}
+
+// Banner is a transport that can cut off a peer for some time. While a peer
+// is banned, messages from and to the peer are dropped, and the peer is not
+// listed among the peers of the transport.
+type Banner interface {
+	Ban(peerID base.Hash, duration time.Duration) error
+}
+
+// Securer turns a raw connection between two nodes into an authenticated and
+// encrypted channel. The client is the side that opened the connection. Both
+// return the identity the other side proved during the handshake.
+type Securer interface {
+	Client(conn net.Conn) (net.Conn, base.Hash, error)
+	Server(conn net.Conn) (net.Conn, base.Hash, error)
+}
+
+// Receiver processes any message a transport receives from a peer. A receiver
+// returns a QueueFull signal when it can't take the message right now, in which
+// case the transport holds off and delivers the message again later, rather
+// than dropping it; all other errors are final.
+type Receiver interface {
+	Receive(originID base.Hash, msg interface{}) error
+}
+
+// Gossip is a proposal relayed through a gossip overlay, along with the number
+// of hops it may still travel.
+type Gossip struct {
+	TTL      uint8
+	Proposal *message.Proposal
+}
+
+// Chunk is one of the coded chunks of a payload, along with the proof that it
+// is part of the arc with the given identifier, which is the Merkle root over
+// all chunks. The chunk a node receives from the disperser of the payload is
+// marked for relay, so that the node passes it on to all of its peers.
+type Chunk struct {
+	ArcID    base.Hash
+	Index    uint16
+	Required uint16
+	Total    uint16
+	Relay    bool
+	Data     []byte
+	Proof    []base.Hash
+}
+
+// Requester is a transport that can ask a single peer for data, and wait for
+// its response. The request fails if the context is canceled before the
+// response arrives.
+type Requester interface {
+	Request(ctx context.Context, peerID base.Hash, msg interface{}) (interface{}, error)
+}
+
+// Responder answers the requests a node receives from its peers, such as
+// queries for vertices it is missing. An error is passed on to the peer that
+// made the request.
+type Responder interface {
+	Respond(originID base.Hash, msg interface{}) (interface{}, error)
+}
+
+// Request is a message that asks a peer for a response, with an identifier to
+// correlate the response to the request.
+type Request struct {
+	ID      uint64
+	Message interface{}
+}
+
+// Response answers the request with the same identifier, either with a
+// message, which may be nil, or with an error.
+type Response struct {
+	ID      uint64
+	Message interface{}
+	Error   string
+}
+
+// QueryKind is the kind of data a query asks for.
+type QueryKind uint8
+
+// The kinds of data that can be queried.
+const (
+	QueryVertex QueryKind = 1 // the vertex with the identifier
+	QueryQuorum QueryKind = 2 // the quorum on the vertex with the identifier
+)
+
+// Query asks a peer for the data of the given kind with the given identifier,
+// which is usually sent as request to recover missing parts of the graph.
+type Query struct {
+	Kind QueryKind
+	ID   base.Hash
+}
+
+// Handler processes the messages a node receives from its peers. The origin
+// is the peer that the message was received from, which is not necessarily
+// its author if the message was relayed. Handlers can be stacked to filter
+// messages before they reach the engine.
+type Handler interface {
+	Proposal(originID base.Hash, proposal *message.Proposal) error
+	Vote(originID base.Hash, vote *message.Vote) error
+}
+
+// Engine is the consumer of the messages at the end of the handler stack,
+// which is usually the processor.
+type Engine interface {
+	OnProposal(proposal *message.Proposal) error
+	OnVote(vote *message.Vote) error
+}
+
+// Queue buffers votes in front of the engine, such as the vote queue of the
+// consensus package.
+type Queue interface {
+	Push(vote *message.Vote) error
+}
+
+// Backpressure checks whether the error signals that the message could not be
+// processed right now and should be delivered again later.
+func Backpressure(err error) bool {
+	return errors.As(err, &signal.QueueFull{})
+}
+
+// deliver is a handler passing messages to an engine.
+type deliver struct {
+	engine Engine
+}
+
+// Deliver returns a handler that passes all messages to the given engine,
+// without regard for their origin.
+func Deliver(engine Engine) Handler {
+	return &deliver{engine: engine}
+}
+
+func (d *deliver) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	return d.engine.OnProposal(proposal)
+}
+
+func (d *deliver) Vote(originID base.Hash, vote *message.Vote) error {
+	return d.engine.OnVote(vote)
+}
+
+// enqueue is a handler passing proposals to an engine and votes to a queue.
+type enqueue struct {
+	engine Engine
+	queue  Queue
+}
+
+// Enqueue returns a handler that passes proposals to the given engine and
+// votes to the given queue, without regard for their origin. A full queue
+// signals backpressure all the way to the transport.
+func Enqueue(engine Engine, queue Queue) Handler {
+	return &enqueue{engine: engine, queue: queue}
+}
+
+func (e *enqueue) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	return e.engine.OnProposal(proposal)
+}
+
+func (e *enqueue) Vote(originID base.Hash, vote *message.Vote) error {
+	return e.queue.Push(vote)
+}
+
+// dispatch is a receiver passing consensus messages to a handler.
+type dispatch struct {
+	handler Handler
+}
+
+// Dispatch returns a receiver that passes proposals and votes to the given
+// handler, and rejects all other messages.
+func Dispatch(handler Handler) Receiver {
+	return &dispatch{handler: handler}
+}
+
+func (d *dispatch) Receive(originID base.Hash, msg interface{}) error {
+	switch m := msg.(type) {
+	case *message.Proposal:
+		return d.handler.Proposal(originID, m)
+	case *message.Vote:
+		return d.handler.Vote(originID, m)
+	default:
+		return rich.Errorf("unsupported message type").Str("type", fmt.Sprintf("%T", msg)).Hex("origin", originID[:])
+	}
+}
@@ -0,0 +1,106 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package noise
+
+import (
+	"net"
+	"sync"
+
+	"github.com/awfm/rich"
+)
+
+// overhead is the size of the authentication tag added to every message.
+const overhead = 16
+
+// Conn is a connection secured by the handshake. Data written to it is split
+// into Noise messages, which are encrypted and authenticated separately; any
+// message that fails to decrypt breaks the connection for good.
+type Conn struct {
+	net.Conn
+	rmu     sync.Mutex
+	recv    *cipherState
+	pending []byte
+	failure error
+	wmu     sync.Mutex
+	send    *cipherState
+}
+
+// newConn wraps the connection with the cipher states of both directions.
+func newConn(conn net.Conn, send *cipherState, recv *cipherState) *Conn {
+
+	c := Conn{
+		Conn: conn,
+		recv: recv,
+		send: send,
+	}
+
+	return &c
+}
+
+// Read reads decrypted data, reading and decrypting the next message from the
+// underlying connection when no data is pending.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.failure != nil {
+		return 0, c.failure
+	}
+	for len(c.pending) == 0 {
+		msg, err := readMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recv.decrypt(msg[:0], nil, msg)
+		if err != nil {
+			c.failure = rich.Errorf("could not decrypt message: %w", err)
+			return 0, c.failure
+		}
+		c.pending = plaintext
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Write encrypts the data in messages of the maximum size and writes them to
+// the underlying connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxMessage-overhead {
+			chunk = chunk[:MaxMessage-overhead]
+		}
+		msg, err := c.send.encrypt(nil, nil, chunk)
+		if err != nil {
+			return written, rich.Errorf("could not encrypt message: %w", err)
+		}
+		err = writeMessage(c.Conn, msg)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,354 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package noise secures the connections between nodes with the XX handshake
+// of the Noise protocol framework, using X25519, ChaCha20-Poly1305 and
+// SHA-256. Both sides send their static key during the handshake, along with
+// the identity they claim, and each side only accepts the channel if the
+// static key is the one configured for that identity. The identity is thus
+// bound to the channel, and every message on it is encrypted and
+// authenticated.
+//
+// Transports that work on connections can use the handshaker as a securer, by
+// wrapping each connection right after it was established.
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/awfm/consensus/model/base"
+)
+
+// Protocol is the full name of the Noise protocol, which is mixed into the
+// handshake, so that both sides have to agree on it.
+const Protocol = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+// Prologue is mixed into the handshake after the protocol name, so that the
+// channel can't be confused with a channel of another application using the
+// same protocol.
+const Prologue = "awfm consensus v1"
+
+// MaxMessage is the maximum size of a Noise message, including the
+// authentication tag.
+const MaxMessage = 65535
+
+// KeySize is the size of the public and private keys.
+const KeySize = 32
+
+// Key is the static X25519 key pair that a node uses for all its channels.
+type Key struct {
+	Public  []byte
+	Private []byte
+}
+
+// GenerateKey creates a new random key pair, reading from the random source,
+// or from the system random source if it is nil.
+func GenerateKey(random io.Reader) (*Key, error) {
+
+	if random == nil {
+		random = rand.Reader
+	}
+	private := make([]byte, KeySize)
+	_, err := io.ReadFull(random, private)
+	if err != nil {
+		return nil, rich.Errorf("could not read private key: %w", err)
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, rich.Errorf("could not derive public key: %w", err)
+	}
+
+	key := Key{
+		Public:  public,
+		Private: private,
+	}
+
+	return &key, nil
+}
+
+// Handshaker secures connections for a node with its static key, and accepts
+// the peers with the given static public keys.
+type Handshaker struct {
+	selfID base.Hash
+	key    *Key
+	peers  map[base.Hash][]byte
+}
+
+// New creates a handshaker for the node with the given identity and static
+// key, which accepts the given peers, mapped to their static public keys.
+func New(selfID base.Hash, key *Key, peers map[base.Hash][]byte) (*Handshaker, error) {
+
+	if len(key.Private) != KeySize || len(key.Public) != KeySize {
+		return nil, rich.Errorf("invalid key size").Int("private", len(key.Private)).Int("public", len(key.Public))
+	}
+	public, err := curve25519.X25519(key.Private, curve25519.Basepoint)
+	if err != nil {
+		return nil, rich.Errorf("could not derive public key: %w", err)
+	}
+	if !bytes.Equal(public, key.Public) {
+		return nil, rich.Errorf("public key does not match private key")
+	}
+	for peerID, public := range peers {
+		if len(public) != KeySize {
+			return nil, rich.Errorf("invalid peer key size").Hex("peer", peerID[:]).Int("size", len(public))
+		}
+	}
+
+	h := Handshaker{
+		selfID: selfID,
+		key:    key,
+		peers:  peers,
+	}
+
+	return &h, nil
+}
+
+// Client runs the handshake as initiator on a connection we opened, and
+// returns the secured connection along with the identity of the peer.
+func (h *Handshaker) Client(conn net.Conn) (net.Conn, base.Hash, error) {
+
+	ss, e, err := h.start()
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+
+	// 1) -> e
+	msg := append([]byte(nil), e.Public...)
+	ss.mixHash(e.Public)
+	msg, err = ss.encryptAndHash(msg, nil)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not encrypt payload: %w", err)
+	}
+	err = writeMessage(conn, msg)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not write first message: %w", err)
+	}
+
+	// 2) <- e, ee, s, es, with the identity of the responder as payload
+	msg, err = readMessage(conn)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not read second message: %w", err)
+	}
+	if len(msg) < KeySize {
+		return nil, base.ZeroHash, rich.Errorf("second message too short").Int("size", len(msg))
+	}
+	re := msg[:KeySize]
+	ss.mixHash(re)
+	err = mixDH(ss, e.Private, re)
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+	if len(msg) < 2*KeySize+16 {
+		return nil, base.ZeroHash, rich.Errorf("second message too short").Int("size", len(msg))
+	}
+	rs, err := ss.decryptAndHash(msg[KeySize : 2*KeySize+16])
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not decrypt static key: %w", err)
+	}
+	err = mixDH(ss, e.Private, rs)
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+	payload, err := ss.decryptAndHash(msg[2*KeySize+16:])
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not decrypt payload: %w", err)
+	}
+	peerID, err := h.identify(payload, rs)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not identify responder: %w", err)
+	}
+
+	// 3) -> s, se, with our identity as payload
+	msg, err = ss.encryptAndHash(nil, h.key.Public)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not encrypt static key: %w", err)
+	}
+	err = mixDH(ss, h.key.Private, re)
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+	msg, err = ss.encryptAndHash(msg, h.selfID[:])
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not encrypt payload: %w", err)
+	}
+	err = writeMessage(conn, msg)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not write third message: %w", err)
+	}
+
+	send, recv := ss.split()
+	return newConn(conn, send, recv), peerID, nil
+}
+
+// Server runs the handshake as responder on a connection a peer opened, and
+// returns the secured connection along with the identity of the peer.
+func (h *Handshaker) Server(conn net.Conn) (net.Conn, base.Hash, error) {
+
+	ss, e, err := h.start()
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+
+	// 1) <- e
+	msg, err := readMessage(conn)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not read first message: %w", err)
+	}
+	if len(msg) != KeySize {
+		return nil, base.ZeroHash, rich.Errorf("invalid first message size").Int("size", len(msg))
+	}
+	re := msg[:KeySize]
+	ss.mixHash(re)
+	_, err = ss.decryptAndHash(nil)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not decrypt payload: %w", err)
+	}
+
+	// 2) -> e, ee, s, es, with our identity as payload
+	msg = append([]byte(nil), e.Public...)
+	ss.mixHash(e.Public)
+	err = mixDH(ss, e.Private, re)
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+	msg, err = ss.encryptAndHash(msg, h.key.Public)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not encrypt static key: %w", err)
+	}
+	err = mixDH(ss, h.key.Private, re)
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+	msg, err = ss.encryptAndHash(msg, h.selfID[:])
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not encrypt payload: %w", err)
+	}
+	err = writeMessage(conn, msg)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not write second message: %w", err)
+	}
+
+	// 3) <- s, se, with the identity of the initiator as payload
+	msg, err = readMessage(conn)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not read third message: %w", err)
+	}
+	if len(msg) < KeySize+16 {
+		return nil, base.ZeroHash, rich.Errorf("third message too short").Int("size", len(msg))
+	}
+	rs, err := ss.decryptAndHash(msg[:KeySize+16])
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not decrypt static key: %w", err)
+	}
+	err = mixDH(ss, e.Private, rs)
+	if err != nil {
+		return nil, base.ZeroHash, err
+	}
+	payload, err := ss.decryptAndHash(msg[KeySize+16:])
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not decrypt payload: %w", err)
+	}
+	peerID, err := h.identify(payload, rs)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not identify initiator: %w", err)
+	}
+
+	recv, send := ss.split()
+	return newConn(conn, send, recv), peerID, nil
+}
+
+// start initializes the handshake state and generates the ephemeral key.
+func (h *Handshaker) start() (*symmetricState, *Key, error) {
+
+	var ss symmetricState
+	ss.initialize(Protocol)
+	ss.mixHash([]byte(Prologue))
+
+	e, err := GenerateKey(nil)
+	if err != nil {
+		return nil, nil, rich.Errorf("could not generate ephemeral key: %w", err)
+	}
+
+	return &ss, e, nil
+}
+
+// identify checks that the static key the peer proved to own is the one we
+// know for the identity it claims.
+func (h *Handshaker) identify(payload []byte, static []byte) (base.Hash, error) {
+
+	if len(payload) != len(base.ZeroHash) {
+		return base.ZeroHash, rich.Errorf("invalid identity size").Int("size", len(payload))
+	}
+	var peerID base.Hash
+	copy(peerID[:], payload)
+	if peerID == h.selfID {
+		return base.ZeroHash, rich.Errorf("peer claims our identity")
+	}
+	expected, ok := h.peers[peerID]
+	if !ok {
+		return base.ZeroHash, rich.Errorf("unknown peer").Hex("peer", peerID[:])
+	}
+	if !bytes.Equal(expected, static) {
+		return base.ZeroHash, rich.Errorf("static key mismatch").Hex("peer", peerID[:]).Hex("expected", expected).Hex("actual", static)
+	}
+
+	return peerID, nil
+}
+
+// mixDH mixes the result of a Diffie-Hellman exchange into the key; it fails
+// for low-order points, which would result in a predictable key.
+func mixDH(ss *symmetricState, private []byte, public []byte) error {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return rich.Errorf("could not compute shared secret: %w", err)
+	}
+	ss.mixKey(shared)
+	return nil
+}
+
+// writeMessage writes a message with a two-byte length prefix.
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxMessage {
+		return rich.Errorf("message too large").Int("size", len(msg))
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readMessage reads a message with a two-byte length prefix.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
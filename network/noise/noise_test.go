@@ -0,0 +1,207 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package noise
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/network"
+)
+
+var _ network.Securer = (*Handshaker)(nil)
+var _ net.Conn = (*Conn)(nil)
+
+// node is the identity and static key of a test node.
+type node struct {
+	id  base.Hash
+	key *Key
+}
+
+// nodes generates the given number of nodes.
+func nodes(t *testing.T, n uint) []node {
+	nodeIDs := fixture.Hashes(t, n)
+	nodes := make([]node, 0, n)
+	for _, nodeID := range nodeIDs {
+		key, err := GenerateKey(nil)
+		require.NoError(t, err, "should generate key")
+		nodes = append(nodes, node{id: nodeID, key: key})
+	}
+	return nodes
+}
+
+// handshaker creates a handshaker for the node that accepts the given peers.
+func handshaker(t *testing.T, self node, peers ...node) *Handshaker {
+	keys := make(map[base.Hash][]byte, len(peers))
+	for _, p := range peers {
+		keys[p.id] = p.key.Public
+	}
+	h, err := New(self.id, self.key, keys)
+	require.NoError(t, err, "should create handshaker")
+	return h
+}
+
+// result is the outcome of one side of the handshake.
+type result struct {
+	conn   net.Conn
+	peerID base.Hash
+	err    error
+}
+
+// connect runs the handshake between the client and the server over an
+// in-memory connection; a side that fails closes its end, so that the other
+// side doesn't wait forever.
+func connect(client *Handshaker, server *Handshaker) (result, result) {
+	left, right := net.Pipe()
+	done := make(chan result)
+	go func() {
+		conn, peerID, err := server.Server(right)
+		if err != nil {
+			right.Close()
+		}
+		done <- result{conn: conn, peerID: peerID, err: err}
+	}()
+	conn, peerID, err := client.Client(left)
+	if err != nil {
+		left.Close()
+	}
+	return result{conn: conn, peerID: peerID, err: err}, <-done
+}
+
+func TestHandshake(t *testing.T) {
+
+	nodes := nodes(t, 2)
+	client, server := connect(handshaker(t, nodes[0], nodes[1]), handshaker(t, nodes[1], nodes[0]))
+	require.NoError(t, client.err, "client should complete handshake")
+	require.NoError(t, server.err, "server should complete handshake")
+	defer client.conn.Close()
+	assert.Equal(t, nodes[1].id, client.peerID, "client should identify server")
+	assert.Equal(t, nodes[0].id, server.peerID, "server should identify client")
+
+	// data larger than a single message should arrive intact in both
+	// directions
+	data := make([]byte, 3*MaxMessage)
+	_, _ = rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		_, _ = client.conn.Write(data)
+	}()
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(server.conn, received)
+	require.NoError(t, err, "server should read data")
+	assert.Equal(t, data, received, "server should receive data")
+	go func() {
+		_, _ = server.conn.Write([]byte("pong"))
+	}()
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(client.conn, reply)
+	require.NoError(t, err, "client should read reply")
+	assert.Equal(t, []byte("pong"), reply, "client should receive reply")
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+
+	nodes := nodes(t, 3)
+
+	// a server that doesn't know the client should refuse it; the client only
+	// notices once it reads from the channel, as the server is the last to
+	// learn about the other side in the handshake
+	client, server := connect(handshaker(t, nodes[0], nodes[1]), handshaker(t, nodes[1]))
+	assert.Error(t, server.err, "server should reject unknown client")
+	require.NoError(t, client.err, "client should complete handshake")
+	_, err := client.conn.Read(make([]byte, 1))
+	assert.Error(t, err, "client should not read from refused channel")
+
+	// a client that doesn't know the server should refuse it
+	client, server = connect(handshaker(t, nodes[0]), handshaker(t, nodes[1], nodes[0]))
+	assert.Error(t, client.err, "client should reject unknown server")
+	assert.Error(t, server.err, "server should fail with unknown server")
+
+	// a node claiming the identity of another node without its static key
+	// should be refused
+	impostor := node{id: nodes[2].id, key: nodes[0].key}
+	client, server = connect(handshaker(t, impostor, nodes[1]), handshaker(t, nodes[1], nodes[0], nodes[2]))
+	assert.Error(t, server.err, "server should reject impostor")
+	require.NoError(t, client.err, "client should complete handshake")
+	_, err = client.conn.Read(make([]byte, 1))
+	assert.Error(t, err, "impostor should not read from refused channel")
+
+	// keys that don't belong together should not be accepted
+	_, err = New(nodes[0].id, &Key{Public: nodes[1].key.Public, Private: nodes[0].key.Private}, nil)
+	assert.Error(t, err, "should reject mismatched key")
+	_, err = New(nodes[0].id, nodes[0].key, map[base.Hash][]byte{nodes[1].id: {1, 2, 3}})
+	assert.Error(t, err, "should reject invalid peer key")
+}
+
+// tamper is a connection that flips a bit in the first byte after the given
+// offset that is written to it.
+type tamper struct {
+	net.Conn
+	offset  int
+	written int
+}
+
+func (t *tamper) Write(b []byte) (int, error) {
+	if t.written <= t.offset && t.offset < t.written+len(b) {
+		b = append([]byte(nil), b...)
+		b[t.offset-t.written] ^= 0x01
+	}
+	t.written += len(b)
+	return t.Conn.Write(b)
+}
+
+func TestConnTamper(t *testing.T) {
+
+	nodes := nodes(t, 2)
+	client, server := connect(handshaker(t, nodes[0], nodes[1]), handshaker(t, nodes[1], nodes[0]))
+	require.NoError(t, client.err, "client should complete handshake")
+	require.NoError(t, server.err, "server should complete handshake")
+	defer client.conn.Close()
+
+	// the data should not be readable on the wire
+	secure := client.conn.(*Conn)
+	var wire bytes.Buffer
+	secure.Conn = &tamper{Conn: secure.Conn, offset: -1}
+	plaintext := []byte("a vote for the candidate at height ten")
+	go func() {
+		_, _ = client.conn.Write(plaintext)
+	}()
+	msg, err := readMessage(io.TeeReader(server.conn.(*Conn).Conn, &wire))
+	require.NoError(t, err, "should read message")
+	assert.NotContains(t, wire.String(), string(plaintext), "should encrypt data")
+	assert.Len(t, msg, len(plaintext)+overhead, "should add authentication tag")
+	decrypted, err := server.conn.(*Conn).recv.decrypt(nil, nil, msg)
+	require.NoError(t, err, "should decrypt message")
+	assert.Equal(t, plaintext, decrypted, "should decrypt to plaintext")
+
+	// a modified message should break the connection
+	secure.Conn = &tamper{Conn: secure.Conn.(*tamper).Conn, offset: 5}
+	go func() {
+		_, _ = client.conn.Write(plaintext)
+	}()
+	_, err = server.conn.Read(make([]byte, 64))
+	assert.Error(t, err, "should reject modified message")
+	_, err = server.conn.Read(make([]byte, 64))
+	assert.Error(t, err, "should stay broken")
+}
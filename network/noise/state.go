@@ -0,0 +1,161 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// cipherState encrypts and decrypts the messages in one direction, with a
+// counter as nonce. Until it has a key, messages pass through as plaintext.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+// initialize sets the key and resets the nonce.
+func (cs *cipherState) initialize(key []byte) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err) // only happens for keys of the wrong size
+	}
+	cs.aead = aead
+	cs.nonce = 0
+}
+
+// encrypt seals the plaintext with the associated data, and appends the
+// result to the destination.
+func (cs *cipherState) encrypt(dst []byte, ad []byte, plaintext []byte) ([]byte, error) {
+	if cs.aead == nil {
+		return append(dst, plaintext...), nil
+	}
+	if cs.nonce == math.MaxUint64 {
+		return nil, rich.Errorf("nonce exhausted")
+	}
+	out := cs.aead.Seal(dst, cs.next(), plaintext, ad)
+	return out, nil
+}
+
+// decrypt opens the ciphertext with the associated data, and appends the
+// result to the destination.
+func (cs *cipherState) decrypt(dst []byte, ad []byte, ciphertext []byte) ([]byte, error) {
+	if cs.aead == nil {
+		return append(dst, ciphertext...), nil
+	}
+	if cs.nonce == math.MaxUint64 {
+		return nil, rich.Errorf("nonce exhausted")
+	}
+	out, err := cs.aead.Open(dst, cs.next(), ciphertext, ad)
+	if err != nil {
+		return nil, rich.Errorf("could not open ciphertext: %w", err)
+	}
+	return out, nil
+}
+
+// next returns the nonce for the next message and increments the counter; the
+// counter is encoded little-endian after four zero bytes.
+func (cs *cipherState) next() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+	return nonce
+}
+
+// symmetricState holds the chaining key and the handshake hash, which commit
+// to everything that was exchanged during the handshake.
+type symmetricState struct {
+	cs cipherState
+	ck []byte
+	h  []byte
+}
+
+// initialize starts the handshake for the protocol with the given name, which
+// is exactly as long as the hash and thus used as is.
+func (ss *symmetricState) initialize(protocol string) {
+	ss.h = []byte(protocol)
+	ss.ck = []byte(protocol)
+}
+
+// mixKey derives a new chaining key and encryption key from the input.
+func (ss *symmetricState) mixKey(input []byte) {
+	ck, key := hkdf(ss.ck, input)
+	ss.ck = ck
+	ss.cs.initialize(key)
+}
+
+// mixHash adds the data to the handshake hash.
+func (ss *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	_, _ = hash.Write(ss.h)
+	_, _ = hash.Write(data)
+	ss.h = hash.Sum(nil)
+}
+
+// encryptAndHash encrypts the plaintext with the handshake hash as associated
+// data, and adds the ciphertext to the hash.
+func (ss *symmetricState) encryptAndHash(dst []byte, plaintext []byte) ([]byte, error) {
+	out, err := ss.cs.encrypt(dst, ss.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(out[len(dst):])
+	return out, nil
+}
+
+// decryptAndHash decrypts the ciphertext with the handshake hash as associated
+// data, and adds the ciphertext to the hash.
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decrypt(nil, ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the cipher states for both directions once the handshake is
+// done; the first one is for messages from the initiator.
+func (ss *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(ss.ck, nil)
+	var c1, c2 cipherState
+	c1.initialize(k1)
+	c2.initialize(k2)
+	return &c1, &c2
+}
+
+// hkdf derives two outputs from the chaining key and input, as specified by
+// the Noise protocol framework.
+func hkdf(ck []byte, input []byte) ([]byte, []byte) {
+	temp := mac(ck, input)
+	out1 := mac(temp, []byte{0x01})
+	out2 := mac(temp, append(out1, 0x02))
+	return out1, out2
+}
+
+// mac computes the HMAC-SHA256 of the data with the key.
+func mac(key []byte, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	_, _ = m.Write(data)
+	return m.Sum(nil)
+}
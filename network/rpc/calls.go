@@ -0,0 +1,213 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package rpc implements requests and responses on top of the one-way
+// messages of a transport. Every request carries an identifier, which the
+// response repeats, so that several requests can be in flight at once. A
+// response is only accepted from the peer the request was sent to, and only
+// if it is not larger than the configured limit; requests without a response
+// fail after a timeout.
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/codec"
+)
+
+// Config holds the limits of requests and responses.
+type Config struct {
+	Timeout     time.Duration // time to wait for a response, unless the context expires first
+	MaxResponse int           // maximum size of an encoded response message
+}
+
+// DefaultConfig gives peers a few seconds to respond with a message of any
+// size the codec supports.
+var DefaultConfig = Config{
+	Timeout:     5 * time.Second,
+	MaxResponse: codec.MaxSize,
+}
+
+// call is a request waiting for its response.
+type call struct {
+	peerID    base.Hash
+	responses chan *network.Response
+}
+
+// Calls keeps track of the requests a transport sent and answers the requests
+// it receives with a responder.
+type Calls struct {
+	sync.Mutex
+	config    Config
+	next      uint64
+	pending   map[uint64]*call
+	responder network.Responder
+}
+
+// New creates an empty set of calls with the given limits.
+func New(config Config) *Calls {
+
+	c := Calls{
+		config:  config,
+		pending: make(map[uint64]*call),
+	}
+
+	return &c
+}
+
+// Serve sets the responder that answers the requests of peers. Without a
+// responder, requests are answered with an error.
+func (c *Calls) Serve(responder network.Responder) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.responder = responder
+}
+
+// Request sends the message as request to the peer over the transport, and
+// waits for the response until it arrives, the timeout expires or the context
+// is canceled.
+func (c *Calls) Request(ctx context.Context, trans network.Transport, peerID base.Hash, msg interface{}) (interface{}, error) {
+
+	// 1) register the call with a new identifier
+	c.Lock()
+	c.next++
+	id := c.next
+	responses := make(chan *network.Response, 1)
+	c.pending[id] = &call{peerID: peerID, responses: responses}
+	c.Unlock()
+	defer c.forget(id)
+
+	// 2) send the request and wait for the response
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	err := trans.Send(peerID, &network.Request{ID: id, Message: msg})
+	if err != nil {
+		return nil, rich.Errorf("could not send request: %w", err)
+	}
+	var response *network.Response
+	select {
+	case response = <-responses:
+	case <-ctx.Done():
+		return nil, rich.Errorf("no response: %w", ctx.Err()).Hex("peer", peerID[:]).Uint64("request", id)
+	}
+
+	// 3) pass on the result, which might be an error on the side of the peer
+	if response.Error != "" {
+		return nil, rich.Errorf("request failed").Str("error", response.Error).Hex("peer", peerID[:]).Uint64("request", id)
+	}
+
+	return response.Message, nil
+}
+
+// Receive handles the requests and responses among the messages a transport
+// receives, and returns false for any other message. Requests are answered
+// right away, over the same transport; responses complete the request they
+// belong to. Responses that arrive after their request gave up are dropped,
+// while responses to requests we never sent, or from the wrong peer, are
+// returned as errors, so that the transport can deal with the peer.
+func (c *Calls) Receive(trans network.Transport, originID base.Hash, msg interface{}) (bool, error) {
+
+	switch m := msg.(type) {
+
+	case *network.Request:
+		response := c.respond(originID, m)
+		err := trans.Send(originID, response)
+		if err != nil {
+			return true, rich.Errorf("could not send response: %w", err).Uint64("request", m.ID)
+		}
+		return true, nil
+
+	case *network.Response:
+		c.Lock()
+		pending, ok := c.pending[m.ID]
+		if ok && pending.peerID == originID {
+			delete(c.pending, m.ID)
+		}
+		late := !ok && m.ID != 0 && m.ID <= c.next
+		c.Unlock()
+		if late {
+			return true, nil
+		}
+		if !ok || pending.peerID != originID {
+			return true, rich.Errorf("unexpected response").Hex("origin", originID[:]).Uint64("request", m.ID)
+		}
+		err := c.check(m)
+		if err != nil {
+			m = &network.Response{ID: m.ID, Error: err.Error()}
+		}
+		pending.responses <- m
+		return true, nil
+
+	default:
+		return false, nil
+	}
+}
+
+// respond creates the response to the request with the responder; a response
+// that is too large is replaced by an error, so the peer doesn't wait for it.
+func (c *Calls) respond(originID base.Hash, request *network.Request) *network.Response {
+
+	c.Lock()
+	responder := c.responder
+	c.Unlock()
+	if responder == nil {
+		return &network.Response{ID: request.ID, Error: "requests not supported"}
+	}
+
+	msg, err := responder.Respond(originID, request.Message)
+	if err != nil {
+		return &network.Response{ID: request.ID, Error: err.Error()}
+	}
+	response := network.Response{ID: request.ID, Message: msg}
+	err = c.check(&response)
+	if err != nil {
+		return &network.Response{ID: request.ID, Error: err.Error()}
+	}
+
+	return &response
+}
+
+// check makes sure the message of the response is within the size limit.
+func (c *Calls) check(response *network.Response) error {
+
+	if response.Message == nil {
+		return nil
+	}
+	data, err := codec.Encode(response.Message)
+	if err != nil {
+		return rich.Errorf("could not encode response: %w", err)
+	}
+	if len(data) > c.config.MaxResponse {
+		return rich.Errorf("response too large").Int("size", len(data)).Int("max", c.config.MaxResponse)
+	}
+
+	return nil
+}
+
+// forget removes the call, once it has completed or failed.
+func (c *Calls) forget(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.pending, id)
+}
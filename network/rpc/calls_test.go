@@ -0,0 +1,168 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/network"
+)
+
+// loop is a transport that hands messages directly to the calls of the
+// recipient, unless it drops them.
+type loop struct {
+	selfID base.Hash
+	nodes  map[base.Hash]*loop
+	calls  *Calls
+	drop   bool
+}
+
+func (l *loop) Peers() []base.Hash {
+	return nil
+}
+
+func (l *loop) Send(peerID base.Hash, msg interface{}) error {
+	if l.drop {
+		return nil
+	}
+	recipient, ok := l.nodes[peerID]
+	if !ok {
+		return errors.New("unknown peer")
+	}
+	_, err := recipient.calls.Receive(recipient, l.selfID, msg)
+	return err
+}
+
+// connect creates looped transports for the given number of nodes.
+func connect(t *testing.T, n uint, config Config) []*loop {
+	nodeIDs := fixture.Hashes(t, n)
+	nodes := make(map[base.Hash]*loop, n)
+	loops := make([]*loop, 0, n)
+	for _, nodeID := range nodeIDs {
+		l := &loop{selfID: nodeID, nodes: nodes, calls: New(config)}
+		nodes[nodeID] = l
+		loops = append(loops, l)
+	}
+	return loops
+}
+
+// responder answers queries for a single vertex.
+type responder struct {
+	vertex *base.Vertex
+}
+
+func (r *responder) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+	query, ok := msg.(*network.Query)
+	if !ok {
+		return nil, errors.New("unsupported request")
+	}
+	if query.Kind != network.QueryVertex || query.ID != r.vertex.ID() {
+		return nil, nil
+	}
+	return r.vertex, nil
+}
+
+func TestCallsRequest(t *testing.T) {
+
+	loops := connect(t, 2, Config{Timeout: time.Second, MaxResponse: 1 << 10})
+	vertex := fixture.Vertex(t)
+	loops[1].calls.Serve(&responder{vertex: vertex})
+	ctx := context.Background()
+
+	// a query should be answered with the vertex, or nothing if it's unknown
+	msg, err := loops[0].calls.Request(ctx, loops[0], loops[1].selfID, &network.Query{Kind: network.QueryVertex, ID: vertex.ID()})
+	require.NoError(t, err, "should get response")
+	assert.Equal(t, vertex, msg, "should respond with vertex")
+	msg, err = loops[0].calls.Request(ctx, loops[0], loops[1].selfID, &network.Query{Kind: network.QueryVertex, ID: fixture.Hash(t)})
+	require.NoError(t, err, "should get response")
+	assert.Nil(t, msg, "should respond with nothing")
+
+	// errors of the responder should be passed back
+	_, err = loops[0].calls.Request(ctx, loops[0], loops[1].selfID, fixture.Vote(t))
+	assert.Error(t, err, "should fail with error of responder")
+
+	// a node without responder should answer with an error
+	_, err = loops[1].calls.Request(ctx, loops[1], loops[0].selfID, &network.Query{Kind: network.QueryVertex, ID: vertex.ID()})
+	assert.Error(t, err, "should fail without responder")
+
+	// requests that can't be sent should fail right away
+	_, err = loops[0].calls.Request(ctx, loops[0], fixture.Hash(t), &network.Query{})
+	assert.Error(t, err, "should fail for unknown peer")
+	assert.Empty(t, loops[0].calls.pending, "should forget completed calls")
+}
+
+func TestCallsLimits(t *testing.T) {
+
+	loops := connect(t, 2, Config{Timeout: 50 * time.Millisecond, MaxResponse: 1 << 10})
+	vertex := fixture.Vertex(t)
+	loops[1].calls.Serve(&responder{vertex: vertex})
+	query := &network.Query{Kind: network.QueryVertex, ID: vertex.ID()}
+
+	// requests without a response should time out, or fail when the context
+	// is canceled first
+	loops[0].drop = true
+	start := time.Now()
+	_, err := loops[0].calls.Request(context.Background(), loops[0], loops[1].selfID, query)
+	assert.Error(t, err, "should time out without response")
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "should wait for timeout")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = loops[0].calls.Request(ctx, loops[0], loops[1].selfID, query)
+	assert.True(t, errors.Is(err, context.Canceled), "should fail with canceled context")
+	loops[0].drop = false
+
+	// responses over the size limit should be refused on both sides
+	loops[1].calls.config.MaxResponse = 16
+	_, err = loops[0].calls.Request(context.Background(), loops[0], loops[1].selfID, query)
+	assert.Error(t, err, "should not respond with large message")
+	loops[1].calls.config.MaxResponse = 1 << 10
+	loops[0].calls.config.MaxResponse = 16
+	_, err = loops[0].calls.Request(context.Background(), loops[0], loops[1].selfID, query)
+	assert.Error(t, err, "should not accept large response")
+
+	// responses that weren't requested, or come from the wrong peer, should
+	// be rejected
+	handled, err := loops[0].calls.Receive(loops[0], loops[1].selfID, &network.Response{ID: 42})
+	assert.True(t, handled, "should handle response")
+	assert.Error(t, err, "should reject unexpected response")
+	loops[0].calls.pending[43] = &call{peerID: loops[1].selfID, responses: make(chan *network.Response, 1)}
+	_, err = loops[0].calls.Receive(loops[0], fixture.Hash(t), &network.Response{ID: 43})
+	assert.Error(t, err, "should reject response from wrong peer")
+	assert.Contains(t, loops[0].calls.pending, uint64(43), "should keep waiting for right peer")
+
+	// responses arriving after their request timed out should be dropped
+	loops[0].drop = true
+	_, err = loops[0].calls.Request(context.Background(), loops[0], loops[1].selfID, query)
+	require.Error(t, err, "should time out without response")
+	loops[0].drop = false
+	handled, err = loops[0].calls.Receive(loops[0], loops[1].selfID, &network.Response{ID: loops[0].calls.next})
+	assert.True(t, handled, "should handle late response")
+	assert.NoError(t, err, "should drop late response")
+
+	// other messages should be left to the transport
+	handled, err = loops[0].calls.Receive(loops[0], loops[1].selfID, fixture.Vote(t))
+	assert.False(t, handled, "should not handle vote")
+	assert.NoError(t, err, "should not fail on vote")
+}
@@ -0,0 +1,277 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package score keeps a misbehaviour score for every peer, based on the
+// signals the processor returns for the messages the peer sent us, and bans
+// peers at the transport once their score crosses a threshold. Scores decay
+// exponentially over time, so that occasional faults, such as a vote that
+// arrives at a collector after a view change, are forgiven, while peers that
+// keep sending invalid messages are cut off.
+//
+// Most penalties are charged to the peer that sent the message. Double
+// proposals and double votes carry two valid signatures by the same author,
+// so they are charged to the author instead, which might be a different peer
+// when messages are relayed by gossip. Proposals are relayed by the gossip
+// overlay before the engine validates them, so an honest peer may pass on an
+// invalid proposal it received from someone else; invalid proposals are thus
+// not charged to anyone, and only double proposals count against their author.
+// Votes are sent directly by their signer, so the sender pays for them.
+package score
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+	"github.com/awfm/consensus/network"
+)
+
+// Config holds the penalties for each signal, how fast scores decay, and when
+// and for how long peers are banned.
+type Config struct {
+	InvalidCollector float64
+	InvalidSignature float64
+	DoubleSign       float64
+	HalfLife         time.Duration
+	Threshold        float64
+	BanDuration      time.Duration
+	Evidence         uint
+}
+
+// DefaultConfig bans a peer immediately for a double sign or a few invalid
+// signatures, while it takes a couple dozen messages to the wrong collector.
+var DefaultConfig = Config{
+	InvalidCollector: 5,
+	InvalidSignature: 50,
+	DoubleSign:       100,
+	HalfLife:         10 * time.Minute,
+	Threshold:        100,
+	BanDuration:      time.Hour,
+	Evidence:         8,
+}
+
+// record is the score of a single peer, along with the most recent signals
+// that contributed to it.
+type record struct {
+	score    float64
+	updated  time.Time
+	evidence []error
+	until    time.Time
+}
+
+// Scorer is a handler that passes messages on to the wrapped handler and
+// penalizes peers for the signals it returns. Messages from banned peers are
+// dropped, in case the transport still delivers some of them.
+type Scorer struct {
+	sync.Mutex
+	handler network.Handler
+	banner  network.Banner
+	config  Config
+	logger  *log.Logger
+	clock   func() time.Time
+	records map[base.Hash]*record
+}
+
+// New creates a scorer in front of the given handler, which bans peers on the
+// given banner and logs the bans to the given logger.
+func New(handler network.Handler, banner network.Banner, config Config, logger *log.Logger) *Scorer {
+
+	s := Scorer{
+		handler: handler,
+		banner:  banner,
+		config:  config,
+		logger:  logger,
+		clock:   time.Now,
+		records: make(map[base.Hash]*record),
+	}
+
+	return &s
+}
+
+// Proposal passes the proposal on and penalizes the responsible peer if it is
+// invalid.
+func (s *Scorer) Proposal(originID base.Hash, proposal *message.Proposal) error {
+
+	if s.Banned(originID) {
+		return rich.Errorf("peer banned").Hex("origin", originID[:])
+	}
+
+	err := s.handler.Proposal(originID, proposal)
+	if err != nil {
+		s.assess(originID, err, true)
+		return err
+	}
+
+	return nil
+}
+
+// Vote passes the vote on and penalizes the responsible peer if it is invalid.
+func (s *Scorer) Vote(originID base.Hash, vote *message.Vote) error {
+
+	if s.Banned(originID) {
+		return rich.Errorf("peer banned").Hex("origin", originID[:])
+	}
+
+	err := s.handler.Vote(originID, vote)
+	if err != nil {
+		s.assess(originID, err, false)
+		return err
+	}
+
+	return nil
+}
+
+// Responder returns a responder in front of the given one, which refuses the
+// requests of banned peers. It should be served by the transport instead of
+// the given responder, so that banned peers can't keep querying us.
+func (s *Scorer) Responder(responder network.Responder) network.Responder {
+	return &scored{scorer: s, responder: responder}
+}
+
+// scored is a responder that refuses the requests of peers banned by a scorer.
+type scored struct {
+	scorer    *Scorer
+	responder network.Responder
+}
+
+// Respond passes the request on, unless its origin is banned.
+func (r *scored) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+
+	if r.scorer.Banned(originID) {
+		return nil, rich.Errorf("peer banned").Hex("origin", originID[:])
+	}
+
+	return r.responder.Respond(originID, msg)
+}
+
+// Score returns the current score of the peer.
+func (s *Scorer) Score(peerID base.Hash) float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.records[peerID]
+	if !ok {
+		return 0
+	}
+	s.decay(r)
+
+	return r.score
+}
+
+// Banned checks whether the peer is currently banned.
+func (s *Scorer) Banned(peerID base.Hash) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.records[peerID]
+	if !ok {
+		return false
+	}
+
+	return s.clock().Before(r.until)
+}
+
+// assess maps the error to a penalty for the responsible peer; errors that are
+// not a sign of misbehaviour, such as stale messages, are not penalized. If the
+// message may have been relayed without being validated, only the signals
+// that prove who authored it are penalized.
+func (s *Scorer) assess(originID base.Hash, err error, relayed bool) {
+
+	var doubleProposal signal.DoubleProposal
+	if errors.As(err, &doubleProposal) {
+		s.penalize(doubleProposal.Second.Candidate.ProposerID, s.config.DoubleSign, err)
+		return
+	}
+	var doubleVote signal.DoubleVote
+	if errors.As(err, &doubleVote) {
+		s.penalize(doubleVote.Second.SignerID, s.config.DoubleSign, err)
+		return
+	}
+	if relayed {
+		return
+	}
+	if errors.As(err, &signal.InvalidSignature{}) {
+		s.penalize(originID, s.config.InvalidSignature, err)
+		return
+	}
+	if errors.As(err, &signal.InvalidCollector{}) {
+		s.penalize(originID, s.config.InvalidCollector, err)
+		return
+	}
+}
+
+// penalize adds the penalty to the score of the peer and bans the peer if the
+// score crosses the threshold.
+func (s *Scorer) penalize(peerID base.Hash, penalty float64, evidence error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// 1) bring the score of the peer up to date and add the penalty
+	r, ok := s.records[peerID]
+	if !ok {
+		r = &record{updated: s.clock()}
+		s.records[peerID] = r
+	}
+	s.decay(r)
+	r.score += penalty
+
+	// 2) keep the most recent evidence, so that we can justify the ban
+	r.evidence = append(r.evidence, evidence)
+	if uint(len(r.evidence)) > s.config.Evidence {
+		r.evidence = r.evidence[uint(len(r.evidence))-s.config.Evidence:]
+	}
+
+	// 3) ban the peer if it crossed the threshold and is not already banned;
+	// the score is reset, so that the peer starts over once the ban expires
+	now := s.clock()
+	if r.score < s.config.Threshold || now.Before(r.until) {
+		return
+	}
+	err := s.banner.Ban(peerID, s.config.BanDuration)
+	if err != nil {
+		s.logger.Printf("could not ban peer (peer: %x, score: %.2f): %v", peerID, r.score, err)
+		return
+	}
+	s.logger.Printf("banned peer (peer: %x, score: %.2f, duration: %s)", peerID, r.score, s.config.BanDuration)
+	for _, evidence := range r.evidence {
+		s.logger.Printf("  evidence: %v", evidence)
+	}
+	r.until = now.Add(s.config.BanDuration)
+	r.score = 0
+	r.evidence = nil
+}
+
+// decay reduces the score of the peer according to the time that passed since
+// it was last updated. It has to be called with the lock held.
+func (s *Scorer) decay(r *record) {
+
+	now := s.clock()
+	elapsed := now.Sub(r.updated)
+	if elapsed <= 0 {
+		return
+	}
+	if s.config.HalfLife > 0 {
+		r.score *= math.Pow(0.5, float64(elapsed)/float64(s.config.HalfLife))
+	}
+	r.updated = now
+}
@@ -0,0 +1,204 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package score
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+	"github.com/awfm/consensus/network"
+)
+
+var _ network.Handler = (*Scorer)(nil)
+
+// failer is a handler that returns its configured error for every message.
+type failer struct {
+	err error
+}
+
+func (f *failer) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	return f.err
+}
+
+func (f *failer) Vote(originID base.Hash, vote *message.Vote) error {
+	return f.err
+}
+
+// counter is a responder that counts the requests it answers.
+type counter struct {
+	requests int
+}
+
+func (c *counter) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+	c.requests++
+	return msg, nil
+}
+
+// recorder is a banner that records the bans.
+type recorder struct {
+	bans map[base.Hash]time.Duration
+	err  error
+}
+
+func (r *recorder) Ban(peerID base.Hash, duration time.Duration) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.bans[peerID] = duration
+	return nil
+}
+
+// setup creates a scorer with a controlled clock that logs to a buffer.
+func setup(t *testing.T) (*Scorer, *failer, *recorder, *bytes.Buffer, *time.Time) {
+	now := time.Unix(1000, 0)
+	handler := &failer{}
+	banner := &recorder{bans: make(map[base.Hash]time.Duration)}
+	buffer := &bytes.Buffer{}
+	s := New(handler, banner, DefaultConfig, log.New(buffer, "", 0))
+	s.clock = func() time.Time {
+		return now
+	}
+	return s, handler, banner, buffer, &now
+}
+
+func TestScorerPenalties(t *testing.T) {
+
+	s, handler, banner, _, _ := setup(t)
+	originID := fixture.Hash(t)
+	proposal := fixture.Proposal(t)
+	vote := fixture.Vote(t)
+
+	// valid messages and harmless signals should not cost anything
+	require.NoError(t, s.Proposal(originID, proposal), "should pass valid proposal")
+	handler.err = signal.StaleVote{Vote: vote}
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	handler.err = errors.New("dummy error")
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	assert.Zero(t, s.Score(originID), "should not penalize harmless errors")
+
+	// each signal should add its penalty, also when wrapped
+	handler.err = signal.InvalidCollector{Vote: vote}
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	assert.Equal(t, DefaultConfig.InvalidCollector, s.Score(originID), "should penalize invalid collector")
+	handler.err = fmt.Errorf("could not process vote: %w", signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID})
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	assert.Equal(t, DefaultConfig.InvalidCollector+DefaultConfig.InvalidSignature, s.Score(originID), "should penalize wrapped invalid signature")
+	assert.Empty(t, banner.bans, "should not ban below threshold")
+
+	// invalid proposals may have been relayed by gossip before anyone could
+	// validate them, so they should not be charged to the relay
+	relayID := fixture.Hash(t)
+	handler.err = fmt.Errorf("could not apply proposal: %w", signal.InvalidProposer{Proposal: proposal})
+	require.Error(t, s.Proposal(relayID, proposal), "should return handler error")
+	handler.err = signal.InvalidSignature{Entity: "proposal", Signer: proposal.Candidate.ProposerID}
+	for i := 0; i < 10; i++ {
+		require.Error(t, s.Proposal(relayID, proposal), "should return handler error")
+	}
+	assert.Zero(t, s.Score(relayID), "should not penalize relay of invalid proposal")
+
+	// double signs should be charged to their author rather than the relay
+	authorID := fixture.Hash(t)
+	first := fixture.Vote(t, fixture.WithVoter(authorID))
+	second := fixture.Vote(t, fixture.WithVoter(authorID))
+	handler.err = signal.DoubleVote{First: first, Second: second}
+	require.Error(t, s.Vote(originID, second), "should return handler error")
+	assert.Contains(t, banner.bans, authorID, "should ban author of double vote")
+	assert.NotContains(t, banner.bans, originID, "should not ban relay of double vote")
+}
+
+func TestScorerDecay(t *testing.T) {
+
+	s, handler, _, _, now := setup(t)
+	originID := fixture.Hash(t)
+	vote := fixture.Vote(t)
+
+	handler.err = signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID}
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	assert.Equal(t, float64(50), s.Score(originID), "should have full penalty")
+
+	*now = now.Add(DefaultConfig.HalfLife)
+	assert.InDelta(t, 25, s.Score(originID), 0.001, "should halve score after half-life")
+
+	*now = now.Add(2 * DefaultConfig.HalfLife)
+	assert.InDelta(t, 6.25, s.Score(originID), 0.001, "should keep decaying")
+
+	// a second penalty now should not take the peer over the threshold
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	assert.InDelta(t, 56.25, s.Score(originID), 0.001, "should add penalty to decayed score")
+	assert.False(t, s.Banned(originID), "should not ban peer with decayed score")
+}
+
+func TestScorerBan(t *testing.T) {
+
+	s, handler, banner, buffer, now := setup(t)
+	originID := fixture.Hash(t)
+	proposal := fixture.Proposal(t)
+	vote := fixture.Vote(t)
+
+	// two invalid signatures in short succession should get the peer banned
+	handler.err = signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID}
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	require.Empty(t, banner.bans, "should not ban after first penalty")
+	require.Error(t, s.Vote(originID, vote), "should return handler error")
+	assert.Equal(t, DefaultConfig.BanDuration, banner.bans[originID], "should ban peer on banner")
+	assert.True(t, s.Banned(originID), "should consider peer banned")
+
+	// the ban should be logged with all of the evidence
+	output := buffer.String()
+	assert.Contains(t, output, "banned peer", "should log ban")
+	assert.Equal(t, 2, strings.Count(output, "evidence: invalid signature"), "should log all evidence")
+
+	// messages from the banned peer should be dropped without reaching the
+	// handler
+	handler.err = nil
+	assert.Error(t, s.Proposal(originID, proposal), "should drop proposal from banned peer")
+
+	// requests from the banned peer should be refused as well
+	responder := &counter{}
+	r := s.Responder(responder)
+	_, err := r.Respond(originID, fixture.Vertex(t))
+	assert.Error(t, err, "should refuse request from banned peer")
+	_, err = r.Respond(fixture.Hash(t), fixture.Vertex(t))
+	assert.NoError(t, err, "should answer request from other peer")
+	assert.Equal(t, 1, responder.requests, "should only pass request from other peer")
+
+	// once the ban expires, the peer should start over
+	*now = now.Add(DefaultConfig.BanDuration)
+	assert.False(t, s.Banned(originID), "should lift ban after duration")
+	assert.Zero(t, s.Score(originID), "should reset score after ban")
+	assert.NoError(t, s.Proposal(originID, proposal), "should pass proposal after ban")
+
+	// failing to ban should be logged, and the peer should not be considered
+	// banned
+	banner.err = errors.New("dummy error")
+	handler.err = signal.DoubleProposal{First: proposal, Second: proposal}
+	require.Error(t, s.Proposal(originID, proposal), "should return handler error")
+	assert.False(t, s.Banned(proposal.Candidate.ProposerID), "should not consider peer banned")
+	assert.Contains(t, buffer.String(), "could not ban peer", "should log ban failure")
+}
@@ -0,0 +1,498 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package sim simulates the network between consensus nodes inside a single
+// process. Every node joins a hub and gets an endpoint, which implements the
+// consensus network interface and the transport interface, and delivers the
+// messages to the receivers of the other nodes. Endpoints can also make
+// requests to each other, which travel over the hub like any other message.
+// The hub can inject latency, message loss, duplication and reordering, and
+// can split the nodes into partitions that are healed later, which makes it
+// possible to test the consensus logic under adverse network conditions
+// without any sockets.
+package sim
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/rpc"
+)
+
+// retry is the pause before delivering a message again to a receiver that
+// signaled backpressure.
+const retry = 5 * time.Millisecond
+
+// Faults configures the faults the hub injects into each message it sends.
+// The probabilities are applied independently to every message and recipient.
+type Faults struct {
+	Latency   Latency // distribution of delays, no delay if nil
+	Drop      float64 // probability that a message is lost
+	Duplicate float64 // probability that a message is delivered twice
+	Reorder   float64 // probability that a message skips the queue of its link
+}
+
+// Stats counts what happened to the messages sent over the hub.
+type Stats struct {
+	Sent       uint
+	Delivered  uint
+	Dropped    uint
+	Duplicated uint
+	Reordered  uint
+	Throttled  uint
+	Rejected   uint
+}
+
+// Hub connects the endpoints of all simulated nodes. Messages between each
+// pair of nodes are delivered in order on a link, unless they are reordered,
+// and messages to different nodes are delivered concurrently. Messages are
+// passed to the handlers as is, so they have to be treated as immutable.
+type Hub struct {
+	sync.Mutex
+	rng        *rand.Rand
+	faults     Faults
+	endpoints  map[base.Hash]*Endpoint
+	partitions map[string]map[base.Hash]int
+	bans       map[link]time.Time
+	links      map[link]*queue
+	stats      Stats
+	done       chan struct{}
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// link identifies the direction of a connection between two nodes.
+type link struct {
+	senderID    base.Hash
+	recipientID base.Hash
+}
+
+// queue holds the pending deliveries of a link in the order they were sent.
+type queue struct {
+	pending []delivery
+	signal  chan struct{}
+}
+
+// delivery is a message scheduled for delivery at a given time.
+type delivery struct {
+	at  time.Time
+	msg interface{}
+}
+
+// NewHub creates a new hub that injects the given faults, using the given seed
+// for all random decisions.
+func NewHub(seed int64, faults Faults) *Hub {
+
+	h := Hub{
+		rng:        rand.New(rand.NewSource(seed)),
+		faults:     faults,
+		endpoints:  make(map[base.Hash]*Endpoint),
+		partitions: make(map[string]map[base.Hash]int),
+		bans:       make(map[link]time.Time),
+		links:      make(map[link]*queue),
+		done:       make(chan struct{}),
+	}
+
+	return &h
+}
+
+// Join adds the node with the given identity to the hub, which passes the
+// messages for the node to the given receiver. Errors returned by the receiver
+// are dropped, just like a remote node would not report them.
+func (h *Hub) Join(nodeID base.Hash, receiver network.Receiver) (*Endpoint, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	_, ok := h.endpoints[nodeID]
+	if ok {
+		return nil, rich.Errorf("node already joined").Hex("node", nodeID[:])
+	}
+
+	e := Endpoint{
+		hub:      h,
+		nodeID:   nodeID,
+		receiver: receiver,
+		calls:    rpc.New(rpc.DefaultConfig),
+	}
+	h.endpoints[nodeID] = &e
+
+	return &e, nil
+}
+
+// Leave removes the node with the given identity from the hub, so that it no
+// longer receives any messages, including the ones that are still in flight.
+func (h *Hub) Leave(nodeID base.Hash) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.endpoints, nodeID)
+}
+
+// SetFaults changes the faults injected into messages sent from now on.
+func (h *Hub) SetFaults(faults Faults) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.faults = faults
+}
+
+// Partition splits the nodes into the given groups under the given name. All
+// nodes that are not part of any group form one more group together. While
+// the partition is in place, messages between nodes of different groups are
+// dropped. Several partitions can be in place at the same time.
+func (h *Hub) Partition(name string, groups ...[]base.Hash) error {
+	h.Lock()
+	defer h.Unlock()
+
+	_, ok := h.partitions[name]
+	if ok {
+		return rich.Errorf("partition already exists").Str("name", name)
+	}
+
+	partition := make(map[base.Hash]int)
+	for index, group := range groups {
+		for _, nodeID := range group {
+			_, ok := partition[nodeID]
+			if ok {
+				return rich.Errorf("node in several groups").Str("name", name).Hex("node", nodeID[:])
+			}
+			partition[nodeID] = index
+		}
+	}
+	h.partitions[name] = partition
+
+	return nil
+}
+
+// Heal removes the partition with the given name. Messages that were dropped
+// because of the partition are not delivered after it is healed.
+func (h *Hub) Heal(name string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.partitions, name)
+}
+
+// Stats returns the message counters of the hub.
+func (h *Hub) Stats() Stats {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.stats
+}
+
+// Close stops the delivery of messages and waits for the deliveries that are
+// in progress to finish. Messages still in flight are discarded.
+func (h *Hub) Close() {
+	h.Lock()
+	if h.closed {
+		h.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.done)
+	h.Unlock()
+
+	h.wg.Wait()
+}
+
+// send schedules the delivery of a message from the sender to the recipient,
+// after applying the configured faults. It has to be called with the lock
+// held.
+func (h *Hub) send(senderID base.Hash, recipientID base.Hash, msg interface{}) {
+
+	// 1) drop the message if the nodes are partitioned or banned each other,
+	// or if it gets lost
+	h.stats.Sent++
+	if !h.connected(senderID, recipientID) || h.banned(senderID, recipientID) || h.banned(recipientID, senderID) || h.rng.Float64() < h.faults.Drop {
+		h.stats.Dropped++
+		return
+	}
+
+	// 2) decide how many times the message is delivered
+	copies := 1
+	if h.rng.Float64() < h.faults.Duplicate {
+		h.stats.Duplicated++
+		copies = 2
+	}
+
+	// 3) schedule each copy on the link queue, or on its own if it is
+	// reordered; reordered copies are delayed by an additional sample, so that
+	// they are likely to arrive after messages that were sent later
+	l := link{senderID: senderID, recipientID: recipientID}
+	for i := 0; i < copies; i++ {
+		now := time.Now()
+		if h.rng.Float64() < h.faults.Reorder {
+			h.stats.Reordered++
+			at := now.Add(h.delay() + h.delay())
+			h.wg.Add(1)
+			go h.schedule(l, delivery{at: at, msg: msg})
+			continue
+		}
+		q, ok := h.links[l]
+		if !ok {
+			q = &queue{signal: make(chan struct{}, 1)}
+			h.links[l] = q
+			h.wg.Add(1)
+			go h.run(l, q)
+		}
+		q.pending = append(q.pending, delivery{at: now.Add(h.delay()), msg: msg})
+		select {
+		case q.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// connected checks whether no partition separates the two nodes. It has to be
+// called with the lock held.
+func (h *Hub) connected(senderID base.Hash, recipientID base.Hash) bool {
+	for _, partition := range h.partitions {
+		senderGroup, ok := partition[senderID]
+		if !ok {
+			senderGroup = -1
+		}
+		recipientGroup, ok := partition[recipientID]
+		if !ok {
+			recipientGroup = -1
+		}
+		if senderGroup != recipientGroup {
+			return false
+		}
+	}
+	return true
+}
+
+// banned checks whether the node currently bans the peer. It has to be called
+// with the lock held.
+func (h *Hub) banned(nodeID base.Hash, peerID base.Hash) bool {
+	l := link{senderID: nodeID, recipientID: peerID}
+	until, ok := h.bans[l]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(h.bans, l)
+	return false
+}
+
+// delay draws a delay from the configured latency. It has to be called with
+// the lock held.
+func (h *Hub) delay() time.Duration {
+	if h.faults.Latency == nil {
+		return 0
+	}
+	return h.faults.Latency(h.rng)
+}
+
+// run delivers the messages of a link queue in order until the hub is closed.
+func (h *Hub) run(l link, q *queue) {
+	defer h.wg.Done()
+
+	for {
+
+		// wait for the next message on the link
+		h.Lock()
+		if len(q.pending) == 0 {
+			h.Unlock()
+			select {
+			case <-q.signal:
+				continue
+			case <-h.done:
+				return
+			}
+		}
+		next := q.pending[0]
+		q.pending = q.pending[1:]
+		h.Unlock()
+
+		// wait for its delivery time and deliver it
+		if !h.wait(next.at) {
+			return
+		}
+		h.deliver(l, next)
+	}
+}
+
+// schedule delivers a single message at its delivery time.
+func (h *Hub) schedule(l link, next delivery) {
+	defer h.wg.Done()
+
+	if !h.wait(next.at) {
+		return
+	}
+	h.deliver(l, next)
+}
+
+// wait waits until the given time and returns false if the hub was closed in
+// the meantime.
+func (h *Hub) wait(at time.Time) bool {
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// deliver passes a message to the receiver of the recipient, if it is still
+// part of the hub. The message only counts as delivered once the receiver is
+// done with it. As long as the receiver signals backpressure, the delivery is
+// retried after a short pause, which holds up the rest of the link.
+func (h *Hub) deliver(l link, next delivery) {
+	h.Lock()
+	e, ok := h.endpoints[l.recipientID]
+	if !ok || h.closed {
+		h.Unlock()
+		return
+	}
+	h.Unlock()
+
+	for {
+		handled, err := e.calls.Receive(e, l.senderID, next.msg)
+		if err != nil {
+			h.Lock()
+			h.stats.Rejected++
+			h.Unlock()
+		}
+		if handled {
+			break
+		}
+		err = e.receiver.Receive(l.senderID, next.msg)
+		if !network.Backpressure(err) {
+			break
+		}
+		h.Lock()
+		h.stats.Throttled++
+		h.Unlock()
+		if !h.wait(time.Now().Add(retry)) {
+			return
+		}
+	}
+
+	h.Lock()
+	h.stats.Delivered++
+	h.Unlock()
+}
+
+// Endpoint is the connection of a single node to the hub.
+type Endpoint struct {
+	hub      *Hub
+	nodeID   base.Hash
+	receiver network.Receiver
+	calls    *rpc.Calls
+}
+
+// Peers returns the identities of all other nodes of the hub.
+func (e *Endpoint) Peers() []base.Hash {
+	e.hub.Lock()
+	defer e.hub.Unlock()
+
+	return e.peers()
+}
+
+// Send sends any message to the node with the given identity.
+func (e *Endpoint) Send(peerID base.Hash, msg interface{}) error {
+	e.hub.Lock()
+	defer e.hub.Unlock()
+
+	if e.hub.closed {
+		return rich.Errorf("hub closed")
+	}
+	_, ok := e.hub.endpoints[peerID]
+	if !ok || peerID == e.nodeID {
+		return rich.Errorf("unknown peer").Hex("peer", peerID[:])
+	}
+	if e.hub.banned(e.nodeID, peerID) {
+		return rich.Errorf("peer banned").Hex("peer", peerID[:])
+	}
+
+	e.hub.send(e.nodeID, peerID, msg)
+
+	return nil
+}
+
+// Broadcast sends the proposal to all other nodes of the hub.
+func (e *Endpoint) Broadcast(proposal *message.Proposal) error {
+	e.hub.Lock()
+	defer e.hub.Unlock()
+
+	if e.hub.closed {
+		return rich.Errorf("hub closed")
+	}
+	for _, peerID := range e.peers() {
+		e.hub.send(e.nodeID, peerID, proposal)
+	}
+
+	return nil
+}
+
+// Transmit sends the vote to the node with the given identity.
+func (e *Endpoint) Transmit(vote *message.Vote, recipientID base.Hash) error {
+	return e.Send(recipientID, vote)
+}
+
+// Request sends the message as request to the peer and waits for its
+// response, for as long as the context allows.
+func (e *Endpoint) Request(ctx context.Context, peerID base.Hash, msg interface{}) (interface{}, error) {
+	return e.calls.Request(ctx, e, peerID, msg)
+}
+
+// Serve sets the responder that answers the requests of other nodes. Requests
+// don't pass through the receiver, so limits and bans have to be applied in
+// front of the responder.
+func (e *Endpoint) Serve(responder network.Responder) {
+	e.calls.Serve(responder)
+}
+
+// Ban drops all messages between this node and the given peer for the given
+// duration.
+func (e *Endpoint) Ban(peerID base.Hash, duration time.Duration) error {
+	e.hub.Lock()
+	defer e.hub.Unlock()
+
+	_, ok := e.hub.endpoints[peerID]
+	if !ok || peerID == e.nodeID {
+		return rich.Errorf("unknown peer").Hex("peer", peerID[:])
+	}
+	e.hub.bans[link{senderID: e.nodeID, recipientID: peerID}] = time.Now().Add(duration)
+
+	return nil
+}
+
+// peers returns the other nodes that are not banned, in a fixed order, so
+// that the random decisions for a seed are the same on every run. It has to be
+// called with the lock of the hub held.
+func (e *Endpoint) peers() []base.Hash {
+	peerIDs := make([]base.Hash, 0, len(e.hub.endpoints))
+	for peerID := range e.hub.endpoints {
+		if peerID != e.nodeID && !e.hub.banned(e.nodeID, peerID) {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	return message.SortIDs(peerIDs)
+}
@@ -0,0 +1,361 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sim
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+	"github.com/awfm/consensus/network"
+)
+
+var _ consensus.Network = (*Endpoint)(nil)
+var _ network.Transport = (*Endpoint)(nil)
+var _ network.Requester = (*Endpoint)(nil)
+
+// recorder is a handler that records the messages it receives.
+type recorder struct {
+	sync.Mutex
+	proposals []*message.Proposal
+	votes     []*message.Vote
+	origins   []base.Hash
+}
+
+func (r *recorder) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	r.Lock()
+	defer r.Unlock()
+	r.proposals = append(r.proposals, proposal)
+	r.origins = append(r.origins, originID)
+	return nil
+}
+
+func (r *recorder) Vote(originID base.Hash, vote *message.Vote) error {
+	r.Lock()
+	defer r.Unlock()
+	r.votes = append(r.votes, vote)
+	r.origins = append(r.origins, originID)
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.proposals) + len(r.votes)
+}
+
+// join adds the given number of recording nodes to the hub.
+func join(t *testing.T, hub *Hub, n uint) ([]base.Hash, []*Endpoint, []*recorder) {
+	nodeIDs := fixture.Hashes(t, n)
+	endpoints := make([]*Endpoint, 0, n)
+	recorders := make([]*recorder, 0, n)
+	for _, nodeID := range nodeIDs {
+		r := &recorder{}
+		e, err := hub.Join(nodeID, network.Dispatch(r))
+		require.NoError(t, err, "should join hub")
+		endpoints = append(endpoints, e)
+		recorders = append(recorders, r)
+	}
+	return nodeIDs, endpoints, recorders
+}
+
+// settle waits until the hub has delivered the given number of messages.
+func settle(t *testing.T, hub *Hub, delivered uint) {
+	require.Eventually(t, func() bool {
+		return hub.Stats().Delivered >= delivered
+	}, time.Second, time.Millisecond, "should deliver messages")
+}
+
+func TestHubDelivery(t *testing.T) {
+
+	hub := NewHub(1, Faults{})
+	defer hub.Close()
+	nodeIDs, endpoints, recorders := join(t, hub, 4)
+	_, err := hub.Join(nodeIDs[0], network.Dispatch(&recorder{}))
+	assert.Error(t, err, "should not join twice")
+
+	// a broadcast should reach every other node exactly once
+	proposal := fixture.Proposal(t)
+	require.NoError(t, endpoints[0].Broadcast(proposal), "should broadcast proposal")
+	settle(t, hub, 3)
+	assert.Empty(t, recorders[0].proposals, "should not deliver broadcast to sender")
+	for _, r := range recorders[1:] {
+		assert.Equal(t, []*message.Proposal{proposal}, r.proposals, "should deliver proposal")
+		assert.Equal(t, []base.Hash{nodeIDs[0]}, r.origins, "should deliver with sender as origin")
+	}
+
+	// a transmission should only reach its recipient
+	vote := fixture.Vote(t)
+	require.NoError(t, endpoints[1].Transmit(vote, nodeIDs[2]), "should transmit vote")
+	settle(t, hub, 4)
+	assert.Equal(t, []*message.Vote{vote}, recorders[2].votes, "should deliver vote to recipient")
+	assert.Empty(t, recorders[3].votes, "should not deliver vote to others")
+	assert.Error(t, endpoints[1].Transmit(vote, fixture.Hash(t)), "should not transmit to unknown recipient")
+	assert.Error(t, endpoints[1].Send(nodeIDs[1], vote), "should not send to self")
+	assert.Equal(t, message.SortIDs([]base.Hash{nodeIDs[0], nodeIDs[2], nodeIDs[3]}), endpoints[1].Peers(), "should have other nodes as peers")
+
+	// after leaving, a node should no longer receive anything
+	hub.Leave(nodeIDs[3])
+	require.NoError(t, endpoints[0].Broadcast(proposal), "should broadcast proposal")
+	settle(t, hub, 6)
+	assert.Len(t, recorders[3].proposals, 1, "should not deliver to node that left")
+	stats := hub.Stats()
+	assert.Equal(t, Stats{Sent: 6, Delivered: 6}, stats, "should count messages")
+
+	// after closing, nothing should be sent anymore
+	hub.Close()
+	assert.Error(t, endpoints[0].Broadcast(proposal), "should not broadcast on closed hub")
+	assert.Error(t, endpoints[0].Transmit(vote, nodeIDs[1]), "should not transmit on closed hub")
+}
+
+func TestHubPartition(t *testing.T) {
+
+	hub := NewHub(2, Faults{})
+	defer hub.Close()
+	nodeIDs, endpoints, recorders := join(t, hub, 4)
+
+	// the first two nodes should only reach each other
+	err := hub.Partition("split", nodeIDs[:2])
+	require.NoError(t, err, "should create partition")
+	require.NoError(t, endpoints[0].Broadcast(fixture.Proposal(t)), "should broadcast proposal")
+	require.NoError(t, endpoints[2].Broadcast(fixture.Proposal(t)), "should broadcast proposal")
+	settle(t, hub, 2)
+	assert.Equal(t, 0, recorders[0].count(), "should not deliver across partition")
+	assert.Equal(t, 1, recorders[1].count(), "should deliver within group")
+	assert.Equal(t, 0, recorders[2].count(), "should not deliver broadcast to sender")
+	assert.Equal(t, 1, recorders[3].count(), "should deliver within implicit group")
+	assert.Equal(t, uint(4), hub.Stats().Dropped, "should drop messages across partition")
+
+	// overlapping partitions should both apply, and invalid ones should fail
+	err = hub.Partition("isolate", nodeIDs[2:3], nodeIDs[3:4])
+	require.NoError(t, err, "should create second partition")
+	assert.Error(t, hub.Partition("isolate"), "should not create partition twice")
+	assert.Error(t, hub.Partition("invalid", nodeIDs[:2], nodeIDs[1:3]), "should not put node in two groups")
+	require.NoError(t, endpoints[2].Transmit(fixture.Vote(t), nodeIDs[3]), "should transmit vote")
+	assert.Equal(t, uint(5), hub.Stats().Dropped, "should drop message across second partition")
+
+	// once healed, all messages should go through again
+	hub.Heal("split")
+	hub.Heal("isolate")
+	require.NoError(t, endpoints[0].Broadcast(fixture.Proposal(t)), "should broadcast proposal")
+	settle(t, hub, 5)
+	assert.Equal(t, 2, recorders[1].count(), "should deliver after healing")
+	assert.Equal(t, 2, recorders[3].count(), "should deliver after healing")
+}
+
+func TestHubBan(t *testing.T) {
+
+	hub := NewHub(6, Faults{})
+	defer hub.Close()
+	nodeIDs, endpoints, recorders := join(t, hub, 3)
+	var _ network.Banner = endpoints[0]
+
+	// a ban should cut the link in both directions, but not the others
+	require.NoError(t, endpoints[0].Ban(nodeIDs[1], time.Hour), "should ban peer")
+	assert.Error(t, endpoints[0].Ban(fixture.Hash(t), time.Hour), "should not ban unknown peer")
+	assert.Error(t, endpoints[0].Ban(nodeIDs[0], time.Hour), "should not ban self")
+	assert.Equal(t, []base.Hash{nodeIDs[2]}, endpoints[0].Peers(), "should not list banned peer")
+	assert.Error(t, endpoints[0].Send(nodeIDs[1], fixture.Vote(t)), "should not send to banned peer")
+	require.NoError(t, endpoints[1].Transmit(fixture.Vote(t), nodeIDs[0]), "should transmit vote")
+	require.NoError(t, endpoints[0].Broadcast(fixture.Proposal(t)), "should broadcast proposal")
+	settle(t, hub, 1)
+	assert.Equal(t, 0, recorders[0].count(), "should drop message from banned peer")
+	assert.Equal(t, 0, recorders[1].count(), "should not deliver to banned peer")
+	assert.Equal(t, 1, recorders[2].count(), "should deliver to other peer")
+
+	// once the ban expires, the link should work again
+	require.NoError(t, endpoints[0].Ban(nodeIDs[1], 0), "should lift ban")
+	require.NoError(t, endpoints[1].Transmit(fixture.Vote(t), nodeIDs[0]), "should transmit vote")
+	settle(t, hub, 2)
+	assert.Equal(t, 1, recorders[0].count(), "should deliver after ban expired")
+}
+
+func TestHubFaults(t *testing.T) {
+
+	hub := NewHub(3, Faults{Drop: 1})
+	defer hub.Close()
+	nodeIDs, endpoints, recorders := join(t, hub, 2)
+
+	// all messages should be lost
+	for i := 0; i < 10; i++ {
+		require.NoError(t, endpoints[0].Transmit(fixture.Vote(t), nodeIDs[1]), "should transmit vote")
+	}
+	assert.Equal(t, Stats{Sent: 10, Dropped: 10}, hub.Stats(), "should drop all messages")
+
+	// all messages should be delivered twice
+	hub.SetFaults(Faults{Duplicate: 1})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, endpoints[0].Transmit(fixture.Vote(t), nodeIDs[1]), "should transmit vote")
+	}
+	settle(t, hub, 20)
+	assert.Equal(t, 20, recorders[1].count(), "should deliver every message twice")
+	assert.Equal(t, uint(10), hub.Stats().Duplicated, "should count duplicates")
+
+	// the messages should be delayed by the latency
+	hub.SetFaults(Faults{Latency: Fixed(50 * time.Millisecond)})
+	start := time.Now()
+	require.NoError(t, endpoints[0].Transmit(fixture.Vote(t), nodeIDs[1]), "should transmit vote")
+	settle(t, hub, 21)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "should delay message")
+}
+
+func TestHubOrder(t *testing.T) {
+
+	hub := NewHub(4, Faults{Latency: Uniform(0, 10*time.Millisecond)})
+	defer hub.Close()
+	nodeIDs, endpoints, recorders := join(t, hub, 2)
+
+	// messages on a link should arrive in order despite random latencies
+	for height := uint64(0); height < 50; height++ {
+		vote := fixture.Vote(t)
+		vote.Height = height
+		require.NoError(t, endpoints[0].Transmit(vote, nodeIDs[1]), "should transmit vote")
+	}
+	settle(t, hub, 50)
+	for i, vote := range recorders[1].votes {
+		assert.Equal(t, uint64(i), vote.Height, "should deliver votes in order")
+	}
+
+	// with reordering, some of them should overtake others
+	hub.SetFaults(Faults{Latency: Uniform(0, 10*time.Millisecond), Reorder: 0.5})
+	for height := uint64(50); height < 100; height++ {
+		vote := fixture.Vote(t)
+		vote.Height = height
+		require.NoError(t, endpoints[0].Transmit(vote, nodeIDs[1]), "should transmit vote")
+	}
+	settle(t, hub, 100)
+	inversions := 0
+	for i := 51; i < 100; i++ {
+		if recorders[1].votes[i].Height < recorders[1].votes[i-1].Height {
+			inversions++
+		}
+	}
+	assert.True(t, inversions > 0, "should reorder votes")
+	assert.True(t, hub.Stats().Reordered > 0, "should count reordered votes")
+}
+
+// busy is a handler that signals backpressure for a number of attempts before
+// passing messages on.
+type busy struct {
+	sync.Mutex
+	refusals int
+	handler  network.Handler
+}
+
+func (b *busy) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.refusals > 0 {
+		b.refusals--
+		return signal.QueueFull{Queue: "proposal", Capacity: 0}
+	}
+	return b.handler.Proposal(originID, proposal)
+}
+
+func (b *busy) Vote(originID base.Hash, vote *message.Vote) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.refusals > 0 {
+		b.refusals--
+		return signal.QueueFull{Queue: "vote", Capacity: 0}
+	}
+	return b.handler.Vote(originID, vote)
+}
+
+func TestHubBackpressure(t *testing.T) {
+
+	hub := NewHub(5, Faults{})
+	defer hub.Close()
+	nodeIDs, endpoints, _ := join(t, hub, 1)
+	r := &recorder{}
+	recipientID := fixture.Hash(t)
+	_, err := hub.Join(recipientID, network.Dispatch(&busy{refusals: 3, handler: r}))
+	require.NoError(t, err, "should join hub")
+
+	// a busy receiver should get the messages again, and in order, once it
+	// can take them
+	first := fixture.Vote(t)
+	second := fixture.Vote(t)
+	require.NoError(t, endpoints[0].Transmit(first, recipientID), "should transmit vote")
+	require.NoError(t, endpoints[0].Transmit(second, recipientID), "should transmit vote")
+	settle(t, hub, 2)
+	assert.Equal(t, []*message.Vote{first, second}, r.votes, "should deliver votes in order")
+	assert.Equal(t, []base.Hash{nodeIDs[0], nodeIDs[0]}, r.origins, "should deliver with sender as origin")
+	assert.Equal(t, Stats{Sent: 2, Delivered: 2, Throttled: 3}, hub.Stats(), "should count throttled deliveries")
+}
+
+// echo is a responder that answers every request with the message itself.
+type echo struct{}
+
+func (echo) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+	return msg, nil
+}
+
+func TestHubRequest(t *testing.T) {
+
+	hub := NewHub(7, Faults{Latency: Fixed(time.Millisecond)})
+	defer hub.Close()
+	nodeIDs, endpoints, recorders := join(t, hub, 3)
+	endpoints[1].Serve(echo{})
+
+	// a request should get its response, and not reach the receivers
+	query := &network.Query{Kind: network.QueryQuorum, ID: fixture.Hash(t)}
+	msg, err := endpoints[0].Request(context.Background(), nodeIDs[1], query)
+	require.NoError(t, err, "should get response")
+	assert.Equal(t, query, msg, "should get echo of query")
+	assert.Equal(t, 0, recorders[0].count()+recorders[1].count(), "should not pass requests to receivers")
+
+	// a node without a responder should answer with an error
+	_, err = endpoints[0].Request(context.Background(), nodeIDs[2], query)
+	assert.Error(t, err, "should fail without responder")
+
+	// a response nobody asked for should be rejected, and not reach the
+	// receivers either
+	require.NoError(t, endpoints[2].Send(nodeIDs[0], &network.Response{ID: 99}), "should send response")
+	require.Eventually(t, func() bool {
+		return hub.Stats().Rejected == 1
+	}, time.Second, time.Millisecond, "should reject unexpected response")
+	assert.Equal(t, 0, recorders[0].count(), "should not pass response to receiver")
+
+	// a request across a partition should fail once the context expires
+	require.NoError(t, hub.Partition("split", nodeIDs[:1]), "should create partition")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = endpoints[0].Request(ctx, nodeIDs[1], query)
+	assert.Error(t, err, "should fail without response")
+}
+
+func TestLatency(t *testing.T) {
+
+	hub := NewHub(5, Faults{})
+	defer hub.Close()
+	for _, latency := range []Latency{Uniform(time.Millisecond, 2*time.Millisecond), Normal(time.Millisecond, time.Second), Exponential(time.Millisecond)} {
+		for i := 0; i < 100; i++ {
+			assert.True(t, latency(hub.rng) >= 0, "should not have negative latency")
+		}
+	}
+	assert.Equal(t, time.Millisecond, Uniform(time.Millisecond, 0)(hub.rng), "should use minimum for empty range")
+}
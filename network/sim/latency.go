@@ -0,0 +1,63 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sim
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Latency is a distribution of message delays, which draws a delay from the
+// given source of randomness.
+type Latency func(rng *rand.Rand) time.Duration
+
+// Fixed delays all messages by the same duration.
+func Fixed(delay time.Duration) Latency {
+	return func(rng *rand.Rand) time.Duration {
+		return delay
+	}
+}
+
+// Uniform delays messages by a duration uniformly distributed in [min, max).
+func Uniform(min time.Duration, max time.Duration) Latency {
+	return func(rng *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rng.Int63n(int64(max-min)))
+	}
+}
+
+// Normal delays messages by a normally distributed duration, which is cut off
+// at zero.
+func Normal(mean time.Duration, deviation time.Duration) Latency {
+	return func(rng *rand.Rand) time.Duration {
+		delay := mean + time.Duration(rng.NormFloat64()*float64(deviation))
+		if delay < 0 {
+			return 0
+		}
+		return delay
+	}
+}
+
+// Exponential delays messages by an exponentially distributed duration with
+// the given mean, which models the long tail of real networks.
+func Exponential(mean time.Duration) Latency {
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+}
@@ -0,0 +1,106 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/network/codec"
+)
+
+// Version is the version of the wire protocol, which is exchanged in the
+// handshake.
+const Version = 1
+
+// magic identifies connections of the consensus transport.
+var magic = [4]byte{'A', 'W', 'F', 'M'}
+
+// hello is the handshake message both sides send when a connection opens.
+type hello struct {
+	Magic   [4]byte
+	Version uint8
+	NodeID  base.Hash
+}
+
+// handshake sends our own identity and reads the identity of the other side,
+// making sure it speaks the same protocol version.
+func handshake(rw io.ReadWriter, selfID base.Hash) (base.Hash, error) {
+
+	out := hello{Magic: magic, Version: Version, NodeID: selfID}
+	err := binary.Write(rw, binary.BigEndian, &out)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not write hello: %w", err)
+	}
+
+	var in hello
+	err = binary.Read(rw, binary.BigEndian, &in)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not read hello: %w", err)
+	}
+	if !bytes.Equal(in.Magic[:], magic[:]) {
+		return base.ZeroHash, rich.Errorf("invalid magic").Hex("magic", in.Magic[:])
+	}
+	if in.Version != Version {
+		return base.ZeroHash, rich.Errorf("unsupported version").Uint("version", uint(in.Version))
+	}
+
+	return in.NodeID, nil
+}
+
+// encode creates a frame with the binary encoding of the message, which is
+// prefixed with its length.
+func encode(msg interface{}, max uint32) ([]byte, error) {
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return nil, rich.Errorf("could not encode message: %w", err)
+	}
+	if uint64(len(data)) > uint64(max) {
+		return nil, rich.Errorf("frame too large").Int("size", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame, nil
+}
+
+// read reads the next frame and decodes the message it contains.
+func read(r io.Reader, max uint32) (interface{}, error) {
+	var prefix [4]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, rich.Errorf("could not read frame length: %w", err)
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > max {
+		return nil, rich.Errorf("frame too large").Uint64("size", uint64(size))
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, rich.Errorf("could not read frame: %w", err)
+	}
+	msg, err := codec.Decode(data)
+	if err != nil {
+		return nil, rich.Errorf("could not decode frame: %w", err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,553 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package tcp implements the consensus network over TCP connections between a
+// static set of peers, so that clusters of separate processes can run on one
+// or several machines. Every node dials each of its peers for the messages it
+// sends, and accepts the connections of its peers for the messages it
+// receives. Both sides of a connection exchange their identities in a
+// handshake, and then send messages in their binary encoding, prefixed with
+// their length.
+//
+// The handshake does not authenticate the identities by itself, so the
+// transport should only be used on trusted networks, unless it is configured
+// with a securer, which authenticates and encrypts every connection before the
+// handshake.
+package tcp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/rpc"
+)
+
+// Peer is the identity and address of a peer in the static configuration.
+type Peer struct {
+	ID      base.Hash
+	Address string
+}
+
+// Config contains the parameters of the transport.
+type Config struct {
+	QueueSize        int             // number of messages buffered per peer
+	MaxFrame         uint32          // maximum size of a single message frame
+	DialTimeout      time.Duration   // limit for establishing a connection
+	HandshakeTimeout time.Duration   // limit for exchanging identities
+	WriteTimeout     time.Duration   // limit for writing a single frame
+	MinBackoff       time.Duration   // first delay before redialing or redelivering
+	MaxBackoff       time.Duration   // maximum delay before redialing or redelivering
+	Securer          network.Securer // wraps connections in secure channels, if set
+	Requests         rpc.Config      // limits of requests to peers and their responses
+}
+
+// DefaultConfig is a configuration suitable for clusters on a local network.
+var DefaultConfig = Config{
+	QueueSize:        1024,
+	MaxFrame:         1 << 20,
+	DialTimeout:      time.Second,
+	HandshakeTimeout: time.Second,
+	WriteTimeout:     5 * time.Second,
+	MinBackoff:       50 * time.Millisecond,
+	MaxBackoff:       5 * time.Second,
+	Requests:         rpc.DefaultConfig,
+}
+
+// Transport sends and receives consensus messages over TCP.
+type Transport struct {
+	selfID   base.Hash
+	receiver network.Receiver
+	config   Config
+	peerIDs  []base.Hash
+	peers    map[base.Hash]*peer
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]base.Hash
+	bans     map[base.Hash]time.Time
+	done     chan struct{}
+	calls    *rpc.Calls
+}
+
+// peer is the outgoing side of the connection to a peer. Messages are queued
+// per peer and written by a separate goroutine, so that a slow or unreachable
+// peer never blocks sending to the others.
+type peer struct {
+	id      base.Hash
+	address string
+	queue   chan []byte
+}
+
+// New creates a transport for the node with the given identity, which sends
+// messages to the given peers and passes the messages it receives from them to
+// the receiver. Errors returned by the receiver are dropped.
+func New(selfID base.Hash, peers []Peer, receiver network.Receiver, config Config) (*Transport, error) {
+
+	t := Transport{
+		selfID:   selfID,
+		receiver: receiver,
+		config:   config,
+		peerIDs:  make([]base.Hash, 0, len(peers)),
+		peers:    make(map[base.Hash]*peer, len(peers)),
+		conns:    make(map[net.Conn]base.Hash),
+		bans:     make(map[base.Hash]time.Time),
+		done:     make(chan struct{}),
+		calls:    rpc.New(config.Requests),
+	}
+	for _, p := range peers {
+		if p.ID == selfID {
+			return nil, rich.Errorf("self in peers").Hex("peer", p.ID[:])
+		}
+		_, ok := t.peers[p.ID]
+		if ok {
+			return nil, rich.Errorf("duplicate peer").Hex("peer", p.ID[:])
+		}
+		t.peers[p.ID] = &peer{
+			id:      p.ID,
+			address: p.Address,
+			queue:   make(chan []byte, config.QueueSize),
+		}
+		t.peerIDs = append(t.peerIDs, p.ID)
+	}
+	t.peerIDs = message.SortIDs(t.peerIDs)
+
+	return &t, nil
+}
+
+// Run accepts connections from peers on the listener and sends the queued
+// messages to them until the context is canceled. It then closes the listener
+// and all connections. A transport can only be run once.
+func (t *Transport) Run(ctx context.Context, ln net.Listener) error {
+
+	go func() {
+		<-ctx.Done()
+		close(t.done)
+		ln.Close()
+		t.mu.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.conns = nil
+		t.mu.Unlock()
+	}()
+	defer t.wg.Wait()
+
+	// start sending to each peer
+	for _, p := range t.peers {
+		t.wg.Add(1)
+		go func(p *peer) {
+			defer t.wg.Done()
+			t.send(ctx, p)
+		}(p)
+	}
+
+	// accept the connections of peers sending to us
+	for {
+		conn, err := ln.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return rich.Errorf("could not accept connection: %w", err)
+		}
+		if !t.track(conn) {
+			conn.Close()
+			return nil
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer t.untrack(conn)
+			t.receive(conn)
+		}()
+	}
+}
+
+// Peers returns the identities of the configured peers that are not banned.
+func (t *Transport) Peers() []base.Hash {
+	peerIDs := make([]base.Hash, 0, len(t.peerIDs))
+	for _, peerID := range t.peerIDs {
+		if !t.banned(peerID) {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	return peerIDs
+}
+
+// Send queues any message for the peer with the given identity.
+func (t *Transport) Send(peerID base.Hash, msg interface{}) error {
+
+	p, ok := t.peers[peerID]
+	if !ok {
+		return rich.Errorf("unknown peer").Hex("peer", peerID[:])
+	}
+	if t.banned(peerID) {
+		return rich.Errorf("peer banned").Hex("peer", peerID[:])
+	}
+	frame, err := encode(msg, t.config.MaxFrame)
+	if err != nil {
+		return rich.Errorf("could not encode message: %w", err)
+	}
+	err = t.enqueue(p, frame)
+	if err != nil {
+		return rich.Errorf("could not queue message: %w", err)
+	}
+
+	return nil
+}
+
+// Broadcast queues the proposal for all peers that are not banned. It returns
+// the first error if the proposal could not be queued for some of them, but
+// still queues it for all others.
+func (t *Transport) Broadcast(proposal *message.Proposal) error {
+
+	frame, err := encode(proposal, t.config.MaxFrame)
+	if err != nil {
+		return rich.Errorf("could not encode proposal: %w", err)
+	}
+
+	var failure error
+	for _, p := range t.peers {
+		if t.banned(p.id) {
+			continue
+		}
+		err = t.enqueue(p, frame)
+		if err != nil && failure == nil {
+			failure = rich.Errorf("could not queue proposal: %w", err)
+		}
+	}
+
+	return failure
+}
+
+// Transmit queues the vote for the peer with the given identity.
+func (t *Transport) Transmit(vote *message.Vote, recipientID base.Hash) error {
+	return t.Send(recipientID, vote)
+}
+
+// Request sends the message as request to the peer and waits for its
+// response. The request is queued like any other message, and the response
+// arrives over the connection the peer opened to us.
+func (t *Transport) Request(ctx context.Context, peerID base.Hash, msg interface{}) (interface{}, error) {
+	return t.calls.Request(ctx, t, peerID, msg)
+}
+
+// Serve sets the responder that answers the requests of peers. Requests don't
+// pass through the receiver, so limits and bans have to be applied in front of
+// the responder, for example with the responders of a limiter and a scorer.
+func (t *Transport) Serve(responder network.Responder) {
+	t.calls.Serve(responder)
+}
+
+// Ban closes all connections with the peer and refuses new ones for the given
+// duration. Messages queued for the peer are dropped.
+func (t *Transport) Ban(peerID base.Hash, duration time.Duration) error {
+
+	_, ok := t.peers[peerID]
+	if !ok {
+		return rich.Errorf("unknown peer").Hex("peer", peerID[:])
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bans[peerID] = time.Now().Add(duration)
+	for conn, connID := range t.conns {
+		if connID == peerID {
+			conn.Close()
+		}
+	}
+
+	return nil
+}
+
+// enqueue adds the frame to the queue of the peer without blocking.
+func (t *Transport) enqueue(p *peer, frame []byte) error {
+	select {
+	case p.queue <- frame:
+		return nil
+	default:
+		return rich.Errorf("peer queue full").Hex("peer", p.id[:]).Int("capacity", cap(p.queue))
+	}
+}
+
+// send writes the queued frames to the peer until the context is canceled. It
+// connects when the first frame is queued, and reconnects with exponential
+// backoff when the connection fails. The frame being written is kept and
+// written again on the next connection, while the rest wait in the queue; it
+// is only dropped if the peer gets banned.
+func (t *Transport) send(ctx context.Context, p *peer) {
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			t.untrack(conn)
+		}
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	backoff := t.config.MinBackoff
+	for {
+
+		// 1) wait for the next frame
+		var frame []byte
+		select {
+		case frame = <-p.queue:
+		case <-ctx.Done():
+			return
+		}
+
+		// 2) write the frame, connecting first if needed; if anything fails,
+		// we wait and try again with a new connection, unless the peer was
+		// banned in the meantime
+		for {
+			if t.banned(p.id) {
+				break
+			}
+			if conn == nil {
+				var err error
+				conn, err = t.dial(ctx, p)
+				if err != nil {
+					conn = nil
+				}
+			}
+			if conn != nil {
+				_ = conn.SetWriteDeadline(time.Now().Add(t.config.WriteTimeout))
+				_, err := conn.Write(frame)
+				if err == nil {
+					backoff = t.config.MinBackoff
+					break
+				}
+				t.untrack(conn)
+				conn = nil
+			}
+			timer.Reset(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > t.config.MaxBackoff {
+				backoff = t.config.MaxBackoff
+			}
+		}
+	}
+}
+
+// dial connects to the peer and makes sure it has the expected identity.
+func (t *Transport) dial(ctx context.Context, p *peer) (net.Conn, error) {
+
+	dialer := net.Dialer{Timeout: t.config.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, rich.Errorf("could not dial peer: %w", err).Str("address", p.address)
+	}
+	if !t.track(conn) {
+		conn.Close()
+		return nil, rich.Errorf("transport closed")
+	}
+
+	secured, peerID, err := t.open(conn, true)
+	if err != nil {
+		t.untrack(conn)
+		return nil, rich.Errorf("could not open connection: %w", err)
+	}
+	if peerID != p.id {
+		t.untrack(conn)
+		return nil, rich.Errorf("unexpected peer identity").Hex("expected", p.id[:]).Hex("actual", peerID[:])
+	}
+	if !t.identify(conn, secured, peerID) {
+		t.untrack(conn)
+		return nil, rich.Errorf("peer banned").Hex("peer", peerID[:])
+	}
+
+	return secured, nil
+}
+
+// open runs the handshakes on a new connection, and returns the connection to
+// use from then on, along with the identity of the peer. If there is a
+// securer, it secures the connection first, and the identity exchanged in our
+// own handshake has to match the one the securer authenticated.
+func (t *Transport) open(conn net.Conn, client bool) (net.Conn, base.Hash, error) {
+
+	_ = conn.SetDeadline(time.Now().Add(t.config.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// 1) secure the connection, if we have a securer
+	secured := conn
+	var authID base.Hash
+	var err error
+	if t.config.Securer != nil && client {
+		secured, authID, err = t.config.Securer.Client(conn)
+	}
+	if t.config.Securer != nil && !client {
+		secured, authID, err = t.config.Securer.Server(conn)
+	}
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not secure connection: %w", err)
+	}
+
+	// 2) exchange identities and make sure they match the authenticated ones
+	peerID, err := handshake(secured, t.selfID)
+	if err != nil {
+		return nil, base.ZeroHash, rich.Errorf("could not complete handshake: %w", err)
+	}
+	if t.config.Securer != nil && peerID != authID {
+		return nil, base.ZeroHash, rich.Errorf("identity not authenticated").Hex("claimed", peerID[:]).Hex("authenticated", authID[:])
+	}
+
+	return secured, peerID, nil
+}
+
+// receive completes the handshake with a peer that connected to us and passes
+// the messages it sends to the handler until the connection fails.
+func (t *Transport) receive(conn net.Conn) {
+
+	// 1) make sure the connection comes from one of our peers, which is not
+	// banned
+	secured, peerID, err := t.open(conn, false)
+	if err != nil {
+		return
+	}
+	_, ok := t.peers[peerID]
+	if !ok || !t.identify(conn, secured, peerID) {
+		return
+	}
+	defer t.untrack(secured)
+
+	// 2) decode the messages one by one; a peer sending garbage loses its
+	// connection, and has to reconnect to send anything else
+	for {
+		msg, err := read(secured, t.config.MaxFrame)
+		if err != nil {
+			return
+		}
+		if !t.deliver(peerID, msg) {
+			return
+		}
+	}
+}
+
+// deliver passes the message to the receiver, unless it is a request or
+// response. As long as the receiver signals backpressure, it waits and tries
+// again; meanwhile, nothing is read from the connection, so that TCP flow
+// control slows down the peer. It returns false if the connection should be
+// closed, because the peer sent a response we didn't ask it for, or because
+// the transport shut down in the meantime.
+func (t *Transport) deliver(peerID base.Hash, msg interface{}) bool {
+
+	// a response to a request that could not be sent is dropped like the
+	// errors of the receiver, and the requester will time out
+	handled, err := t.calls.Receive(t, peerID, msg)
+	_, response := msg.(*network.Response)
+	if err != nil && response {
+		return false
+	}
+	if handled {
+		return true
+	}
+
+	var timer *time.Timer
+	backoff := t.config.MinBackoff
+	for {
+		err := t.receiver.Receive(peerID, msg)
+		if !network.Backpressure(err) {
+			return true
+		}
+		if timer == nil {
+			timer = time.NewTimer(backoff)
+		} else {
+			timer.Reset(backoff)
+		}
+		select {
+		case <-timer.C:
+		case <-t.done:
+			timer.Stop()
+			return false
+		}
+		backoff *= 2
+		if backoff > t.config.MaxBackoff {
+			backoff = t.config.MaxBackoff
+		}
+	}
+}
+
+// track registers an open connection, so that it is closed on shutdown. It
+// returns false if the transport is already shutting down.
+func (t *Transport) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		return false
+	}
+	t.conns[conn] = base.ZeroHash
+	return true
+}
+
+// identify associates an open connection with the peer on the other side,
+// tracking it as the secured connection from then on. It returns false if the
+// peer is banned or the transport is shutting down.
+func (t *Transport) identify(conn net.Conn, secured net.Conn, peerID base.Hash) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil || t.isBanned(peerID) {
+		return false
+	}
+	delete(t.conns, conn)
+	t.conns[secured] = peerID
+	return true
+}
+
+// banned checks whether the peer is currently banned.
+func (t *Transport) banned(peerID base.Hash) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.isBanned(peerID)
+}
+
+// isBanned checks whether the peer is currently banned, and forgets about
+// expired bans. It has to be called with the lock held.
+func (t *Transport) isBanned(peerID base.Hash) bool {
+	until, ok := t.bans[peerID]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(t.bans, peerID)
+	return false
+}
+
+// untrack closes a connection and removes it from the open connections.
+func (t *Transport) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn.Close()
+	if t.conns != nil {
+		delete(t.conns, conn)
+	}
+}
@@ -0,0 +1,502 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tcp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+	"github.com/awfm/consensus/network"
+	"github.com/awfm/consensus/network/noise"
+	"github.com/awfm/consensus/network/rpc"
+)
+
+var _ consensus.Network = (*Transport)(nil)
+var _ network.Transport = (*Transport)(nil)
+var _ network.Requester = (*Transport)(nil)
+
+// testConfig uses short timeouts, so that failures are detected quickly.
+var testConfig = Config{
+	QueueSize:        16,
+	MaxFrame:         1 << 16,
+	DialTimeout:      100 * time.Millisecond,
+	HandshakeTimeout: 100 * time.Millisecond,
+	WriteTimeout:     100 * time.Millisecond,
+	MinBackoff:       10 * time.Millisecond,
+	MaxBackoff:       50 * time.Millisecond,
+	Requests:         rpc.Config{Timeout: time.Second, MaxResponse: 1 << 10},
+}
+
+// envelope is a message received by a node along with its origin.
+type envelope struct {
+	originID base.Hash
+	proposal *message.Proposal
+	vote     *message.Vote
+}
+
+// inbox is a handler that forwards the received messages on a channel.
+type inbox chan envelope
+
+func (i inbox) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	i <- envelope{originID: originID, proposal: proposal}
+	return nil
+}
+
+func (i inbox) Vote(originID base.Hash, vote *message.Vote) error {
+	i <- envelope{originID: originID, vote: vote}
+	return nil
+}
+
+// next waits for the next message in the inbox.
+func (i inbox) next(t *testing.T) envelope {
+	select {
+	case env := <-i:
+		return env
+	case <-time.After(time.Second):
+		require.FailNow(t, "should receive message")
+		return envelope{}
+	}
+}
+
+// listen opens a listener on a random local port.
+func listen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "should listen")
+	return ln
+}
+
+// start runs a transport for the node on the listener until the returned
+// function is called.
+func start(t *testing.T, selfID base.Hash, ln net.Listener, peers []Peer, handler inbox) (*Transport, func()) {
+	others := make([]Peer, 0, len(peers))
+	for _, p := range peers {
+		if p.ID != selfID {
+			others = append(others, p)
+		}
+	}
+	tr, err := New(selfID, others, network.Dispatch(handler), testConfig)
+	require.NoError(t, err, "should create transport")
+	return tr, run(t, tr, ln)
+}
+
+// run runs the transport on the listener until the returned function is
+// called.
+func run(t *testing.T, tr *Transport, ln net.Listener) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- tr.Run(ctx, ln)
+	}()
+	return func() {
+		cancel()
+		select {
+		case err := <-done:
+			require.NoError(t, err, "should stop transport")
+		case <-time.After(time.Second):
+			require.FailNow(t, "should stop transport")
+		}
+	}
+}
+
+// cluster starts transports for the given number of nodes, all peering with
+// each other.
+func cluster(t *testing.T, n uint) ([]Peer, []*Transport, []inbox, func()) {
+	nodeIDs := fixture.Hashes(t, n)
+	listeners := make([]net.Listener, 0, n)
+	peers := make([]Peer, 0, n)
+	for _, nodeID := range nodeIDs {
+		ln := listen(t)
+		listeners = append(listeners, ln)
+		peers = append(peers, Peer{ID: nodeID, Address: ln.Addr().String()})
+	}
+	transports := make([]*Transport, 0, n)
+	inboxes := make([]inbox, 0, n)
+	stops := make([]func(), 0, n)
+	for i, p := range peers {
+		in := make(inbox, 64)
+		tr, stop := start(t, p.ID, listeners[i], peers, in)
+		transports = append(transports, tr)
+		inboxes = append(inboxes, in)
+		stops = append(stops, stop)
+	}
+	return peers, transports, inboxes, func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func TestTransportDelivery(t *testing.T) {
+
+	peers, transports, inboxes, stop := cluster(t, 3)
+	defer stop()
+
+	// a broadcast should reach all other nodes with its origin
+	proposal := fixture.Proposal(t)
+	require.NoError(t, transports[0].Broadcast(proposal), "should broadcast proposal")
+	for _, in := range inboxes[1:] {
+		env := in.next(t)
+		assert.Equal(t, peers[0].ID, env.originID, "should have sender as origin")
+		assert.Equal(t, proposal, env.proposal, "should receive proposal")
+	}
+
+	// a transmission should only reach the recipient
+	vote := fixture.Vote(t)
+	require.NoError(t, transports[1].Transmit(vote, peers[2].ID), "should transmit vote")
+	env := inboxes[2].next(t)
+	assert.Equal(t, peers[1].ID, env.originID, "should have sender as origin")
+	assert.Equal(t, vote, env.vote, "should receive vote")
+	assert.Empty(t, inboxes[0], "should not deliver vote to others")
+	assert.Error(t, transports[1].Transmit(vote, fixture.Hash(t)), "should not transmit to unknown peer")
+	assert.Error(t, transports[1].Transmit(vote, peers[1].ID), "should not transmit to self")
+	assert.Equal(t, message.SortIDs([]base.Hash{peers[0].ID, peers[2].ID}), transports[1].Peers(), "should have other nodes as peers")
+
+	// messages that exceed the frame limit should be rejected
+	large := fixture.Vote(t)
+	large.Signature = make([]byte, testConfig.MaxFrame)
+	assert.Error(t, transports[1].Transmit(large, peers[2].ID), "should not transmit oversized vote")
+
+	// invalid configurations should be rejected
+	_, err := New(peers[0].ID, peers, network.Dispatch(inboxes[0]), testConfig)
+	assert.Error(t, err, "should not create transport with self as peer")
+	_, err = New(peers[0].ID, []Peer{peers[1], peers[1]}, network.Dispatch(inboxes[0]), testConfig)
+	assert.Error(t, err, "should not create transport with duplicate peer")
+}
+
+func TestTransportHandshake(t *testing.T) {
+
+	peers, _, inboxes, stop := cluster(t, 2)
+	defer stop()
+
+	// connections from unknown identities should be closed after the handshake
+	conn, err := net.Dial("tcp", peers[0].Address)
+	require.NoError(t, err, "should connect")
+	defer conn.Close()
+	_, err = handshake(conn, fixture.Hash(t))
+	require.NoError(t, err, "should exchange identities")
+	frame, err := encode(fixture.Vote(t), testConfig.MaxFrame)
+	require.NoError(t, err, "should encode vote")
+	_, _ = conn.Write(frame)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "should close connection of unknown peer")
+	assert.Empty(t, inboxes[0], "should not deliver message of unknown peer")
+
+	// connections with a wrong protocol should be closed as well
+	conn, err = net.Dial("tcp", peers[0].Address)
+	require.NoError(t, err, "should connect")
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, 64))
+	require.NoError(t, err, "should write garbage")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = ioutil.ReadAll(conn)
+	timeout, ok := err.(net.Error)
+	assert.False(t, ok && timeout.Timeout(), "should close connection with garbage handshake")
+
+	// a node listening under the wrong identity should never get messages
+	impostorID := fixture.Hash(t)
+	ln := listen(t)
+	impostor := make(inbox, 1)
+	_, stopImpostor := start(t, impostorID, ln, []Peer{peers[0]}, impostor)
+	defer stopImpostor()
+	tr, stopSender := start(t, peers[0].ID, listen(t), []Peer{{ID: peers[1].ID, Address: ln.Addr().String()}}, make(inbox))
+	defer stopSender()
+	require.NoError(t, tr.Transmit(fixture.Vote(t), peers[1].ID), "should queue vote")
+	select {
+	case <-impostor:
+		assert.Fail(t, "should not deliver to wrong identity")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTransportSecure(t *testing.T) {
+
+	// give each node a static key, and let the first two know each other; the
+	// third node is an impostor
+	nodeIDs := fixture.Hashes(t, 3)
+	keys := make([]*noise.Key, 0, len(nodeIDs))
+	for range nodeIDs {
+		key, err := noise.GenerateKey(nil)
+		require.NoError(t, err, "should generate key")
+		keys = append(keys, key)
+	}
+	secure := func(selfID base.Hash, key *noise.Key, peerID base.Hash, peerKey *noise.Key) Config {
+		h, err := noise.New(selfID, key, map[base.Hash][]byte{peerID: peerKey.Public})
+		require.NoError(t, err, "should create handshaker")
+		config := testConfig
+		config.Securer = h
+		return config
+	}
+	listeners := []net.Listener{listen(t), listen(t), listen(t)}
+	peers := make([]Peer, 0, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		peers = append(peers, Peer{ID: nodeID, Address: listeners[i].Addr().String()})
+	}
+	in := make(inbox, 64)
+	receiver, err := New(nodeIDs[1], peers[:1], network.Dispatch(in), secure(nodeIDs[1], keys[1], nodeIDs[0], keys[0]))
+	require.NoError(t, err, "should create transport")
+	defer run(t, receiver, listeners[1])()
+	sender, err := New(nodeIDs[0], peers[1:2], network.Dispatch(make(inbox)), secure(nodeIDs[0], keys[0], nodeIDs[1], keys[1]))
+	require.NoError(t, err, "should create transport")
+	defer run(t, sender, listeners[0])()
+
+	// messages should go through the secure channel
+	vote := fixture.Vote(t)
+	require.NoError(t, sender.Transmit(vote, nodeIDs[1]), "should transmit vote")
+	env := in.next(t)
+	assert.Equal(t, nodeIDs[0], env.originID, "should deliver with authenticated origin")
+	assert.Equal(t, vote, env.vote, "should deliver vote")
+
+	// a node using the identity of the sender with its own key should not get
+	// through, even though the receiver knows the identity
+	impostor, err := New(nodeIDs[0], peers[1:2], network.Dispatch(make(inbox)), secure(nodeIDs[0], keys[2], nodeIDs[1], keys[1]))
+	require.NoError(t, err, "should create transport")
+	defer run(t, impostor, listeners[2])()
+	require.NoError(t, impostor.Transmit(fixture.Vote(t), nodeIDs[1]), "should queue vote")
+
+	// a plaintext connection should not get through either
+	conn, err := net.Dial("tcp", peers[1].Address)
+	require.NoError(t, err, "should connect")
+	defer conn.Close()
+	_, _ = handshake(conn, nodeIDs[0])
+	frame, err := encode(fixture.Vote(t), testConfig.MaxFrame)
+	require.NoError(t, err, "should encode vote")
+	_, _ = conn.Write(frame)
+
+	select {
+	case <-in:
+		assert.Fail(t, "should not deliver unauthenticated messages")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// echo is a responder that answers every request with the message itself.
+type echo struct{}
+
+func (echo) Respond(originID base.Hash, msg interface{}) (interface{}, error) {
+	return msg, nil
+}
+
+func TestTransportRequest(t *testing.T) {
+
+	peers, transports, inboxes, stop := cluster(t, 3)
+	defer stop()
+	transports[1].Serve(echo{})
+
+	// several requests in flight should each get their own response
+	results := make(chan error, 8)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			query := &network.Query{Kind: network.QueryVertex, ID: fixture.Hash(t)}
+			msg, err := transports[0].Request(context.Background(), peers[1].ID, query)
+			if err == nil && !assert.ObjectsAreEqual(query, msg) {
+				err = assert.AnError
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < cap(results); i++ {
+		assert.NoError(t, <-results, "should get matching response")
+	}
+	assert.Empty(t, inboxes[0], "should not pass responses to receiver")
+	assert.Empty(t, inboxes[1], "should not pass requests to receiver")
+
+	// a node without a responder should answer with an error
+	_, err := transports[0].Request(context.Background(), peers[2].ID, &network.Query{})
+	assert.Error(t, err, "should fail without responder")
+
+	// a response over the size limit should not be sent
+	large := fixture.Vote(t)
+	large.Signature = make([]byte, 2<<10)
+	_, err = transports[0].Request(context.Background(), peers[1].ID, large)
+	assert.Error(t, err, "should fail with large response")
+
+	// a request to an unreachable peer should time out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	unreachable, stopUnreachable := start(t, peers[0].ID, listen(t), []Peer{{ID: peers[1].ID, Address: "127.0.0.1:1"}}, make(inbox))
+	defer stopUnreachable()
+	_, err = unreachable.Request(ctx, peers[1].ID, &network.Query{})
+	assert.Error(t, err, "should time out without response")
+}
+
+func TestTransportReconnect(t *testing.T) {
+
+	// run a sender and a receiver and make sure they are connected
+	nodeIDs := fixture.Hashes(t, 2)
+	ln := listen(t)
+	address := ln.Addr().String()
+	peers := []Peer{{ID: nodeIDs[0], Address: listen(t).Addr().String()}, {ID: nodeIDs[1], Address: address}}
+	sender, stopSender := start(t, nodeIDs[0], listen(t), peers, make(inbox))
+	defer stopSender()
+	in := make(inbox, 64)
+	_, stopReceiver := start(t, nodeIDs[1], ln, peers, in)
+	require.NoError(t, sender.Transmit(fixture.Vote(t), nodeIDs[1]), "should transmit vote")
+	in.next(t)
+
+	// restart the receiver, and make sure the sender reconnects; votes written
+	// to the old connection before the failure is noticed may be lost
+	stopReceiver()
+	ln, err := net.Listen("tcp", address)
+	require.NoError(t, err, "should listen on same address")
+	in = make(inbox, 64)
+	_, stopReceiver = start(t, nodeIDs[1], ln, peers, in)
+	defer stopReceiver()
+	require.Eventually(t, func() bool {
+		_ = sender.Transmit(fixture.Vote(t), nodeIDs[1])
+		return len(in) > 0
+	}, 2*time.Second, 20*time.Millisecond, "should deliver after reconnect")
+}
+
+func TestTransportBan(t *testing.T) {
+
+	peers, transports, inboxes, stop := cluster(t, 3)
+	defer stop()
+	var _ network.Banner = transports[0]
+
+	// make sure the banned peer is connected, so that banning has to cut the
+	// existing connection
+	require.NoError(t, transports[1].Transmit(fixture.Vote(t), peers[0].ID), "should transmit vote")
+	inboxes[0].next(t)
+
+	// the banned peer should neither be reachable nor be able to reach us
+	require.NoError(t, transports[0].Ban(peers[1].ID, time.Hour), "should ban peer")
+	assert.Error(t, transports[0].Ban(fixture.Hash(t), time.Hour), "should not ban unknown peer")
+	assert.Equal(t, []base.Hash{peers[2].ID}, transports[0].Peers(), "should not list banned peer")
+	assert.Error(t, transports[0].Send(peers[1].ID, fixture.Vote(t)), "should not send to banned peer")
+	require.NoError(t, transports[0].Broadcast(fixture.Proposal(t)), "should broadcast proposal")
+	assert.NotNil(t, inboxes[2].next(t).proposal, "should deliver proposal to other peer")
+	require.NoError(t, transports[1].Transmit(fixture.Vote(t), peers[0].ID), "should queue vote")
+	select {
+	case <-inboxes[0]:
+		assert.Fail(t, "should not receive from banned peer")
+	case <-inboxes[1]:
+		assert.Fail(t, "should not deliver to banned peer")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// once the ban expires, the peer should be able to reconnect
+	require.NoError(t, transports[0].Ban(peers[1].ID, 0), "should lift ban")
+	require.Eventually(t, func() bool {
+		_ = transports[1].Transmit(fixture.Vote(t), peers[0].ID)
+		return len(inboxes[0]) > 0
+	}, 2*time.Second, 20*time.Millisecond, "should deliver after ban expired")
+}
+
+// busy is a handler that signals backpressure for a number of attempts before
+// passing messages on.
+type busy struct {
+	refusals int32
+	handler  network.Handler
+}
+
+func (b *busy) Proposal(originID base.Hash, proposal *message.Proposal) error {
+	if atomic.AddInt32(&b.refusals, -1) >= 0 {
+		return signal.QueueFull{Queue: "proposal", Capacity: 0}
+	}
+	return b.handler.Proposal(originID, proposal)
+}
+
+func (b *busy) Vote(originID base.Hash, vote *message.Vote) error {
+	if atomic.AddInt32(&b.refusals, -1) >= 0 {
+		return signal.QueueFull{Queue: "vote", Capacity: 0}
+	}
+	return b.handler.Vote(originID, vote)
+}
+
+func TestTransportBackpressure(t *testing.T) {
+
+	// run a receiver that refuses the first few deliveries
+	nodeIDs := fixture.Hashes(t, 2)
+	ln := listen(t)
+	peers := []Peer{{ID: nodeIDs[0], Address: listen(t).Addr().String()}, {ID: nodeIDs[1], Address: ln.Addr().String()}}
+	sender, stopSender := start(t, nodeIDs[0], listen(t), peers, make(inbox))
+	defer stopSender()
+	in := make(inbox, 64)
+	b := &busy{refusals: 3, handler: in}
+	receiver, err := New(nodeIDs[1], peers[:1], network.Dispatch(b), testConfig)
+	require.NoError(t, err, "should create transport")
+	stopReceiver := run(t, receiver, ln)
+
+	// the votes should still arrive, in order, once the receiver takes them
+	first := fixture.Vote(t)
+	second := fixture.Vote(t)
+	require.NoError(t, sender.Transmit(first, nodeIDs[1]), "should transmit vote")
+	require.NoError(t, sender.Transmit(second, nodeIDs[1]), "should transmit vote")
+	assert.Equal(t, first, in.next(t).vote, "should deliver first vote after backpressure")
+	assert.Equal(t, second, in.next(t).vote, "should deliver second vote")
+
+	// a receiver that is stuck on backpressure should still shut down
+	atomic.StoreInt32(&b.refusals, 1<<30)
+	require.NoError(t, sender.Transmit(fixture.Vote(t), nodeIDs[1]), "should transmit vote")
+	time.Sleep(50 * time.Millisecond)
+	stopReceiver()
+}
+
+func TestTransportSlowPeer(t *testing.T) {
+
+	// one peer accepts connections but never answers the handshake
+	nodeIDs := fixture.Hashes(t, 3)
+	silent := listen(t)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ln := listen(t)
+	peers := []Peer{
+		{ID: nodeIDs[0], Address: listen(t).Addr().String()},
+		{ID: nodeIDs[1], Address: silent.Addr().String()},
+		{ID: nodeIDs[2], Address: ln.Addr().String()},
+	}
+	in := make(inbox, 64)
+	_, stopReceiver := start(t, nodeIDs[2], ln, peers, in)
+	defer stopReceiver()
+	sender, stopSender := start(t, nodeIDs[0], listen(t), peers, make(inbox))
+	defer stopSender()
+
+	// broadcasting should never block, even once the slow peer's queue is
+	// full, and the other peer should receive all proposals
+	failures := 0
+	for i := 0; i < 2*testConfig.QueueSize; i++ {
+		start := time.Now()
+		err := sender.Broadcast(fixture.Proposal(t))
+		if err != nil {
+			failures++
+		}
+		assert.True(t, time.Since(start) < 50*time.Millisecond, "should not block broadcast")
+		in.next(t)
+	}
+	assert.True(t, failures >= testConfig.QueueSize-1, "should report full queue of slow peer")
+}
@@ -17,6 +17,10 @@
 package consensus
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/awfm/rich"
 
 	"github.com/awfm/consensus/model/base"
@@ -25,32 +29,54 @@ import (
 )
 
 type Processor struct {
-	net    Network
-	graph  Graph
-	build  Builder
-	strat  Strategy
-	sign   Signer
-	verify Verifier
-	cache  Cache
-	loop   Looper
+	mu      sync.Mutex
+	net     Network
+	graph   Graph
+	build   Builder
+	strat   Strategy
+	sign    Signer
+	verify  Verifier
+	cache   Cache
+	loop    Looper
+	looped  []interface{}
+	parked  map[base.Hash]*message.Proposal
+	voted   map[uint64]base.Hash
+	waiting map[uint64]struct{}
+	after   func(delay time.Duration, f func())
 }
 
 func NewProcessor(net Network, graph Graph, build Builder, strat Strategy, sign Signer, verify Verifier, cache Cache) *Processor {
 
 	pro := Processor{
-		net:    net,
-		graph:  graph,
-		build:  build,
-		strat:  strat,
-		sign:   sign,
-		verify: verify,
-		cache:  cache,
-	}
+		net:     net,
+		graph:   graph,
+		build:   build,
+		strat:   strat,
+		sign:    sign,
+		verify:  verify,
+		cache:   cache,
+		parked:  make(map[base.Hash]*message.Proposal),
+		voted:   make(map[uint64]base.Hash),
+		waiting: make(map[uint64]struct{}),
+		after:   func(delay time.Duration, f func()) { time.AfterFunc(delay, f) },
+	}
+	pro.loop = direct{pro: &pro}
 
 	return &pro
 }
 
+// Attach sets the looper that messages are looped back to ourselves through.
+// Until one is attached, the processor processes them right away itself.
+func (pro *Processor) Attach(loop Looper) {
+	pro.mu.Lock()
+	defer pro.mu.Unlock()
+
+	pro.loop = loop
+}
+
 func (pro *Processor) Bootstrap() error {
+	pro.mu.Lock()
+	defer pro.unlock()
 
 	// get current tip of the state
 	tip, err := pro.graph.Tip()
@@ -63,7 +89,12 @@ func (pro *Processor) Bootstrap() error {
 		return rich.Errorf("invalid tip height").Uint64("tip_height", tip.Height)
 	}
 
-	// vote on the vertex
+	// vote on the vertex, including for ourselves if we are a collector, as
+	// there is no proposal for the genesis vertex that would make us do so
+	err = pro.loopVote(tip)
+	if err != nil {
+		return rich.Errorf("could not loop vote: %w", err)
+	}
 	err = pro.castVote(tip)
 	if err != nil {
 		return rich.Errorf("could not cast vote: %w", err)
@@ -73,9 +104,12 @@ func (pro *Processor) Bootstrap() error {
 }
 
 func (pro *Processor) OnProposal(proposal *message.Proposal) error {
+	pro.mu.Lock()
+	defer pro.unlock()
 
 	// NOTE: the network layer should de-duplicate proposals if we want to
-	// avoid expensive double processing of the same proposal multiple times
+	// avoid expensive double processing of the same proposal multiple times,
+	// for example by putting the dedup filter in front of the processor
 
 	// 1) try to confirm the parent vertex of the proposal
 	err := pro.confirmParent(proposal)
@@ -110,10 +144,34 @@ func (pro *Processor) OnProposal(proposal *message.Proposal) error {
 	return nil
 }
 
+// OnArc processes the proposals that were waiting for the payload of the arc
+// again, now that it arrived, and forgets the ones that can't be applied
+// anymore.
+func (pro *Processor) OnArc(arcID base.Hash) error {
+	pro.mu.Lock()
+	defer pro.unlock()
+
+	final, err := pro.graph.Final()
+	if err != nil {
+		return rich.Errorf("could not get final: %w", err)
+	}
+	for proposerID, proposal := range pro.parked {
+		if proposal.Candidate.Height <= final.Height {
+			delete(pro.parked, proposerID)
+		}
+	}
+	pro.release(arcID)
+
+	return nil
+}
+
 func (pro *Processor) OnVote(vote *message.Vote) error {
+	pro.mu.Lock()
+	defer pro.unlock()
 
 	// NOTE: the network layer should de-duplicate votes if we want to avoid
-	// processing the same vote expensively multiple times
+	// processing the same vote expensively multiple times, for example by
+	// putting the dedup filter in front of the processor
 
 	// 1) collect the vote in our cache
 	err := pro.collectVote(vote)
@@ -130,6 +188,78 @@ func (pro *Processor) OnVote(vote *message.Vote) error {
 	return nil
 }
 
+// OnVotes processes a batch of votes at once, so that their signatures can be
+// verified together if the verifier supports batch verification. It returns
+// one error for each vote, which is nil if the vote was processed successfully.
+func (pro *Processor) OnVotes(votes []*message.Vote) []error {
+	pro.mu.Lock()
+	defer pro.unlock()
+
+	errs := make([]error, len(votes))
+
+	// 1) run the cheap checks on all votes before verifying any signatures
+	var checked []*message.Vote
+	var indices []int
+	for i, vote := range votes {
+		err := pro.checkVote(vote)
+		if err != nil {
+			errs[i] = rich.Errorf("could not check vote: %w", err)
+			continue
+		}
+		checked = append(checked, vote)
+		indices = append(indices, i)
+	}
+
+	// 2) verify the signatures of the remaining votes together
+	invalid, err := pro.verifyVotes(checked)
+	if err != nil {
+		for _, index := range indices {
+			errs[index] = rich.Errorf("could not verify votes: %w", err)
+		}
+		return errs
+	}
+
+	// 3) collect the valid votes in our cache
+	type key struct {
+		height      uint64
+		candidateID base.Hash
+	}
+	var candidates []key
+	collected := make(map[key][]int)
+	for j, vote := range checked {
+		index := indices[j]
+		err, ok := invalid[vote]
+		if ok {
+			errs[index] = rich.Errorf("could not verify vote signature: %w", err)
+			continue
+		}
+		err = pro.cache.Vote(vote)
+		if err != nil {
+			errs[index] = rich.Errorf("could not cache vote: %w", err)
+			continue
+		}
+		k := key{height: vote.Height, candidateID: vote.CandidateID}
+		_, ok = collected[k]
+		if !ok {
+			candidates = append(candidates, k)
+		}
+		collected[k] = append(collected[k], index)
+	}
+
+	// 4) try to build a proposal for each of the candidates we got votes for
+	for _, k := range candidates {
+		err := pro.proposeCandidate(k.height, k.candidateID)
+		if err == nil {
+			continue
+		}
+		for _, index := range collected[k] {
+			errs[index] = rich.Errorf("could not propose candidate: %w", err)
+		}
+	}
+
+	return errs
+}
+
 func (pro *Processor) confirmParent(proposal *message.Proposal) error {
 
 	// 1) validate the quorum signature
@@ -157,6 +287,19 @@ func (pro *Processor) confirmParent(proposal *message.Proposal) error {
 		return rich.Errorf("could not clear cache: %w", err)
 	}
 
+	// 4) forget which candidates we signed and which proposals we held back
+	// up to the parent, as nothing can be added at those heights anymore
+	for height := range pro.voted {
+		if height < proposal.Candidate.Height {
+			delete(pro.voted, height)
+		}
+	}
+	for height := range pro.waiting {
+		if height < proposal.Candidate.Height {
+			delete(pro.waiting, height)
+		}
+	}
+
 	return nil
 }
 
@@ -173,15 +316,20 @@ func (pro *Processor) applyCandidate(proposal *message.Proposal) error {
 		return signal.StaleProposal{Proposal: proposal}
 	}
 
-	// 2) check that the proposal is made by the correct leader for the height
-	// -> proposals should only ever be made by the valid leader at a given
-	// height, so if someone else tries to make one, we should punish them
-	leaderID, err := pro.strat.Leader(proposal.Candidate.Height)
+	// 2) check that the proposal is made by one of the collectors of the
+	// parent height, the first of which is the leader for the height
+	// -> proposals should only ever be made by the nodes that collected the
+	// votes for the parent, so if someone else tries to make one, we should
+	// punish them
+	if proposal.Candidate.Height == 0 {
+		return signal.InvalidProposer{Proposal: proposal}
+	}
+	proposerIDs, err := pro.strat.Collectors(proposal.Candidate.Height - 1)
 	if err != nil {
-		return rich.Errorf("could not get leader: %w", err)
+		return rich.Errorf("could not get proposers: %w", err)
 	}
-	if proposal.Candidate.ProposerID != leaderID {
-		return signal.InvalidProposer{Proposal: proposal, Leader: leaderID}
+	if !includes(proposerIDs, proposal.Candidate.ProposerID) {
+		return signal.InvalidProposer{Proposal: proposal, Proposers: proposerIDs}
 	}
 
 	// 3) check that the proposal is for a height that has not been finalized
@@ -222,7 +370,13 @@ func (pro *Processor) applyCandidate(proposal *message.Proposal) error {
 	// however, we delegate the responsibility for checking what a valid
 	// extension is to the external module, which can do additional checks such
 	// as validating the payload
+	// -> if the graph is only missing the payload of the arc, we hold on to
+	// the latest such proposal of each proposer, and process it again once the
+	// payload arrived
 	err = pro.graph.Extend(proposal.Candidate)
+	if errors.As(err, &signal.MissingArc{}) {
+		pro.parked[proposal.Candidate.ProposerID] = proposal
+	}
 	if err != nil {
 		return rich.Errorf("could not extend graph: %w", err)
 	}
@@ -239,23 +393,23 @@ func (pro *Processor) applyCandidate(proposal *message.Proposal) error {
 
 func (pro *Processor) extractVote(proposal *message.Proposal) error {
 
-	// if we are not the collector, no action is required
+	// if we are not one of the collectors, no action is required
 	selfID, err := pro.sign.Self()
 	if err != nil {
 		return rich.Errorf("could not get self: %w", err)
 	}
-	collectorID, err := pro.strat.Collector(proposal.Candidate.Height)
+	collectorIDs, err := pro.strat.Collectors(proposal.Candidate.Height)
 	if err != nil {
-		return rich.Errorf("could not get collector: %w", err)
+		return rich.Errorf("could not get collectors: %w", err)
 	}
-	if selfID != collectorID {
+	if !includes(collectorIDs, selfID) {
 		return nil
 	}
 
-	// if we are the collector, process the proposer's vote immediately to give
+	// if we are a collector, process the proposer's vote immediately to give
 	// it priority and to make sure that a proposal is generated if the
 	// proposer's vote is the only one required to have a qualified majority
-	pro.loop.Vote(proposal.Vote())
+	pro.looped = append(pro.looped, proposal.Vote())
 
 	return nil
 }
@@ -272,25 +426,31 @@ func (pro *Processor) loopVote(candidate *base.Vertex) error {
 		return nil
 	}
 
-	// if we are not the collector, no action is required, as the vote will be
-	// transmitted over the network to the collector
-	collectorID, err := pro.strat.Collector(candidate.Height)
+	// if we are not one of the collectors, no action is required, as the vote
+	// will be transmitted over the network to the collectors
+	collectorIDs, err := pro.strat.Collectors(candidate.Height)
 	if err != nil {
-		return rich.Errorf("could not get collector: %w", err)
+		return rich.Errorf("could not get collectors: %w", err)
 	}
-	if collectorID != selfID {
+	if !includes(collectorIDs, selfID) {
 		return nil
 	}
 
-	// finally, if we are not the proposer, but the collector, create our own
+	// finally, if we are not the proposer, but a collector, create our own
 	// vote for the proposal and immediately process it locally to give it
 	// priority and make sure a proposal is generated if our own vote is the
 	// only one required for a qualified majority
+	if !pro.vouch(candidate) {
+		return nil
+	}
 	vote, err := pro.sign.Vote(candidate)
+	if errors.As(err, &signal.DoubleSign{}) {
+		return nil
+	}
 	if err != nil {
 		return rich.Errorf("could not create vote: %w", err)
 	}
-	pro.loop.Vote(vote)
+	pro.looped = append(pro.looped, vote)
 
 	return nil
 }
@@ -307,31 +467,76 @@ func (pro *Processor) castVote(candidate *base.Vertex) error {
 		return nil
 	}
 
-	// if we are the collector, no action is required, because we already
-	// locally processed our own vote and don't need to send it
-	collectorID, err := pro.strat.Collector(candidate.Height)
+	// we don't need to send our vote to ourselves if we are a collector,
+	// because we already processed it locally
+	collectorIDs, err := pro.strat.Collectors(candidate.Height)
 	if err != nil {
-		return rich.Errorf("could not get collector: %w", err)
+		return rich.Errorf("could not get collectors: %w", err)
+	}
+	recipientIDs := make([]base.Hash, 0, len(collectorIDs))
+	for _, collectorID := range collectorIDs {
+		if collectorID != selfID {
+			recipientIDs = append(recipientIDs, collectorID)
+		}
 	}
-	if collectorID == selfID {
+	if len(recipientIDs) == 0 {
 		return nil
 	}
 
-	// otherwise, if we are neither proposer nor collector, we should transmit
-	// our vote to the collector over the network
+	// otherwise, we should transmit our vote to all other collectors over the
+	// network, so that any of them can build the next proposal; if we already
+	// signed a competing proposal by another collector, or our signer refuses
+	// to vote because it signed a conflicting vertex before, we simply abstain
+	if !pro.vouch(candidate) {
+		return nil
+	}
 	vote, err := pro.sign.Vote(candidate)
+	if errors.As(err, &signal.DoubleSign{}) {
+		return nil
+	}
 	if err != nil {
 		return rich.Errorf("could not create vote: %w", err)
 	}
-	err = pro.net.Transmit(vote, collectorID)
+
+	// a collector that can't be reached should not keep the others from
+	// getting our vote, so we try all of them and report the first failure
+	var failure error
+	for _, recipientID := range recipientIDs {
+		err = pro.net.Transmit(vote, recipientID)
+		if err != nil && failure == nil {
+			failure = rich.Errorf("could not transmit vote: %w", err).Hex("collector", recipientID[:])
+		}
+	}
+
+	return failure
+}
+
+func (pro *Processor) collectVote(vote *message.Vote) error {
+
+	// 1) check that the vote is for a pending candidate and that we are the
+	// collector for it
+	err := pro.checkVote(vote)
+	if err != nil {
+		return rich.Errorf("could not check vote: %w", err)
+	}
+
+	// 2) check the signature on the vote
+	err = pro.verify.Vote(vote)
+	if err != nil {
+		return rich.Errorf("could not verify vote signature: %w", err)
+	}
+
+	// 3) check if this particular vote has already been processed, or whether
+	// it is a double vote situation being created
+	err = pro.cache.Vote(vote)
 	if err != nil {
-		return rich.Errorf("could not transmit vote: %w", err)
+		return rich.Errorf("could not cache vote: %w", err)
 	}
 
 	return nil
 }
 
-func (pro *Processor) collectVote(vote *message.Vote) error {
+func (pro *Processor) checkVote(vote *message.Vote) error {
 
 	// 1) discard votes that are on a vertex already included in the state
 	contains, err := pro.graph.Contains(vote.CandidateID)
@@ -343,11 +548,14 @@ func (pro *Processor) collectVote(vote *message.Vote) error {
 	}
 
 	// 2) discard votes on vertices that can't be finalized anymore
+	// -> the only votes on the final vertex that still matter are the ones on
+	// the genesis vertex, which is final without having been confirmed; once
+	// it is confirmed, they are discarded as stale above
 	final, err := pro.graph.Final()
 	if err != nil {
 		return rich.Errorf("could not get final: %w", err)
 	}
-	if vote.Height <= final.Height {
+	if vote.Height <= final.Height && vote.CandidateID != final.ID() {
 		return signal.ConflictingVote{Vote: vote, Final: final}
 	}
 
@@ -361,33 +569,48 @@ func (pro *Processor) collectVote(vote *message.Vote) error {
 		return signal.ObsoleteVote{Vote: vote, Tip: tip}
 	}
 
-	// 4) check if we are the collector for the given vote
+	// 4) check if we are one of the collectors for the given vote
 	selfID, err := pro.sign.Self()
 	if err != nil {
 		return rich.Errorf("could not get self: %w", err)
 	}
-	collectorID, err := pro.strat.Collector(vote.Height)
+	collectorIDs, err := pro.strat.Collectors(vote.Height)
 	if err != nil {
-		return rich.Errorf("could not get collector: %w", err)
+		return rich.Errorf("could not get collectors: %w", err)
 	}
-	if collectorID != selfID {
-		return signal.InvalidCollector{Vote: vote, Receiver: selfID, Collector: collectorID}
+	if !includes(collectorIDs, selfID) {
+		return signal.InvalidCollector{Vote: vote, Receiver: selfID, Collectors: collectorIDs}
 	}
 
-	// 5) check the signature on the vote
-	err = pro.verify.Vote(vote)
-	if err != nil {
-		return rich.Errorf("could not verify vote signature: %w", err)
+	return nil
+}
+
+func (pro *Processor) verifyVotes(votes []*message.Vote) (map[*message.Vote]error, error) {
+
+	invalid := make(map[*message.Vote]error)
+
+	// if the verifier can't verify batches, we check the votes one by one
+	batch, ok := pro.verify.(BatchVerifier)
+	if !ok {
+		for _, vote := range votes {
+			err := pro.verify.Vote(vote)
+			if err != nil {
+				invalid[vote] = err
+			}
+		}
+		return invalid, nil
 	}
 
-	// 6) check if this particular vote has already been processed, or whether
-	// it is a double vote situation being created
-	err = pro.cache.Vote(vote)
+	// otherwise, we verify them all at once and get the invalid ones back
+	failed, err := batch.Votes(votes)
 	if err != nil {
-		return rich.Errorf("could not cache vote: %w", err)
+		return nil, rich.Errorf("could not verify batch: %w", err)
+	}
+	for _, vote := range failed {
+		invalid[vote] = signal.InvalidSignature{Entity: "vote", Signer: vote.SignerID}
 	}
 
-	return nil
+	return invalid, nil
 }
 
 func (pro *Processor) proposeCandidate(height uint64, parentID base.Hash) error {
@@ -401,7 +624,85 @@ func (pro *Processor) proposeCandidate(height uint64, parentID base.Hash) error
 	if err != nil {
 		return rich.Errorf("could not build parent: %w", err)
 	}
-	if uint(len(quorum.SignerIDs)) < threshold {
+	if uint(quorum.Size()) < threshold {
+		return nil
+	}
+
+	// 2) if we are a backup collector, we hold our proposal back for the delay
+	// of our rank, so that we don't compete with the collectors before us
+	_, waiting := pro.waiting[height]
+	if waiting {
+		return nil
+	}
+	delay, err := pro.delay(height)
+	if err != nil {
+		return rich.Errorf("could not get delay: %w", err)
+	}
+	if delay > 0 {
+		pro.waiting[height] = struct{}{}
+		pro.after(delay, func() {
+			_ = pro.backup(height, parentID)
+		})
+		return nil
+	}
+
+	return pro.propose(height, parentID, quorum)
+}
+
+// backup builds our proposal as backup collector once we waited for the
+// collectors before us, unless a candidate for the next height reached us in
+// the meantime. There is no one to report errors to, so they are dropped.
+func (pro *Processor) backup(height uint64, parentID base.Hash) error {
+	pro.mu.Lock()
+	defer pro.unlock()
+
+	tip, err := pro.graph.Tip()
+	if err != nil {
+		return rich.Errorf("could not get tip: %w", err)
+	}
+	if tip.Height > height {
+		return nil
+	}
+	quorum, err := pro.cache.Quorum(height, parentID)
+	if err != nil {
+		return rich.Errorf("could not build parent: %w", err)
+	}
+
+	return pro.propose(height, parentID, quorum)
+}
+
+// delay returns how long we hold back our proposal as collector of the given
+// height; only the backup collectors of a backup strategy wait at all.
+func (pro *Processor) delay(height uint64) (time.Duration, error) {
+
+	backup, ok := pro.strat.(BackupStrategy)
+	if !ok {
+		return 0, nil
+	}
+	selfID, err := pro.sign.Self()
+	if err != nil {
+		return 0, rich.Errorf("could not get self: %w", err)
+	}
+	collectorIDs, err := pro.strat.Collectors(height)
+	if err != nil {
+		return 0, rich.Errorf("could not get collectors: %w", err)
+	}
+	for rank, collectorID := range collectorIDs {
+		if collectorID == selfID {
+			return backup.Delay(height, uint(rank)), nil
+		}
+	}
+
+	return 0, nil
+}
+
+// propose builds our proposal for the next height on top of the candidate with
+// the given quorum, unless we already signed another candidate at that height.
+func (pro *Processor) propose(height uint64, parentID base.Hash, quorum *message.Quorum) error {
+
+	// 1) check that we didn't sign any other candidate at the next height
+	_, voted := pro.voted[height+1]
+	if voted {
 		return nil
 	}
 
@@ -421,12 +722,24 @@ func (pro *Processor) proposeCandidate(height uint64, parentID base.Hash) error
 		ArcID:      arcID,
 	}
 
-	// 3) create the proposal and loop it back to ourselves for processing
+	pro.voted[candidate.Height] = candidate.ID()
+
+	// -> the payload of our own arc is available now, but we are not told
+	// about it, as it arrives while we are still processing
+	pro.release(arcID)
+
+	// 3) create the proposal with the quorum for the parent and loop it back
+	// to ourselves for processing; if our signer refuses because we already
+	// proposed a different candidate at this height, we keep the first one
 	proposal, err := pro.sign.Proposal(&candidate)
+	if errors.As(err, &signal.DoubleSign{}) {
+		return nil
+	}
 	if err != nil {
 		return rich.Errorf("could not create proposal: %w", err)
 	}
-	pro.loop.Proposal(proposal)
+	proposal.Quorum = quorum
+	pro.looped = append(pro.looped, proposal)
 
 	// 4) broadcast the proposal to the network
 	err = pro.net.Broadcast(proposal)
@@ -436,3 +749,55 @@ func (pro *Processor) proposeCandidate(height uint64, parentID base.Hash) error
 
 	return nil
 }
+
+// unlock releases the processor and only then passes the messages that were
+// looped back while processing to the looper, so that a looper which processes
+// them synchronously can re-enter the processor without deadlocking.
+func (pro *Processor) unlock() {
+	looped := pro.looped
+	pro.looped = nil
+	pro.mu.Unlock()
+
+	for _, msg := range looped {
+		switch msg := msg.(type) {
+		case *message.Proposal:
+			pro.loop.Proposal(msg)
+		case *message.Vote:
+			pro.loop.Vote(msg)
+		}
+	}
+}
+
+// vouch records that we sign the candidate, unless we already signed another
+// candidate at its height. This keeps us from voting for competing proposals
+// by different collectors, whether our signer is guarded or not.
+func (pro *Processor) vouch(candidate *base.Vertex) bool {
+	candidateID := candidate.ID()
+	signedID, ok := pro.voted[candidate.Height]
+	if ok && signedID != candidateID {
+		return false
+	}
+	pro.voted[candidate.Height] = candidateID
+	return true
+}
+
+// release loops back the proposals that were waiting for the payload of the
+// arc.
+func (pro *Processor) release(arcID base.Hash) {
+	for proposerID, proposal := range pro.parked {
+		if proposal.Candidate.ArcID == arcID {
+			delete(pro.parked, proposerID)
+			pro.looped = append(pro.looped, proposal)
+		}
+	}
+}
+
+// includes checks whether the given ID is part of the list of IDs.
+func includes(ids []base.Hash, id base.Hash) bool {
+	for _, candidateID := range ids {
+		if candidateID == id {
+			return true
+		}
+	}
+	return false
+}
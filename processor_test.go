@@ -19,6 +19,7 @@ package consensus
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -31,6 +32,22 @@ import (
 	"github.com/awfm/consensus/model/signal"
 )
 
+// looper loops messages back into the processor synchronously.
+type looper struct {
+	pro       *Processor
+	proposals []*message.Proposal
+	errs      []error
+}
+
+func (l *looper) Proposal(proposal *message.Proposal) {
+	l.proposals = append(l.proposals, proposal)
+	l.errs = append(l.errs, l.pro.OnProposal(proposal))
+}
+
+func (l *looper) Vote(vote *message.Vote) {
+	l.errs = append(l.errs, l.pro.OnVote(vote))
+}
+
 func TestProcessor(t *testing.T) {
 	suite.Run(t, new(ProcessorSuite))
 }
@@ -47,8 +64,8 @@ type ProcessorSuite struct {
 	staleID base.Hash
 
 	// parameters for strategy mock
-	leaderID    base.Hash
-	collectorID base.Hash
+	leaderID     base.Hash
+	collectorIDs []base.Hash
 
 	// mocked dependencies
 	net    *mocks.Network
@@ -76,7 +93,7 @@ func (ps *ProcessorSuite) SetupTest() {
 
 	// parameters for the strategy mock
 	ps.leaderID = fixture.Hash(ps.T())
-	ps.collectorID = fixture.Hash(ps.T())
+	ps.collectorIDs = fixture.Hashes(ps.T(), 1)
 
 	// initialize the mocked dependencies
 	ps.net = &mocks.Network{}
@@ -134,9 +151,9 @@ func (ps *ProcessorSuite) SetupTest() {
 		},
 		nil,
 	).Maybe()
-	ps.strat.On("Collector", mock.Anything).Return(
-		func(height uint64) base.Hash {
-			return ps.collectorID
+	ps.strat.On("Collectors", mock.Anything).Return(
+		func(height uint64) []base.Hash {
+			return ps.collectorIDs
 		},
 		nil,
 	).Maybe()
@@ -164,7 +181,7 @@ func (ps *ProcessorSuite) TestBootstrap() {
 			require.Equal(ps.T(), ps.tip.Height, vote.Height, "should send vote for tip height")
 			require.Equal(ps.T(), ps.tip.ID(), vote.CandidateID, "should send vote for tip vertex")
 			require.Equal(ps.T(), ps.self, vote.SignerID, "should send vote by self")
-			require.Equal(ps.T(), ps.collectorID, collectorID, "should send vote to collector")
+			require.Equal(ps.T(), ps.collectorIDs[0], collectorID, "should send vote to collector")
 		},
 	)
 
@@ -217,7 +234,7 @@ func (ps *ProcessorSuite) TestConfirmParent() {
 func (ps *ProcessorSuite) TestApplyCandidate() {
 
 	// create candidate and proposal
-	candidate := fixture.Vertex(ps.T(), fixture.WithProposer(ps.leaderID), fixture.WithParent(ps.tip))
+	candidate := fixture.Vertex(ps.T(), fixture.WithProposer(ps.collectorIDs[0]), fixture.WithParent(ps.tip))
 	proposal := fixture.Proposal(ps.T(), fixture.WithCandidate(candidate))
 
 	// make sure we get a stale error if graph already contains candidate
@@ -229,16 +246,23 @@ func (ps *ProcessorSuite) TestApplyCandidate() {
 	ps.staleID = base.ZeroHash
 
 	// make sure we get an invalid proposer error with wrong proposer
-	tempID := ps.leaderID
-	ps.leaderID = fixture.Hash(ps.T())
+	collectorIDs := ps.collectorIDs
+	ps.collectorIDs = fixture.Hashes(ps.T(), 3)
 	err = ps.pro.applyCandidate(proposal)
 	require.Error(ps.T(), err, "should not pass with wrong proposer")
 	require.True(ps.T(), errors.As(err, &signal.InvalidProposer{}), "should have invalid proposer error")
 	ps.graph.AssertNumberOfCalls(ps.T(), "Extend", 0)
-	ps.leaderID = tempID
+	ps.collectorIDs = collectorIDs
 
-	// make sure that a height at final leads to conflicting error
+	// make sure we get an invalid proposer error at genesis height
 	height := candidate.Height
+	candidate.Height = 0
+	err = ps.pro.applyCandidate(proposal)
+	require.True(ps.T(), errors.As(err, &signal.InvalidProposer{}), "should have invalid proposer error at genesis")
+	ps.graph.AssertNumberOfCalls(ps.T(), "Extend", 0)
+	candidate.Height = height
+
+	// make sure that a height at final leads to conflicting error
 	candidate.Height = ps.final.Height
 	err = ps.pro.applyCandidate(proposal)
 	require.Error(ps.T(), err, "should not pass conflicting candidate")
@@ -275,4 +299,314 @@ func (ps *ProcessorSuite) TestApplyCandidate() {
 	require.NoError(ps.T(), err, "should pass valid proposal")
 	ps.graph.AssertExpectations(ps.T())
 	ps.cache.AssertExpectations(ps.T())
+
+	// make sure a proposal by any of the other collectors is valid as well
+	ps.collectorIDs = append(fixture.Hashes(ps.T(), 2), ps.collectorIDs...)
+	ps.graph.On("Extend", mock.Anything).Return(nil).Once()
+	ps.cache.On("Proposal", mock.Anything).Return(nil).Once()
+	err = ps.pro.applyCandidate(proposal)
+	require.NoError(ps.T(), err, "should pass proposal by redundant collector")
+}
+
+func (ps *ProcessorSuite) TestOnArc() {
+
+	// use a looper so we can see which proposals are processed again
+	loop := &looper{pro: ps.pro}
+	ps.pro.Attach(loop)
+
+	// create candidate and proposal
+	candidate := fixture.Vertex(ps.T(), fixture.WithProposer(ps.collectorIDs[0]), fixture.WithParent(ps.tip))
+	proposal := fixture.Proposal(ps.T(), fixture.WithCandidate(candidate))
+
+	// make sure a proposal with a missing arc payload is held on to
+	ps.graph.On("Extend", mock.Anything).Return(signal.MissingArc{Vertex: candidate}).Once()
+	err := ps.pro.applyCandidate(proposal)
+	require.Error(ps.T(), err, "should not pass candidate with missing arc")
+	require.True(ps.T(), errors.As(err, &signal.MissingArc{}), "should have missing arc error")
+	require.Contains(ps.T(), ps.pro.parked, candidate.ProposerID, "should hold on to proposal")
+
+	// make sure the payload of another arc doesn't release the proposal
+	err = ps.pro.OnArc(fixture.Hash(ps.T()))
+	require.NoError(ps.T(), err, "should process other arc")
+	require.Empty(ps.T(), loop.proposals, "should not loop back proposal for other arc")
+	require.Contains(ps.T(), ps.pro.parked, candidate.ProposerID, "should still hold on to proposal")
+
+	// make sure the payload of the arc loops the proposal back once
+	ps.verify.On("Quorum", mock.Anything).Return(errors.New("invalid quorum")).Once()
+	err = ps.pro.OnArc(candidate.ArcID)
+	require.NoError(ps.T(), err, "should process arc")
+	require.Len(ps.T(), loop.proposals, 1, "should loop back proposal")
+	require.Equal(ps.T(), proposal, loop.proposals[0], "should loop back parked proposal")
+	require.Empty(ps.T(), ps.pro.parked, "should forget looped back proposal")
+
+	// make sure proposals that were finalized past are forgotten
+	ps.graph.On("Extend", mock.Anything).Return(signal.MissingArc{Vertex: candidate}).Once()
+	_ = ps.pro.applyCandidate(proposal)
+	ps.final.Height = candidate.Height
+	err = ps.pro.OnArc(candidate.ArcID)
+	require.NoError(ps.T(), err, "should process arc")
+	require.Len(ps.T(), loop.proposals, 1, "should not loop back finalized proposal")
+	require.Empty(ps.T(), ps.pro.parked, "should forget finalized proposal")
+	ps.verify.AssertExpectations(ps.T())
+}
+
+func (ps *ProcessorSuite) TestOnVotes() {
+
+	// use a batch verifier and make ourselves one of the collectors
+	batch := &mocks.BatchVerifier{}
+	pro := NewProcessor(ps.net, ps.graph, ps.build, ps.strat, ps.sign, batch, ps.cache)
+	ps.collectorIDs = []base.Hash{fixture.Hash(ps.T()), ps.self}
+
+	// create valid votes for a candidate, one with an invalid signature and
+	// one that is on a stale candidate
+	candidate := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	votes := []*message.Vote{
+		fixture.Vote(ps.T(), fixture.ForCandidate(candidate)),
+		fixture.Vote(ps.T(), fixture.ForCandidate(candidate)),
+		fixture.Vote(ps.T(), fixture.ForCandidate(candidate)),
+		fixture.Vote(ps.T(), fixture.ForCandidate(candidate)),
+	}
+	stale := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	ps.staleID = stale.ID()
+	votes[3].CandidateID = ps.staleID
+
+	// the stale vote should never reach the batch verifier
+	batch.On("Votes", mock.Anything).Return(votes[1:2], nil).Once().Run(
+		func(args mock.Arguments) {
+			verified := args.Get(0).([]*message.Vote)
+			require.Equal(ps.T(), votes[:3], verified, "should batch verify votes passing checks")
+		},
+	)
+
+	// only the votes with valid signatures should be cached
+	ps.cache.On("Vote", mock.Anything).Return(nil).Twice().Run(
+		func(args mock.Arguments) {
+			cached := args.Get(0).(*message.Vote)
+			require.NotEqual(ps.T(), votes[1], cached, "should not cache invalid vote")
+		},
+	)
+
+	// we should only try to propose once for the candidate, without quorum
+	ps.strat.On("Threshold", mock.Anything).Return(uint(3), nil).Once()
+	ps.cache.On("Quorum", candidate.Height, candidate.ID()).Return(&message.Quorum{}, nil).Once()
+
+	errs := pro.OnVotes(votes)
+	require.Len(ps.T(), errs, len(votes), "should have one error slot per vote")
+	require.NoError(ps.T(), errs[0], "should process first valid vote")
+	require.True(ps.T(), errors.As(errs[1], &signal.InvalidSignature{}), "should have invalid signature error")
+	require.NoError(ps.T(), errs[2], "should process second valid vote")
+	require.True(ps.T(), errors.As(errs[3], &signal.StaleVote{}), "should have stale vote error")
+	batch.AssertExpectations(ps.T())
+	ps.cache.AssertExpectations(ps.T())
+	ps.strat.AssertExpectations(ps.T())
+}
+
+func (ps *ProcessorSuite) TestCheckVoteFinal() {
+
+	// make ourselves collector, with the final vertex still being the tip
+	ps.collectorIDs = []base.Hash{ps.self}
+	ps.tip = ps.final
+
+	// votes on the unconfirmed final vertex should pass, as they are needed to
+	// confirm the genesis vertex
+	vote := fixture.Vote(ps.T(), fixture.ForCandidate(ps.final))
+	err := ps.pro.checkVote(vote)
+	require.NoError(ps.T(), err, "should accept vote on unconfirmed final vertex")
+
+	// votes on other vertices at the final height should conflict
+	other := fixture.Vertex(ps.T(), fixture.WithHeight(ps.final.Height))
+	vote = fixture.Vote(ps.T(), fixture.ForCandidate(other))
+	err = ps.pro.checkVote(vote)
+	require.True(ps.T(), errors.As(err, &signal.ConflictingVote{}), "should have conflicting vote error")
+
+	// once the final vertex is confirmed, votes on it should be stale
+	ps.staleID = ps.final.ID()
+	vote = fixture.Vote(ps.T(), fixture.ForCandidate(ps.final))
+	err = ps.pro.checkVote(vote)
+	require.True(ps.T(), errors.As(err, &signal.StaleVote{}), "should have stale vote error")
+}
+
+func (ps *ProcessorSuite) TestCastVoteRefused() {
+
+	// use a signer that refuses to sign a conflicting vote
+	candidate := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	sign := &mocks.Signer{}
+	sign.On("Self").Return(ps.self, nil)
+	sign.On("Vote", candidate).Return(nil, signal.DoubleSign{Entity: "vote", Vertex: candidate}).Once()
+	pro := NewProcessor(ps.net, ps.graph, ps.build, ps.strat, sign, ps.verify, ps.cache)
+
+	// we should abstain without error and without transmitting anything
+	err := pro.castVote(candidate)
+	require.NoError(ps.T(), err, "should abstain from conflicting vote")
+	ps.net.AssertNumberOfCalls(ps.T(), "Transmit", 0)
+	sign.AssertExpectations(ps.T())
+}
+
+func (ps *ProcessorSuite) TestCastVoteCollectors() {
+
+	// make us one of several collectors, with one of them unreachable
+	candidate := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	ps.collectorIDs = fixture.Hashes(ps.T(), 3)
+	ps.collectorIDs = append(ps.collectorIDs[:1], append([]base.Hash{ps.self}, ps.collectorIDs[1:]...)...)
+	ps.net.On("Transmit", mock.Anything, ps.collectorIDs[0]).Return(errors.New("unreachable")).Once()
+	ps.net.On("Transmit", mock.Anything, ps.collectorIDs[2]).Return(nil).Once()
+	ps.net.On("Transmit", mock.Anything, ps.collectorIDs[3]).Return(nil).Once()
+
+	// we should send the same vote to all other collectors despite the failure
+	err := ps.pro.castVote(candidate)
+	require.Error(ps.T(), err, "should report failed transmission")
+	ps.net.AssertExpectations(ps.T())
+	ps.net.AssertNumberOfCalls(ps.T(), "Transmit", 3)
+	ps.sign.AssertNumberOfCalls(ps.T(), "Vote", 1)
+}
+
+func (ps *ProcessorSuite) TestCastVoteOnce() {
+
+	// make sure we vote for the first candidate at a height
+	candidate := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	ps.net.On("Transmit", mock.Anything, ps.collectorIDs[0]).Return(nil).Once()
+	err := ps.pro.castVote(candidate)
+	require.NoError(ps.T(), err, "should vote for first candidate")
+
+	// make sure we don't vote for a competing candidate at the same height,
+	// even if our signer would sign it, but still for the same one again
+	competing := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	err = ps.pro.castVote(competing)
+	require.NoError(ps.T(), err, "should abstain from competing candidate")
+	ps.net.On("Transmit", mock.Anything, ps.collectorIDs[0]).Return(nil).Once()
+	err = ps.pro.castVote(candidate)
+	require.NoError(ps.T(), err, "should vote for first candidate again")
+	ps.net.AssertExpectations(ps.T())
+	ps.sign.AssertNumberOfCalls(ps.T(), "Vote", 2)
+
+	// make sure we forget about the height once it is confirmed
+	proposal := fixture.Proposal(ps.T(), fixture.WithCandidate(fixture.Vertex(ps.T(), fixture.WithParent(candidate))))
+	ps.verify.On("Quorum", proposal).Return(nil).Once()
+	ps.graph.On("Confirm", candidate.ID()).Return(nil).Once()
+	ps.cache.On("Clear", candidate.Height).Return(nil).Once()
+	err = ps.pro.confirmParent(proposal)
+	require.NoError(ps.T(), err, "should confirm parent")
+	require.Empty(ps.T(), ps.pro.voted, "should forget confirmed height")
+}
+
+// backup is a strategy with backup collectors, which wait for the delay times
+// their rank.
+type backup struct {
+	*mocks.Strategy
+	delay time.Duration
+}
+
+func (b backup) Delay(height uint64, rank uint) time.Duration {
+	return time.Duration(rank) * b.delay
+}
+
+func (ps *ProcessorSuite) TestProposeBackup() {
+
+	// make us the second collector, with a single vote being enough for a
+	// quorum, and capture the timer instead of running it
+	ps.pro.strat = backup{Strategy: ps.strat, delay: time.Second}
+	var delays []time.Duration
+	var timers []func()
+	ps.pro.after = func(delay time.Duration, f func()) {
+		delays = append(delays, delay)
+		timers = append(timers, f)
+	}
+	ps.collectorIDs = []base.Hash{fixture.Hash(ps.T()), ps.self}
+	height := ps.tip.Height
+	parentID := ps.tip.ID()
+	quorum := &message.Quorum{SignerIDs: []base.Hash{ps.self}}
+	ps.strat.On("Threshold", height).Return(uint(1), nil)
+	ps.cache.On("Quorum", height, parentID).Return(quorum, nil)
+
+	// make sure we hold back our proposal only once
+	err := ps.pro.proposeCandidate(height, parentID)
+	require.NoError(ps.T(), err, "should hold back proposal")
+	err = ps.pro.proposeCandidate(height, parentID)
+	require.NoError(ps.T(), err, "should still hold back proposal")
+	require.Equal(ps.T(), []time.Duration{time.Second}, delays, "should wait for delay of rank once")
+	ps.build.AssertNumberOfCalls(ps.T(), "Arc", 0)
+
+	// make sure we don't propose if a candidate for the next height reached us
+	tip := ps.tip
+	ps.tip = fixture.Vertex(ps.T(), fixture.WithParent(tip))
+	timers[0]()
+	ps.build.AssertNumberOfCalls(ps.T(), "Arc", 0)
+	ps.tip = tip
+
+	// make sure we propose otherwise, unless we signed another candidate at
+	// the next height in the meantime
+	ps.build.On("Arc").Return(base.Hash{}, nil).Once()
+	ps.sign.On("Proposal", mock.Anything).Return(
+		func(candidate *base.Vertex) *message.Proposal {
+			return fixture.Proposal(ps.T(), fixture.WithCandidate(candidate))
+		},
+		nil,
+	).Once()
+	ps.net.On("Broadcast", mock.Anything).Return(nil).Once()
+	ps.verify.On("Quorum", mock.Anything).Return(errors.New("invalid quorum")).Once()
+	timers[0]()
+	ps.build.AssertExpectations(ps.T())
+	ps.net.AssertExpectations(ps.T())
+	timers[0]()
+	ps.build.AssertNumberOfCalls(ps.T(), "Arc", 1)
+}
+
+// proposing makes us the only collector, with a single vote being enough for
+// a quorum, and returns a vote that makes us propose, along with the candidate
+// it is for; the looped back proposal fails on its quorum.
+func (ps *ProcessorSuite) proposing() (*message.Vote, *base.Vertex) {
+	ps.collectorIDs = []base.Hash{ps.self}
+	candidate := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	vote := fixture.Vote(ps.T(), fixture.ForCandidate(candidate))
+	ps.verify.On("Vote", vote).Return(nil).Once()
+	ps.cache.On("Vote", vote).Return(nil).Once()
+	ps.strat.On("Threshold", candidate.Height).Return(uint(1), nil).Once()
+	ps.cache.On("Quorum", candidate.Height, candidate.ID()).Return(&message.Quorum{SignerIDs: []base.Hash{vote.SignerID}}, nil).Once()
+	ps.build.On("Arc").Return(fixture.Hash(ps.T()), nil).Once()
+	ps.sign.On("Proposal", mock.Anything).Return(
+		func(candidate *base.Vertex) *message.Proposal {
+			return fixture.Proposal(ps.T(), fixture.WithCandidate(candidate))
+		},
+		nil,
+	).Once()
+	ps.net.On("Broadcast", mock.Anything).Return(nil).Once()
+	ps.verify.On("Quorum", mock.Anything).Return(errors.New("invalid quorum")).Once()
+	return vote, candidate
+}
+
+func (ps *ProcessorSuite) TestLoopback() {
+
+	// use a looper that processes our own proposal synchronously
+	loop := &looper{pro: ps.pro}
+	ps.pro.Attach(loop)
+	vote, candidate := ps.proposing()
+
+	// the looped back proposal should only be processed once the processor is
+	// released, rather than deadlocking it
+	done := make(chan error)
+	go func() {
+		done <- ps.pro.OnVote(vote)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(ps.T(), err, "should process vote")
+	case <-time.After(time.Second):
+		ps.T().Fatal("should not deadlock on looped back proposal")
+	}
+	require.Len(ps.T(), loop.proposals, 1, "should loop back proposal")
+	require.Equal(ps.T(), candidate.ID(), loop.proposals[0].Candidate.ParentID, "should loop back proposal for candidate")
+	require.Len(ps.T(), loop.errs, 1, "should process looped back proposal")
+	require.Error(ps.T(), loop.errs[0], "should have processed looped back proposal")
+	ps.verify.AssertExpectations(ps.T())
+	ps.net.AssertExpectations(ps.T())
+}
+
+func (ps *ProcessorSuite) TestLoopbackDirect() {
+
+	// without an attached looper, our own proposal should still be processed
+	vote, _ := ps.proposing()
+	err := ps.pro.OnVote(vote)
+	require.NoError(ps.T(), err, "should process vote")
+	ps.verify.AssertExpectations(ps.T())
+	ps.net.AssertExpectations(ps.T())
 }
@@ -0,0 +1,105 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package consensus
+
+import (
+	"context"
+	"time"
+
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// VoteQueue buffers the votes received from the network and feeds them to the
+// processor in batches, so that their signatures can be verified together. A
+// batch is processed as soon as it is full, or when the oldest queued vote has
+// waited for the maximum delay.
+type VoteQueue struct {
+	pro    *Processor
+	votes  chan *message.Vote
+	size   int
+	delay  time.Duration
+	report func(vote *message.Vote, err error)
+}
+
+// NewVoteQueue creates a new vote queue for the given processor, which can
+// hold up to the given capacity of votes and processes batches of up to the
+// given size. Errors encountered while processing votes are passed to the
+// report function along with the vote that caused them.
+func NewVoteQueue(pro *Processor, capacity int, size int, delay time.Duration, report func(vote *message.Vote, err error)) *VoteQueue {
+
+	q := VoteQueue{
+		pro:    pro,
+		votes:  make(chan *message.Vote, capacity),
+		size:   size,
+		delay:  delay,
+		report: report,
+	}
+
+	return &q
+}
+
+// Push adds a vote to the queue. It never blocks, and returns a QueueFull
+// signal if the queue is full, so that the network layer can slow down.
+func (q *VoteQueue) Push(vote *message.Vote) error {
+	select {
+	case q.votes <- vote:
+		return nil
+	default:
+		return signal.QueueFull{Queue: "vote", Capacity: cap(q.votes)}
+	}
+}
+
+// Run processes the queued votes in batches until the context is canceled.
+func (q *VoteQueue) Run(ctx context.Context) {
+	for {
+
+		// wait for the first vote of the next batch
+		var batch []*message.Vote
+		select {
+		case vote := <-q.votes:
+			batch = append(batch, vote)
+		case <-ctx.Done():
+			return
+		}
+
+		// fill up the batch until it's full or the first vote waited long
+		// enough
+		timer := time.NewTimer(q.delay)
+	Fill:
+		for len(batch) < q.size {
+			select {
+			case vote := <-q.votes:
+				batch = append(batch, vote)
+			case <-timer.C:
+				break Fill
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+
+		// process the batch and report the votes that failed
+		errs := q.pro.OnVotes(batch)
+		for i, err := range errs {
+			if err != nil {
+				q.report(batch[i], err)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package consensus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// queued sets up a vote queue with the given parameters on a processor whose
+// batch verifier reports every batch on the returned channel and rejects all
+// votes, so that each of them is reported as well.
+func (ps *ProcessorSuite) queued(capacity int, size int, delay time.Duration) (*VoteQueue, <-chan []*message.Vote, func() []*message.Vote) {
+
+	ps.collectorIDs = []base.Hash{ps.self}
+	batches := make(chan []*message.Vote, 16)
+	batch := &mocks.BatchVerifier{}
+	batch.On("Votes", mock.Anything).Return(
+		func(votes []*message.Vote) []*message.Vote {
+			batches <- votes
+			return votes
+		},
+		nil,
+	)
+	pro := NewProcessor(ps.net, ps.graph, ps.build, ps.strat, ps.sign, batch, ps.cache)
+
+	var mutex sync.Mutex
+	var reported []*message.Vote
+	report := func(vote *message.Vote, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		require.True(ps.T(), errors.As(err, &signal.InvalidSignature{}), "should report invalid signature")
+		reported = append(reported, vote)
+	}
+	q := NewVoteQueue(pro, capacity, size, delay, report)
+
+	return q, batches, func() []*message.Vote {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return reported
+	}
+}
+
+// votes creates votes that pass all checks before signature verification.
+func (ps *ProcessorSuite) votes(count int) []*message.Vote {
+	candidate := fixture.Vertex(ps.T(), fixture.WithParent(ps.tip))
+	votes := make([]*message.Vote, 0, count)
+	for i := 0; i < count; i++ {
+		votes = append(votes, fixture.Vote(ps.T(), fixture.ForCandidate(candidate)))
+	}
+	return votes
+}
+
+func (ps *ProcessorSuite) TestQueueSize() {
+
+	// a full batch should be processed right away, without waiting
+	q, batches, reported := ps.queued(8, 3, time.Hour)
+	votes := ps.votes(5)
+	for _, vote := range votes {
+		require.NoError(ps.T(), q.Push(vote), "should push vote")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	select {
+	case batch := <-batches:
+		require.Equal(ps.T(), votes[:3], batch, "should process full batch")
+	case <-time.After(time.Second):
+		ps.T().Fatal("should process full batch without delay")
+	}
+	require.Eventually(ps.T(), func() bool { return len(reported()) == 3 }, time.Second, time.Millisecond, "should report failed votes")
+
+	// the remaining votes should wait for the delay, and the queue should stop
+	// when the context is canceled
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		ps.T().Fatal("should stop on context cancellation")
+	}
+	require.Empty(ps.T(), batches, "should not process partial batch before delay")
+}
+
+func (ps *ProcessorSuite) TestQueueDelay() {
+
+	// a partial batch should be processed once the first vote waited long
+	// enough
+	q, batches, reported := ps.queued(8, 10, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+	votes := ps.votes(2)
+	for _, vote := range votes {
+		require.NoError(ps.T(), q.Push(vote), "should push vote")
+	}
+	select {
+	case batch := <-batches:
+		require.Equal(ps.T(), votes, batch, "should process partial batch")
+	case <-time.After(time.Second):
+		ps.T().Fatal("should process partial batch after delay")
+	}
+	require.Eventually(ps.T(), func() bool { return len(reported()) == 2 }, time.Second, time.Millisecond, "should report failed votes")
+}
+
+func (ps *ProcessorSuite) TestQueueFull() {
+
+	// votes beyond the capacity should be refused with backpressure
+	q, _, _ := ps.queued(2, 2, time.Hour)
+	votes := ps.votes(3)
+	require.NoError(ps.T(), q.Push(votes[0]), "should push first vote")
+	require.NoError(ps.T(), q.Push(votes[1]), "should push second vote")
+	err := q.Push(votes[2])
+	require.Equal(ps.T(), signal.QueueFull{Queue: "vote", Capacity: 2}, err, "should refuse vote beyond capacity")
+
+	// the queue should also stop while waiting for its first vote
+	q, _, _ = ps.queued(2, 2, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		ps.T().Fatal("should stop on context cancellation")
+	}
+}
@@ -0,0 +1,75 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package remote
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"github.com/awfm/rich"
+)
+
+// config creates a TLS configuration that authenticates us with a self-signed
+// certificate for our key and only accepts a peer presenting the given key.
+// Certificates are not checked against any authority; the pinned peer key is
+// the only thing that matters.
+func config(key ed25519.PrivateKey, peer ed25519.PublicKey) (*tls.Config, error) {
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "remote signer"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, rich.Errorf("could not create certificate: %w", err)
+	}
+
+	verify := func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) != 1 {
+			return rich.Errorf("invalid certificate chain").Int("length", len(raw))
+		}
+		cert, err := x509.ParseCertificate(raw[0])
+		if err != nil {
+			return rich.Errorf("could not parse certificate: %w", err)
+		}
+		pub, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || !bytes.Equal(pub, peer) {
+			return rich.Errorf("unauthorized peer key")
+		}
+		return nil
+	}
+
+	cfg := tls.Config{
+		Certificates:          []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verify,
+		MinVersion:            tls.VersionTLS13,
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,209 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package remote
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+)
+
+// Client implements the signer interface by forwarding all requests to a
+// remote signer server. It connects lazily, and reconnects with exponential
+// backoff whenever the connection fails. As signing the same vertex again is
+// always allowed, failed requests are simply retried on a new connection.
+type Client struct {
+	sync.Mutex
+	network  string
+	address  string
+	config   *tls.Config
+	timeout  time.Duration
+	attempts uint
+	backoff  time.Duration
+	conn     *tls.Conn
+	nonce    uint64
+}
+
+// NewClient creates a client for the remote signer at the given network
+// address (e.g. "unix" and a socket path, or "tcp" and a host and port). It
+// authenticates with the given key and only accepts a server with the given
+// public key. The timeout applies to connecting and to each request.
+func NewClient(network string, address string, key ed25519.PrivateKey, server ed25519.PublicKey, timeout time.Duration) (*Client, error) {
+
+	config, err := config(key, server)
+	if err != nil {
+		return nil, rich.Errorf("could not create TLS config: %w", err)
+	}
+
+	c := Client{
+		network:  network,
+		address:  address,
+		config:   config,
+		timeout:  timeout,
+		attempts: 4,
+		backoff:  50 * time.Millisecond,
+	}
+
+	return &c, nil
+}
+
+// Self returns the identity of the remote signer.
+func (c *Client) Self() (base.Hash, error) {
+	res, err := c.call(MethodSelf, nil)
+	if err != nil {
+		return base.ZeroHash, err
+	}
+	if res.SelfID == nil {
+		return base.ZeroHash, rich.Errorf("missing identity in response")
+	}
+	return *res.SelfID, nil
+}
+
+// Proposal requests a signed proposal for the vertex from the remote signer,
+// and checks that it was made for that vertex.
+func (c *Client) Proposal(vertex *base.Vertex) (*message.Proposal, error) {
+	res, err := c.call(MethodProposal, vertex)
+	if err != nil {
+		return nil, err
+	}
+	if res.Proposal == nil || res.Proposal.Candidate == nil {
+		return nil, rich.Errorf("missing proposal in response")
+	}
+	if res.Proposal.Candidate.ID() != vertex.ID() {
+		candidateID := res.Proposal.Candidate.ID()
+		vertexID := vertex.ID()
+		return nil, rich.Errorf("proposal for wrong vertex").Hex("vertex", vertexID[:]).Hex("candidate", candidateID[:])
+	}
+	return res.Proposal, nil
+}
+
+// Vote requests a signed vote for the vertex from the remote signer, and
+// checks that it was cast for that vertex.
+func (c *Client) Vote(vertex *base.Vertex) (*message.Vote, error) {
+	res, err := c.call(MethodVote, vertex)
+	if err != nil {
+		return nil, err
+	}
+	if res.Vote == nil {
+		return nil, rich.Errorf("missing vote in response")
+	}
+	vertexID := vertex.ID()
+	if res.Vote.Height != vertex.Height || res.Vote.CandidateID != vertexID {
+		return nil, rich.Errorf("vote for wrong vertex").Hex("vertex", vertexID[:]).Hex("candidate", res.Vote.CandidateID[:]).Uint64("height", res.Vote.Height)
+	}
+	return res.Vote, nil
+}
+
+// Close closes the connection to the remote signer, if there is one.
+func (c *Client) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// call sends a request to the server and waits for its response, retrying on
+// a new connection with increasing delays when the connection fails.
+func (c *Client) call(method string, vertex *base.Vertex) (*response, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.nonce++
+	req := request{
+		ID:     c.nonce,
+		Method: method,
+		Vertex: vertex,
+	}
+
+	var err error
+	delay := c.backoff
+	for attempt := uint(0); attempt < c.attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var res *response
+		res, err = c.roundtrip(&req)
+		if err != nil {
+			c.drop()
+			continue
+		}
+		if res.DoubleSign != nil {
+			return nil, *res.DoubleSign
+		}
+		if res.Error != "" {
+			return nil, rich.Errorf("remote signer failed: %w", errors.New(res.Error)).Str("method", method)
+		}
+		return res, nil
+	}
+
+	return nil, rich.Errorf("could not reach remote signer: %w", err).Str("address", c.address).Uint64("attempts", uint64(c.attempts))
+}
+
+// roundtrip executes one request on the current connection, connecting first
+// if necessary.
+func (c *Client) roundtrip(req *request) (*response, error) {
+
+	if c.conn == nil {
+		dialer := net.Dialer{Timeout: c.timeout}
+		conn, err := tls.DialWithDialer(&dialer, c.network, c.address, c.config)
+		if err != nil {
+			return nil, rich.Errorf("could not connect: %w", err)
+		}
+		c.conn = conn
+	}
+
+	err := c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return nil, rich.Errorf("could not set deadline: %w", err)
+	}
+	err = write(c.conn, req)
+	if err != nil {
+		return nil, rich.Errorf("could not send request: %w", err)
+	}
+	var res response
+	err = read(c.conn, &res)
+	if err != nil {
+		return nil, rich.Errorf("could not receive response: %w", err)
+	}
+	if res.ID != req.ID {
+		return nil, rich.Errorf("mismatched response").Uint64("request", req.ID).Uint64("response", res.ID)
+	}
+
+	return &res, nil
+}
+
+// drop closes and forgets the current connection after a failure.
+func (c *Client) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
@@ -0,0 +1,105 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package remote keeps the signing keys of a validator in a separate process.
+// The server wraps a local signer and the client implements the signer
+// interface for the consensus node. Both ends authenticate each other with
+// pinned Ed25519 keys over TLS 1.3, which works over TCP and Unix sockets
+// alike, and exchange length-prefixed JSON frames.
+package remote
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// MaxFrame is the maximum size of a single request or response frame.
+const MaxFrame = 1 << 20
+
+// The methods a client can call on the remote signer.
+const (
+	MethodSelf     = "self"
+	MethodProposal = "proposal"
+	MethodVote     = "vote"
+)
+
+// request is a signing request sent by the client.
+type request struct {
+	ID     uint64       `json:"id"`
+	Method string       `json:"method"`
+	Vertex *base.Vertex `json:"vertex,omitempty"`
+}
+
+// response is the answer of the server to a request with the same ID. A
+// refusal to sign is transmitted separately from other errors, so that the
+// client can return it as a signal.
+type response struct {
+	ID         uint64             `json:"id"`
+	SelfID     *base.Hash         `json:"self_id,omitempty"`
+	Proposal   *message.Proposal  `json:"proposal,omitempty"`
+	Vote       *message.Vote      `json:"vote,omitempty"`
+	DoubleSign *signal.DoubleSign `json:"double_sign,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// write writes the value as a JSON frame prefixed with its length.
+func write(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return rich.Errorf("could not encode frame: %w", err)
+	}
+	if len(data) > MaxFrame {
+		return rich.Errorf("frame too large").Int("size", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	if err != nil {
+		return rich.Errorf("could not write frame: %w", err)
+	}
+	return nil
+}
+
+// read reads a length-prefixed JSON frame into the value.
+func read(r io.Reader, v interface{}) error {
+	var prefix [4]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return rich.Errorf("could not read frame length: %w", err)
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > MaxFrame {
+		return rich.Errorf("frame too large").Uint64("size", uint64(size))
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return rich.Errorf("could not read frame: %w", err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return rich.Errorf("could not decode frame: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus/committee"
+	"github.com/awfm/consensus/crypto/edwards"
+	"github.com/awfm/consensus/guard"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+type keys struct {
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+}
+
+func generate(t *testing.T) keys {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err, "should generate key")
+	return keys{pub: pub, priv: priv}
+}
+
+func TestRemoteSigner(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "remote")
+	require.NoError(t, err, "should create temporary directory")
+	defer os.RemoveAll(dir)
+
+	// create the guarded signer held by the server
+	domain := message.Domain{ChainID: "test", Version: 1}
+	selfID := fixture.Hash(t)
+	signKey := generate(t)
+	g, err := guard.New(edwards.NewSigner(domain, selfID, signKey.priv), guard.NewFileStore(filepath.Join(dir, "guard.json")))
+	require.NoError(t, err, "should create guard")
+
+	// start the server on a unix socket
+	serverKey := generate(t)
+	clientKey := generate(t)
+	server, err := NewServer(g, serverKey.priv, clientKey.pub, time.Second)
+	require.NoError(t, err, "should create server")
+	path := filepath.Join(dir, "signer.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err, "should listen on socket")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- server.Serve(ctx, ln) }()
+
+	// the client should sign through the server
+	client, err := NewClient("unix", path, clientKey.priv, serverKey.pub, time.Second)
+	require.NoError(t, err, "should create client")
+	defer client.Close()
+	remoteID, err := client.Self()
+	require.NoError(t, err, "should get remote identity")
+	assert.Equal(t, selfID, remoteID, "should have signer identity")
+
+	com, err := committee.NewStatic(100, []committee.Member{{ID: selfID, Key: base.PublicKey(signKey.pub), Weight: 1}})
+	require.NoError(t, err, "should create committee")
+	verifier := edwards.NewVerifier(domain, nil, com)
+	vertex := fixture.Vertex(t)
+	vote, err := client.Vote(vertex)
+	require.NoError(t, err, "should get remote vote")
+	assert.NoError(t, verifier.Vote(vote), "should have valid vote signature")
+
+	// refusals should come back as signals
+	_, err = client.Vote(fixture.Vertex(t, fixture.WithParent(fixture.Genesis(t))))
+	require.Error(t, err, "should refuse conflicting vote")
+	assert.True(t, errors.As(err, &signal.DoubleSign{}), "should have double sign error")
+
+	// after the server restarts, the client should reconnect transparently
+	cancel()
+	require.NoError(t, <-done, "should stop server")
+	ln, err = net.Listen("unix", path)
+	require.NoError(t, err, "should listen on socket again")
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { done <- server.Serve(ctx, ln) }()
+	proposal, err := client.Proposal(fixture.Vertex(t, fixture.WithParent(vertex), fixture.WithProposer(selfID)))
+	require.NoError(t, err, "should get remote proposal after reconnect")
+	assert.NoError(t, verifier.Vote(proposal.Vote()), "should have valid proposal vote")
+}
+
+func TestRemoteSignerAuthentication(t *testing.T) {
+
+	serverKey := generate(t)
+	clientKey := generate(t)
+	otherKey := generate(t)
+
+	_, priv, err := edwards.GenerateKey(rand.Reader)
+	require.NoError(t, err, "should generate signing key")
+	signer := edwards.NewSigner(message.Domain{}, fixture.Hash(t), priv)
+	server, err := NewServer(signer, serverKey.priv, clientKey.pub, time.Second)
+	require.NoError(t, err, "should create server")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "should listen on TCP")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx, ln)
+
+	// an unknown client should be rejected by the server
+	client, err := NewClient("tcp", ln.Addr().String(), otherKey.priv, serverKey.pub, time.Second)
+	require.NoError(t, err, "should create client")
+	client.backoff = time.Millisecond
+	_, err = client.Self()
+	assert.Error(t, err, "should reject unknown client")
+
+	// the client should not talk to an unknown server
+	client, err = NewClient("tcp", ln.Addr().String(), clientKey.priv, otherKey.pub, time.Second)
+	require.NoError(t, err, "should create client")
+	client.backoff = time.Millisecond
+	_, err = client.Self()
+	assert.Error(t, err, "should reject unknown server")
+
+	// the authorized client works
+	client, err = NewClient("tcp", ln.Addr().String(), clientKey.priv, serverKey.pub, time.Second)
+	require.NoError(t, err, "should create client")
+	defer client.Close()
+	_, err = client.Self()
+	assert.NoError(t, err, "should accept authorized client")
+}
+
+func TestRemoteSignerTimeout(t *testing.T) {
+
+	// a server that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "should listen on TCP")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	clientKey := generate(t)
+	serverKey := generate(t)
+	client, err := NewClient("tcp", ln.Addr().String(), clientKey.priv, serverKey.pub, 50*time.Millisecond)
+	require.NoError(t, err, "should create client")
+	client.backoff = time.Millisecond
+	start := time.Now()
+	_, err = client.Self()
+	assert.Error(t, err, "should time out on silent server")
+	assert.True(t, time.Since(start) < 2*time.Second, "should not block beyond timeouts")
+}
+
+func TestRemoteSignerMismatch(t *testing.T) {
+
+	// a compromised server signs a different vertex than the requested one
+	other := fixture.Vertex(t)
+	sign := &mocks.Signer{}
+	sign.On("Vote", mock.Anything).Return(fixture.Vote(t, fixture.ForCandidate(other)), nil)
+	sign.On("Proposal", mock.Anything).Return(fixture.Proposal(t, fixture.WithCandidate(other)), nil)
+	serverKey := generate(t)
+	clientKey := generate(t)
+	server, err := NewServer(sign, serverKey.priv, clientKey.pub, time.Second)
+	require.NoError(t, err, "should create server")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "should listen on TCP")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx, ln)
+
+	// the client should not accept signatures over anything else
+	client, err := NewClient("tcp", ln.Addr().String(), clientKey.priv, serverKey.pub, time.Second)
+	require.NoError(t, err, "should create client")
+	defer client.Close()
+	_, err = client.Vote(fixture.Vertex(t))
+	assert.Error(t, err, "should reject vote for wrong vertex")
+	_, err = client.Proposal(fixture.Vertex(t))
+	assert.Error(t, err, "should reject proposal for wrong vertex")
+}
+
+func TestRemoteSignerShutdown(t *testing.T) {
+
+	serverKey := generate(t)
+	clientKey := generate(t)
+	server, err := NewServer(&mocks.Signer{}, serverKey.priv, clientKey.pub, time.Second)
+	require.NoError(t, err, "should create server")
+	server.idle = 50 * time.Millisecond
+
+	// connections that stay idle should be closed by the server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "should listen on TCP")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- server.Serve(ctx, ln) }()
+	client, err := NewClient("tcp", ln.Addr().String(), clientKey.priv, serverKey.pub, time.Second)
+	require.NoError(t, err, "should create client")
+	sign := server.sign.(*mocks.Signer)
+	sign.On("Self").Return(fixture.Hash(t), nil)
+	_, err = client.Self()
+	require.NoError(t, err, "should get remote identity")
+	var res response
+	err = read(client.conn, &res)
+	assert.Error(t, err, "should close idle connection")
+	client.Close()
+
+	// open connections should not keep the server from stopping
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err, "should connect")
+	defer raw.Close()
+	cancel()
+	select {
+	case err = <-done:
+		assert.NoError(t, err, "should stop server")
+	case <-time.After(time.Second):
+		t.Fatal("should not hang on open connection")
+	}
+
+	// failing to accept should stop the server as well
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "should listen on TCP")
+	go func() { done <- server.Serve(context.Background(), ln) }()
+	raw, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err, "should connect")
+	defer raw.Close()
+	ln.Close()
+	select {
+	case err = <-done:
+		assert.Error(t, err, "should fail to accept")
+	case <-time.After(time.Second):
+		t.Fatal("should not hang after failing to accept")
+	}
+}
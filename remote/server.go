@@ -0,0 +1,210 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+// IdleTimeout is how long the server keeps a connection open without getting
+// a request, after which the client has to reconnect.
+const IdleTimeout = time.Minute
+
+// Server holds the signing keys in a separate process and answers signing
+// requests from a single authorized consensus node. The wrapped signer should
+// usually be protected against double signing by a guard.
+type Server struct {
+	sign    consensus.Signer
+	config  *tls.Config
+	timeout time.Duration
+	idle    time.Duration
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// NewServer creates a remote signer server that authenticates with the given
+// key and only serves the client with the given public key. The timeout limits
+// the handshake and the writing of each response.
+func NewServer(sign consensus.Signer, key ed25519.PrivateKey, client ed25519.PublicKey, timeout time.Duration) (*Server, error) {
+
+	config, err := config(key, client)
+	if err != nil {
+		return nil, rich.Errorf("could not create TLS config: %w", err)
+	}
+
+	s := Server{
+		sign:    sign,
+		config:  config,
+		timeout: timeout,
+		idle:    IdleTimeout,
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	return &s, nil
+}
+
+// Serve accepts connections on the listener until the context is canceled or
+// accepting fails, and then closes the listener and all open connections.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+
+	s.mu.Lock()
+	s.closed = false
+	s.mu.Unlock()
+
+	// close everything once the context is canceled or we stop serving; the
+	// handlers are only waited for once their connections were closed
+	stop := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		ln.Close()
+		s.mu.Lock()
+		s.closed = true
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}()
+	defer s.wg.Wait()
+	defer func() {
+		close(stop)
+		<-closed
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			return rich.Errorf("could not accept connection: %w", err)
+		}
+
+		// connections accepted after shutdown started are closed right away,
+		// as the shutdown would otherwise miss them
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// handle authenticates the connection and answers requests until the
+// connection is closed, fails or stays idle for too long.
+func (s *Server) handle(raw net.Conn) {
+
+	conn := tls.Server(raw, s.config)
+	defer conn.Close()
+
+	// 1) authenticate the client within the timeout
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	err := conn.Handshake()
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// 2) answer requests one by one; clients may keep the connection idle for
+	// a while, but not forever
+	for {
+		var req request
+		_ = conn.SetReadDeadline(time.Now().Add(s.idle))
+		err := read(conn, &req)
+		if err != nil {
+			return
+		}
+		res := s.process(&req)
+		_ = conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		err = write(conn, res)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// process executes a single request on the wrapped signer.
+func (s *Server) process(req *request) *response {
+
+	res := response{ID: req.ID}
+	if req.Method != MethodSelf && req.Vertex == nil {
+		res.Error = "missing vertex"
+		return &res
+	}
+
+	var err error
+	switch req.Method {
+	case MethodSelf:
+		var selfID base.Hash
+		selfID, err = s.sign.Self()
+		res.SelfID = &selfID
+	case MethodProposal:
+		var proposal *message.Proposal
+		proposal, err = s.sign.Proposal(req.Vertex)
+		res.Proposal = proposal
+	case MethodVote:
+		var vote *message.Vote
+		vote, err = s.sign.Vote(req.Vertex)
+		res.Vote = vote
+	default:
+		err = rich.Errorf("unknown method").Str("method", req.Method)
+	}
+
+	ds := signal.DoubleSign{}
+	if errors.As(err, &ds) {
+		res.DoubleSign = &ds
+	}
+	if err != nil {
+		res.SelfID, res.Proposal, res.Vote = nil, nil, nil
+		res.Error = err.Error()
+	}
+
+	return &res
+}
@@ -21,6 +21,10 @@ import (
 	"github.com/awfm/consensus/model/message"
 )
 
+// Signer signs proposals and votes on behalf of the local participant.
+// Implementations have to sign the canonical payloads of a message.Domain, so
+// that signatures can't be replayed as another message type or on another
+// chain.
 type Signer interface {
 	Self() (base.Hash, error)
 	Proposal(vertex *base.Vertex) (*message.Proposal, error)
@@ -17,11 +17,28 @@
 package consensus
 
 import (
+	"time"
+
 	"github.com/awfm/consensus/model/base"
 )
 
+// Strategy decides who leads and who collects the votes at each height. The
+// collectors of a height are an ordered set of participants who each build a
+// proposal for the next height once they have a quorum; the first of them has
+// to be the leader of the next height.
 type Strategy interface {
 	Threshold(height uint64) (uint, error)
 	Leader(height uint64) (base.Hash, error)
-	Collector(height uint64) (base.Hash, error)
+	Collectors(height uint64) ([]base.Hash, error)
+}
+
+// BackupStrategy is a strategy whose collectors after the first one are only
+// backups. A backup collector holds its proposal back for the delay of its
+// rank among the collectors of the height, and only builds it if no candidate
+// for the next height reached it in the meantime, so that collectors only
+// build competing proposals if the ones before them are offline or slow. The
+// delay of the first collector should be zero.
+type BackupStrategy interface {
+	Strategy
+	Delay(height uint64, rank uint) time.Duration
 }
@@ -0,0 +1,105 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package strategy
+
+import (
+	"time"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+)
+
+// Redundant wraps another strategy and gives each height several collectors,
+// so that a single byzantine or offline collector can't stall the chain. The
+// collectors of a height are the distinct leaders the wrapped strategy selects
+// for the following heights, in order, so the first of them is still the
+// leader of the next height.
+//
+// Only the first collector builds its proposal for the next height as soon as
+// it has a quorum. The others are backups: the collector at rank r waits for r
+// times the delay, and only builds its proposal if no candidate for the next
+// height reached it by then. Every processor also signs at most one candidate
+// per height, so when a slow collector's proposal competes with a backup's,
+// each voter only votes for the one that reached it first, and at most one of
+// them can be confirmed. Votes only split between them if the network delays
+// proposals by more than the delay; as the engine has no view change to
+// recover from a height without any quorum, the delay should be well above
+// the expected latency.
+type Redundant struct {
+	strat consensus.Strategy
+	count uint
+	delay time.Duration
+}
+
+// NewRedundant creates a strategy that selects up to count collectors for each
+// height from the leaders of the given strategy, with backups waiting for the
+// given delay per rank.
+func NewRedundant(strat consensus.Strategy, count uint, delay time.Duration) *Redundant {
+
+	if count == 0 {
+		count = 1
+	}
+
+	r := Redundant{
+		strat: strat,
+		count: count,
+		delay: delay,
+	}
+
+	return &r
+}
+
+// Threshold returns the threshold of the wrapped strategy.
+func (r *Redundant) Threshold(height uint64) (uint, error) {
+	return r.strat.Threshold(height)
+}
+
+// Leader returns the leader of the wrapped strategy.
+func (r *Redundant) Leader(height uint64) (base.Hash, error) {
+	return r.strat.Leader(height)
+}
+
+// Collectors returns the distinct leaders of the wrapped strategy for the
+// following heights. There may be less than the configured number if leaders
+// repeat, for example with a small committee.
+func (r *Redundant) Collectors(height uint64) ([]base.Hash, error) {
+
+	collectorIDs := make([]base.Hash, 0, r.count)
+	seen := make(map[base.Hash]struct{}, r.count)
+	for offset := uint64(1); offset <= uint64(r.count); offset++ {
+		leaderID, err := r.strat.Leader(height + offset)
+		if err != nil {
+			return nil, rich.Errorf("could not get leader: %w", err).Uint64("height", height+offset)
+		}
+		_, duplicate := seen[leaderID]
+		if duplicate {
+			continue
+		}
+		seen[leaderID] = struct{}{}
+		collectorIDs = append(collectorIDs, leaderID)
+	}
+
+	return collectorIDs, nil
+}
+
+// Delay returns how long the collector at the given rank waits before building
+// its proposal, which is the same at every height.
+func (r *Redundant) Delay(height uint64, rank uint) time.Duration {
+	return time.Duration(rank) * r.delay
+}
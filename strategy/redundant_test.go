@@ -0,0 +1,325 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package strategy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/cache"
+	"github.com/awfm/consensus/committee"
+	"github.com/awfm/consensus/crypto/edwards"
+	"github.com/awfm/consensus/graph"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+	"github.com/awfm/consensus/model/signal"
+)
+
+var (
+	_ consensus.Strategy       = (*Redundant)(nil)
+	_ consensus.BackupStrategy = (*Redundant)(nil)
+)
+
+func TestRedundant(t *testing.T) {
+
+	// collectors should be the next leaders of the rotation, in order
+	participants := fixture.Hashes(t, 4)
+	sorted := message.SortIDs(participants)
+	rr := NewRoundRobin(equal(t, participants))
+	r := NewRedundant(rr, 3, time.Second)
+	for height := uint64(0); height < 12; height++ {
+		leaderID, err := r.Leader(height)
+		require.NoError(t, err, "should get leader")
+		assert.Equal(t, sorted[height%4], leaderID, "should keep leader of wrapped strategy")
+		collectorIDs, err := r.Collectors(height)
+		require.NoError(t, err, "should get collectors")
+		expected := []base.Hash{sorted[(height+1)%4], sorted[(height+2)%4], sorted[(height+3)%4]}
+		assert.Equal(t, expected, collectorIDs, "should have next leaders as collectors")
+	}
+
+	// collectors should be distinct, even with more than there are participants
+	r = NewRedundant(rr, 6, time.Second)
+	collectorIDs, err := r.Collectors(5)
+	require.NoError(t, err, "should get collectors")
+	assert.Equal(t, []base.Hash{sorted[2], sorted[3], sorted[0], sorted[1]}, collectorIDs, "should not repeat collectors")
+
+	// a redundancy of zero should still give us one collector
+	r = NewRedundant(rr, 0, time.Second)
+	collectorIDs, err = r.Collectors(5)
+	require.NoError(t, err, "should get collectors")
+	assert.Equal(t, []base.Hash{sorted[2]}, collectorIDs, "should have single collector")
+
+	// backups should wait longer the further back they rank
+	assert.Zero(t, r.Delay(5, 0), "should not delay first collector")
+	assert.Equal(t, 2*time.Second, r.Delay(5, 2), "should delay backups by rank")
+}
+
+// empty builds candidates without any payload.
+type empty struct{}
+
+func (empty) Arc() (base.Hash, error) {
+	return base.ZeroHash, nil
+}
+
+// timely delays the backup collectors of the redundant strategy as if the
+// proposals of online collectors always arrived before the delay passed: they
+// only step in when the first collector of the height is the offline one.
+type timely struct {
+	*Redundant
+	offlineID base.Hash
+}
+
+func (tl timely) Delay(height uint64, rank uint) time.Duration {
+	collectorIDs, err := tl.Collectors(height)
+	if rank > 0 && (err != nil || collectorIDs[0] != tl.offlineID) {
+		return time.Hour
+	}
+	return tl.Redundant.Delay(height, rank)
+}
+
+// delivery is a message on its way to a node.
+type delivery struct {
+	recipientID base.Hash
+	msg         interface{}
+}
+
+// switchboard delivers the messages of all nodes in the order they were sent,
+// except for messages looped back, which are delivered first. Backup
+// collectors send their proposals from their own timers, so it can be used
+// concurrently.
+type switchboard struct {
+	sync.Mutex
+	processors map[base.Hash]*consensus.Processor
+	order      []base.Hash
+	looped     []delivery
+	queue      []delivery
+	proposals  map[uint64][]*message.Proposal
+	wake       chan struct{}
+}
+
+// endpoint is how a single node sends messages through the switchboard, and
+// how it loops messages back to itself.
+type endpoint struct {
+	s      *switchboard
+	selfID base.Hash
+}
+
+func (e *endpoint) Broadcast(proposal *message.Proposal) error {
+	e.s.Lock()
+	e.s.proposals[proposal.Candidate.Height] = append(e.s.proposals[proposal.Candidate.Height], proposal)
+	for _, nodeID := range e.s.order {
+		if nodeID != e.selfID {
+			e.s.queue = append(e.s.queue, delivery{recipientID: nodeID, msg: proposal})
+		}
+	}
+	e.s.Unlock()
+	e.s.notify()
+	return nil
+}
+
+func (e *endpoint) Transmit(vote *message.Vote, recipientID base.Hash) error {
+	e.s.Lock()
+	e.s.queue = append(e.s.queue, delivery{recipientID: recipientID, msg: vote})
+	e.s.Unlock()
+	e.s.notify()
+	return nil
+}
+
+func (e *endpoint) Proposal(proposal *message.Proposal) {
+	e.s.Lock()
+	e.s.looped = append(e.s.looped, delivery{recipientID: e.selfID, msg: proposal})
+	e.s.Unlock()
+	e.s.notify()
+}
+
+func (e *endpoint) Vote(vote *message.Vote) {
+	e.s.Lock()
+	e.s.looped = append(e.s.looped, delivery{recipientID: e.selfID, msg: vote})
+	e.s.Unlock()
+	e.s.notify()
+}
+
+// notify wakes up the switchboard if it is waiting for messages.
+func (s *switchboard) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next message to deliver, if there is one.
+func (s *switchboard) next() (delivery, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	var next delivery
+	switch {
+	case len(s.looped) > 0:
+		next, s.looped = s.looped[0], s.looped[1:]
+	case len(s.queue) > 0:
+		next, s.queue = s.queue[0], s.queue[1:]
+	default:
+		return delivery{}, false
+	}
+	return next, true
+}
+
+// confirm runs a chain of four participants with two redundant collectors
+// until all online participants finalized the given height, and returns the
+// proposals made at each height. The signers are not guarded, so it also
+// shows that the processor never signs competing proposals.
+func confirm(t *testing.T, offline bool, height uint64) (map[uint64][]*message.Proposal, *Redundant, base.Hash) {
+
+	domain := message.Domain{ChainID: "test", Version: 1}
+	participants := message.SortIDs(fixture.Hashes(t, 4))
+	members := make([]committee.Member, 0, len(participants))
+	keys := make(map[base.Hash]ed25519.PrivateKey, len(participants))
+	for _, participantID := range participants {
+		pub, priv, err := edwards.GenerateKey(rand.Reader)
+		require.NoError(t, err, "should generate key")
+		members = append(members, committee.Member{ID: participantID, Key: base.PublicKey(pub), Weight: 1})
+		keys[participantID] = priv
+	}
+	c, err := committee.NewStatic(100, members)
+	require.NoError(t, err, "should create committee")
+
+	// the last participant is offline, and backups step in for it right away
+	offlineID := base.ZeroHash
+	if offline {
+		offlineID = participants[3]
+	}
+	r := NewRedundant(NewRoundRobin(c), 2, time.Millisecond)
+	strat := timely{Redundant: r, offlineID: offlineID}
+
+	s := &switchboard{
+		processors: make(map[base.Hash]*consensus.Processor),
+		order:      participants,
+		proposals:  make(map[uint64][]*message.Proposal),
+		wake:       make(chan struct{}, 1),
+	}
+	genesis := fixture.Genesis(t)
+	var graphs []*graph.Graph
+	for _, participantID := range participants {
+		if participantID == offlineID {
+			continue
+		}
+		g, err := graph.New(genesis, nil)
+		require.NoError(t, err, "should create graph")
+		sign := edwards.NewSigner(domain, participantID, keys[participantID])
+		verify := edwards.NewVerifier(domain, strat, c)
+		votes := cache.NewCache(strat, edwards.NewAggregator(), c)
+		e := &endpoint{s: s, selfID: participantID}
+		pro := consensus.NewProcessor(e, g, empty{}, strat, sign, verify, votes)
+		pro.Attach(e)
+		s.processors[participantID] = pro
+		graphs = append(graphs, g)
+	}
+
+	// deliver the messages until every online participant finalized the height,
+	// waiting for the backups when there is nothing left to deliver
+	for _, pro := range s.processors {
+		require.NoError(t, pro.Bootstrap(), "should bootstrap")
+	}
+	finalized := func() bool {
+		for _, g := range graphs {
+			final, err := g.Final()
+			require.NoError(t, err, "should get final")
+			if final.Height < height {
+				return false
+			}
+		}
+		return true
+	}
+	for !finalized() {
+		next, ok := s.next()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "should not stall")
+			}
+		}
+		pro, online := s.processors[next.recipientID]
+		if !online {
+			continue
+		}
+		switch msg := next.msg.(type) {
+		case *message.Proposal:
+			err = pro.OnProposal(msg)
+		case *message.Vote:
+			err = pro.OnVote(msg)
+		}
+		assert.False(t, errors.As(err, &signal.DoubleVote{}), "should not sign competing proposals")
+		assert.False(t, errors.As(err, &signal.DoubleProposal{}), "should not make competing proposals")
+	}
+
+	// all online participants should agree on the finalized chain
+	for _, g := range graphs {
+		for h := uint64(1); h <= height; h++ {
+			vertex, err := g.Finalized(h)
+			require.NoError(t, err, "should get finalized vertex")
+			reference, err := graphs[0].Finalized(h)
+			require.NoError(t, err, "should get reference vertex")
+			assert.Equal(t, reference.ID(), vertex.ID(), "should agree on vertex (height: %d)", h)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.proposals, r, offlineID
+}
+
+func TestRedundantConfirm(t *testing.T) {
+
+	// with all collectors online, only the first collector of each height
+	// proposes, so the votes never split and every height is confirmed
+	proposals, r, _ := confirm(t, false, 12)
+	for height := uint64(1); height <= 12; height++ {
+		collectorIDs, err := r.Collectors(height - 1)
+		require.NoError(t, err, "should get collectors")
+		require.Len(t, proposals[height], 1, "should have single proposal (height: %d)", height)
+		assert.Equal(t, collectorIDs[0], proposals[height][0].Candidate.ProposerID, "should be proposed by first collector (height: %d)", height)
+	}
+
+	// with the first collector of some heights offline, the backup collector
+	// proposes in its place once it waited, and every height is confirmed
+	proposals, r, offlineID := confirm(t, true, 12)
+	backups := 0
+	for height := uint64(1); height <= 12; height++ {
+		collectorIDs, err := r.Collectors(height - 1)
+		require.NoError(t, err, "should get collectors")
+		require.Len(t, proposals[height], 1, "should have single proposal (height: %d)", height)
+		proposerID := collectorIDs[0]
+		if proposerID == offlineID {
+			proposerID = collectorIDs[1]
+			backups++
+		}
+		assert.Equal(t, proposerID, proposals[height][0].Candidate.ProposerID, "should be proposed by first online collector (height: %d)", height)
+	}
+	assert.NotZero(t, backups, "should have backups step in")
+}
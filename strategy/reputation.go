@@ -0,0 +1,216 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package strategy
+
+import (
+	"sync"
+
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+)
+
+// Reputation wraps another strategy and skips leaders that recently failed to
+// get a quorum. The engine always builds on the parent height, so a failed
+// leader doesn't leave a gap in the chain; instead, another collector of the
+// previous height proposes in its place. The strategy is thus meant to be
+// wrapped in a Redundant strategy, whose backup collectors step in for a
+// leader that is offline, and a finalized vertex proposed by anyone but the
+// leader we selected for its height marks that leader as failed. A leader
+// whose proposal loses against the one of a backup collector counts as failed
+// as well, which is what a slow leader looks like. A failed leader is replaced
+// by the participant that follows it in the committee of the height.
+//
+// It only looks at heights that are at least the finalization depth below the
+// height in question, so that all honest nodes see the same history and agree
+// on the leader without exchanging any messages. The depth has to cover how
+// far above the final vertex leaders are looked up: voters on a height ask for
+// its collectors while only its parent is final, so with count redundant
+// collectors, the depth has to be at least count plus one. A node that hasn't
+// finalized enough history returns an error rather than guessing a leader
+// other nodes might not agree on, until it catches up.
+//
+// Each selected leader depends on the ones selected before it, so they are
+// kept for the heights in the window of the next selection; leaders of heights
+// below that can't be looked up anymore.
+type Reputation struct {
+	sync.Mutex
+	strat     consensus.Strategy
+	committee consensus.Committee
+	graph     consensus.Graph
+	depth     uint64
+	window    uint64
+	offset    uint64
+	leaders   []base.Hash
+}
+
+// NewReputation creates a strategy that excludes the leaders who failed at any
+// of the last window heights that are at least depth heights in the past. A
+// depth below one is raised to one, as the leader of a height can't depend on
+// the vertex finalized at that height.
+func NewReputation(strat consensus.Strategy, committee consensus.Committee, graph consensus.Graph, depth uint64, window uint64) *Reputation {
+
+	if depth == 0 {
+		depth = 1
+	}
+
+	r := Reputation{
+		strat:     strat,
+		committee: committee,
+		graph:     graph,
+		depth:     depth,
+		window:    window,
+	}
+
+	return &r
+}
+
+// Threshold returns the threshold of the wrapped strategy.
+func (r *Reputation) Threshold(height uint64) (uint, error) {
+	return r.strat.Threshold(height)
+}
+
+// Leader returns the leader of the wrapped strategy for the height, unless it
+// failed recently. In that case, it moves on through the committee of the
+// height, starting after the failed leader, until it finds a participant
+// without failures. If there is none, it falls back to the original leader.
+func (r *Reputation) Leader(height uint64) (base.Hash, error) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	// 1) make sure the leader of the height wasn't pruned already
+	if height < r.offset {
+		return base.ZeroHash, rich.Errorf("leader pruned").Uint64("height", height).Uint64("offset", r.offset)
+	}
+
+	// 2) select the leaders of all heights up to the height in order, so that
+	// each selection only needs earlier ones
+	for r.offset+uint64(len(r.leaders)) <= height {
+		next := r.offset + uint64(len(r.leaders))
+		leaderID, err := r.choose(next)
+		if err != nil {
+			return base.ZeroHash, rich.Errorf("could not select leader: %w", err).Uint64("height", next)
+		}
+		r.leaders = append(r.leaders, leaderID)
+	}
+
+	leaderID := r.leaders[height-r.offset]
+
+	// 3) forget the leaders below the window of the next selection
+	next := r.offset + uint64(len(r.leaders))
+	if next > r.depth+r.window {
+		lowest := next - r.depth - r.window
+		if lowest > r.offset {
+			r.leaders = r.leaders[lowest-r.offset:]
+			r.offset = lowest
+		}
+	}
+
+	return leaderID, nil
+}
+
+// Collectors returns the leader of the next height as single collector.
+func (r *Reputation) Collectors(height uint64) ([]base.Hash, error) {
+	leaderID, err := r.Leader(height + 1)
+	if err != nil {
+		return nil, rich.Errorf("could not get next leader: %w", err)
+	}
+	return []base.Hash{leaderID}, nil
+}
+
+// choose returns the leader of the height. It has to be called with the lock
+// held, once the leaders of all heights in the window of the height are kept.
+func (r *Reputation) choose(height uint64) (base.Hash, error) {
+
+	leaderID, err := r.strat.Leader(height)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not get leader: %w", err)
+	}
+	failed, err := r.failed(height)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not get failed leaders: %w", err)
+	}
+	_, excluded := failed[leaderID]
+	if !excluded {
+		return leaderID, nil
+	}
+
+	// move through the committee of the height in order, starting after the
+	// failed leader, so every node picks the same alternative
+	_, participants, err := lookup(r.committee, height)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not look up participants: %w", err)
+	}
+	start := 0
+	for index, participantID := range participants {
+		if participantID == leaderID {
+			start = index + 1
+			break
+		}
+	}
+	for offset := 0; offset < len(participants); offset++ {
+		candidateID := participants[(start+offset)%len(participants)]
+		_, excluded := failed[candidateID]
+		if !excluded {
+			return candidateID, nil
+		}
+	}
+
+	return leaderID, nil
+}
+
+// failed returns the leaders we selected for the heights in the window before
+// the given height whose finalized vertex was proposed by someone else. It
+// returns an error if the history of the window isn't finalized yet. It has
+// to be called with the lock held.
+func (r *Reputation) failed(height uint64) (map[base.Hash]struct{}, error) {
+
+	// determine the window of heights that is guaranteed to be finalized
+	failed := make(map[base.Hash]struct{})
+	if height <= r.depth || r.window == 0 {
+		return failed, nil
+	}
+	last := height - r.depth
+	first := uint64(1)
+	if last > r.window {
+		first = last - r.window + 1
+	}
+	final, err := r.graph.Final()
+	if err != nil {
+		return nil, rich.Errorf("could not get final: %w", err)
+	}
+	if final.Height < last {
+		return nil, rich.Errorf("history not finalized").Uint64("last", last).Uint64("final", final.Height)
+	}
+
+	// the leaders we selected failed at all heights where the finalized vertex
+	// was proposed by a substitute, or where there is none
+	for h := first; h <= last; h++ {
+		vertex, err := r.graph.Finalized(h)
+		if err != nil {
+			return nil, rich.Errorf("could not get finalized vertex: %w", err).Uint64("height", h)
+		}
+		leaderID := r.leaders[h-r.offset]
+		if vertex != nil && vertex.ProposerID == leaderID {
+			continue
+		}
+		failed[leaderID] = struct{}{}
+	}
+
+	return failed, nil
+}
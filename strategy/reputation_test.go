@@ -0,0 +1,235 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package strategy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/graph"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+)
+
+var _ consensus.Strategy = (*Reputation)(nil)
+
+// extend finalizes vertices on the graph up to the given height, proposed by
+// the first of the redundant collectors over the strategy, or by the second
+// one at the heights where the first one is offline; leaders repeat when one
+// of them is substituted, so we look at three heights for two collectors. It
+// returns the leaders of the extended heights, indexed by height.
+func extend(t *testing.T, g *graph.Graph, r consensus.Strategy, height uint64, offline ...uint64) []base.Hash {
+	failed := make(map[uint64]struct{})
+	for _, h := range offline {
+		failed[h] = struct{}{}
+	}
+	redundant := NewRedundant(r, 3, time.Second)
+	parent, err := g.Final()
+	require.NoError(t, err, "should get final")
+	leaderIDs := make([]base.Hash, height+1)
+	for h := parent.Height + 1; h <= height; h++ {
+		collectorIDs, err := redundant.Collectors(h - 1)
+		require.NoError(t, err, "should get collectors")
+		leaderIDs[h] = collectorIDs[0]
+		proposerID := collectorIDs[0]
+		_, ok := failed[h]
+		if ok {
+			require.True(t, len(collectorIDs) > 1, "should have backup collector (height: %d)", h)
+			proposerID = collectorIDs[1]
+		}
+		vertex := &base.Vertex{Height: h, ParentID: parent.ID(), ProposerID: proposerID}
+		require.NoError(t, g.Extend(vertex), "should extend graph")
+		require.NoError(t, g.Confirm(vertex.ID()), "should confirm vertex")
+		parent = vertex
+	}
+	return leaderIDs
+}
+
+// leaders selects the leaders of all heights up to the given one in order,
+// which is how a strategy that only keeps its window has to be asked.
+func leaders(t *testing.T, r *Reputation, height uint64) []base.Hash {
+	leaderIDs := make([]base.Hash, 0, height+1)
+	for h := uint64(0); h <= height; h++ {
+		leaderID, err := r.Leader(h)
+		require.NoError(t, err, "should get leader (height: %d)", h)
+		leaderIDs = append(leaderIDs, leaderID)
+	}
+	return leaderIDs
+}
+
+func TestReputation(t *testing.T) {
+
+	participants := fixture.Hashes(t, 4)
+	sorted := message.SortIDs(participants)
+	c := equal(t, participants)
+	rr := NewRoundRobin(c)
+
+	// without failures, we should get the same leaders as the rotation
+	g, err := graph.New(fixture.Genesis(t), nil)
+	require.NoError(t, err, "should create graph")
+	extend(t, g, NewReputation(rr, c, g, 4, 8), 30)
+	leaderIDs := leaders(t, NewReputation(rr, c, g, 4, 8), 29)
+	for height, leaderID := range leaderIDs {
+		assert.Equal(t, sorted[height%4], leaderID, "should not change leader without failures")
+	}
+
+	// the leader who is offline at height 13 is replaced by the backup
+	// collector there, and should be skipped at height 17 in favor of the
+	// participant that follows it in the committee
+	g, err = graph.New(fixture.Genesis(t), nil)
+	require.NoError(t, err, "should create graph")
+	extend(t, g, NewReputation(rr, c, g, 4, 8), 30, 13)
+	vertex, err := g.Finalized(13)
+	require.NoError(t, err, "should get finalized vertex")
+	assert.Equal(t, sorted[2], vertex.ProposerID, "should have backup collector propose")
+	r := NewReputation(rr, c, g, 4, 8)
+	leaderIDs = leaders(t, r, 16)
+	leaderID, err := r.Leader(17)
+	require.NoError(t, err, "should get leader")
+	assert.Equal(t, sorted[2], leaderID, "should skip failed leader")
+	collectorIDs, err := r.Collectors(16)
+	require.NoError(t, err, "should get collector")
+	assert.Equal(t, []base.Hash{leaderID}, collectorIDs, "should have next leader as collector")
+
+	// within the finalization depth, the failure should not be known yet
+	assert.Equal(t, sorted[2], leaderIDs[14], "should not use failure within depth")
+	assert.Equal(t, sorted[3], leaderIDs[15], "should not change other leaders")
+
+	// once the failure is out of the window, the leader should be back
+	leaderIDs = leaders(t, NewReputation(rr, c, g, 4, 8), 25)
+	assert.Equal(t, sorted[1], leaderIDs[25], "should restore leader after window")
+
+	// if everyone failed, we fall back to the rotation
+	g, err = graph.New(fixture.Genesis(t), nil)
+	require.NoError(t, err, "should create graph")
+	extend(t, g, NewReputation(rr, c, g, 4, 8), 30, 20, 21, 22, 23)
+	r = NewReputation(rr, c, g, 4, 8)
+	leaderIDs = leaders(t, r, 27)
+	assert.Equal(t, sorted[3], leaderIDs[27], "should fall back to rotation")
+	failed, err := r.failed(27)
+	require.NoError(t, err, "should get failed leaders")
+	assert.Len(t, failed, 4, "should have every leader failed")
+}
+
+func TestReputationPrune(t *testing.T) {
+
+	participants := fixture.Hashes(t, 4)
+	c := equal(t, participants)
+	rr := NewRoundRobin(c)
+	g, err := graph.New(fixture.Genesis(t), nil)
+	require.NoError(t, err, "should create graph")
+	extend(t, g, NewReputation(rr, c, g, 4, 8), 100, 13, 50)
+
+	// only the leaders in the window of the next selection should be kept
+	r := NewReputation(rr, c, g, 4, 8)
+	leaders(t, r, 100)
+	assert.Equal(t, uint64(89), r.offset, "should prune leaders below window")
+	assert.Len(t, r.leaders, 12, "should keep leaders of window")
+
+	// leaders of pruned heights can't be looked up anymore, but the ones of
+	// the window can
+	_, err = r.Leader(88)
+	assert.Error(t, err, "should not get pruned leader")
+	_, err = r.Leader(89)
+	assert.NoError(t, err, "should get kept leader")
+}
+
+func TestReputationSubstitute(t *testing.T) {
+
+	participants := fixture.Hashes(t, 4)
+	sorted := message.SortIDs(participants)
+	c := equal(t, participants)
+	rr := NewRoundRobin(c)
+	g, err := graph.New(fixture.Genesis(t), nil)
+	require.NoError(t, err, "should create graph")
+
+	// the leader of height 13 fails, and so does the leader that replaces the
+	// one of the rotation at height 17
+	extendedIDs := extend(t, g, NewReputation(rr, c, g, 4, 8), 40, 13, 17)
+	leaderIDs := leaders(t, NewReputation(rr, c, g, 4, 8), 40)
+	assert.Equal(t, sorted[2], leaderIDs[17], "should substitute failed leader")
+	vertex, err := g.Finalized(17)
+	require.NoError(t, err, "should get finalized vertex")
+	assert.NotEqual(t, leaderIDs[17], vertex.ProposerID, "should have backup collector propose")
+
+	// the substitute should be blamed for its failure, not the leader of the
+	// rotation, which is back once its own failure is out of the window
+	assert.Equal(t, sorted[1], leaderIDs[25], "should not blame leader of rotation")
+	assert.Equal(t, sorted[3], leaderIDs[26], "should skip failed substitute")
+	assert.Equal(t, sorted[2], leaderIDs[30], "should restore substitute after window")
+
+	// a strategy that selects the leaders from scratch should agree with the
+	// one that selected them while the history was built
+	for height := uint64(1); height <= 40; height++ {
+		assert.Equal(t, extendedIDs[height], leaderIDs[height], "should agree on leader (height: %d)", height)
+	}
+}
+
+func TestReputationDeterministic(t *testing.T) {
+
+	// build the history on one node, and give another node only part of it
+	participants := fixture.Hashes(t, 5)
+	c := equal(t, participants)
+	rr := NewRoundRobin(c)
+	genesis := fixture.Genesis(t)
+	full, err := graph.New(genesis, nil)
+	require.NoError(t, err, "should create graph")
+	extend(t, full, NewReputation(rr, c, full, 4, 10), 60, 3, 7, 8, 30, 31, 32)
+	partial, err := graph.New(genesis, nil)
+	require.NoError(t, err, "should create graph")
+	copy := func(to uint64) {
+		final, err := partial.Final()
+		require.NoError(t, err, "should get final")
+		for height := final.Height + 1; height <= to; height++ {
+			vertex, err := full.Finalized(height)
+			require.NoError(t, err, "should get finalized vertex")
+			require.NoError(t, partial.Extend(vertex), "should extend partial graph")
+			require.NoError(t, partial.Confirm(vertex.ID()), "should confirm partial graph")
+		}
+	}
+	copy(47)
+
+	// nodes that finalized different amounts of history should agree
+	ahead := NewReputation(rr, c, full, 4, 10)
+	behind := NewReputation(rr, c, partial, 4, 10)
+	for height := uint64(0); height <= 51; height++ {
+		aheadID, err := ahead.Leader(height)
+		require.NoError(t, err, "should get leader ahead")
+		behindID, err := behind.Leader(height)
+		require.NoError(t, err, "should get leader behind")
+		assert.Equal(t, aheadID, behindID, "should agree on leader (height: %d)", height)
+	}
+
+	// a node that has not finalized enough history should not select a leader
+	// others might disagree with, and agree again once it caught up
+	for height := uint64(52); height <= 60; height++ {
+		_, err := behind.Leader(height)
+		assert.Error(t, err, "should not select leader without history (height: %d)", height)
+	}
+	copy(60)
+	for height := uint64(52); height <= 60; height++ {
+		aheadID, err := ahead.Leader(height)
+		require.NoError(t, err, "should get leader ahead")
+		behindID, err := behind.Leader(height)
+		require.NoError(t, err, "should get leader behind")
+		assert.Equal(t, aheadID, behindID, "should agree after catching up (height: %d)", height)
+	}
+}
@@ -0,0 +1,95 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package strategy implements selection strategies, which decide who leads and
+// who collects votes at each height, and how many votes make a quorum.
+package strategy
+
+import (
+	"github.com/awfm/rich"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+)
+
+// RoundRobin rotates leaders deterministically through the participants of
+// the committee, in committee order. The collector of a height is the leader
+// of the next height, as it builds the next proposal from the collected votes.
+type RoundRobin struct {
+	committee consensus.Committee
+}
+
+// NewRoundRobin creates a round-robin strategy over the given committee.
+func NewRoundRobin(committee consensus.Committee) *RoundRobin {
+
+	rr := RoundRobin{
+		committee: committee,
+	}
+
+	return &rr
+}
+
+// Threshold returns the BFT supermajority of floor(2n/3)+1 participants of
+// the committee at the height.
+func (rr *RoundRobin) Threshold(height uint64) (uint, error) {
+	_, participants, err := lookup(rr.committee, height)
+	if err != nil {
+		return 0, rich.Errorf("could not look up participants: %w", err)
+	}
+	return supermajority(uint(len(participants))), nil
+}
+
+// Leader returns the participant at the height's position in the rotation.
+func (rr *RoundRobin) Leader(height uint64) (base.Hash, error) {
+	_, participants, err := lookup(rr.committee, height)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not look up participants: %w", err)
+	}
+	index := height % uint64(len(participants))
+	return participants[index], nil
+}
+
+// Collectors returns the leader of the next height as single collector.
+func (rr *RoundRobin) Collectors(height uint64) ([]base.Hash, error) {
+	leaderID, err := rr.Leader(height + 1)
+	if err != nil {
+		return nil, rich.Errorf("could not get next leader: %w", err)
+	}
+	return []base.Hash{leaderID}, nil
+}
+
+// supermajority returns the smallest number of votes out of n that is more
+// than two thirds.
+func supermajority(n uint) uint {
+	return 2*n/3 + 1
+}
+
+// lookup returns the epoch and participants of the committee at the height,
+// making sure there is at least one participant.
+func lookup(committee consensus.Committee, height uint64) (uint64, []base.Hash, error) {
+	epoch, err := committee.Epoch(height)
+	if err != nil {
+		return 0, nil, rich.Errorf("could not get epoch: %w", err).Uint64("height", height)
+	}
+	participants, err := committee.Participants(epoch)
+	if err != nil {
+		return 0, nil, rich.Errorf("could not get participants: %w", err).Uint64("epoch", epoch)
+	}
+	if len(participants) == 0 {
+		return 0, nil, rich.Errorf("empty committee").Uint64("epoch", epoch)
+	}
+	return epoch, participants, nil
+}
@@ -0,0 +1,103 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package strategy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/committee"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+	"github.com/awfm/consensus/model/message"
+)
+
+var _ consensus.Strategy = (*RoundRobin)(nil)
+
+// static creates a committee with the given participants and weights.
+func static(t *testing.T, weights map[base.Hash]uint64) *committee.Static {
+	members := make([]committee.Member, 0, len(weights))
+	for participantID, weight := range weights {
+		members = append(members, committee.Member{ID: participantID, Key: base.PublicKey{1}, Weight: weight})
+	}
+	c, err := committee.NewStatic(100, members)
+	require.NoError(t, err, "should create committee")
+	return c
+}
+
+// equal creates a committee of the given participants with equal weights.
+func equal(t *testing.T, participantIDs []base.Hash) *committee.Static {
+	weights := make(map[base.Hash]uint64, len(participantIDs))
+	for _, participantID := range participantIDs {
+		weights[participantID] = 1
+	}
+	return static(t, weights)
+}
+
+func TestRoundRobin(t *testing.T) {
+
+	// leaders should rotate through the participants in committee order
+	participants := fixture.Hashes(t, 4)
+	rr := NewRoundRobin(equal(t, participants))
+	sorted := message.SortIDs(participants)
+	for height := uint64(0); height < 12; height++ {
+		leaderID, err := rr.Leader(height)
+		require.NoError(t, err, "should get leader")
+		assert.Equal(t, sorted[height%4], leaderID, "should rotate leader")
+		collectorIDs, err := rr.Collectors(height)
+		require.NoError(t, err, "should get collector")
+		nextID, err := rr.Leader(height + 1)
+		require.NoError(t, err, "should get next leader")
+		assert.Equal(t, []base.Hash{nextID}, collectorIDs, "should have next leader as collector")
+	}
+
+	// the rotation should not break at the end of the height range
+	_, err := rr.Collectors(^uint64(0))
+	assert.NoError(t, err, "should get collector at maximum height")
+}
+
+func TestRoundRobinThreshold(t *testing.T) {
+
+	expected := map[uint]uint{1: 1, 2: 2, 3: 3, 4: 3, 5: 4, 6: 5, 7: 5, 10: 7, 100: 67}
+	for n, threshold := range expected {
+		rr := NewRoundRobin(equal(t, fixture.Hashes(t, n)))
+		actual, err := rr.Threshold(0)
+		require.NoError(t, err, "should get threshold")
+		assert.Equal(t, threshold, actual, "should have supermajority threshold (n: %d)", n)
+	}
+}
+
+func TestRoundRobinInvalid(t *testing.T) {
+
+	// an empty committee or a failing committee should give errors
+	c := &mocks.Committee{}
+	c.On("Epoch", uint64(1)).Return(uint64(0), nil)
+	c.On("Participants", uint64(0)).Return(nil, nil)
+	c.On("Epoch", uint64(2)).Return(uint64(0), errors.New("no epoch"))
+	rr := NewRoundRobin(c)
+	_, err := rr.Leader(1)
+	assert.Error(t, err, "should not select leader from empty committee")
+	_, err = rr.Threshold(1)
+	assert.Error(t, err, "should not have threshold for empty committee")
+	_, err = rr.Leader(2)
+	assert.Error(t, err, "should not select leader without epoch")
+}
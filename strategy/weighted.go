@@ -0,0 +1,191 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package strategy
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/awfm/rich"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/model/base"
+)
+
+// Beacon provides the random seed for the leader selection at a given height.
+// All nodes have to get the same seed for the same height, for example from a
+// finalized vertex ID or from the threshold signature randomness.
+type Beacon interface {
+	Seed(height uint64) (base.Hash, error)
+}
+
+// StaticBeacon is a beacon that returns the same seed for all heights, such
+// as the ID of the genesis vertex.
+type StaticBeacon base.Hash
+
+// Seed returns the static seed.
+func (sb StaticBeacon) Seed(height uint64) (base.Hash, error) {
+	return base.Hash(sb), nil
+}
+
+// ChainBeacon is a beacon that takes the seed for a height from the vertex
+// finalized a fixed number of heights earlier, so that the leaders only become
+// known as the chain progresses. The lag has to be larger than the distance
+// between the final vertex and the heights the strategy is asked about, which
+// is at least two more than the finalization depth, as the collectors of a
+// height are the leaders of the next one. Proposers can still try different
+// payloads to influence the vertex ID, so the seed is only as unpredictable as
+// the vertices are; a beacon based on threshold signatures avoids that.
+type ChainBeacon struct {
+	graph consensus.Graph
+	lag   uint64
+}
+
+// NewChainBeacon creates a beacon that seeds each height with the ID of the
+// vertex finalized the given number of heights earlier, or of the genesis
+// vertex for the first heights.
+func NewChainBeacon(graph consensus.Graph, lag uint64) *ChainBeacon {
+
+	cb := ChainBeacon{
+		graph: graph,
+		lag:   lag,
+	}
+
+	return &cb
+}
+
+// Seed returns the ID of the vertex finalized at the lagging height, or at the
+// closest height below it, if no vertex was finalized there.
+func (cb *ChainBeacon) Seed(height uint64) (base.Hash, error) {
+
+	anchor := uint64(0)
+	if height > cb.lag {
+		anchor = height - cb.lag
+	}
+	for {
+		vertex, err := cb.graph.Finalized(anchor)
+		if err != nil {
+			return base.ZeroHash, rich.Errorf("could not get finalized vertex: %w", err).Uint64("height", anchor)
+		}
+		if vertex != nil {
+			return vertex.ID(), nil
+		}
+		if anchor == 0 {
+			return base.ZeroHash, rich.Errorf("missing genesis vertex")
+		}
+		anchor--
+	}
+}
+
+// Weighted selects the leader of each height pseudo-randomly, with a
+// probability proportional to the weight of each participant in the
+// committee. The selection is derived from the beacon seed and the height
+// only, so it is reproducible on all nodes. The collector of a height is the
+// leader of the next height, as it builds the next proposal. Quorums are still
+// counted by participants, not by weight.
+type Weighted struct {
+	committee consensus.Committee
+	beacon    Beacon
+}
+
+// NewWeighted creates a weighted strategy for the given committee, using the
+// given beacon for the random seeds.
+func NewWeighted(committee consensus.Committee, beacon Beacon) *Weighted {
+
+	w := Weighted{
+		committee: committee,
+		beacon:    beacon,
+	}
+
+	return &w
+}
+
+// Threshold returns the BFT supermajority of floor(2n/3)+1 participants of
+// the committee at the height.
+func (w *Weighted) Threshold(height uint64) (uint, error) {
+	_, participants, err := lookup(w.committee, height)
+	if err != nil {
+		return 0, rich.Errorf("could not look up participants: %w", err)
+	}
+	return supermajority(uint(len(participants))), nil
+}
+
+// Leader samples the leader for the height proportionally to weight.
+func (w *Weighted) Leader(height uint64) (base.Hash, error) {
+
+	// 1) compute the cumulative weights of the participants at the height
+	epoch, participants, err := lookup(w.committee, height)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not look up participants: %w", err)
+	}
+	cumulative := make([]uint64, 0, len(participants))
+	total := uint64(0)
+	for _, participantID := range participants {
+		weight, err := w.committee.Weight(epoch, participantID)
+		if err != nil {
+			return base.ZeroHash, rich.Errorf("could not get weight: %w", err).Hex("participant", participantID[:])
+		}
+		if total+weight < total {
+			return base.ZeroHash, rich.Errorf("total weight overflow").Uint64("epoch", epoch)
+		}
+		total += weight
+		cumulative = append(cumulative, total)
+	}
+	if total == 0 {
+		return base.ZeroHash, rich.Errorf("zero total weight").Uint64("epoch", epoch)
+	}
+
+	// 2) draw a ticket from the seed and find the participant holding it
+	seed, err := w.beacon.Seed(height)
+	if err != nil {
+		return base.ZeroHash, rich.Errorf("could not get seed: %w", err).Uint64("height", height)
+	}
+	ticket := sample(seed, height, total)
+	index := sort.Search(len(cumulative), func(i int) bool {
+		return cumulative[i] > ticket
+	})
+
+	return participants[index], nil
+}
+
+// Collectors returns the leader of the next height as single collector.
+func (w *Weighted) Collectors(height uint64) ([]base.Hash, error) {
+	leaderID, err := w.Leader(height + 1)
+	if err != nil {
+		return nil, rich.Errorf("could not get next leader: %w", err)
+	}
+	return []base.Hash{leaderID}, nil
+}
+
+// sample draws a uniformly distributed number in [0, total) from the seed and
+// height. It hashes them with an increasing counter and rejects draws in the
+// incomplete last range of 64-bit values, so that there is no modulo bias.
+func sample(seed base.Hash, height uint64, total uint64) uint64 {
+	limit := ^uint64(0) - (^uint64(0)%total+1)%total
+	data := make([]byte, len(seed)+16)
+	copy(data, seed[:])
+	binary.BigEndian.PutUint64(data[len(seed):], height)
+	for counter := uint64(0); ; counter++ {
+		binary.BigEndian.PutUint64(data[len(seed)+8:], counter)
+		hash := sha3.Sum256(data)
+		draw := binary.BigEndian.Uint64(hash[:8])
+		if draw <= limit {
+			return draw % total
+		}
+	}
+}
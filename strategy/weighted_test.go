@@ -0,0 +1,237 @@
+// Consensus is a general purpose event-driven BFT consensus harness.
+// Copyright (C) 2020 Max Wolter
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package strategy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awfm/consensus"
+	"github.com/awfm/consensus/mocks"
+	"github.com/awfm/consensus/model/base"
+	"github.com/awfm/consensus/model/fixture"
+)
+
+var _ consensus.Strategy = (*Weighted)(nil)
+var _ Beacon = (*ChainBeacon)(nil)
+
+// failingBeacon is a beacon that never has a seed.
+type failingBeacon struct{}
+
+func (failingBeacon) Seed(height uint64) (base.Hash, error) {
+	return base.ZeroHash, errors.New("no seed")
+}
+
+// chiSquare computes Pearson's chi-square statistic for observed counts
+// against expected counts.
+func chiSquare(observed map[base.Hash]float64, expected map[base.Hash]float64) float64 {
+	stat := 0.0
+	for key, e := range expected {
+		d := observed[key] - e
+		stat += d * d / e
+	}
+	return stat
+}
+
+func TestWeightedReproducible(t *testing.T) {
+
+	stakes := make(map[base.Hash]uint64)
+	for i, participantID := range fixture.Hashes(t, 7) {
+		stakes[participantID] = uint64(i + 1)
+	}
+	seed := fixture.Hash(t)
+	first := NewWeighted(static(t, stakes), StaticBeacon(seed))
+	second := NewWeighted(static(t, stakes), StaticBeacon(seed))
+	other := NewWeighted(static(t, stakes), StaticBeacon(fixture.Hash(t)))
+
+	differences := 0
+	for height := uint64(0); height < 100; height++ {
+		leaderID, err := first.Leader(height)
+		require.NoError(t, err, "should get leader")
+		secondID, err := second.Leader(height)
+		require.NoError(t, err, "should get second leader")
+		assert.Equal(t, leaderID, secondID, "should select same leader with same seed")
+		collectorIDs, err := first.Collectors(height)
+		require.NoError(t, err, "should get collector")
+		nextID, err := first.Leader(height + 1)
+		require.NoError(t, err, "should get next leader")
+		assert.Equal(t, []base.Hash{nextID}, collectorIDs, "should have next leader as collector")
+		otherID, err := other.Leader(height)
+		require.NoError(t, err, "should get other leader")
+		if otherID != leaderID {
+			differences++
+		}
+	}
+	assert.True(t, differences > 50, "should select different leaders with other seed")
+
+	failing := NewWeighted(static(t, stakes), failingBeacon{})
+	_, err := failing.Leader(0)
+	assert.Error(t, err, "should fail without seed")
+}
+
+func TestWeightedFrequencies(t *testing.T) {
+
+	// the critical values are for a significance level of 0.001, so that a
+	// correct implementation fails with a one in a thousand chance for any
+	// given seed; the seeds are fixed, so the test is deterministic
+	cases := []struct {
+		name     string
+		stakes   []uint64
+		critical float64
+	}{
+		{name: "uniform", stakes: []uint64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, critical: 27.877},
+		{name: "skewed", stakes: []uint64{1, 2, 3, 4, 10}, critical: 18.467},
+		{name: "large", stakes: []uint64{1 << 40, 3 << 40, 1<<62 + 7}, critical: 13.816},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+
+			stakes := make(map[base.Hash]uint64)
+			total := 0.0
+			var seed base.Hash
+			for i, stake := range c.stakes {
+				var participantID base.Hash
+				participantID[0] = byte(i + 1)
+				stakes[participantID] = stake
+				total += float64(stake)
+			}
+			w := NewWeighted(static(t, stakes), StaticBeacon(seed))
+
+			samples := 20000
+			observed := make(map[base.Hash]float64)
+			for height := uint64(0); height < uint64(samples); height++ {
+				leaderID, err := w.Leader(height)
+				require.NoError(t, err, "should get leader")
+				observed[leaderID]++
+			}
+			expected := make(map[base.Hash]float64)
+			for participantID, stake := range stakes {
+				expected[participantID] = float64(samples) * float64(stake) / total
+			}
+
+			stat := chiSquare(observed, expected)
+			assert.True(t, stat < c.critical, "should select proportional to stake (chi-square: %f, critical: %f)", stat, c.critical)
+		})
+	}
+}
+
+func TestWeightedIndependence(t *testing.T) {
+
+	// check that the leaders of consecutive heights are independent, by
+	// comparing the pairs against the product of their probabilities
+	stakes := map[base.Hash]uint64{}
+	participantIDs := make([]base.Hash, 0, 5)
+	for i := 0; i < 5; i++ {
+		var participantID base.Hash
+		participantID[0] = byte(i + 1)
+		participantIDs = append(participantIDs, participantID)
+		stakes[participantID] = uint64(i + 1)
+	}
+	w := NewWeighted(static(t, stakes), StaticBeacon(base.ZeroHash))
+
+	samples := 30000
+	observed := make(map[base.Hash]float64)
+	previousID, err := w.Leader(0)
+	require.NoError(t, err, "should get first leader")
+	for height := uint64(1); height <= uint64(samples); height++ {
+		leaderID, err := w.Leader(height)
+		require.NoError(t, err, "should get leader")
+		observed[pair(previousID, leaderID)]++
+		previousID = leaderID
+	}
+	expected := make(map[base.Hash]float64)
+	for _, firstID := range participantIDs {
+		for _, secondID := range participantIDs {
+			expected[pair(firstID, secondID)] = float64(samples) * float64(stakes[firstID]*stakes[secondID]) / (15 * 15)
+		}
+	}
+
+	// 24 degrees of freedom at a significance level of 0.001
+	stat := chiSquare(observed, expected)
+	assert.True(t, stat < 51.179, "should select independent consecutive leaders (chi-square: %f)", stat)
+}
+
+func TestWeightedInvalid(t *testing.T) {
+
+	participantIDs := fixture.Hashes(t, 2)
+	w := NewWeighted(static(t, map[base.Hash]uint64{participantIDs[0]: ^uint64(0), participantIDs[1]: 1}), StaticBeacon{})
+	_, err := w.Leader(0)
+	assert.Error(t, err, "should not select with overflowing weight")
+}
+
+// pair combines two participant IDs into a single key.
+func pair(firstID base.Hash, secondID base.Hash) base.Hash {
+	var key base.Hash
+	copy(key[:16], firstID[:16])
+	copy(key[16:], secondID[:16])
+	return key
+}
+
+func TestChainBeacon(t *testing.T) {
+
+	// finalize a chain of ten vertices, without a vertex at height six
+	genesis := fixture.Genesis(t)
+	chain := []*base.Vertex{genesis}
+	for len(chain) <= 10 {
+		chain = append(chain, fixture.Vertex(t, fixture.WithParent(chain[len(chain)-1])))
+	}
+	graph := &mocks.Graph{}
+	graph.On("Finalized", mock.Anything).Return(
+		func(height uint64) *base.Vertex {
+			if height == 6 || height > 10 {
+				return nil
+			}
+			return chain[height]
+		},
+		func(height uint64) error {
+			if height > 10 {
+				return errors.New("not finalized")
+			}
+			return nil
+		},
+	)
+
+	// the first heights should use the genesis seed, later ones the lagging
+	// vertex, or the one below if there is none
+	cb := NewChainBeacon(graph, 4)
+	for height, expected := range map[uint64]*base.Vertex{0: genesis, 4: genesis, 5: chain[1], 9: chain[5], 10: chain[5], 11: chain[7], 14: chain[10]} {
+		seed, err := cb.Seed(height)
+		require.NoError(t, err, "should get seed")
+		assert.Equal(t, expected.ID(), seed, "should use lagging vertex for height %d", height)
+	}
+	_, err := cb.Seed(15)
+	assert.Error(t, err, "should not seed height without finalized history")
+
+	// the leaders should change with the finalized chain
+	stakes := make(map[base.Hash]uint64)
+	for _, participantID := range fixture.Hashes(t, 16) {
+		stakes[participantID] = 1
+	}
+	w := NewWeighted(static(t, stakes), cb)
+	leaders := make(map[base.Hash]struct{})
+	for height := uint64(5); height <= 14; height++ {
+		leaderID, err := w.Leader(height)
+		require.NoError(t, err, "should get leader")
+		leaders[leaderID] = struct{}{}
+	}
+	assert.True(t, len(leaders) > 1, "should select different leaders")
+}
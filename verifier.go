@@ -20,8 +20,20 @@ import (
 	"github.com/awfm/consensus/model/message"
 )
 
+// Verifier verifies the signatures on quorums, proposals and votes.
+// Implementations have to verify against the canonical payloads of a
+// message.Domain, which are the payloads that the signer signs.
 type Verifier interface {
 	Quorum(quorum *message.Proposal) error
 	Proposal(proposal *message.Proposal) error
 	Vote(vote *message.Vote) error
 }
+
+// BatchVerifier is a verifier that can verify the signatures of many votes at
+// once, which is much cheaper than verifying them one by one. It returns the
+// votes with invalid signatures, which should be rare, so implementations can
+// find them by bisecting the batch.
+type BatchVerifier interface {
+	Verifier
+	Votes(votes []*message.Vote) ([]*message.Vote, error)
+}